@@ -2,61 +2,301 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/tuneinsight/lattigo/v6/core/rlwe"
 	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
-	"io/ioutil"
+	"io"
+	"log/slog"
 	"net/http"
 	"time"
 )
 
 // ResponseData represents the structure of the response from the KNN API.
 type ResponseData struct {
-	Distances [][]Distance    `json:"Distances"`
-	Classes   []string        `json:"Classes"`
-	Params    ckks.Parameters `json:"Params"`
+	Distances [][]Distance      `json:"Distances"`
+	Classes   []string          `json:"Classes"`
+	Params    ckks.Parameters   `json:"Params"`
+	Kernel    string            `json:"Kernel"`
+	Mode      string            `json:"Mode"`
+	Votes     []rlwe.Ciphertext `json:"Votes"`   // Encrypted vote vector per face in ModeTopK and ModeClassScores
+	Labels    []string          `json:"Labels"`  // Labels indexing the slots of the vote vectors
+	FrameID   uint64            `json:"FrameID"` // Frame and face of the query answered on the gRPC stream
+	FaceID    uint64            `json:"FaceID"`
 }
 
 // Euclidean distance of packed targets
 type Distance struct {
-	Distance rlwe.Ciphertext // Distances from a given target example
-	Classes  []string        // Classes of the given target example (packed)
+	Distance  rlwe.Ciphertext // Distances from a given target example
+	Classes   []string        // Classes of the given target example (packed)
+	PackSizes []int           // Targets per merged pack when the server summed the slots, empty otherwise
 }
 
-type QueryResult struct {
-	Distances []Distance
-	QueryNum  int
+// SessionResponse is returned by the server after registering a PublicContext.
+type SessionResponse struct {
+	SessionID string
 }
 
-// CallAPI sends a POST request with the serialized data to the KNN API,
+// QueryRequest carries the encrypted queries of one frame and the session holding their keys.
+type QueryRequest struct {
+	SessionID string
+	Kernel    string
+	SumSlots  bool // Ask the server to sum each block, needs the keys of GenSummationKeys
+	Mode      string
+	K         int // Number of nearest neighbours voting in ModeTopK
+	Query     []rlwe.Ciphertext
+	FrameID   uint64 // Frame and face of the query, echoed by the gRPC stream
+	FaceID    uint64
+}
+
+// ParameterSet is a CKKS parameter set accepted by the server.
+type ParameterSet struct {
+	Name          string
+	Params        ckks.ParametersLiteral
+	Bootstrapping bool     // Leaves room for bootstrapping, as needed by ModeTopK
+	Modes         []string // Response modes the set has enough levels for
+
+	BootstrappingLogP []int // Auxiliary moduli of the bootstrapping keys
+}
+
+// Capabilities describes what the server accepts, as returned by GET /api/capabilities.
+type Capabilities struct {
+	Dimension      int     // Length of the embeddings in the gallery
+	BlockSize      int     // Slots holding one embedding in a query ciphertext
+	MaxNorm        float64 // Longest norm of a query, longer ones must be scaled down with ClipNorm
+	ParameterSets  []ParameterSet
+	Kernels        []string
+	MaxTopK        int
+	GalleryVersion uint64
+	WireVersion    string
+}
+
+// APIServer is the base URL of the HTTP API of the server.
+var APIServer = "http://localhost:8080"
+
+// apiClient sends the requests of the HTTP API, over TLS once UseTLS is called.
+var apiClient = http.DefaultClient
+
+// UseTLS sends the requests of the HTTP API with config, which holds the client certificate for mutual TLS.
+// APIServer should then use the https scheme.
+func UseTLS(config *tls.Config) {
+	apiClient = &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: config,
+	}}
+}
+
+// ErrUnknownSession is returned by CallAPI when the server no longer knows the session,
+// for instance after a restart or an idle timeout. The caller should register again.
+var ErrUnknownSession = errors.New("server does not know the session")
+
+// ErrQuotaExceeded is wrapped by the errors of CallAPI when the server refuses the query because
+// the client went over its rate limit or daily budget. The frame can be skipped.
+var ErrQuotaExceeded = errors.New("server refused the query over the quota of the client")
+
+// RegisterSession uploads the evaluation keys of the public context once
+// and returns the session ID to attach to subsequent queries.
+func RegisterSession(publicContext PublicContext) (string, error) {
+	// API endpoint for session registration
+	url := APIServer + "/api/sessions"
+
+	payload, err := publicContext.MarshalWire()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, span := StartSpan(context.Background(), "RegisterSession")
+	defer span.End()
+	timings := NewTimings(ctx)
+	timings.RequestID = newRequestID()
+	body, err := post(url, EncodeFrame(MsgSessionRequest, payload), timings)
+	timings.Stage("rpc")
+	if err != nil {
+		return "", err
+	}
+
+	var session SessionResponse
+	if err := readResponse(body, MsgSessionResponse, &session); err != nil {
+		return "", err
+	}
+	timings.Stage("deserialize")
+	slog.Info("Registered session", "request_id", timings.RequestID, "session", session.SessionID, "key_bytes", len(payload), timings.Attr())
+	return session.SessionID, nil
+}
+
+// FetchCapabilities asks the server for the embedding dimension, the parameter sets
+// and the kernels it accepts, from which NewEncryptor picks its parameters.
+func FetchCapabilities() (Capabilities, error) {
+	// API endpoint for capability discovery
+	url := APIServer + "/api/capabilities"
+
+	resp, err := apiClient.Get(url)
+	if err != nil {
+		return Capabilities{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Capabilities{}, fmt.Errorf("%s: failed to fetch the capabilities of the server", resp.Status)
+	}
+
+	var capabilities Capabilities
+	if err := json.NewDecoder(resp.Body).Decode(&capabilities); err != nil {
+		return Capabilities{}, fmt.Errorf("Failed to decode capabilities: %v", err)
+	}
+	return capabilities, nil
+}
+
+// ReadinessResponse is the body returned by GET /readyz.
+type ReadinessResponse struct {
+	Ready  bool
+	Reason string // Why the server is not ready
+}
+
+// WaitReady polls /readyz until the server is ready to answer queries, so that the client can be started
+// along with a server still loading its gallery. It gives up with the last error when ctx expires.
+// A server that predates /readyz answers 404 and is taken as ready.
+func WaitReady(ctx context.Context) error {
+	// API endpoint for readiness
+	url := APIServer + "/readyz"
+
+	delay := 250 * time.Millisecond
+	for {
+		err := checkReady(ctx, url)
+		if err == nil {
+			return nil
+		}
+		slog.Info("Waiting for the server", "server", APIServer, "reason", err, "retry_in", delay)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("server is not ready: %v", err)
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, 5*time.Second)
+	}
+}
+
+// checkReady asks /readyz once and returns why the server is not ready, nil if it is.
+func checkReady(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return err // Most likely not listening yet
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNotFound:
+		return nil
+	case http.StatusServiceUnavailable:
+		var readiness ReadinessResponse
+		if err := json.NewDecoder(resp.Body).Decode(&readiness); err != nil || readiness.Reason == "" {
+			return errors.New(resp.Status)
+		}
+		return errors.New(readiness.Reason)
+	default:
+		return fmt.Errorf("%s from /readyz", resp.Status)
+	}
+}
+
+// CallAPI sends the encrypted queries of a frame to the KNN API,
 // deserializes the response, and returns it as ResponseData.
-func CallAPI(serializedData []byte) (ResponseData, error) {
+// It sets the request ID of timings and records the "serialize", "rpc" and "deserialize" stages;
+// the server traces the query under the "rpc" stage.
+func CallAPI(query QueryRequest, timings *Timings) (ResponseData, error) {
 	// API endpoint for KNN service
-	url := "http://localhost:8080/api/knn"
+	url := APIServer + "/api/knn"
 
-	// Send POST request with serialized data as the payload
-	resp, err := http.Post(url, "application/octet-stream", bytes.NewReader(serializedData))
+	timings.RequestID = newRequestID()
+	payload, err := query.MarshalWire()
 	if err != nil {
-		panic(err) // Handle request failure
+		return ResponseData{}, err
 	}
-	defer resp.Body.Close() // Ensure response body is closed after reading
+	timings.Stage("serialize")
 
-	// Read the response body
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := post(url, EncodeFrame(MsgQueryRequest, payload), timings)
+	timings.Stage("rpc")
 	if err != nil {
-		panic(err) // Handle body read failure
+		return ResponseData{}, err
 	}
 
 	// Deserialize the response body into a ResponseData struct
-	responseData, err := DeserializeObject(body)
+	var responseData ResponseData
+	err = readResponse(body, MsgQueryResponse, &responseData)
+	timings.Stage("deserialize")
 	if err != nil {
-		panic(err) // Handle deserialization failure
+		return ResponseData{}, err
 	}
 
 	return responseData, nil
 }
 
+// readResponse decodes a response body into v. Servers that predate the wire protocol answer with gob.
+func readResponse(body []byte, msgType MessageType, v interface{ UnmarshalWire([]byte) error }) error {
+	if !IsFrame(body) {
+		return DeserializeObject(body, v)
+	}
+
+	got, payload, err := DecodeFrame(body)
+	if err != nil {
+		return err
+	}
+	if got != msgType {
+		return fmt.Errorf("expected message type %d, got %d", msgType, got)
+	}
+	if err := v.UnmarshalWire(payload); err != nil {
+		return fmt.Errorf("Failed to deserialize message: %v", err)
+	}
+	return nil
+}
+
+// post sends a framed payload to url with the apiCredentials, the request ID of timings and the
+// trace context of its stage in progress, and returns the response body, mapping non-200 status codes to errors.
+func post(url string, payload []byte, timings *Timings) ([]byte, error) {
+	// Send POST request with the frame as the payload
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", WireContentType)
+	req.Header.Set(RequestIDHeader, timings.RequestID)
+	if traceparent := timings.Traceparent(); traceparent != "" {
+		req.Header.Set(TraceparentHeader, traceparent)
+	}
+	apiCredentials.Authorize(req, payload)
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // Ensure response body is closed after reading
+
+	// Read the response body
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return body, nil
+	case http.StatusNotFound:
+		return nil, ErrUnknownSession
+	case http.StatusTooManyRequests:
+		if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+			return nil, fmt.Errorf("%w, retry after %ss: %s", ErrQuotaExceeded, retryAfter, bytes.TrimSpace(body))
+		}
+		return nil, fmt.Errorf("%w: %s", ErrQuotaExceeded, bytes.TrimSpace(body))
+	default:
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+}
+
 // SerializeObject serializes an object into a byte slice using Gob encoding.
 // It also logs the time taken to complete the serialization.
 func SerializeObject(obj interface{}) ([]byte, error) {
@@ -70,27 +310,24 @@ func SerializeObject(obj interface{}) ([]byte, error) {
 	}
 
 	// Log time taken for serialization
-	elapsedTime := time.Since(startTime)
-	fmt.Println("Time to serialize ciphertexts: ", elapsedTime)
+	slog.Debug("Serialized object", "bytes", buffer.Len(), "duration", time.Since(startTime))
 
 	return buffer.Bytes(), nil
 }
 
-// DeserializeObject deserializes a byte slice into a ResponseData object.
+// DeserializeObject deserializes a byte slice into the object pointed to by obj.
 // It also logs the time taken to complete the deserialization.
-func DeserializeObject(data []byte) (ResponseData, error) {
+func DeserializeObject(data []byte, obj interface{}) error {
 	startTime := time.Now() // Track deserialization time
 
-	var obj ResponseData
 	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&obj)
+	err := decoder.Decode(obj)
 	if err != nil {
-		panic(err) // Handle deserialization failure
+		return fmt.Errorf("Failed to deserialize object: %v", err) // Return error if deserialization fails
 	}
 
 	// Log time taken for deserialization
-	elapsedTime := time.Since(startTime)
-	fmt.Println("Time to deserialize ciphertexts: ", elapsedTime)
+	slog.Debug("Deserialized object", "bytes", len(data), "duration", time.Since(startTime))
 
-	return obj, nil
+	return nil
 }
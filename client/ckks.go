@@ -2,8 +2,12 @@ package main
 
 import (
 	"fmt"
+	"github.com/tuneinsight/lattigo/v6/circuits/ckks/bootstrapping"
 	"github.com/tuneinsight/lattigo/v6/core/rlwe"
 	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+	"log/slog"
+	"math"
+	"slices"
 	"time"
 )
 
@@ -19,30 +23,91 @@ type Context struct {
 	Evk       rlwe.MemEvaluationKeySet // Memory-based evaluation keys for homomorphic operations
 	Evaluator *ckks.Evaluator          // Evaluator used for homomorphic operations on ciphertexts
 	Decryptor rlwe.Decryptor           // Decryptor for decrypting ciphertexts
+
+	BtpParams *bootstrapping.Parameters     // Bootstrapping parameters, set for the parameter sets that allow it
+	BtpKeys   *bootstrapping.EvaluationKeys // Bootstrapping keys, set by GenTopKKeys
+
+	ParameterSet string  // Name of the parameter set of the server
+	Dimension    int     // Length of the embeddings expected by the server
+	MaxNorm      float64 // Longest norm of a query the server bounds the distances with, 0 for no limit
 }
 
-// Context holds the cryptographic parameters, key management, encryption, decryption,
-// and evaluation structures needed to perform FHE operations.
+// PublicContext holds the public evaluation keys that are registered with the server
+// once per session. Queries only carry the ciphertexts and the session ID.
 type PublicContext struct {
-	Params     ckks.Parameters            // CKKS parameters
-	Rlk        rlwe.RelinearizationKey    // Relinearization key for homomorphic multiplication
-	Evk        rlwe.MemEvaluationKeySet   // Memory-based evaluation keys for homomorphic operations
-	GaloisKeys []rlwe.MemEvaluationKeySet // Decryptor for decrypting ciphertexts
-	Query      []rlwe.Ciphertext
+	Params ckks.Parameters          // CKKS parameters
+	Rlk    rlwe.RelinearizationKey  // Relinearization key for homomorphic multiplication
+	Evk    rlwe.MemEvaluationKeySet // Evaluation keys, including the Galois keys for server-side summation
+
+	// Bootstrapping parameters and keys, only needed by the top-k mode
+	Bootstrapping     *bootstrapping.Parameters
+	BootstrappingKeys *bootstrapping.EvaluationKeys
+}
+
+// Number of slots holding one embedding in a packed ciphertext
+const blockSize = 512
+
+// Distance kernels the server can evaluate, selected per query.
+const (
+	KernelSquaredDifference = "squared-difference" // (q - t)², needs the relinearization key
+	KernelInnerProduct      = "inner-product"      // -2·q·t + ||t||², the client adds ||q||² after decryption
+)
+
+// Response modes, selected per query.
+const (
+	ModeDistances   = "distances"    // One encrypted distance per gallery entry
+	ModeTopK        = "top-k"        // One encrypted vote vector per face, needs GenTopKKeys
+	ModeClassScores = "class-scores" // One encrypted score per class and face, needs GenClassScoreKeys
+)
+
+// NewEncryptor generates a client-side encryption context with the parameter set of the server
+// named parameterSet, or else the first one, as returned by FetchCapabilities, that has enough
+// levels for mode. The sets that can be bootstrapped also get the bootstrapping parameters needed by GenTopKKeys.
+func NewEncryptor(capabilities Capabilities, mode, parameterSet string) (Context, error) {
+	if capabilities.BlockSize != blockSize {
+		return Context{}, fmt.Errorf("server packs embeddings in blocks of %d slots, this client in blocks of %d", capabilities.BlockSize, blockSize)
+	}
+	if capabilities.Dimension != blockSize {
+		return Context{}, fmt.Errorf("server gallery has embeddings of %d values, this client sums blocks of %d slots", capabilities.Dimension, blockSize)
+	}
+
+	for _, set := range capabilities.ParameterSets {
+		if parameterSet != "" && set.Name != parameterSet {
+			continue
+		}
+		if !slices.Contains(set.Modes, mode) {
+			if parameterSet != "" {
+				return Context{}, fmt.Errorf("parameter set %q of the server does not have enough levels for mode %q", parameterSet, mode)
+			}
+			continue
+		}
+
+		c := newContext(set.Params)
+		c.ParameterSet = set.Name
+		c.Dimension = capabilities.Dimension
+		c.MaxNorm = capabilities.MaxNorm
+		if set.Bootstrapping {
+			btpParams, err := bootstrapping.NewParametersFromLiteral(c.Params, bootstrapping.ParametersLiteral{
+				LogP: set.BootstrappingLogP, // Auxiliary moduli of the bootstrapping keys, as expected by the server
+				Xs:   c.Params.Xs(),         // Same secret distribution as the residual parameters
+			})
+			if err != nil {
+				return Context{}, fmt.Errorf("parameter set %q cannot be bootstrapped: %v", set.Name, err)
+			}
+			c.BtpParams = &btpParams
+		}
+		return c, nil
+	}
+	if parameterSet != "" {
+		return Context{}, fmt.Errorf("server offers no parameter set named %q", parameterSet)
+	}
+	return Context{}, fmt.Errorf("server offers no parameter set for mode %q", mode)
 }
 
-// Generate a new client-side encryption context
-func NewEncryptor() Context {
+// newContext generates the keys and the cryptographic components of the given parameters.
+func newContext(literal ckks.ParametersLiteral) Context {
 	startTime := time.Now()
-	// Initialize CKKS parameters
-	var params ckks.Parameters
-	params, err := ckks.NewParametersFromLiteral(
-		ckks.ParametersLiteral{
-			LogN:            14,                                    // log2(ring degree)
-			LogQ:            []int{60, 50, 50, 50, 50, 50, 50, 50}, // Moduli sizes for CKKS
-			LogP:            []int{61},                             // Log2 of auxiliary modulus P
-			LogDefaultScale: 45,                                    // Default scale factor
-		})
+	params, err := ckks.NewParametersFromLiteral(literal)
 	if err != nil {
 		panic(err)
 	}
@@ -57,8 +122,7 @@ func NewEncryptor() Context {
 	evaluator := ckks.NewEvaluator(params, evk)
 	decryptor := rlwe.NewDecryptor(params, sk)
 
-	elapsedTime := time.Since(startTime)
-	fmt.Println("Time to create local CKKS context: ", elapsedTime.Milliseconds())
+	slog.Info("Created local CKKS context", "log_n", params.LogN(), "duration", time.Since(startTime))
 
 	// Return the fully populated Context
 	return Context{
@@ -76,10 +140,11 @@ func NewEncryptor() Context {
 
 // Encrypt facial embeddings
 func (c *Context) Encrypt(vec []float64) rlwe.Ciphertext {
+	if c.Dimension != 0 && len(vec) != c.Dimension {
+		panic(fmt.Sprintf("embedding has %d values, the server expects %d", len(vec), c.Dimension))
+	}
 
-	startTime := time.Now()
-
-	maxRepeat := int(c.Params.MaxSlots()) / 512
+	maxRepeat := int(c.Params.MaxSlots()) / blockSize
 	vec = repeatVector(vec, maxRepeat)
 
 	plaintext := ckks.NewPlaintext(c.Params, c.Params.MaxLevel())
@@ -92,32 +157,140 @@ func (c *Context) Encrypt(vec []float64) rlwe.Ciphertext {
 		panic(err)
 	}
 
-	elapsedTime := time.Since(startTime)
-	fmt.Println("Time to encrypt: ", elapsedTime.Milliseconds())
-
 	return *ciphertext
 }
 
-// Generate new public context for server
-func (c *Context) NewPublicContext(query []rlwe.Ciphertext) PublicContext {
+// ClipNorm returns vec scaled down to the MaxNorm of the server if it is longer. The top-k and class-score
+// modes bound the distances with it. Scaling keeps the order of the distances to gallery entries of equal
+// norms, as in a gallery of normalized embeddings.
+func (c *Context) ClipNorm(vec []float64) []float64 {
+	norm := math.Sqrt(squaredNorm(vec))
+	if c.MaxNorm == 0 || norm <= c.MaxNorm {
+		return vec
+	}
+	clipped := make([]float64, len(vec))
+	for i, v := range vec {
+		clipped[i] = v * c.MaxNorm / norm
+	}
+	return clipped
+}
 
-	return PublicContext{
-		Params: c.Params,
-		Rlk:    c.Rlk,
-		Evk:    c.Evk,
-		Query:  query,
+// GenSummationKeys adds the Galois keys the server needs to sum each block of slots
+// and merge the packs, which shrinks the responses to one slot per gallery entry.
+func (c *Context) GenSummationKeys() {
+	startTime := time.Now()
+
+	galEls := c.Params.GaloisElementsForInnerSum(1, blockSize)
+	for _, gk := range c.Kgen.GenGaloisKeysNew(galEls, &c.Sk) {
+		c.Evk.GaloisKeys[gk.GaloisElement] = gk
 	}
+
+	slog.Info("Generated summation keys", "keys", len(galEls), "duration", time.Since(startTime))
 }
 
-// Decrypt and unpack distances for each detected face
-func (c *Context) Decrypt(res [][]Distance, params ckks.Parameters) ([][]float64, [][]string) {
+// GenClassScoreKeys adds the Galois keys the server needs to add up the scores of each class
+// over all slots, on top of those of GenSummationKeys.
+func (c *Context) GenClassScoreKeys() {
+	startTime := time.Now()
+
+	galEls := c.Params.GaloisElementsForInnerSum(1, c.Params.MaxSlots())
+	for _, gk := range c.Kgen.GenGaloisKeysNew(galEls, &c.Sk) {
+		c.Evk.GaloisKeys[gk.GaloisElement] = gk
+	}
 
+	slog.Info("Generated class score keys", "keys", len(galEls), "duration", time.Since(startTime))
+}
+
+// GenTopKKeys adds the rotation, conjugation and bootstrapping keys the server needs to reduce the
+// distances to a vote vector. The context must use a parameter set that can be bootstrapped.
+// The bootstrapping keys take a few seconds to generate and weigh about a gigabyte.
+func (c *Context) GenTopKKeys() {
 	startTime := time.Now()
 
+	if c.BtpParams == nil {
+		panic("top-k keys need a parameter set that can be bootstrapped")
+	}
+
+	// Rotations by every power of two in both directions, and the complex conjugation
+	var rotations []int
+	for k := 1; k < c.Params.MaxSlots(); k <<= 1 {
+		rotations = append(rotations, k, -k)
+	}
+	galEls := append(c.Params.GaloisElements(rotations), c.Params.GaloisElementForComplexConjugation())
+	for _, gk := range c.Kgen.GenGaloisKeysNew(galEls, &c.Sk) {
+		c.Evk.GaloisKeys[gk.GaloisElement] = gk
+	}
+
+	btpKeys, _, err := c.BtpParams.GenEvaluationKeys(&c.Sk)
+	if err != nil {
+		panic(err)
+	}
+	c.BtpKeys = btpKeys
+
+	slog.Info("Generated top-k keys", "keys", len(galEls), "duration", time.Since(startTime))
+}
+
+// Generate new public context to register with the server.
+// The relinearization key is only needed by the squared-difference kernel and can be left out otherwise.
+func (c *Context) NewPublicContext(withRlk bool) PublicContext {
+
+	if !withRlk {
+		return PublicContext{
+			Params:            c.Params,
+			Evk:               rlwe.MemEvaluationKeySet{GaloisKeys: c.Evk.GaloisKeys},
+			Bootstrapping:     c.BtpParams,
+			BootstrappingKeys: c.BtpKeys,
+		}
+	}
+
+	return PublicContext{
+		Params:            c.Params,
+		Rlk:               c.Rlk,
+		Evk:               c.Evk,
+		Bootstrapping:     c.BtpParams,
+		BootstrappingKeys: c.BtpKeys,
+	}
+}
+
+// DecryptVotes decrypts the vote vector of each face and returns the label with the most votes.
+// Slot c of a vote vector approximately counts how many of the k nearest gallery entries have labels[c],
+// or holds the kernel-weighted score of labels[c] in ModeClassScores.
+func (c *Context) DecryptVotes(votes []rlwe.Ciphertext, labels []string) []string {
+	var predictions []string
+	for i := range votes {
+		have := make([]float64, c.Params.MaxSlots())
+		if err := c.Encoder.Decode(c.Decryptor.DecryptNew(&votes[i]), have); err != nil {
+			panic(err)
+		}
+
+		// The counts carry approximation noise, so compare them as real numbers
+		best, bestVotes := "", math.Inf(-1)
+		for i, label := range labels {
+			if have[i] > bestVotes {
+				best, bestVotes = label, have[i]
+			}
+		}
+		predictions = append(predictions, best)
+	}
+
+	return predictions
+}
+
+// Decrypt and unpack distances for each detected face.
+// Distances summed on the server hold one slot per target, laid out as described by PackSizes;
+// otherwise each block of slots is summed here.
+// offsets holds a value to add to every distance of each face, such as ||q||² for the
+// inner-product kernel, and may be nil.
+func (c *Context) Decrypt(res [][]Distance, params ckks.Parameters, offsets []float64) ([][]float64, [][]string) {
 	var results [][]float64
 	var resultsClasses [][]string
 
-	for _, face := range res {
+	for faceIdx, face := range res {
+		var offset float64
+		if offsets != nil {
+			offset = offsets[faceIdx]
+		}
+
 		var distances []float64
 		var classes []string
 		for _, target := range face {
@@ -131,16 +304,28 @@ func (c *Context) Decrypt(res [][]Distance, params ckks.Parameters) ([][]float64
 				panic(err)
 			}
 
+			// Target x of the r-th merged pack sits in slot x*blockSize - r
+			if len(target.PackSizes) > 0 {
+				slots := len(have)
+				classIdx := 0
+				for r, size := range target.PackSizes {
+					for x := 0; x < size; x++ {
+						distances = append(distances, have[(x*blockSize-r+slots)%slots]+offset)
+						classes = append(classes, target.Classes[classIdx])
+						classIdx++
+					}
+				}
+				continue
+			}
+
 			for x := 0; x < len(target.Classes); x++ {
-				distances = append(distances, sum(have[x*512:x*512+512]))
+				distances = append(distances, sum(have[x*blockSize:x*blockSize+blockSize])+offset)
 				classes = append(classes, target.Classes[x])
 			}
 		}
 		results = append(results, distances)
 		resultsClasses = append(resultsClasses, classes)
 	}
-	elapsedTime := time.Since(startTime)
-	fmt.Println("Time to decrypt: ", elapsedTime.Milliseconds())
 	return results, resultsClasses
 
 }
@@ -153,6 +338,15 @@ func sum(arr []float64) float64 {
 	return total
 }
 
+// squaredNorm returns ||vec||²
+func squaredNorm(vec []float64) float64 {
+	var total float64
+	for _, v := range vec {
+		total += v * v
+	}
+	return total
+}
+
 func repeatVector(vec []float64, n int) []float64 {
 	result := make([]float64, 0, len(vec)*n)
 	for i := 0; i < n; i++ {
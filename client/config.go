@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Configuration
+//
+// Every setting of the client is a field of Config and a flag, so that each camera deployment runs
+// the same binary with a file of its own. The settings are read from the defaults below, then the
+// YAML file given with -config, then the environment variables named after the flags,
+// SECURESIGHT_CLIENT_SOURCE for -source, then the flags themselves, each overriding the previous
+// ones. SECURESIGHT_CLIENT_CONFIG names the file when -config is not given.
+
+// envPrefix prefixes the environment variables holding settings, distinct from those of the server.
+const envPrefix = "SECURESIGHT_CLIENT_"
+
+// Config is the configuration of the client. The YAML keys follow the names of the flags, grouped in
+// sections, as in config.example.yaml.
+type Config struct {
+	Server ServerConfig `yaml:"server"`
+	TLS    TLSFiles     `yaml:"tls"`
+	Auth   AuthConfig   `yaml:"auth"`
+
+	Source    string          `yaml:"source"` // Video file, stream URL or index of a camera
+	Models    ModelConfig     `yaml:"models"`
+	Detection DetectionConfig `yaml:"detection"`
+	Query     QueryConfig     `yaml:"query"`
+	Output    OutputConfig    `yaml:"output"`
+
+	LogFormat string `yaml:"log-format"` // Format of the logs, text or json
+	TraceFile string `yaml:"trace-file"` // Chrome trace file of the frames, no tracing if empty
+}
+
+// ServerConfig locates the server.
+type ServerConfig struct {
+	URL          string        `yaml:"url"`           // Base URL of the HTTP API, https:// to use TLS
+	Stream       string        `yaml:"stream"`        // Address of the gRPC stream
+	UseStream    bool          `yaml:"use-stream"`    // Send the faces over the stream instead of one POST per frame
+	ReadyTimeout time.Duration `yaml:"ready-timeout"` // Time to wait for the server to be ready
+}
+
+// AuthConfig holds the credential files of the client, see LoadCredentials.
+type AuthConfig struct {
+	TokenFile   string `yaml:"token-file"`
+	HMACClient  string `yaml:"hmac-client"`
+	HMACKeyFile string `yaml:"hmac-key-file"`
+}
+
+// ModelConfig holds the paths of the models run on each frame.
+type ModelConfig struct {
+	YOLO   string `yaml:"yolo"`   // ONNX face detector
+	ResNet string `yaml:"resnet"` // ONNX embedding network
+}
+
+// QueryConfig selects how the server evaluates the queries.
+type QueryConfig struct {
+	Mode         string `yaml:"mode"`          // Response mode, see ModeDistances
+	Kernel       string `yaml:"kernel"`        // Distance kernel, see KernelSquaredDifference
+	K            int    `yaml:"k"`             // Nearest neighbours voting for each face
+	SumSlots     bool   `yaml:"sum-slots"`     // Let the server sum each block
+	ParameterSet string `yaml:"parameter-set"` // CKKS parameter set of the server, the first that fits the mode if empty
+}
+
+// OutputConfig selects what is done with the annotated frames.
+type OutputConfig struct {
+	Window bool   `yaml:"window"` // Show the frames in a window
+	Video  string `yaml:"video"`  // Video file receiving the frames, none if empty
+	Codec  string `yaml:"codec"`  // FourCC of the video file
+}
+
+// defaultConfig returns the configuration of a client started without a file, environment or flags.
+func defaultConfig() Config {
+	return Config{
+		Server: ServerConfig{
+			URL:          APIServer,
+			Stream:       "localhost:8081",
+			ReadyTimeout: 2 * time.Minute,
+		},
+		Source: "../video.mp4",
+		Models: ModelConfig{
+			YOLO:   "../weights/yolov11n-face.onnx",
+			ResNet: "../weights/inception_resnet_v1.onnx",
+		},
+		Detection: defaultDetection,
+		Query: QueryConfig{
+			Mode:     ModeDistances,
+			Kernel:   KernelSquaredDifference,
+			K:        5,
+			SumSlots: true,
+		},
+		Output: OutputConfig{
+			Window: true,
+			Codec:  "mp4v",
+		},
+		LogFormat: "text",
+	}
+}
+
+// Flags registers a flag for each setting of c on fs, defaulting to its current value.
+func (c *Config) Flags(fs *flag.FlagSet) {
+	// Address of the server; an https URL and the TLS flags secure both the HTTP API and the stream
+	fs.StringVar(&c.Server.URL, "server", c.Server.URL, "base URL of the HTTP API, https:// to use TLS")
+	fs.StringVar(&c.Server.Stream, "stream", c.Server.Stream, "address of the gRPC streaming service")
+	fs.BoolVar(&c.Server.UseStream, "use-stream", c.Server.UseStream, "send the faces over the gRPC stream instead of one POST per frame")
+	fs.DurationVar(&c.Server.ReadyTimeout, "ready-timeout", c.Server.ReadyTimeout, "time to wait for the server to be ready before giving up")
+	fs.StringVar(&c.TLS.CAFile, "tls-ca", c.TLS.CAFile, "PEM bundle of the CAs signing the server certificate, system roots if empty")
+	fs.StringVar(&c.TLS.CertFile, "tls-cert", c.TLS.CertFile, "PEM certificate of the client, for mutual TLS")
+	fs.StringVar(&c.TLS.KeyFile, "tls-key", c.TLS.KeyFile, "PEM private key of the client")
+	fs.StringVar(&c.TLS.ServerName, "tls-server-name", c.TLS.ServerName, "name expected in the server certificate, the host of the server if empty")
+	fs.StringVar(&c.Auth.TokenFile, "token-file", c.Auth.TokenFile, "file holding the bearer token of the client")
+	fs.StringVar(&c.Auth.HMACClient, "hmac-client", c.Auth.HMACClient, "name of the client in the clients file of the server, to sign requests with -hmac-key-file")
+	fs.StringVar(&c.Auth.HMACKeyFile, "hmac-key-file", c.Auth.HMACKeyFile, "file holding the base64 HMAC key of the client")
+
+	fs.StringVar(&c.Source, "source", c.Source, "video file, stream URL or index of a camera")
+	fs.StringVar(&c.Models.YOLO, "yolo", c.Models.YOLO, "ONNX model detecting the faces")
+	fs.StringVar(&c.Models.ResNet, "resnet", c.Models.ResNet, "ONNX model computing the embeddings of the faces")
+
+	fs.Float64Var(&c.Detection.Confidence, "confidence", c.Detection.Confidence, "confidence a detection needs to be kept")
+	fs.Float64Var(&c.Detection.NMSScore, "nms-score", c.Detection.NMSScore, "score a box needs to go through non-maximum suppression")
+	fs.Float64Var(&c.Detection.NMSOverlap, "nms-overlap", c.Detection.NMSOverlap, "overlap, as intersection over union, above which the weaker of two boxes is suppressed")
+
+	fs.StringVar(&c.Query.Mode, "mode", c.Query.Mode, fmt.Sprintf("response mode, one of %v", modes))
+	fs.StringVar(&c.Query.Kernel, "kernel", c.Query.Kernel, fmt.Sprintf("distance kernel, one of %v", kernels))
+	fs.IntVar(&c.Query.K, "k", c.Query.K, "nearest neighbours voting for each face")
+	fs.BoolVar(&c.Query.SumSlots, "sum-slots", c.Query.SumSlots, "let the server sum each block, so that responses carry one value per gallery entry")
+	fs.StringVar(&c.Query.ParameterSet, "parameter-set", c.Query.ParameterSet, "CKKS parameter set of the server, the first that fits the mode if empty")
+
+	fs.BoolVar(&c.Output.Window, "window", c.Output.Window, "show the annotated frames in a window")
+	fs.StringVar(&c.Output.Video, "output", c.Output.Video, "video file receiving the annotated frames, none if empty")
+	fs.StringVar(&c.Output.Codec, "codec", c.Output.Codec, "FourCC of the codec of -output")
+
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "format of the logs written to stderr, text or json")
+	fs.StringVar(&c.TraceFile, "trace-file", c.TraceFile, "file receiving the spans of each frame in the Chrome trace event format, no tracing if empty")
+}
+
+// modes and kernels list the response modes and distance kernels the client can ask for.
+var (
+	modes   = []string{ModeDistances, ModeTopK, ModeClassScores}
+	kernels = []string{KernelSquaredDifference, KernelInnerProduct}
+)
+
+// LoadConfig parses the command line args of the client into a Config, over the file given with -config
+// and the SECURESIGHT_CLIENT_* variables, and validates it. It is a copy of the layering of
+// server/config.go, since the client is a module of its own; keep both in step.
+func LoadConfig(fs *flag.FlagSet, args []string) (Config, error) {
+	config := defaultConfig()
+	config.Flags(fs)
+	path := fs.String("config", "", "YAML configuration file, overridden by the SECURESIGHT_CLIENT_* environment variables and the flags")
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	// The flags were written over the defaults, the file and the environment go in between
+	flagged := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		flagged[f.Name] = f.Value.String()
+	})
+	if *path == "" {
+		*path = os.Getenv(envPrefix + "CONFIG")
+	}
+	if *path != "" {
+		if err := config.readFile(*path); err != nil {
+			return Config{}, err
+		}
+	}
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(name); ok {
+			if err := f.Value.Set(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", name, err))
+			}
+		}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return Config{}, err
+	}
+	for name, value := range flagged {
+		if err := fs.Set(name, value); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// readFile reads the settings of the YAML file at path over c. Unknown keys are refused,
+// they are usually misspelt settings or settings of the server.
+func (c *Config) readFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// Validate checks that the client can start with c. The server checks the rest, such as
+// whether it offers the kernel, the mode and the parameter set.
+func (c *Config) Validate() error {
+	switch {
+	case !strings.HasPrefix(c.Server.URL, "http://") && !strings.HasPrefix(c.Server.URL, "https://"):
+		return fmt.Errorf("server URL %q is neither http:// nor https://", c.Server.URL)
+	case c.Server.UseStream && c.Server.Stream == "":
+		return fmt.Errorf("no stream address")
+	case c.Server.ReadyTimeout <= 0:
+		return fmt.Errorf("ready timeout %v is not positive", c.Server.ReadyTimeout)
+	case c.Source == "":
+		return fmt.Errorf("no video source")
+	case c.Models.YOLO == "" || c.Models.ResNet == "":
+		return fmt.Errorf("the YOLO and ResNet models are both needed")
+	case !slices.Contains(modes, c.Query.Mode):
+		return fmt.Errorf("unknown response mode %q, expected one of %v", c.Query.Mode, modes)
+	case !slices.Contains(kernels, c.Query.Kernel):
+		return fmt.Errorf("unknown distance kernel %q, expected one of %v", c.Query.Kernel, kernels)
+	case c.Query.K < 1:
+		return fmt.Errorf("k %d is less than one", c.Query.K)
+	case c.Output.Video != "" && len(c.Output.Codec) != 4:
+		return fmt.Errorf("codec %q is not a FourCC", c.Output.Codec)
+	}
+	return c.Detection.Validate()
+}
+
+// logConfig logs the effective value of every flag of fs, that is every setting.
+func logConfig(fs *flag.FlagSet) {
+	var attrs []any
+	fs.VisitAll(func(f *flag.Flag) {
+		attrs = append(attrs, slog.String(f.Name, f.Value.String()))
+	})
+	slog.Info("Configuration", attrs...)
+}
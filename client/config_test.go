@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := func(content string) string {
+		f, err := os.CreateTemp(dir, "*.yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(content); err != nil {
+			t.Fatal(err)
+		}
+		return f.Name()
+	}
+	lobby := file("source: rtsp://lobby/stream\nquery:\n  mode: top-k\n  k: 3\noutput:\n  window: false\n")
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		check func(Config) bool
+		err   string
+	}{
+		{"defaults", nil, nil, func(c Config) bool {
+			return c.Server.URL == APIServer && c.Query.Mode == ModeDistances && c.Output.Window
+		}, ""},
+		{"file over defaults", nil, []string{"-config", lobby}, func(c Config) bool {
+			return c.Source == "rtsp://lobby/stream" && c.Query.Mode == ModeTopK && c.Query.K == 3 && !c.Output.Window &&
+				c.Query.Kernel == KernelSquaredDifference && c.Output.Codec == "mp4v"
+		}, ""},
+		{"environment over file", map[string]string{"SECURESIGHT_CLIENT_SOURCE": "0", "SECURESIGHT_CLIENT_WINDOW": "true"}, []string{"-config", lobby}, func(c Config) bool {
+			return c.Source == "0" && c.Output.Window && c.Query.K == 3
+		}, ""},
+		{"flags over environment", map[string]string{"SECURESIGHT_CLIENT_K": "7"}, []string{"-config", lobby, "-k", "1", "-window=false"}, func(c Config) bool {
+			return c.Query.K == 1 && !c.Output.Window && c.Query.Mode == ModeTopK
+		}, ""},
+		{"file from the environment", map[string]string{"SECURESIGHT_CLIENT_CONFIG": lobby}, nil, func(c Config) bool {
+			return c.Source == "rtsp://lobby/stream"
+		}, ""},
+		{"variables of the server ignored", map[string]string{"SECURESIGHT_WORKERS": "2", "SECURESIGHT_K": "9"}, nil, func(c Config) bool {
+			return c.Query.K == 5
+		}, ""},
+		{"unknown key", nil, []string{"-config", file("sorce: 0\n")}, nil, "field sorce not found"},
+		{"key of the server", nil, []string{"-config", file("workers: 2\n")}, nil, "field workers not found"},
+		{"missing file", nil, []string{"-config", filepath.Join(dir, "missing.yaml")}, nil, "no such file"},
+		{"malformed environment", map[string]string{"SECURESIGHT_CLIENT_READY_TIMEOUT": "soon"}, nil, nil, "SECURESIGHT_CLIENT_READY_TIMEOUT"},
+		{"invalid value", nil, []string{"-server", "localhost:8080"}, nil, "neither http:// nor https://"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			fs := flag.NewFlagSet("client", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			config, err := LoadConfig(fs, test.args)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.check(config) {
+				t.Errorf("got %+v", config)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(*Config)
+		err  string
+	}{
+		{"defaults", func(*Config) {}, ""},
+		{"stream without address", func(c *Config) { c.Server.UseStream, c.Server.Stream = true, "" }, "no stream address"},
+		{"no source", func(c *Config) { c.Source = "" }, "no video source"},
+		{"no detector", func(c *Config) { c.Models.YOLO = "" }, "YOLO and ResNet"},
+		{"unknown mode", func(c *Config) { c.Query.Mode = "argmin" }, `unknown response mode "argmin"`},
+		{"unknown kernel", func(c *Config) { c.Query.Kernel = "cosine" }, `unknown distance kernel "cosine"`},
+		{"no neighbour", func(c *Config) { c.Query.K = 0 }, "k 0 is less than one"},
+		{"codec not a FourCC", func(c *Config) { c.Output.Video, c.Output.Codec = "out.mp4", "h264x" }, "not a FourCC"},
+		{"threshold above one", func(c *Config) { c.Detection.NMSOverlap = 1.5 }, "NMS overlap threshold 1.5"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := defaultConfig()
+			test.edit(&config)
+			err := config.Validate()
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
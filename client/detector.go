@@ -1,19 +1,45 @@
 package main
 
 import (
+	"fmt"
 	"gocv.io/x/gocv"
 	"image"
 )
 
+// DetectionConfig holds the thresholds applied to the output of the detector.
+type DetectionConfig struct {
+	Confidence float64 `yaml:"confidence"`  // Confidence a detection needs to be kept
+	NMSScore   float64 `yaml:"nms-score"`   // Score a box needs to go through non-maximum suppression
+	NMSOverlap float64 `yaml:"nms-overlap"` // Intersection over union above which the weaker of two boxes is suppressed
+}
+
+// defaultDetection holds the thresholds the YOLO face model was tuned with.
+var defaultDetection = DetectionConfig{Confidence: 0.25, NMSScore: 0.5, NMSOverlap: 0.4}
+
+// Validate checks that the thresholds are between 0 and 1.
+func (c DetectionConfig) Validate() error {
+	for _, threshold := range []struct {
+		name  string
+		value float64
+	}{{"confidence", c.Confidence}, {"NMS score", c.NMSScore}, {"NMS overlap", c.NMSOverlap}} {
+		if !(threshold.value >= 0 && threshold.value <= 1) {
+			return fmt.Errorf("%s threshold %g is not between 0 and 1", threshold.name, threshold.value)
+		}
+	}
+	return nil
+}
+
 // Detector struct holds the network used for object detection.
 type Detector struct {
-	Net gocv.Net // Deep learning model for inference
+	Net        gocv.Net        // Deep learning model for inference
+	Thresholds DetectionConfig // Thresholds applied to the detections
 }
 
-// NewDetector initializes and returns a new Detector instance with the provided network.
-func NewDetector(net gocv.Net) Detector {
+// NewDetector initializes and returns a new Detector instance with the provided network and thresholds.
+func NewDetector(net gocv.Net, thresholds DetectionConfig) Detector {
 	return Detector{
-		Net: net,
+		Net:        net,
+		Thresholds: thresholds,
 	}
 }
 
@@ -47,14 +73,14 @@ func (d *Detector) Detect(i *gocv.Mat) ([]image.Rectangle, []float32, []int) {
 	results := d.Net.Forward("")
 
 	// Format the results into bounding boxes, scores, and indices
-	boxes, scores, indices := FormatResultsYOLO(&results, scale)
+	boxes, scores, indices := FormatResultsYOLO(&results, scale, d.Thresholds)
 
 	return boxes, scores, indices
 }
 
 // FormatResultsYOLO processes the YOLO model's output into bounding boxes, confidence scores, and indices.
-// It uses a threshold to filter out low-confidence detections.
-func FormatResultsYOLO(m *gocv.Mat, scale float32) ([]image.Rectangle, []float32, []int) {
+// It uses the confidence threshold to filter out low-confidence detections.
+func FormatResultsYOLO(m *gocv.Mat, scale float32, thresholds DetectionConfig) ([]image.Rectangle, []float32, []int) {
 	var boxes []image.Rectangle // List of bounding boxes for detected objects
 	var scores []float32        // Confidence scores corresponding to each box
 
@@ -65,7 +91,7 @@ func FormatResultsYOLO(m *gocv.Mat, scale float32) ([]image.Rectangle, []float32
 			confidence := m.GetFloatAt3(0, 4, subSection)
 
 			// If confidence exceeds threshold, process the detection
-			if confidence >= 0.25 {
+			if float64(confidence) >= thresholds.Confidence {
 				// Extract bounding box coordinates from the model output
 				x := m.GetFloatAt3(0, 0, subSection)
 				y := m.GetFloatAt3(0, 1, subSection)
@@ -89,7 +115,7 @@ func FormatResultsYOLO(m *gocv.Mat, scale float32) ([]image.Rectangle, []float32
 	// Perform Non-Maximum Suppression (NMS) to eliminate overlapping boxes
 	indices := make([]int, len(boxes))
 	if len(boxes) > 0 {
-		indices = gocv.NMSBoxes(boxes, scores, 0.5, 0.4)
+		indices = gocv.NMSBoxes(boxes, scores, float32(thresholds.NMSScore), float32(thresholds.NMSOverlap))
 	}
 
 	return boxes, scores, indices
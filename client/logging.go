@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// RequestIDHeader is the HTTP header, and in lower case the gRPC metadata, carrying the ID of a
+// request. The server logs it with the request and echoes it, see server/logging.go.
+const RequestIDHeader = "X-Request-ID"
+
+// setupLogging makes the default logger write records to stderr in format, "text" or "json".
+func setupLogging(format string) error {
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, nil)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, nil)
+	default:
+		return fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs err and exits, for the errors that prevent the client from starting.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// newRequestID returns a random ID for a request to the server.
+func newRequestID() string {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// Timings records the time spent in each stage of a frame and the ID of its request to the server,
+// to log the frame as one line that matches the lines of the server. When tracing, each stage is
+// also a span under the current span of the context given to NewTimings.
+type Timings struct {
+	RequestID string // Set by CallAPI, or the ID of the stream
+
+	start  time.Time // Start of the frame
+	last   time.Time // End of the previous stage
+	names  []string
+	stages map[string]time.Duration
+
+	span spanRef // Span of the frame, if traced
+	next [8]byte // ID of the span of the stage in progress
+}
+
+// NewTimings starts timing a frame, traced under the current span of ctx.
+func NewTimings(ctx context.Context) *Timings {
+	now := time.Now()
+	t := &Timings{start: now, last: now, stages: make(map[string]time.Duration)}
+	if tracer != nil {
+		t.span, _ = ctx.Value(spanKey{}).(spanRef)
+		t.next = newSpanID()
+	}
+	return t
+}
+
+// Stage records the time spent in stage since the end of the previous stage.
+// A stage that runs again, such as a query retried after registering again, adds up.
+func (t *Timings) Stage(stage string) {
+	now := time.Now()
+	if _, ok := t.stages[stage]; !ok {
+		t.names = append(t.names, stage)
+	}
+	t.stages[stage] += now.Sub(t.last)
+	if t.span.local {
+		span := &Span{Parent: t.span.SpanID, Name: stage, Start: t.last, track: t.span.track}
+		span.TraceID, span.SpanID = t.span.TraceID, t.next
+		if t.RequestID != "" {
+			span.Attrs = []any{"request_id", t.RequestID}
+		}
+		tracer.record(span, now)
+		t.next = newSpanID()
+	}
+	t.last = now
+}
+
+// Traceparent returns the traceparent header of the stage in progress, empty when not tracing.
+func (t *Timings) Traceparent() string {
+	if !t.span.local {
+		return ""
+	}
+	return SpanContext{TraceID: t.span.TraceID, SpanID: t.next}.Traceparent()
+}
+
+// Attr returns the stages recorded so far and the total time of the frame, as the "stages" group.
+func (t *Timings) Attr() slog.Attr {
+	attrs := make([]any, 0, len(t.names)+1)
+	for _, stage := range t.names {
+		attrs = append(attrs, slog.Duration(stage, t.stages[stage]))
+	}
+	attrs = append(attrs, slog.Duration("total", time.Since(t.start)))
+	return slog.Group("stages", attrs...)
+}
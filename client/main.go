@@ -1,118 +1,382 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/tuneinsight/lattigo/v6/core/rlwe"
 	"gocv.io/x/gocv"
 	"image"
 	"image/color"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
 	"sort"
 	"strings"
-	"time"
 )
 
 func main() {
+	// Settings from the defaults, the configuration file, the environment and the flags, in that order
+	config, err := LoadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		os.Exit(2)
+	}
+	if err := setupLogging(config.LogFormat); err != nil {
+		fatal("Invalid log format", err)
+	}
+	logConfig(flag.CommandLine)
+	if config.TraceFile != "" {
+		if tracer, err = OpenTracer(config.TraceFile, "securesight client"); err != nil {
+			fatal("Failed to create the trace file", err)
+		}
+		defer tracer.Close()
+	}
 
-	// Print a start message with a visual separator
-	fmt.Println(strings.Repeat("-", 20) + "\nStarting client...\n" + strings.Repeat("-", 20))
+	// Address of the server; an https URL secures both the HTTP API and the stream
+	APIServer = config.Server.URL
+	var tlsConfig *tls.Config
+	if strings.HasPrefix(APIServer, "https://") {
+		if tlsConfig, err = config.TLS.Config(); err != nil {
+			fatal("Failed to load the TLS certificates", err)
+		}
+		UseTLS(tlsConfig)
+	}
 
-	// Open the video file for processing
-	videoFile := "../video.mp4"
-	webcam, err := gocv.VideoCaptureFile(videoFile)
+	// Credentials of the client, when the server authenticates its API clients
+	if apiCredentials, err = LoadCredentials(config.Auth.TokenFile, config.Auth.HMACClient, config.Auth.HMACKeyFile); err != nil {
+		fatal("Failed to read the API credentials", err)
+	}
+
+	// Log the start of the client and the server it talks to
+	slog.Info("Starting client", "server", APIServer, "tls", tlsConfig != nil)
+
+	// Open the video source for processing, a file, a stream URL or the index of a camera
+	webcam, err := gocv.OpenVideoCapture(config.Source)
 	if err != nil {
-		panic(err) // Panic if video file can't be opened
+		fatal("Failed to open the video source", err)
 	}
 	defer webcam.Close() // Ensure the webcam is closed after processing
 
-	// Create a window for video playback
-	window := gocv.NewWindow("Video Playback")
-	defer window.Close()
+	// Create a window for video playback, and the video file receiving the annotated frames once their size is known
+	var window *gocv.Window
+	if config.Output.Window {
+		window = gocv.NewWindow("Video Playback")
+		defer window.Close()
+	}
+	var output *gocv.VideoWriter
+	defer func() {
+		if output != nil {
+			output.Close()
+		}
+	}()
 	img := gocv.NewMat() // Initialize an empty image matrix for each frame
 
 	// Load YOLO model for object detection
-	yolo_path := "../weights/yolov11n-face.onnx"
-	yolo_net := gocv.ReadNet(yolo_path, "")
+	yolo_net := gocv.ReadNet(config.Models.YOLO, "")
 	if yolo_net.Empty() {
-		fmt.Println("Failed to load YOLO model.") // Handle error if YOLO model fails to load
+		slog.Error("Failed to load YOLO model", "path", config.Models.YOLO) // Handle error if YOLO model fails to load
 	}
 	defer yolo_net.Close()
-	detector := NewDetector(yolo_net) // Create detector using YOLO model
+	detector := NewDetector(yolo_net, config.Detection) // Create detector using YOLO model
 
 	// Load ResNet model for feature extraction (embeddings)
-	resnet_path := "../weights/inception_resnet_v1.onnx"
-	resnet_net := gocv.ReadNet(resnet_path, "")
+	resnet_net := gocv.ReadNet(config.Models.ResNet, "")
 	if resnet_net.Empty() {
-		fmt.Println("Failed to load ResNet model.") // Handle error if ResNet model fails to load
+		slog.Error("Failed to load ResNet model", "path", config.Models.ResNet) // Handle error if ResNet model fails to load
 	}
 	defer resnet_net.Close()
 	encoder := NewEncoder(resnet_net) // Create encoder using ResNet model
 
+	// Response mode: ModeTopK only reveals the votes of the k nearest neighbours, at a much higher cost,
+	// and ModeClassScores only reveals one kernel-weighted score per class
+	mode := config.Query.Mode
+	k := config.Query.K
+
+	// Wait for the server to load its gallery, in case both were started together
+	readyCtx, cancelReady := context.WithTimeout(context.Background(), config.Server.ReadyTimeout)
+	err = WaitReady(readyCtx)
+	cancelReady()
+	if err != nil {
+		fatal("Server did not get ready", err)
+	}
+
+	// Ask the server which parameters, kernels and embedding dimension it accepts
+	capabilities, err := FetchCapabilities()
+	if err != nil {
+		fatal("Failed to fetch the capabilities of the server", err)
+	}
+
 	// Initialize encryptor for encrypting embeddings
-	encryptor := NewEncryptor()
+	// The top-k mode gets parameters that the server can bootstrap
+	encryptor, err := NewEncryptor(capabilities, mode, config.Query.ParameterSet)
+	if err != nil {
+		fatal("No parameter set of the server fits", err)
+	}
 
-	// Load PCA model for dimensionality reduction (if needed)
-	pca := NewPCA("../weights/pca_components.json")
-	_ = pca // PCA isn't currently used, but can be enabled if required
+	// Distance kernel evaluated by the server; the inner-product kernel does not need the relinearization key
+	kernel := config.Query.Kernel
+	if !slices.Contains(capabilities.Kernels, kernel) {
+		fatal("Unsupported kernel", fmt.Errorf("server does not support the %q kernel, only %v", kernel, capabilities.Kernels))
+	}
 
-	// Start processing video frames
-	for {
-		// Print message for processing current frame
-		fmt.Println(strings.Repeat("-", 20) + "\nProcessing frame...\n" + strings.Repeat("-", 20))
+	// Let the server sum each block so that responses carry one value per gallery entry
+	sumSlots := config.Query.SumSlots
+	if sumSlots || mode != ModeDistances {
+		encryptor.GenSummationKeys()
+	}
+	if mode == ModeClassScores {
+		encryptor.GenClassScoreKeys()
+	}
+	if mode == ModeTopK {
+		encryptor.GenTopKKeys()
+	}
 
-		// Read the next frame from the webcam
-		webcam.Read(&img)
+	// Register the evaluation keys with the server once for the whole stream
+	// The top-k and class-score modes multiply ciphertexts whatever the kernel
+	publicContext := encryptor.NewPublicContext(kernel == KernelSquaredDifference || mode != ModeDistances)
+
+	// Send the faces over the gRPC stream instead of one POST per frame, so that the frame loop
+	// does not wait for the server; the boxes are then labelled with the latest predictions received,
+	// see streamQuery
+	useStream := config.Server.UseStream
+	var stream *StreamClient
+	results := make(chan streamResult, 64)
+	var sessionID string
+	if useStream {
+		if stream, err = DialStream(context.Background(), config.Server.Stream, tlsConfig); err != nil {
+			fatal("Failed to connect to the gRPC stream", err)
+		}
+		defer stream.Close()
+		go receiveStream(stream, results)
+	}
+	if sessionID, err = registerKeys(stream, publicContext); err != nil {
+		fatal("Failed to register the evaluation keys", err)
+	}
 
-		// Track time taken for processing the current frame
-		startTime := time.Now()
+	// Latest prediction per face index on the stream, and the queries in flight by frame and face
+	latest := make(map[uint64]string)
+	latestFrame := make(map[uint64]uint64)
+	inFlight := make(map[[2]uint64]streamQuery)
+
+	// Start processing video frames
+	for frameID := uint64(1); ; frameID++ {
+		// Read the next frame from the webcam, until the end of a video file
+		if !webcam.Read(&img) || img.Empty() {
+			slog.Info("End of the video source", "source", config.Source, "frames", frameID-1)
+			break
+		}
+
+		// Track time taken by each stage of the current frame, traced as one trace per frame
+		ctx, frameSpan := StartSpan(context.Background(), "frame", "frame", frameID)
+		timings := NewTimings(ctx)
 
 		// Detect objects in the frame using YOLO (bounding boxes, indices)
 		boxes, _, indices := detector.Detect(&img)
+		timings.Stage("detect")
 
 		// Extract embeddings (feature vectors) for the detected objects using ResNet
 		embeddings := encoder.Encode(&img, boxes, indices)
+		timings.Stage("encode")
 
 		// Optional: Apply PCA for dimensionality reduction on embeddings (commented out here)
 		// embeddings = pca.Transform(embeddings)
 
-		// Encrypt the embeddings before sending them to the server
+		// Encrypt the embeddings before sending them to the server, within the norm the server bounds the distances with
 		var ciphertexts []rlwe.Ciphertext
 		for idx := range embeddings {
+			if mode != ModeDistances {
+				embeddings[idx] = encryptor.ClipNorm(embeddings[idx])
+			}
 			ciphertext := encryptor.Encrypt(embeddings[idx]) // Encrypt each embedding
 			ciphertexts = append(ciphertexts, ciphertext)
 		}
+		timings.Stage("encrypt")
+
+		var predictions []string
+		if useStream {
+			// The server logs the queries of the stream under its request ID, with their frame and face
+			timings.RequestID = stream.RequestID
+
+			// Push one query per face, tagged with the frame and its position in the frame
+			for i := range ciphertexts {
+				query := QueryRequest{SessionID: sessionID, Kernel: kernel, SumSlots: sumSlots, Mode: mode, K: k,
+					Query: ciphertexts[i : i+1], FrameID: frameID, FaceID: uint64(i)}
+				if err := stream.Send(query); err != nil {
+					panic(err) // Handle error if the stream broke
+				}
+				inFlight[[2]uint64{frameID, uint64(i)}] = streamQuery{session: sessionID, norm: squaredNorm(embeddings[i])}
+			}
+			timings.Stage("send")
+
+			// Decrypt the responses received meanwhile, in this goroutine since the encoder is not thread-safe
+			expired := false
+		drain:
+			for {
+				select {
+				case result := <-results:
+					var failure *ErrorMessage
+					if errors.As(result.err, &failure) {
+						// Only a query of the current session tells that it expired, the older ones
+						// were sent before the last registration
+						key := [2]uint64{failure.FrameID, failure.FaceID}
+						expired = expired || (failure.Status == http.StatusNotFound && inFlight[key].session == sessionID)
+						delete(inFlight, key)
+						slog.Warn("Stream query failed", "request_id", stream.RequestID, "frame", failure.FrameID, "face", failure.FaceID, "status", failure.Status, "err", failure.Message)
+						continue
+					}
+					if result.err != nil {
+						panic(result.err) // Handle error if the stream broke
+					}
+					response := result.response
+					key := [2]uint64{response.FrameID, response.FaceID}
+					if response.FrameID >= latestFrame[response.FaceID] {
+						latest[response.FaceID] = predict(&encryptor, response, []float64{inFlight[key].norm}, k)[0]
+						latestFrame[response.FaceID] = response.FrameID
+					}
+					delete(inFlight, key)
+				default:
+					break drain
+				}
+			}
+			timings.Stage("decrypt")
+			if expired {
+				// The server dropped the session (restart or idle timeout), register again for the next frames
+				if sessionID, err = registerKeys(stream, publicContext); err != nil {
+					panic(err)
+				}
+				timings.Stage("register")
+			}
+
+			for i := range embeddings {
+				prediction, ok := latest[uint64(i)]
+				if !ok {
+					prediction = "..."
+				}
+				predictions = append(predictions, prediction)
+			}
+		} else {
+			// Send the query to the API and receive the response
+			query := QueryRequest{SessionID: sessionID, Kernel: kernel, SumSlots: sumSlots, Mode: mode, K: k, Query: ciphertexts}
+			responseData, err := CallAPI(query, timings)
+			if err == ErrUnknownSession {
+				// The server dropped the session (restart or idle timeout), register again and retry once
+				if sessionID, err = RegisterSession(publicContext); err != nil {
+					panic(err)
+				}
+				timings.Stage("register")
+				query.SessionID = sessionID
+				responseData, err = CallAPI(query, timings)
+			}
+			switch {
+			case errors.Is(err, ErrQuotaExceeded):
+				// Over the quota of the client, leave the faces of this frame unlabelled
+				slog.Warn("Query refused over the quota", "request_id", timings.RequestID, "frame", frameID, "err", err)
+				for range embeddings {
+					predictions = append(predictions, "...")
+				}
+			case err != nil:
+				panic(err) // Handle error if API call fails
+			default:
+				var queryNorms []float64
+				for _, embedding := range embeddings {
+					queryNorms = append(queryNorms, squaredNorm(embedding))
+				}
+				predictions = predict(&encryptor, responseData, queryNorms, k)
+				timings.Stage("decrypt")
+			}
+		}
 
-		// Create public context from encrypted ciphertexts
-		publicContext := encryptor.NewPublicContext(ciphertexts)
+		// Draw the bounding boxes and predicted classes on the image
+		DrawBoxes(&img, predictions, boxes, indices)
 
-		// Serialize the public context to send to the server
-		serializedPublicContext, err := SerializeObject(publicContext)
-		if err != nil {
-			panic(err) // Handle error if serialization fails
+		timings.Stage("draw")
+
+		// Log the frame with the time taken by each stage, under the request ID found in the server log
+		slog.Info("Processed frame", "frame", frameID, "request_id", timings.RequestID, "faces", len(embeddings), timings.Attr())
+		frameSpan.SetAttr("request_id", timings.RequestID)
+		frameSpan.SetAttr("faces", len(embeddings))
+		frameSpan.End()
+
+		// Write the processed frame to the output video, opened with the size of the first frame
+		if config.Output.Video != "" {
+			if output == nil {
+				fps := webcam.Get(gocv.VideoCaptureFPS)
+				if fps <= 0 {
+					fps = 25 // Cameras and streams may not report their frame rate
+				}
+				if output, err = gocv.VideoWriterFile(config.Output.Video, config.Output.Codec, fps, img.Cols(), img.Rows(), true); err != nil {
+					panic(err) // Handle error if the output video cannot be created
+				}
+			}
+			if err := output.Write(img); err != nil {
+				panic(err) // Handle error if the output video cannot be written
+			}
 		}
 
-		// Send the serialized public context to the API and receive the response
-		responseData, err := CallAPI(serializedPublicContext)
-		if err != nil {
-			panic(err) // Handle error if API call fails
+		// Display the processed frame in the window
+		if window != nil {
+			window.IMShow(img)
+			window.WaitKey(1) // Wait for a key press (needed for proper window handling)
 		}
+	}
+}
 
-		// Decrypt the response data (distances and classes) from the server
-		distances, classes := encryptor.Decrypt(responseData.Distances, responseData.Params)
+// streamQuery is a query sent on the stream and not answered yet.
+//
+// Its response labels the face with the same index in the frames drawn afterwards, until a response
+// of a later frame replaces it. This is a best-effort overlay: it labels the right person only while
+// the detector keeps the faces in the same order from frame to frame.
+type streamQuery struct {
+	session string  // Session the query was sent with
+	norm    float64 // Squared norm of the face, which the inner-product kernel needs to decrypt the distances
+}
 
-		// Convert the distances into predicted classes based on nearest neighbors
-		predictions, err := DistancesToClasses(distances, classes)
+// streamResult is a response or an error received on the stream.
+type streamResult struct {
+	response ResponseData
+	err      error
+}
 
-		// Draw the bounding boxes and predicted classes on the image
-		DrawBoxes(&img, predictions, boxes, indices)
+// receiveStream forwards the responses of the stream to results until the stream ends.
+// Failed queries do not end the stream, any other error does.
+func receiveStream(stream *StreamClient, results chan<- streamResult) {
+	for {
+		response, err := stream.Recv()
+		if err == io.EOF {
+			return
+		}
+		results <- streamResult{response: response, err: err}
+		var failure *ErrorMessage
+		if err != nil && !errors.As(err, &failure) {
+			return
+		}
+	}
+}
 
-		// Calculate and print the total time taken to process the frame
-		elapsedTime := time.Since(startTime)
-		fmt.Println("Total time to process frame: ", elapsedTime.Milliseconds())
+// predict decrypts a response into one predicted class per query, voted by its k nearest neighbours.
+// norms holds the squared norm of each query, which the inner-product kernel leaves out.
+func predict(encryptor *Context, responseData ResponseData, norms []float64, k int) []string {
+	if responseData.Mode == ModeTopK || responseData.Mode == ModeClassScores {
+		// The server already reduced the gallery to one value per label
+		return encryptor.DecryptVotes(responseData.Votes, responseData.Labels)
+	}
 
-		// Display the processed frame in the window
-		window.IMShow(img)
-		window.WaitKey(1) // Wait for a key press (needed for proper window handling)
+	// Decrypt the response data (distances and classes) from the server
+	// With the inner-product kernel the server leaves out ||q||², which only the client knows
+	var offsets []float64
+	if responseData.Kernel == KernelInnerProduct {
+		offsets = norms
 	}
+	distances, classes := encryptor.Decrypt(responseData.Distances, responseData.Params, offsets)
+
+	// Convert the distances into predicted classes based on nearest neighbors
+	predictions, _ := DistancesToClasses(distances, classes, k)
+	return predictions
 }
 
 // DrawBoxes overlays bounding boxes and predicted class labels on the image.
@@ -136,8 +400,8 @@ func DrawBoxes(img *gocv.Mat, predictions []string, boxes []image.Rectangle, ind
 	}
 }
 
-// DistancesToClasses converts distances to predicted class labels using nearest neighbors.
-func DistancesToClasses(d [][]float64, c [][]string) ([]string, error) {
+// DistancesToClasses converts distances to predicted class labels using the k nearest neighbors.
+func DistancesToClasses(d [][]float64, c [][]string, k int) ([]string, error) {
 	predictions := []string{}
 
 	// Iterate over each query and its associated distances
@@ -154,8 +418,8 @@ func DistancesToClasses(d [][]float64, c [][]string) ([]string, error) {
 			return zipped[i][0].(float64) < zipped[j][0].(float64)
 		})
 
-		// Select top-k closest neighbors
-		k := 5
+		// Select top-k closest neighbors, the whole gallery if it is smaller
+		k := min(k, len(zipped))
 		var classes []string
 		for i := 0; i < k; i++ {
 			classes = append(classes, zipped[i][1].(string)) // Add the class label of the neighbor
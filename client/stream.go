@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+// Full method names of the streaming service of the server, see server/stream.go.
+const (
+	StreamRegisterMethod = "/securesight.KNN/Register"
+	StreamQueryMethod    = "/securesight.KNN/Stream"
+)
+
+// frameCodec passes the frames of the wire protocol through gRPC untouched.
+type frameCodec struct{}
+
+func (frameCodec) Marshal(v any) ([]byte, error) {
+	frame, ok := v.(*[]byte)
+	if !ok {
+		return nil, fmt.Errorf("frame codec cannot marshal %T", v)
+	}
+	return *frame, nil
+}
+
+func (frameCodec) Unmarshal(data []byte, v any) error {
+	frame, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("frame codec cannot unmarshal into %T", v)
+	}
+	*frame = append((*frame)[:0], data...)
+	return nil
+}
+
+func (frameCodec) Name() string {
+	return "frame"
+}
+
+// StreamClient keeps a gRPC connection to the server for continuous video recognition.
+// Queries are sent without waiting for the previous ones, and the responses arrive
+// in the order the server finishes them, tagged with the frame and face of their query.
+type StreamClient struct {
+	RequestID string // Sent with every call of the connection, to find its queries in the server log
+
+	span   *Span // Parent of the spans of the server for the queries of the stream
+	conn   *grpc.ClientConn
+	stream grpc.ClientStream
+	sendMu sync.Mutex // Send may be called from several goroutines
+}
+
+// DialStream connects to the streaming service at address, for instance "localhost:8081", over TLS
+// unless tlsConfig is nil, and opens the query stream, which lives until Close or the cancellation of ctx.
+// The options are added to those of the connection.
+func DialStream(ctx context.Context, address string, tlsConfig *tls.Config, options ...grpc.DialOption) (*StreamClient, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	options = append([]grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithPerRPCCredentials(apiCredentials),
+		grpc.WithDefaultCallOptions(
+			grpc.ForceCodec(frameCodec{}),
+			// Evaluation keys and ciphertexts are far larger than the default limit of 4 MiB
+			grpc.MaxCallRecvMsgSize(math.MaxInt32),
+			grpc.MaxCallSendMsgSize(math.MaxInt32),
+		),
+	}, options...)
+	conn, err := grpc.NewClient(address, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &StreamClient{RequestID: newRequestID(), conn: conn}
+	ctx, c.span = StartSpan(ctx, "Stream", "request_id", c.RequestID, "address", address)
+	if c.stream, err = conn.NewStream(c.outgoing(ctx), &grpc.StreamDesc{StreamName: "Stream", ServerStreams: true, ClientStreams: true}, StreamQueryMethod); err != nil {
+		c.span.End()
+		conn.Close()
+		return nil, err
+	}
+	slog.Info("Opened stream", "request_id", c.RequestID, "address", address)
+	return c, nil
+}
+
+// outgoing adds the request ID and the trace context of the stream to the metadata of a call.
+func (c *StreamClient) outgoing(ctx context.Context) context.Context {
+	ctx = metadata.AppendToOutgoingContext(ctx, RequestIDHeader, c.RequestID)
+	if c.span != nil {
+		ctx = metadata.AppendToOutgoingContext(ctx, TraceparentHeader, c.span.Traceparent())
+	}
+	return ctx
+}
+
+// Register uploads the evaluation keys of the public context over the stream connection
+// and returns the session ID to attach to the queries, like RegisterSession.
+func (c *StreamClient) Register(ctx context.Context, publicContext PublicContext) (string, error) {
+	payload, err := publicContext.MarshalWire()
+	if err != nil {
+		return "", err
+	}
+	request := EncodeFrame(MsgSessionRequest, payload)
+
+	startTime := time.Now()
+	var reply []byte
+	if err := c.conn.Invoke(c.outgoing(ctx), StreamRegisterMethod, &request, &reply); err != nil {
+		return "", err
+	}
+	var session SessionResponse
+	if err := readResponse(reply, MsgSessionResponse, &session); err != nil {
+		return "", err
+	}
+	slog.Info("Registered stream session", "request_id", c.RequestID, "session", session.SessionID, "key_bytes", len(payload), "duration", time.Since(startTime))
+	return session.SessionID, nil
+}
+
+// registerKeys registers the evaluation keys of publicContext over stream, or over POST /api/sessions
+// without a stream. Keys larger than the stream accepts, bootstrapping keys among them, are refused
+// with ResourceExhausted and also go through POST /api/sessions.
+func registerKeys(stream *StreamClient, publicContext PublicContext) (string, error) {
+	if stream != nil {
+		sessionID, err := stream.Register(context.Background(), publicContext)
+		if status.Code(err) != codes.ResourceExhausted {
+			return sessionID, err
+		}
+		slog.Info("Registering the keys over HTTP instead of the stream", "err", err)
+	}
+	return RegisterSession(publicContext)
+}
+
+// Send pushes a query on the stream. Its FrameID and FaceID identify the response.
+func (c *StreamClient) Send(query QueryRequest) error {
+	payload, err := query.MarshalWire()
+	if err != nil {
+		return err
+	}
+	frame := EncodeFrame(MsgQueryRequest, payload)
+
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return c.stream.SendMsg(&frame)
+}
+
+// Recv waits for the next response of the stream. A query that failed on the server is
+// reported as an *ErrorMessage, after which the stream can still be used; any other error
+// ends the stream, io.EOF once the server answered every query after CloseSend.
+func (c *StreamClient) Recv() (ResponseData, error) {
+	var frame []byte
+	if err := c.stream.RecvMsg(&frame); err != nil {
+		return ResponseData{}, err
+	}
+
+	msgType, payload, err := DecodeFrame(frame)
+	if err != nil {
+		return ResponseData{}, err
+	}
+	switch msgType {
+	case MsgQueryResponse:
+		var response ResponseData
+		if err := response.UnmarshalWire(payload); err != nil {
+			return ResponseData{}, fmt.Errorf("Failed to deserialize message: %v", err)
+		}
+		return response, nil
+	case MsgError:
+		failure := &ErrorMessage{}
+		if err := failure.UnmarshalWire(payload); err != nil {
+			return ResponseData{}, fmt.Errorf("Failed to deserialize message: %v", err)
+		}
+		return ResponseData{}, failure
+	default:
+		return ResponseData{}, fmt.Errorf("unexpected message type %d on the stream", msgType)
+	}
+}
+
+// CloseSend tells the server that no more queries will be sent. Recv keeps returning
+// the responses of the queries in flight, then io.EOF.
+func (c *StreamClient) CloseSend() error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return c.stream.CloseSend()
+}
+
+// Close tears down the connection, abandoning the queries in flight.
+func (c *StreamClient) Close() error {
+	c.span.End()
+	return c.conn.Close()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// fakeStreamServer stands in for the streaming service of the server. It registers every session as
+// "session-1", holds the first queries of the stream back and answers them in reverse order, failing
+// the query of face 1 with a MsgError, then answers the others as they come.
+type fakeStreamServer struct {
+	held int // Queries held back before answering
+}
+
+func (s fakeStreamServer) register(_ any, _ context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+	var frame []byte
+	if err := dec(&frame); err != nil {
+		return nil, err
+	}
+	var w wireWriter
+	w.string(1, "session-1")
+	response := EncodeFrame(MsgSessionResponse, w.buf.Bytes())
+	return &response, nil
+}
+
+func (s fakeStreamServer) stream(_ any, stream grpc.ServerStream) error {
+	answer := func(ids [2]uint64) error {
+		var w wireWriter
+		msgType := MsgQueryResponse
+		if ids[1] == 1 {
+			msgType = MsgError
+			w.string(1, "unknown session")
+			w.uint(2, http.StatusNotFound)
+			w.uint(3, ids[0])
+			w.uint(4, ids[1])
+		} else {
+			w.string(3, ModeDistances)
+			w.uint(8, ids[0])
+			w.uint(9, ids[1])
+		}
+		frame := EncodeFrame(msgType, w.buf.Bytes())
+		return stream.SendMsg(&frame)
+	}
+
+	var held [][2]uint64
+	for {
+		var frame []byte
+		if err := stream.RecvMsg(&frame); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		_, payload, err := DecodeFrame(frame)
+		if err != nil {
+			return err
+		}
+		var ids [2]uint64
+		err = readFields(payload, func(tag uint64, data []byte) (err error) {
+			switch tag {
+			case 7:
+				ids[0], err = readUint(data)
+			case 8:
+				ids[1], err = readUint(data)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		if held = append(held, ids); len(held) < s.held {
+			continue
+		}
+		for len(held) > 0 {
+			if err := answer(held[len(held)-1]); err != nil {
+				return err
+			}
+			held = held[:len(held)-1]
+		}
+		s.held = 0
+	}
+}
+
+func TestStreamClient(t *testing.T) {
+	fake := fakeStreamServer{held: 3}
+	server := grpc.NewServer(grpc.ForceServerCodec(frameCodec{}))
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "securesight.KNN",
+		HandlerType: (*any)(nil),
+		Methods:     []grpc.MethodDesc{{MethodName: "Register", Handler: fake.register}},
+		Streams:     []grpc.StreamDesc{{StreamName: "Stream", Handler: fake.stream, ServerStreams: true, ClientStreams: true}},
+	}, nil)
+	listener := bufconn.Listen(1 << 20)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	dialer := grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return listener.DialContext(ctx)
+	})
+	stream, err := DialStream(context.Background(), "passthrough:///bufconn", nil, dialer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	encryptor := newContext(ckks.ParametersLiteral{LogN: 10, LogQ: []int{40, 30}, LogP: []int{40}, LogDefaultScale: 30})
+	sessionID, err := stream.Register(context.Background(), encryptor.NewPublicContext(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessionID != "session-1" {
+		t.Errorf("registered session %q, expected session-1", sessionID)
+	}
+
+	send := func(frameID, faceID uint64) {
+		t.Helper()
+		if err := stream.Send(QueryRequest{SessionID: sessionID, Mode: ModeDistances, FrameID: frameID, FaceID: faceID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recv := func(frameID, faceID uint64, failed bool) {
+		t.Helper()
+		response, err := stream.Recv()
+		var failure *ErrorMessage
+		switch {
+		case failed && errors.As(err, &failure):
+			if failure.FrameID != frameID || failure.FaceID != faceID || failure.Status != http.StatusNotFound {
+				t.Errorf("got failure %+v, expected status 404 for frame %d face %d", failure, frameID, faceID)
+			}
+		case failed || err != nil:
+			t.Fatalf("got response %+v and error %v, expected a failure %t of frame %d face %d", response, err, failed, frameID, faceID)
+		case response.FrameID != frameID || response.FaceID != faceID || response.Mode != ModeDistances:
+			t.Errorf("got response of frame %d face %d in mode %q, expected frame %d face %d", response.FrameID, response.FaceID, response.Mode, frameID, faceID)
+		}
+	}
+
+	// Responses in the reverse order of the queries, tagged with their frame and face
+	send(1, 0)
+	send(1, 1)
+	send(2, 0)
+	recv(2, 0, false)
+	recv(1, 1, true)
+	recv(1, 0, false)
+
+	// The failed query left the stream open
+	send(3, 0)
+	recv(3, 0, false)
+
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	if response, err := stream.Recv(); err != io.EOF {
+		t.Errorf("got response %+v and error %v after CloseSend, expected io.EOF", response, err)
+	}
+}
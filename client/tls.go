@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// TLSFiles holds the certificate paths of the client. Without CAFile the server certificate is
+// checked against the system roots; with CertFile the client authenticates itself for mutual TLS.
+type TLSFiles struct {
+	CAFile     string `yaml:"ca"`          // PEM bundle of the CAs trusted to sign the server certificate
+	CertFile   string `yaml:"cert"`        // PEM certificate chain of the client, identifying the camera to the server
+	KeyFile    string `yaml:"key"`         // PEM private key of the client
+	ServerName string `yaml:"server-name"` // Name expected in the server certificate, the host of the server address if empty
+}
+
+// Config loads the certificates into a tls.Config for the HTTP and gRPC clients.
+func (f TLSFiles) Config() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: f.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if f.CAFile != "" {
+		pem, err := os.ReadFile(f.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the server CA: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s holds no PEM certificate", f.CAFile)
+		}
+	}
+	if f.CertFile != "" || f.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Tracing
+//
+// With -trace-file the client records a trace per frame, with a span for the frame and one for
+// each of its stages (see Timings), and appends them to the file in the Chrome trace event format,
+// like the server does, see server/tracing.go. The span of the call to the server is sent in the
+// W3C traceparent header, so that the spans of the server join the trace of the frame. On the
+// gRPC stream, the queries of the server join the trace of the stream instead.
+
+// TraceparentHeader is the W3C Trace Context header, and the gRPC metadata, carrying the trace of a request.
+const TraceparentHeader = "traceparent"
+
+// SpanContext identifies a span across processes.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// IsValid reports whether sc identifies a span.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent returns the traceparent header of sc, for a sampled trace.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%x-%x-01", sc.TraceID, sc.SpanID)
+}
+
+// newSpanID returns a random span ID.
+func newSpanID() (id [8]byte) {
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// newTraceID returns a random trace ID.
+func newTraceID() (id [16]byte) {
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// spanKey is the context key of the current span.
+type spanKey struct{}
+
+// spanRef is the current span of a context.
+type spanRef struct {
+	SpanContext
+	track int  // Track of the span, shared by its sequential children
+	local bool // Set for the spans of this process, which are all the client knows of
+}
+
+// SpanFromContext returns the current span of ctx, invalid if there is none.
+func SpanFromContext(ctx context.Context) SpanContext {
+	ref, _ := ctx.Value(spanKey{}).(spanRef)
+	return ref.SpanContext
+}
+
+// Span is an operation being timed. A nil *Span, returned while tracing is off, does nothing.
+type Span struct {
+	SpanContext
+	Parent [8]byte
+	Name   string
+	Start  time.Time
+	Attrs  []any // Key and value pairs
+
+	track     int
+	ownsTrack bool // The track was taken for this span and is given back by End
+	tracer    *Tracer
+	endOnce   sync.Once
+}
+
+// SetAttr adds a key and value to the args of the span.
+func (s *Span) SetAttr(key string, value any) {
+	if s != nil {
+		s.Attrs = append(s.Attrs, key, value)
+	}
+}
+
+// End records the span.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.endOnce.Do(func() {
+		s.tracer.record(s, time.Now())
+		if s.ownsTrack {
+			s.tracer.releaseTrack(s.track)
+		}
+	})
+}
+
+// StartSpan starts a span named name as a child of the current span of ctx, on its track,
+// or as the root of a new trace. The span is current in the returned context.
+func StartSpan(ctx context.Context, name string, attrs ...any) (context.Context, *Span) {
+	return startSpan(ctx, name, false, attrs)
+}
+
+// StartParallelSpan is StartSpan for a span that runs at the same time as its siblings,
+// which is given a track of its own.
+func StartParallelSpan(ctx context.Context, name string, attrs ...any) (context.Context, *Span) {
+	return startSpan(ctx, name, true, attrs)
+}
+
+func startSpan(ctx context.Context, name string, parallel bool, attrs []any) (context.Context, *Span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	parent, _ := ctx.Value(spanKey{}).(spanRef)
+	span := &Span{Name: name, Start: time.Now(), Attrs: attrs, tracer: tracer}
+	span.SpanID = newSpanID()
+	if parent.IsValid() {
+		span.TraceID, span.Parent = parent.TraceID, parent.SpanID
+	} else {
+		span.TraceID = newTraceID()
+	}
+	if parent.local && !parallel {
+		span.track = parent.track
+	} else {
+		span.track, span.ownsTrack = tracer.takeTrack(), true
+	}
+	return context.WithValue(ctx, spanKey{}, spanRef{SpanContext: span.SpanContext, track: span.track, local: true}), span
+}
+
+// Tracer appends spans to a trace file in the Chrome trace event format.
+type Tracer struct {
+	mu     sync.Mutex
+	file   *os.File
+	pid    int
+	events int   // Events written so far
+	failed bool  // A write failed, which is only logged once
+	closed bool  // Spans ending after Close are dropped
+	free   []int // Tracks no longer used by a span
+	tracks int   // Tracks handed out so far
+}
+
+// tracer records the spans of the client, nil when tracing is off.
+var tracer *Tracer
+
+// traceEvent is an event of the Chrome trace event format.
+type traceEvent struct {
+	Name      string         `json:"name"`
+	Category  string         `json:"cat,omitempty"`
+	Phase     string         `json:"ph"`
+	Timestamp int64          `json:"ts"` // Microseconds since the Unix epoch, so that the files of the client and the server line up
+	Duration  int64          `json:"dur,omitempty"`
+	PID       int            `json:"pid"`
+	TID       int            `json:"tid"`
+	Args      map[string]any `json:"args,omitempty"`
+}
+
+// OpenTracer creates the trace file at path, named process in the trace viewer.
+func OpenTracer(path, process string) (*Tracer, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &Tracer{file: file, pid: os.Getpid()}
+	// The array is closed by Close; the viewers also open a file cut short by a crash
+	if _, err := file.WriteString("["); err != nil {
+		file.Close()
+		return nil, err
+	}
+	t.write(traceEvent{Name: "process_name", Phase: "M", PID: t.pid, Args: map[string]any{"name": process}})
+	return t, nil
+}
+
+// Close ends the trace file.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	if _, err := t.file.WriteString("\n]\n"); err != nil {
+		t.file.Close()
+		return err
+	}
+	return t.file.Close()
+}
+
+// record writes a span that ended at end.
+func (t *Tracer) record(span *Span, end time.Time) {
+	args := map[string]any{
+		"trace_id": hex.EncodeToString(span.TraceID[:]),
+		"span_id":  hex.EncodeToString(span.SpanID[:]),
+	}
+	if span.Parent != [8]byte{} {
+		args["parent_id"] = hex.EncodeToString(span.Parent[:])
+	}
+	for i := 0; i+1 < len(span.Attrs); i += 2 {
+		args[fmt.Sprint(span.Attrs[i])] = span.Attrs[i+1]
+	}
+	t.write(traceEvent{
+		Name:      span.Name,
+		Category:  "securesight",
+		Phase:     "X",
+		Timestamp: span.Start.UnixMicro(),
+		Duration:  max(end.Sub(span.Start).Microseconds(), 1),
+		PID:       t.pid,
+		TID:       span.track,
+		Args:      args,
+	})
+}
+
+// write appends an event to the trace file. Failures are logged once, tracing is not worth failing a request.
+func (t *Tracer) write(event traceEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		data, _ = json.Marshal(traceEvent{Name: event.Name, Phase: event.Phase, Timestamp: event.Timestamp,
+			Duration: event.Duration, PID: event.PID, TID: event.TID, Args: map[string]any{"error": err.Error()}})
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	separator := ",\n"
+	if t.events == 0 {
+		separator = "\n"
+	}
+	if _, err := t.file.WriteString(separator + string(data)); err != nil {
+		if !t.failed {
+			slog.Error("Failed to write the trace file", "path", t.file.Name(), "err", err)
+			t.failed = true
+		}
+		return
+	}
+	t.events++
+}
+
+// takeTrack returns a track that no running span uses.
+func (t *Tracer) takeTrack() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n := len(t.free); n > 0 {
+		track := t.free[n-1]
+		t.free = t.free[:n-1]
+		return track
+	}
+	t.tracks++
+	return t.tracks
+}
+
+// releaseTrack gives back the track of a span that ended.
+func (t *Tracer) releaseTrack(track int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.free = append(t.free, track)
+}
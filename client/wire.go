@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+)
+
+// Wire protocol
+//
+// Messages are framed and versioned as described in server/wire.go: a 16-byte header holding the
+// magic "SSWP", the major and minor versions, the message type and the payload length, followed by
+// tagged fields whose values are strings, uvarints or Lattigo binary encodings.
+// The field tags must be kept in sync with the server.
+
+// MessageType identifies the content of a frame.
+type MessageType uint16
+
+// Message types of the wire protocol.
+const (
+	MsgSessionRequest  MessageType = 1
+	MsgSessionResponse MessageType = 2
+	MsgQueryRequest    MessageType = 3
+	MsgQueryResponse   MessageType = 4
+	MsgError           MessageType = 5
+)
+
+// Version of the wire protocol spoken by this client.
+const (
+	WireVersionMajor = 1
+	WireVersionMinor = 1
+)
+
+// WireContentType is the media type of framed messages.
+const WireContentType = "application/vnd.securesight.frame"
+
+const (
+	wireMagic      = "SSWP"
+	wireHeaderSize = 16
+)
+
+// ErrUnsupportedVersion is returned for frames of another major version.
+var ErrUnsupportedVersion = errors.New("unsupported wire protocol version")
+
+// EncodeFrame wraps a payload in a frame of the given type.
+func EncodeFrame(msgType MessageType, payload []byte) []byte {
+	frame := make([]byte, wireHeaderSize, wireHeaderSize+len(payload))
+	copy(frame, wireMagic)
+	frame[4] = WireVersionMajor
+	frame[5] = WireVersionMinor
+	binary.BigEndian.PutUint16(frame[6:], uint16(msgType))
+	binary.BigEndian.PutUint64(frame[8:], uint64(len(payload)))
+	return append(frame, payload...)
+}
+
+// DecodeFrame checks the header of a frame and returns its type and payload.
+func DecodeFrame(frame []byte) (MessageType, []byte, error) {
+	if !IsFrame(frame) || len(frame) < wireHeaderSize {
+		return 0, nil, fmt.Errorf("not a wire protocol frame")
+	}
+	if frame[4] != WireVersionMajor {
+		return 0, nil, fmt.Errorf("%w %d.%d, this client speaks %d.%d", ErrUnsupportedVersion, frame[4], frame[5], WireVersionMajor, WireVersionMinor)
+	}
+	length := binary.BigEndian.Uint64(frame[8:])
+	if length != uint64(len(frame)-wireHeaderSize) {
+		return 0, nil, fmt.Errorf("frame announces %d bytes of payload but carries %d", length, len(frame)-wireHeaderSize)
+	}
+	return MessageType(binary.BigEndian.Uint16(frame[6:])), frame[wireHeaderSize:], nil
+}
+
+// IsFrame reports whether data starts with the magic of the wire protocol.
+func IsFrame(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(wireMagic))
+}
+
+// wireWriter appends fields to a payload.
+type wireWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *wireWriter) bytes(tag uint64, data []byte) {
+	w.buf.Write(binary.AppendUvarint(nil, tag))
+	w.buf.Write(binary.AppendUvarint(nil, uint64(len(data))))
+	w.buf.Write(data)
+}
+
+func (w *wireWriter) string(tag uint64, s string) {
+	if s != "" {
+		w.bytes(tag, []byte(s))
+	}
+}
+
+func (w *wireWriter) strings(tag uint64, values []string) {
+	for _, s := range values {
+		w.bytes(tag, []byte(s))
+	}
+}
+
+func (w *wireWriter) uint(tag uint64, v uint64) {
+	if v != 0 {
+		w.bytes(tag, binary.AppendUvarint(nil, v))
+	}
+}
+
+func (w *wireWriter) bool(tag uint64, v bool) {
+	if v {
+		w.uint(tag, 1)
+	}
+}
+
+func (w *wireWriter) binary(tag uint64, v encoding.BinaryMarshaler) error {
+	data, err := v.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	w.bytes(tag, data)
+	return nil
+}
+
+// readFields calls fn for every field of a payload, in order.
+func readFields(payload []byte, fn func(tag uint64, data []byte) error) error {
+	for len(payload) > 0 {
+		tag, n := binary.Uvarint(payload)
+		if n <= 0 {
+			return fmt.Errorf("malformed field tag")
+		}
+		payload = payload[n:]
+		length, n := binary.Uvarint(payload)
+		if n <= 0 || length > uint64(len(payload)-n) {
+			return fmt.Errorf("malformed length of field %d", tag)
+		}
+		payload = payload[n:]
+		if err := fn(tag, payload[:length]); err != nil {
+			return fmt.Errorf("field %d: %v", tag, err)
+		}
+		payload = payload[length:]
+	}
+	return nil
+}
+
+// readUint decodes an integer field.
+func readUint(data []byte) (uint64, error) {
+	v, n := binary.Uvarint(data)
+	if n != len(data) {
+		return 0, fmt.Errorf("malformed integer")
+	}
+	return v, nil
+}
+
+// MarshalWire encodes the payload of a MsgSessionRequest.
+// The relinearization key, if any, travels inside the evaluation key set.
+func (pc PublicContext) MarshalWire() ([]byte, error) {
+	var w wireWriter
+	if err := w.binary(1, pc.Params); err != nil {
+		return nil, err
+	}
+	if err := w.binary(2, &pc.Evk); err != nil {
+		return nil, err
+	}
+	if pc.Bootstrapping != nil {
+		if err := w.binary(3, pc.Bootstrapping); err != nil {
+			return nil, err
+		}
+	}
+	if pc.BootstrappingKeys != nil {
+		if err := w.binary(4, pc.BootstrappingKeys); err != nil {
+			return nil, err
+		}
+	}
+	return w.buf.Bytes(), nil
+}
+
+// UnmarshalWire decodes the payload of a MsgSessionResponse.
+func (resp *SessionResponse) UnmarshalWire(payload []byte) error {
+	return readFields(payload, func(tag uint64, data []byte) error {
+		if tag == 1 {
+			resp.SessionID = string(data)
+		}
+		return nil
+	})
+}
+
+// MarshalWire encodes the payload of a MsgQueryRequest.
+func (query QueryRequest) MarshalWire() ([]byte, error) {
+	var w wireWriter
+	w.string(1, query.SessionID)
+	w.string(2, query.Kernel)
+	w.bool(3, query.SumSlots)
+	w.string(4, query.Mode)
+	w.uint(5, uint64(query.K))
+	for i := range query.Query {
+		if err := w.binary(6, &query.Query[i]); err != nil {
+			return nil, err
+		}
+	}
+	w.uint(7, query.FrameID)
+	w.uint(8, query.FaceID)
+	return w.buf.Bytes(), nil
+}
+
+// UnmarshalWire decodes the payload of a MsgQueryResponse.
+func (r *ResponseData) UnmarshalWire(payload []byte) error {
+	return readFields(payload, func(tag uint64, data []byte) (err error) {
+		switch tag {
+		case 1:
+			return r.Params.UnmarshalBinary(data)
+		case 2:
+			r.Kernel = string(data)
+		case 3:
+			r.Mode = string(data)
+		case 4:
+			r.Classes = append(r.Classes, string(data))
+		case 5:
+			r.Labels = append(r.Labels, string(data))
+		case 6:
+			var ct rlwe.Ciphertext
+			if err := ct.UnmarshalBinary(data); err != nil {
+				return err
+			}
+			r.Votes = append(r.Votes, ct)
+		case 7:
+			var distances []Distance
+			err := readFields(data, func(tag uint64, data []byte) error {
+				if tag != 1 {
+					return nil
+				}
+				var distance Distance
+				err := readFields(data, func(tag uint64, data []byte) error {
+					switch tag {
+					case 1:
+						return distance.Distance.UnmarshalBinary(data)
+					case 2:
+						distance.Classes = append(distance.Classes, string(data))
+					case 3:
+						size, err := readUint(data)
+						if err != nil {
+							return err
+						}
+						distance.PackSizes = append(distance.PackSizes, int(size))
+					}
+					return nil
+				})
+				distances = append(distances, distance)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			r.Distances = append(r.Distances, distances)
+		case 8:
+			r.FrameID, err = readUint(data)
+		case 9:
+			r.FaceID, err = readUint(data)
+		}
+		return err
+	})
+}
+
+// ErrorMessage is sent by the gRPC stream in place of the response to a query that failed.
+type ErrorMessage struct {
+	Message string
+	Status  int // HTTP status the failure would have on /api/knn
+	FrameID uint64
+	FaceID  uint64
+}
+
+func (e *ErrorMessage) Error() string {
+	return fmt.Sprintf("query of face %d in frame %d failed (%d): %s", e.FaceID, e.FrameID, e.Status, e.Message)
+}
+
+// UnmarshalWire decodes the payload of a MsgError.
+func (e *ErrorMessage) UnmarshalWire(payload []byte) error {
+	return readFields(payload, func(tag uint64, data []byte) (err error) {
+		var v uint64
+		switch tag {
+		case 1:
+			e.Message = string(data)
+		case 2:
+			v, err = readUint(data)
+			e.Status = int(v)
+		case 3:
+			e.FrameID, err = readUint(data)
+		case 4:
+			e.FaceID, err = readUint(data)
+		}
+		return err
+	})
+}
@@ -105,6 +105,7 @@ def main():
     print(X.shape, y.shape)
     np.savetxt("../weights/knn.csv", np.append(X.astype(str), y.reshape(-1, 1), axis=1),
                delimiter=",", fmt="%s")
+    np.savez("../weights/knn.npz", X=X, y=y.astype(str))  # Lossless copy, readable by the server
     train_knn_classifier(X, y)
     visualize_embeddings_with_pca(X, y)
 
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/metadata"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API authentication
+//
+// Clients are listed in a local JSON file given with -clients, for instance:
+//
+//	{"Clients": [
+//	  {"Name": "camera-1", "TokenSHA256": "<printf %s TOKEN | sha256sum>", "Scopes": ["query"], "Galleries": ["knn"]},
+//	  {"Name": "operator", "HMACKey": "<base64 key>", "Scopes": ["query", "gallery-admin"], "Galleries": ["*"],
+//	   "Quota": {"Rate": 20, "Burst": 100, "DailyBudget": 1000000}}
+//	]}
+//
+// A request authenticates with one of the Authorization headers
+//
+//	Bearer <token>
+//	HMAC-SHA256 Client=<name>,Timestamp=<unix seconds>,Nonce=<random>,Signature=<hex>
+//
+// where the signature is the HMAC-SHA256, under the key of the client, of the method, the path,
+// the raw query, the timestamp and the nonce, each followed by a newline, then of the body. The
+// timestamp must be within MaxClockSkew of the server clock, and the nonce must not have been used
+// by the client within that window, so that a captured request cannot be replayed. The gRPC stream
+// takes the Bearer form in its "authorization" metadata.
+// Without a clients file the API is open to anyone, as before.
+
+// Scopes granted to API clients.
+const (
+	ScopeQuery        = "query"         // Register sessions and query the galleries listed for the client
+	ScopeGalleryAdmin = "gallery-admin" // List, enroll and remove identities through /api/gallery
+)
+
+// MaxClockSkew bounds the difference between the timestamp of an HMAC request and the server clock.
+const MaxClockSkew = 5 * time.Minute
+
+// Bounds of the length of the nonce of an HMAC request.
+const (
+	minNonceLength = 16
+	maxNonceLength = 64
+)
+
+// ErrUnauthenticated is wrapped by the errors of requests whose credentials are missing or wrong.
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// ErrForbidden is wrapped by the errors of authenticated requests the client is not allowed to make.
+var ErrForbidden = errors.New("forbidden")
+
+// APIClient is a client of the API, as listed in the clients file.
+type APIClient struct {
+	Name        string   `json:"Name"`
+	TokenSHA256 string   `json:"TokenSHA256"` // Hex of the SHA-256 of the bearer token of the client, if any
+	HMACKey     []byte   `json:"HMACKey"`     // Key signing the requests of the client, base64 in JSON, if any
+	Scopes      []string `json:"Scopes"`
+	Galleries   []string `json:"Galleries"` // Names of the galleries the client may search, "*" for all
+
+	Quota *QuotaPolicy `json:"Quota,omitempty"` // Query quota of the client, the default one of the server if nil
+}
+
+// HasScope reports whether the client was granted scope.
+func (c *APIClient) HasScope(scope string) bool {
+	return slices.Contains(c.Scopes, scope)
+}
+
+// CanSearch reports whether the client may query the gallery with the given name.
+func (c *APIClient) CanSearch(gallery string) bool {
+	return slices.Contains(c.Galleries, "*") || slices.Contains(c.Galleries, gallery)
+}
+
+// Authenticator checks the credentials of requests against the clients of the clients file.
+// A nil *Authenticator lets every request through as an anonymous client.
+type Authenticator struct {
+	byToken map[[sha256.Size]byte]*APIClient
+	byName  map[string]*APIClient
+	nonces  nonceCache // Nonces of the HMAC requests accepted within MaxClockSkew
+}
+
+// authenticator authenticates the requests of the API, nil when the server runs without a clients file.
+var authenticator *Authenticator
+
+// LoadAuthenticator reads the clients file at path.
+func LoadAuthenticator(path string) (*Authenticator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Clients []APIClient `json:"Clients"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	a := &Authenticator{byToken: make(map[[sha256.Size]byte]*APIClient), byName: make(map[string]*APIClient),
+		nonces: nonceCache{seen: make(map[string]time.Time)}}
+	for i := range file.Clients {
+		client := &file.Clients[i]
+		switch {
+		case client.Name == "":
+			return nil, fmt.Errorf("%s: client %d has no name", path, i)
+		case a.byName[client.Name] != nil:
+			return nil, fmt.Errorf("%s: client %q is listed twice", path, client.Name)
+		case client.TokenSHA256 == "" && len(client.HMACKey) == 0:
+			return nil, fmt.Errorf("%s: client %q has neither a token nor an HMAC key", path, client.Name)
+		}
+		if client.Quota != nil {
+			if err := client.Quota.Validate(); err != nil {
+				return nil, fmt.Errorf("%s: client %q: %v", path, client.Name, err)
+			}
+		}
+		for _, scope := range client.Scopes {
+			if scope != ScopeQuery && scope != ScopeGalleryAdmin {
+				return nil, fmt.Errorf("%s: client %q has unknown scope %q", path, client.Name, scope)
+			}
+		}
+		if client.TokenSHA256 != "" {
+			var digest [sha256.Size]byte
+			if n, err := hex.Decode(digest[:], []byte(client.TokenSHA256)); err != nil || n != sha256.Size {
+				return nil, fmt.Errorf("%s: TokenSHA256 of client %q is not the hex of a SHA-256", path, client.Name)
+			}
+			if a.byToken[digest] != nil {
+				return nil, fmt.Errorf("%s: clients %q and %q share a token", path, a.byToken[digest].Name, client.Name)
+			}
+			a.byToken[digest] = client
+		}
+		a.byName[client.Name] = client
+	}
+	return a, nil
+}
+
+// Len returns the number of clients.
+func (a *Authenticator) Len() int {
+	return len(a.byName)
+}
+
+// bearer returns the client holding token.
+func (a *Authenticator) bearer(token string) (*APIClient, error) {
+	// Tokens are looked up by their digest, which does not leak the token through timing
+	client := a.byToken[sha256.Sum256([]byte(token))]
+	if client == nil {
+		return nil, fmt.Errorf("%w: unknown bearer token", ErrUnauthenticated)
+	}
+	return client, nil
+}
+
+// hmacRequest parses the parameters of an HMAC-SHA256 Authorization header and returns the signed
+// body, whose MAC holds the method, path, query, timestamp and nonce, and to which the body is still to be written.
+func (a *Authenticator) hmacRequest(r *http.Request, params string) (*APIClient, *signedBody, error) {
+	fields := make(map[string]string)
+	for _, field := range strings.Split(params, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		fields[key] = value
+	}
+	client := a.byName[fields["Client"]]
+	if client == nil || len(client.HMACKey) == 0 {
+		return nil, nil, fmt.Errorf("%w: unknown HMAC client %q", ErrUnauthenticated, fields["Client"])
+	}
+	timestamp, err := strconv.ParseInt(fields["Timestamp"], 10, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: malformed HMAC timestamp", ErrUnauthenticated)
+	}
+	if skew := time.Since(time.Unix(timestamp, 0)); skew > MaxClockSkew || skew < -MaxClockSkew {
+		return nil, nil, fmt.Errorf("%w: HMAC timestamp is %v away from the server clock", ErrUnauthenticated, skew.Round(time.Second))
+	}
+	nonce := fields["Nonce"]
+	if len(nonce) < minNonceLength || len(nonce) > maxNonceLength || strings.ContainsAny(nonce, "\n,") {
+		return nil, nil, fmt.Errorf("%w: HMAC nonce must have between %d and %d characters", ErrUnauthenticated, minNonceLength, maxNonceLength)
+	}
+	signature, err := hex.DecodeString(fields["Signature"])
+	if err != nil || len(signature) != sha256.Size {
+		return nil, nil, fmt.Errorf("%w: malformed HMAC signature", ErrUnauthenticated)
+	}
+
+	mac := hmac.New(sha256.New, client.HMACKey)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%d\n%s\n", r.Method, r.URL.Path, r.URL.RawQuery, timestamp, nonce)
+	return client, &signedBody{body: r.Body, mac: mac, signature: signature, nonces: &a.nonces,
+		client: client.Name, nonce: nonce, timestamp: time.Unix(timestamp, 0)}, nil
+}
+
+// Authenticate checks the Authorization header of r and returns its client. The signature of an
+// HMAC request covers the body, so r.Body is replaced by a reader that fails at its end if the
+// signature does not match; handlers of POST, PUT and PATCH must read the body to the end before
+// acting on it. The body of the other methods is read, and the signature checked, right away.
+func (a *Authenticator) Authenticate(r *http.Request) (*APIClient, error) {
+	scheme, params, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	switch scheme {
+	case "Bearer":
+		return a.bearer(params)
+	case "HMAC-SHA256":
+		client, body, err := a.hmacRequest(r, params)
+		if err != nil {
+			return nil, err
+		}
+		r.Body = body
+		if r.ContentLength == 0 || r.Method != "POST" && r.Method != "PUT" && r.Method != "PATCH" {
+			// No handler reads an empty body, nor the body of a GET or DELETE, which may still be
+			// sent chunked; it is read up to the limit of the route and checked before the handler runs
+			if _, err := io.Copy(io.Discard, r.Body); err != nil {
+				return nil, err
+			}
+		}
+		return client, nil
+	case "":
+		return nil, fmt.Errorf("%w: missing Authorization header", ErrUnauthenticated)
+	default:
+		return nil, fmt.Errorf("%w: unsupported authorization scheme %q", ErrUnauthenticated, scheme)
+	}
+}
+
+// signedBody passes a request body through its HMAC and checks the signature when it ends,
+// then that the nonce of the request was not used before.
+type signedBody struct {
+	body      io.ReadCloser
+	mac       hash.Hash
+	signature []byte
+
+	nonces    *nonceCache
+	client    string
+	nonce     string
+	timestamp time.Time
+	verified  bool // The signature matched and the nonce was recorded
+}
+
+func (b *signedBody) Read(p []byte) (int, error) {
+	if b.verified {
+		return b.body.Read(p)
+	}
+	n, err := b.body.Read(p)
+	b.mac.Write(p[:n])
+	if err == io.EOF {
+		if !hmac.Equal(b.mac.Sum(nil), b.signature) {
+			return n, fmt.Errorf("%w: HMAC signature does not match the request", ErrUnauthenticated)
+		}
+		// Nonces are only recorded once signed, so that they cannot be burnt by others
+		if !b.nonces.use(b.client, b.nonce, b.timestamp) {
+			return n, fmt.Errorf("%w: HMAC nonce was already used, the request is replayed", ErrUnauthenticated)
+		}
+		b.verified = true
+	}
+	return n, err
+}
+
+func (b *signedBody) Close() error {
+	return b.body.Close()
+}
+
+// nonceCache remembers the nonces of the signed requests until their timestamp falls out of MaxClockSkew,
+// after which a replay is refused for its timestamp instead.
+type nonceCache struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time // Expiry of each client and nonce
+	pruned time.Time            // Last removal of the expired nonces
+}
+
+// use records the nonce of a request of client signed at timestamp, and reports whether it was new.
+func (c *nonceCache) use(client, nonce string, timestamp time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.pruned) > MaxClockSkew/10 {
+		for key, expiry := range c.seen {
+			if now.After(expiry) {
+				delete(c.seen, key)
+			}
+		}
+		c.pruned = now
+	}
+	key := client + "\n" + nonce
+	if _, ok := c.seen[key]; ok {
+		return false
+	}
+	c.seen[key] = timestamp.Add(MaxClockSkew)
+	return true
+}
+
+// clientKey is the context key of the APIClient of a request.
+type clientKey struct{}
+
+// anonymous stands for every client when the server runs without a clients file.
+var anonymous = &APIClient{Name: "anonymous", Scopes: []string{ScopeQuery, ScopeGalleryAdmin}, Galleries: []string{"*"}}
+
+// RequestClient returns the APIClient of the request of ctx, as set by requireScope.
+func RequestClient(ctx context.Context) *APIClient {
+	if client, ok := ctx.Value(clientKey{}).(*APIClient); ok {
+		return client
+	}
+	return anonymous
+}
+
+// requireScope authenticates the requests of handler and lets through the clients granted scope.
+func requireScope(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := anonymous
+		if authenticator != nil {
+			var err error
+			if client, err = authenticator.Authenticate(r); err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="securesight"`)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
+		if !client.HasScope(scope) {
+			http.Error(w, fmt.Sprintf("%v: client %q lacks the %q scope", ErrForbidden, client.Name, scope), http.StatusForbidden)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), clientKey{}, client)))
+	}
+}
+
+// authenticateStream returns the client of a gRPC call, from the bearer token of its metadata.
+func authenticateStream(ctx context.Context, scope string) (*APIClient, error) {
+	if authenticator == nil {
+		return anonymous, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return nil, fmt.Errorf("%w: missing authorization metadata", ErrUnauthenticated)
+	}
+	token, ok := strings.CutPrefix(values[0], "Bearer ")
+	if !ok {
+		return nil, fmt.Errorf("%w: the stream only accepts bearer tokens", ErrUnauthenticated)
+	}
+	client, err := authenticator.bearer(token)
+	if err != nil {
+		return nil, err
+	}
+	if !client.HasScope(scope) {
+		return nil, fmt.Errorf("%w: client %q lacks the %q scope", ErrForbidden, client.Name, scope)
+	}
+	return client, nil
+}
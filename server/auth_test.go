@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testClients is a clients file with a bearer client and an HMAC client.
+var testClients = fmt.Sprintf(`{"Clients": [
+  {"Name": "camera", "TokenSHA256": "%x", "Scopes": ["query"], "Galleries": ["knn"]},
+  {"Name": "operator", "HMACKey": "a2V5LWtleS1rZXkta2V5LWtleS1rZXkta2V5LWtleQ==", "Scopes": ["query", "gallery-admin"], "Galleries": ["*"]}
+]}`, sha256.Sum256([]byte("camera-token")))
+
+// testHMACKey is the key of the client "operator" of testClients.
+var testHMACKey = []byte("key-key-key-key-key-key-key-key")
+
+// loadTestAuthenticator loads the clients file content.
+func loadTestAuthenticator(t *testing.T, content string) (*Authenticator, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "clients.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadAuthenticator(path)
+}
+
+// signRequest signs r and body as the client does, see client/auth.go.
+func signRequest(r *http.Request, key []byte, timestamp time.Time, nonce, body string) {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%d\n%s\n", r.Method, r.URL.Path, r.URL.RawQuery, timestamp.Unix(), nonce)
+	mac.Write([]byte(body))
+	r.Header.Set("Authorization", fmt.Sprintf("HMAC-SHA256 Client=operator,Timestamp=%d,Nonce=%s,Signature=%s",
+		timestamp.Unix(), nonce, hex.EncodeToString(mac.Sum(nil))))
+}
+
+func TestLoadAuthenticator(t *testing.T) {
+	tests := []struct {
+		name    string
+		clients string
+		err     string
+	}{
+		{"valid", testClients, ""},
+		{"no name", `{"Clients": [{"TokenSHA256": "` + strings.Repeat("0", 64) + `"}]}`, "has no name"},
+		{"listed twice", `{"Clients": [{"Name": "a", "HMACKey": "AA=="}, {"Name": "a", "HMACKey": "AA=="}]}`, "listed twice"},
+		{"no credentials", `{"Clients": [{"Name": "a"}]}`, "neither a token nor an HMAC key"},
+		{"unknown scope", `{"Clients": [{"Name": "a", "HMACKey": "AA==", "Scopes": ["admin"]}]}`, "unknown scope"},
+		{"token not a digest", `{"Clients": [{"Name": "a", "TokenSHA256": "secret"}]}`, "not the hex of a SHA-256"},
+		{"shared token", `{"Clients": [{"Name": "a", "TokenSHA256": "` + strings.Repeat("0", 64) + `"}, {"Name": "b", "TokenSHA256": "` + strings.Repeat("0", 64) + `"}]}`, "share a token"},
+		{"invalid quota", `{"Clients": [{"Name": "a", "HMACKey": "AA==", "Quota": {"Rate": 1}}]}`, "burst"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, err := loadTestAuthenticator(t, test.clients)
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if a.Len() != 2 {
+					t.Errorf("loaded %d clients, expected 2", a.Len())
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	now := time.Now()
+	replayed := httptest.NewRequest("GET", "/api/gallery?name=alice", nil)
+	signRequest(replayed, testHMACKey, now, "replayed-nonce-0001", "")
+
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		client  string // Name of the client authenticated, empty if the request is refused
+		err     string // Error of Authenticate, or of reading the body when client is set
+	}{
+		{"bearer", func() *http.Request {
+			r := httptest.NewRequest("POST", "/api/knn", nil)
+			r.Header.Set("Authorization", "Bearer camera-token")
+			return r
+		}, "camera", ""},
+		{"unknown bearer", func() *http.Request {
+			r := httptest.NewRequest("POST", "/api/knn", nil)
+			r.Header.Set("Authorization", "Bearer other-token")
+			return r
+		}, "", "unknown bearer token"},
+		{"missing header", func() *http.Request {
+			return httptest.NewRequest("POST", "/api/knn", nil)
+		}, "", "missing Authorization header"},
+		{"basic", func() *http.Request {
+			r := httptest.NewRequest("POST", "/api/knn", nil)
+			r.SetBasicAuth("operator", "password")
+			return r
+		}, "", "unsupported authorization scheme"},
+		{"HMAC POST", func() *http.Request {
+			r := httptest.NewRequest("POST", "/api/gallery", strings.NewReader(`{"Label": "alice"}`))
+			signRequest(r, testHMACKey, now, "post-nonce-000001", `{"Label": "alice"}`)
+			return r
+		}, "operator", ""},
+		{"HMAC GET with query", func() *http.Request {
+			r := httptest.NewRequest("GET", "/api/gallery?name=alice", nil)
+			signRequest(r, testHMACKey, now, "get-nonce-0000001", "")
+			return r
+		}, "operator", ""},
+		{"tampered query", func() *http.Request {
+			r := httptest.NewRequest("DELETE", "/api/gallery?label=alice", nil)
+			signRequest(r, testHMACKey, now, "delete-nonce-00001", "")
+			r.URL.RawQuery = "label=bob"
+			return r
+		}, "", "signature does not match"},
+		{"tampered body", func() *http.Request {
+			r := httptest.NewRequest("POST", "/api/gallery", strings.NewReader(`{"Label": "bob"}`))
+			signRequest(r, testHMACKey, now, "post-nonce-000002", `{"Label": "alice"}`)
+			return r
+		}, "operator", "signature does not match"},
+		{"chunked GET body", func() *http.Request {
+			r := httptest.NewRequest("GET", "/api/gallery", strings.NewReader("unsigned"))
+			r.ContentLength = -1
+			signRequest(r, testHMACKey, now, "chunked-nonce-0001", "")
+			return r
+		}, "", "signature does not match"},
+		{"replay", func() *http.Request {
+			return replayed.Clone(replayed.Context())
+		}, "", "already used"},
+		{"wrong key", func() *http.Request {
+			r := httptest.NewRequest("GET", "/api/gallery", nil)
+			signRequest(r, []byte("another-key"), now, "wrong-key-nonce-01", "")
+			return r
+		}, "", "signature does not match"},
+		{"stale timestamp", func() *http.Request {
+			r := httptest.NewRequest("GET", "/api/gallery", nil)
+			signRequest(r, testHMACKey, now.Add(-2*MaxClockSkew), "stale-nonce-000001", "")
+			return r
+		}, "", "away from the server clock"},
+		{"short nonce", func() *http.Request {
+			r := httptest.NewRequest("GET", "/api/gallery", nil)
+			signRequest(r, testHMACKey, now, "short", "")
+			return r
+		}, "", "nonce must have"},
+		{"unknown HMAC client", func() *http.Request {
+			r := httptest.NewRequest("GET", "/api/gallery", nil)
+			signRequest(r, testHMACKey, now, "unknown-nonce-0001", "")
+			r.Header.Set("Authorization", strings.Replace(r.Header.Get("Authorization"), "operator", "camera", 1))
+			return r
+		}, "", `unknown HMAC client "camera"`},
+		{"malformed timestamp", func() *http.Request {
+			r := httptest.NewRequest("GET", "/api/gallery", nil)
+			r.Header.Set("Authorization", "HMAC-SHA256 Client=operator,Timestamp=now,Nonce=abcdefghijklmnopq,Signature=00")
+			return r
+		}, "", "malformed HMAC timestamp"},
+	}
+
+	a, err := loadTestAuthenticator(t, testClients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Authenticate(replayed); err != nil {
+		t.Fatalf("first use of the replayed request: %v", err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := test.request()
+			client, err := a.Authenticate(r)
+			if err == nil && test.client != "" {
+				_, err = io.ReadAll(r.Body)
+				if client.Name != test.client {
+					t.Errorf("authenticated %q, expected %q", client.Name, test.client)
+				}
+			}
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrUnauthenticated) || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestSignedBodyReadsPastEOF(t *testing.T) {
+	a, err := loadTestAuthenticator(t, testClients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/api/gallery", strings.NewReader("body"))
+	signRequest(r, testHMACKey, time.Now(), "eof-nonce-00000001", "body")
+	if _, err := a.Authenticate(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r.Body); err != nil {
+		t.Fatal(err)
+	}
+	// Reading again at the end must not count as a replay of the nonce
+	if n, err := r.Body.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("read %d bytes and %v after the end, expected io.EOF", n, err)
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	a, err := loadTestAuthenticator(t, testClients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator = a
+	defer func() { authenticator = nil }()
+
+	handler := requireScope(ScopeGalleryAdmin, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, RequestClient(r.Context()).Name)
+	})
+	tests := []struct {
+		name   string
+		auth   string
+		status int
+	}{
+		{"granted", "", http.StatusOK},
+		{"lacks the scope", "Bearer camera-token", http.StatusForbidden},
+		{"unauthenticated", "Bearer other-token", http.StatusUnauthorized},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/gallery", nil)
+			if test.auth == "" {
+				signRequest(r, testHMACKey, time.Now(), "scope-nonce-00000"+strconv.Itoa(i), "")
+			} else {
+				r.Header.Set("Authorization", test.auth)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != test.status {
+				t.Errorf("got status %d %q, expected %d", w.Code, w.Body, test.status)
+			}
+			if test.status == http.StatusOK && w.Body.String() != "operator" {
+				t.Errorf("handler saw client %q", w.Body)
+			}
+		})
+	}
+}
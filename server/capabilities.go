@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/tuneinsight/lattigo/v6/circuits/ckks/bootstrapping"
+	"github.com/tuneinsight/lattigo/v6/ring"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+	"net/http"
+	"sync"
+)
+
+// ErrUnsupportedParameters is returned when a session registers CKKS parameters
+// that are not one of the ParameterSets advertised by /api/capabilities.
+var ErrUnsupportedParameters = errors.New("unsupported CKKS parameters")
+
+// ParameterSet is a CKKS parameter set the server accepts from clients.
+type ParameterSet struct {
+	Name          string                 `json:"Name"`
+	Params        ckks.ParametersLiteral `json:"Params"`
+	Bootstrapping bool                   `json:"Bootstrapping"` // Leaves room for bootstrapping, as needed by ModeTopK
+	Modes         []string               `json:"Modes"`         // Response modes the set has enough levels for
+
+	// Auxiliary moduli of the bootstrapping keys. Sessions must register the bootstrapping.Parameters
+	// built from Params and a bootstrapping.ParametersLiteral holding only these and the Xs of Params.
+	BootstrappingLogP []int `json:"BootstrappingLogP,omitempty"`
+}
+
+// ParameterSets lists the accepted parameter sets, in order of preference.
+var ParameterSets = []ParameterSet{
+	{
+		Name: "default",
+		Params: ckks.ParametersLiteral{
+			LogN:            14,
+			LogQ:            []int{60, 50, 50, 50, 50, 50, 50, 50},
+			LogP:            []int{61},
+			LogDefaultScale: 45,
+		},
+		Modes: []string{ModeDistances, ModeClassScores},
+	},
+	{
+		Name: "bootstrappable",
+		Params: ckks.ParametersLiteral{
+			LogN:            16,
+			LogQ:            []int{60, 40, 40, 40, 40, 40, 40, 40, 40, 40},
+			LogP:            []int{61, 61, 61},
+			LogDefaultScale: 40,
+			Xs:              ring.Ternary{H: 192},
+		},
+		Bootstrapping:     true,
+		Modes:             []string{ModeDistances, ModeTopK, ModeClassScores},
+		BootstrappingLogP: []int{61, 61, 61, 61},
+	},
+}
+
+// Capabilities is the body returned by GET /api/capabilities.
+type Capabilities struct {
+	Dimension      int            `json:"Dimension"`      // Length of the embeddings in the gallery
+	BlockSize      int            `json:"BlockSize"`      // Slots holding one embedding in a query ciphertext
+	MaxNorm        float64        `json:"MaxNorm"`        // Longest L2 norm of a query, longer ones must be scaled down
+	ParameterSets  []ParameterSet `json:"ParameterSets"`  // Accepted CKKS parameter sets
+	Kernels        []string       `json:"Kernels"`        // Supported distance kernels
+	MaxTopK        int            `json:"MaxTopK"`        // Largest K of ModeTopK
+	GalleryVersion uint64         `json:"GalleryVersion"` // Changes whenever the gallery is enrolled into, pruned or reloaded
+	WireVersion    string         `json:"WireVersion"`    // Version of the framed wire protocol
+}
+
+// acceptedParams holds the parameters built from ParameterSets, in the same order.
+var acceptedParams = sync.OnceValues(func() ([]ckks.Parameters, error) {
+	params := make([]ckks.Parameters, len(ParameterSets))
+	for i, set := range ParameterSets {
+		var err error
+		if params[i], err = ckks.NewParametersFromLiteral(set.Params); err != nil {
+			return nil, fmt.Errorf("parameter set %q: %v", set.Name, err)
+		}
+	}
+	return params, nil
+})
+
+// acceptedBootstrapping holds the bootstrapping parameters of ParameterSets, in the same order,
+// or nil for the sets that cannot be bootstrapped.
+var acceptedBootstrapping = sync.OnceValues(func() ([]*bootstrapping.Parameters, error) {
+	accepted, err := acceptedParams()
+	if err != nil {
+		return nil, err
+	}
+	btpParams := make([]*bootstrapping.Parameters, len(ParameterSets))
+	for i, set := range ParameterSets {
+		if !set.Bootstrapping {
+			continue
+		}
+		params, err := bootstrapping.NewParametersFromLiteral(accepted[i], bootstrapping.ParametersLiteral{
+			LogP: set.BootstrappingLogP,
+			Xs:   accepted[i].Xs(),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("parameter set %q cannot be bootstrapped: %v", set.Name, err)
+		}
+		btpParams[i] = &params
+	}
+	return btpParams, nil
+})
+
+// expectedBootstrapping returns the bootstrapping parameters of set, or nil if it cannot be bootstrapped.
+func expectedBootstrapping(set *ParameterSet) (*bootstrapping.Parameters, error) {
+	btpParams, err := acceptedBootstrapping()
+	if err != nil {
+		return nil, err
+	}
+	for i := range ParameterSets {
+		if ParameterSets[i].Name == set.Name {
+			return btpParams[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// matchParameterSet returns the accepted parameter set equal to params.
+func matchParameterSet(params ckks.Parameters) (*ParameterSet, error) {
+	accepted, err := acceptedParams()
+	if err != nil {
+		return nil, err
+	}
+	for i := range accepted {
+		if accepted[i].Equal(&params) {
+			return &ParameterSets[i], nil
+		}
+	}
+	return nil, &ValidationError{
+		Status: http.StatusUnprocessableEntity,
+		Field:  "Params",
+		Reason: fmt.Sprintf("%v: LogN %d with %d moduli do not match any parameter set of /api/capabilities", ErrUnsupportedParameters, params.LogN(), params.QCount()),
+		err:    ErrUnsupportedParameters,
+	}
+}
+
+// capabilitiesHandler returns the Capabilities of the server, for clients to pick their parameters.
+func capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	model := gallery.Model()
+	writeJSON(w, http.StatusOK, Capabilities{
+		Dimension:      len(model.Data[0]),
+		BlockSize:      blockSize,
+		MaxNorm:        maxNorm,
+		ParameterSets:  ParameterSets,
+		Kernels:        SupportedKernels,
+		MaxTopK:        maxTopK,
+		GalleryVersion: model.version,
+		WireVersion:    fmt.Sprintf("%d.%d", WireVersionMajor, WireVersionMinor),
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestMatchParameterSet(t *testing.T) {
+	literal := func(set int, edit func(*ckks.ParametersLiteral)) ckks.ParametersLiteral {
+		l := ParameterSets[set].Params
+		l.LogQ = slices.Clone(l.LogQ)
+		edit(&l)
+		return l
+	}
+
+	tests := []struct {
+		name    string
+		literal ckks.ParametersLiteral
+		set     string // Name of the matched set, empty when refused
+		reason  string
+	}{
+		{"default", literal(0, func(*ckks.ParametersLiteral) {}), "default", ""},
+		{"bootstrappable", literal(1, func(*ckks.ParametersLiteral) {}), "bootstrappable", ""},
+		{"other modulus chain", literal(0, func(l *ckks.ParametersLiteral) { l.LogQ[7] = 40 }), "", "LogN 14 with 8 moduli"},
+		{"fewer moduli", literal(0, func(l *ckks.ParametersLiteral) { l.LogQ = l.LogQ[:7] }), "", "LogN 14 with 7 moduli"},
+		{"other ring degree", literal(0, func(l *ckks.ParametersLiteral) { l.LogN = 15 }), "", "LogN 15"},
+		{"other scale", literal(0, func(l *ckks.ParametersLiteral) { l.LogDefaultScale = 40 }), "", "do not match"},
+		{"bootstrappable with a dense secret", literal(1, func(l *ckks.ParametersLiteral) { l.Xs = nil }), "", "LogN 16 with 10 moduli"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params, err := ckks.NewParametersFromLiteral(test.literal)
+			if err != nil {
+				t.Fatal(err)
+			}
+			set, err := matchParameterSet(params)
+			if test.set == "" {
+				checkValidationError(t, err, http.StatusUnprocessableEntity, test.reason)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if set.Name != test.set {
+				t.Errorf("matched %q, expected %q", set.Name, test.set)
+			}
+		})
+	}
+}
+
+func TestParameterSetModes(t *testing.T) {
+	for _, set := range ParameterSets {
+		t.Run(set.Name, func(t *testing.T) {
+			// Only the sets with room for bootstrapping offer ModeTopK, and they must bootstrap
+			if slices.Contains(set.Modes, ModeTopK) != set.Bootstrapping {
+				t.Errorf("modes %q with bootstrapping %t", set.Modes, set.Bootstrapping)
+			}
+			btpParams, err := expectedBootstrapping(&set)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (btpParams != nil) != set.Bootstrapping {
+				t.Errorf("bootstrapping parameters %v, expected some only if the set bootstraps", btpParams)
+			}
+		})
+	}
+}
+
+func TestCapabilitiesHandler(t *testing.T) {
+	saved := gallery
+	t.Cleanup(func() { gallery = saved })
+	var err error
+	if gallery, err = NewGallery(filepath.Join(t.TempDir(), "knn.csv"), *testGallery(1, 3, "alice", "bob")); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	capabilitiesHandler(w, httptest.NewRequest("GET", "/api/capabilities", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != JSONContentType {
+		t.Fatalf("got %d with content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	// Clients decode the fields by name, so the shape of the body is part of the API
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	fields := []string{"BlockSize", "Dimension", "GalleryVersion", "Kernels", "MaxNorm", "MaxTopK", "ParameterSets", "WireVersion"}
+	if got := slices.Sorted(maps.Keys(body)); !slices.Equal(got, fields) {
+		t.Errorf("got fields %q, expected %q", got, fields)
+	}
+	var sets []map[string]json.RawMessage
+	if err := json.Unmarshal(body["ParameterSets"], &sets); err != nil {
+		t.Fatal(err)
+	}
+	setFields := [][]string{
+		{"Bootstrapping", "Modes", "Name", "Params"},
+		{"Bootstrapping", "BootstrappingLogP", "Modes", "Name", "Params"},
+	}
+	if len(sets) != len(setFields) {
+		t.Fatalf("got %d parameter sets, expected %d", len(sets), len(setFields))
+	}
+	for i := range sets {
+		if got := slices.Sorted(maps.Keys(sets[i])); !slices.Equal(got, setFields[i]) {
+			t.Errorf("parameter set %d has fields %q, expected %q", i, got, setFields[i])
+		}
+	}
+
+	var capabilities Capabilities
+	if err := json.Unmarshal(w.Body.Bytes(), &capabilities); err != nil {
+		t.Fatal(err)
+	}
+	expected := Capabilities{
+		Dimension:      blockSize,
+		BlockSize:      blockSize,
+		MaxNorm:        maxNorm,
+		MaxTopK:        maxTopK,
+		GalleryVersion: gallery.Model().version,
+		WireVersion:    fmt.Sprintf("%d.%d", WireVersionMajor, WireVersionMinor),
+	}
+	got := capabilities
+	got.ParameterSets, got.Kernels = nil, nil
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got capabilities %+v, expected %+v", got, expected)
+	}
+	if !slices.Equal(capabilities.Kernels, SupportedKernels) {
+		t.Errorf("got kernels %q, expected %q", capabilities.Kernels, SupportedKernels)
+	}
+	for i, set := range capabilities.ParameterSets {
+		params, err := ckks.NewParametersFromLiteral(set.Params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched, err := matchParameterSet(params); err != nil || matched.Name != set.Name {
+			t.Errorf("parameter set %d %q matched %v with error %v", i, set.Name, matched, err)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	capabilitiesHandler(w, httptest.NewRequest("POST", "/api/capabilities", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got %d, expected %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
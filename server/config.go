@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log/slog"
+	"math"
+	"math/bits"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Configuration
+//
+// Every setting of the server is a field of Config and a flag. The settings are read from the
+// defaults below, then the YAML file given with -config, then the environment variables named
+// after the flags, SECURESIGHT_QUERY_RATE for -query-rate, then the flags themselves, each
+// overriding the previous ones. SECURESIGHT_CONFIG names the file when -config is not given.
+// The effective configuration is logged at startup.
+
+// envPrefix prefixes the environment variables holding settings.
+const envPrefix = "SECURESIGHT_"
+
+// Config is the configuration of the server. The YAML keys follow the names of the flags, grouped in
+// sections, as in config.example.yaml.
+type Config struct {
+	Listen       string   `yaml:"listen"`        // Address of the HTTP API
+	StreamListen string   `yaml:"stream-listen"` // Address of the gRPC stream
+	TLS          TLSFiles `yaml:"tls"`
+	Clients      string   `yaml:"clients"` // JSON file of the API clients, the API is open without it
+
+	Gallery GalleryConfig `yaml:"gallery"`
+
+	Kernel        string        `yaml:"kernel"`         // Distance kernel of the queries that name none
+	BlockSize     int           `yaml:"block-size"`     // Slots holding one embedding in a query ciphertext, the length of the gallery embeddings
+	MaxNorm       float64       `yaml:"max-norm"`       // Longest L2 norm of the gallery embeddings and of the queries
+	Workers       int           `yaml:"workers"`        // Distance workers, 0 for one per usable CPU
+	QueueSize     int           `yaml:"queue-size"`     // Distance jobs waiting for a worker, 0 for four per worker
+	StreamQueries int           `yaml:"stream-queries"` // Queries of one stream evaluated at the same time
+	SessionTTL    time.Duration `yaml:"session-ttl"`    // Time a session lives after its last query
+
+	Sessions   SessionLimits    `yaml:"sessions"`
+	Quota      QuotaPolicy      `yaml:"quota"`
+	Validation ValidationPolicy `yaml:"validation"`
+	HTTP       ServerLimits     `yaml:"http"`
+
+	LogFormat string `yaml:"log-format"` // Format of the logs, text or json
+	TraceFile string `yaml:"trace-file"` // Chrome trace file of the requests, no tracing if empty
+}
+
+// GalleryConfig locates the gallery served to queries.
+type GalleryConfig struct {
+	Path          string        `yaml:"path"`           // Gallery file, in a format given by its extension (see FormatCSV)
+	WatchInterval time.Duration `yaml:"watch-interval"` // Time between checks of the file for replacements
+}
+
+// defaultConfig returns the configuration of a server started without a file, environment or flags.
+func defaultConfig() Config {
+	return Config{
+		Listen:       ":8080",
+		StreamListen: ":8081",
+		Gallery: GalleryConfig{
+			Path:          "../weights/knn.csv",
+			WatchInterval: 5 * time.Second,
+		},
+		Kernel:        KernelSquaredDifference,
+		BlockSize:     blockSize,
+		MaxNorm:       maxNorm,
+		StreamQueries: maxStreamQueries,
+		SessionTTL:    30 * time.Minute,
+		Sessions:      defaultSessionLimits,
+		Quota:         defaultQuota,
+		Validation:    policy,
+		HTTP:          serverLimits,
+		LogFormat:     "text",
+	}
+}
+
+// Flags registers a flag for each setting of c on fs, defaulting to its current value.
+func (c *Config) Flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Listen, "listen", c.Listen, "address of the HTTP API")
+	fs.StringVar(&c.StreamListen, "stream-listen", c.StreamListen, "address of the gRPC stream")
+
+	// TLS certificates; without -tls-cert the server speaks plain HTTP and gRPC
+	fs.StringVar(&c.TLS.CertFile, "tls-cert", c.TLS.CertFile, "PEM certificate chain of the server, enables TLS")
+	fs.StringVar(&c.TLS.KeyFile, "tls-key", c.TLS.KeyFile, "PEM private key of the server")
+	fs.StringVar(&c.TLS.ClientCAFile, "tls-client-ca", c.TLS.ClientCAFile, "PEM bundle of the CAs signing client certificates, enables mutual TLS")
+	fs.BoolVar(&c.TLS.RequireClientCert, "tls-require-client-cert", c.TLS.RequireClientCert, "refuse clients without a certificate signed by -tls-client-ca")
+	fs.StringVar(&c.Clients, "clients", c.Clients, "JSON file of the API clients, their credentials and scopes; the API is open without it")
+
+	fs.StringVar(&c.Gallery.Path, "gallery", c.Gallery.Path, "gallery file, .csv, .npz, .npy or .jsonl, which also receives the changes made through the API")
+	fs.DurationVar(&c.Gallery.WatchInterval, "gallery-watch-interval", c.Gallery.WatchInterval, "time between checks of the gallery file for replacements")
+
+	fs.StringVar(&c.Kernel, "kernel", c.Kernel, fmt.Sprintf("distance kernel of the queries that name none, one of %v", SupportedKernels))
+	fs.IntVar(&c.BlockSize, "block-size", c.BlockSize, "slots holding one embedding in a query ciphertext, a power of two equal to the length of the gallery embeddings; clients must use the same")
+	fs.Float64Var(&c.MaxNorm, "max-norm", c.MaxNorm, "longest L2 norm of the gallery embeddings and of the queries, which clients scale down to it; bounds the distances of the top-k and class-score modes")
+	fs.IntVar(&c.Workers, "workers", c.Workers, "distance workers, 0 for one per usable CPU")
+	fs.IntVar(&c.QueueSize, "queue-size", c.QueueSize, "distance jobs waiting for a worker, 0 for four per worker")
+	fs.IntVar(&c.StreamQueries, "stream-queries", c.StreamQueries, "queries of one gRPC stream evaluated at the same time")
+	fs.DurationVar(&c.SessionTTL, "session-ttl", c.SessionTTL, "time a session lives after its last query")
+	fs.IntVar(&c.Sessions.MaxSessions, "max-sessions", c.Sessions.MaxSessions, "sessions of all clients, more are refused with 429")
+	fs.IntVar(&c.Sessions.MaxPerClient, "max-sessions-per-client", c.Sessions.MaxPerClient, "sessions of one client, or one remote address when the API is open; a new one evicts the least recently used")
+	fs.Int64Var(&c.Sessions.MaxKeyBytes, "max-session-bytes", c.Sessions.MaxKeyBytes, "bytes of evaluation keys, in their binary encoding, held by all sessions; more are refused with 429")
+
+	fs.Float64Var(&c.Quota.Rate, "query-rate", c.Quota.Rate, "query ciphertexts per second allowed to each client without a quota of its own, 0 for no limit")
+	fs.IntVar(&c.Quota.Burst, "query-burst", c.Quota.Burst, "query ciphertexts a client may send at once")
+	fs.IntVar(&c.Quota.DailyBudget, "daily-budget", c.Quota.DailyBudget, "query ciphertexts allowed to each client per UTC day, 0 for no budget")
+
+	fs.IntVar(&c.Validation.MaxQueries, "max-queries", c.Validation.MaxQueries, "ciphertexts in one query request")
+	fs.IntVar(&c.Validation.MaxGaloisKeys, "max-galois-keys", c.Validation.MaxGaloisKeys, "Galois keys in one evaluation key set")
+	fs.Float64Var(&c.Validation.MaxScaleDrift, "max-scale-drift", c.Validation.MaxScaleDrift, "largest gap, in bits, between the scale of a query ciphertext and the default scale")
+
+	fs.DurationVar(&c.HTTP.ReadHeaderTimeout, "read-header-timeout", c.HTTP.ReadHeaderTimeout, "time to read the request line and headers")
+	fs.DurationVar(&c.HTTP.IdleTimeout, "idle-timeout", c.HTTP.IdleTimeout, "time a keep-alive connection may wait for its next request")
+	fs.IntVar(&c.HTTP.MaxHeaderBytes, "max-header-bytes", c.HTTP.MaxHeaderBytes, "size of the request headers")
+	fs.DurationVar(&c.HTTP.ShutdownTimeout, "shutdown-timeout", c.HTTP.ShutdownTimeout, "time given to in-flight requests to finish on SIGTERM")
+	fs.IntVar(&c.HTTP.QueryConcurrency, "query-concurrency", c.HTTP.QueryConcurrency, "query requests served at once, more are refused with 503")
+	fs.IntVar(&c.HTTP.SessionConcurrency, "session-concurrency", c.HTTP.SessionConcurrency, "session registrations served at once, more are refused with 503")
+
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "format of the logs written to stderr, text or json")
+	fs.StringVar(&c.TraceFile, "trace-file", c.TraceFile, "file receiving the spans of each request in the Chrome trace event format, no tracing if empty")
+}
+
+// LoadConfig parses the command line args of the server into a Config, over the file given with -config
+// and the SECURESIGHT_* variables, and validates it. The client layers its own settings the same way
+// with a copy of this code, since it is a module of its own: see client/config.go, and keep both in step.
+func LoadConfig(fs *flag.FlagSet, args []string) (Config, error) {
+	config := defaultConfig()
+	config.Flags(fs)
+	path := fs.String("config", "", "YAML configuration file, overridden by the SECURESIGHT_* environment variables and the flags")
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	// The flags were written over the defaults, the file and the environment go in between
+	flagged := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		flagged[f.Name] = f.Value.String()
+	})
+	if *path == "" {
+		*path = os.Getenv(envPrefix + "CONFIG")
+	}
+	if *path != "" {
+		if err := config.readFile(*path); err != nil {
+			return Config{}, err
+		}
+	}
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(name); ok {
+			if err := f.Value.Set(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", name, err))
+			}
+		}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return Config{}, err
+	}
+	for name, value := range flagged {
+		if err := fs.Set(name, value); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// readFile reads the settings of the YAML file at path over c. Unknown keys are refused,
+// they are usually misspelt settings or settings of the client.
+func (c *Config) readFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// Validate checks that the server can start with c.
+func (c *Config) Validate() error {
+	switch {
+	case c.Listen == "":
+		return fmt.Errorf("no listen address")
+	case c.StreamListen == "":
+		return fmt.Errorf("no stream listen address")
+	case c.Gallery.Path == "":
+		return fmt.Errorf("no gallery file")
+	case c.Gallery.WatchInterval <= 0:
+		return fmt.Errorf("gallery watch interval %v is not positive", c.Gallery.WatchInterval)
+	case !slices.Contains(SupportedKernels, c.Kernel):
+		return fmt.Errorf("unknown distance kernel %q, supported kernels are %v", c.Kernel, SupportedKernels)
+	case c.BlockSize < 2 || bits.OnesCount(uint(c.BlockSize)) != 1:
+		return fmt.Errorf("block size %d is not a power of two", c.BlockSize)
+	case !(c.MaxNorm > 0) || math.IsInf(c.MaxNorm, 0):
+		return fmt.Errorf("max norm %g is not a positive number", c.MaxNorm)
+	case c.Workers < 0:
+		return fmt.Errorf("%d workers", c.Workers)
+	case c.QueueSize < 0:
+		return fmt.Errorf("queue size %d is negative", c.QueueSize)
+	case c.StreamQueries < 1:
+		return fmt.Errorf("stream queries %d is less than one", c.StreamQueries)
+	case c.SessionTTL <= 0:
+		return fmt.Errorf("session TTL %v is not positive", c.SessionTTL)
+	case c.Sessions.MaxSessions < 1 || c.Sessions.MaxPerClient < 1:
+		return fmt.Errorf("session limits %d and %d per client must be at least one", c.Sessions.MaxSessions, c.Sessions.MaxPerClient)
+	case c.Sessions.MaxKeyBytes < 1:
+		return fmt.Errorf("max session bytes %d is less than one", c.Sessions.MaxKeyBytes)
+	case c.Validation.MaxQueries < 1:
+		return fmt.Errorf("max queries %d is less than one", c.Validation.MaxQueries)
+	case c.Validation.MaxGaloisKeys < 1:
+		return fmt.Errorf("max Galois keys %d is less than one", c.Validation.MaxGaloisKeys)
+	case !(c.Validation.MaxScaleDrift >= 0):
+		return fmt.Errorf("max scale drift %g is not a positive number", c.Validation.MaxScaleDrift)
+	case c.HTTP.ReadHeaderTimeout <= 0 || c.HTTP.IdleTimeout <= 0 || c.HTTP.ShutdownTimeout <= 0:
+		return fmt.Errorf("HTTP timeouts must be positive")
+	case c.HTTP.MaxHeaderBytes < 1:
+		return fmt.Errorf("max header bytes %d is less than one", c.HTTP.MaxHeaderBytes)
+	case c.HTTP.QueryConcurrency < 1 || c.HTTP.SessionConcurrency < 1:
+		return fmt.Errorf("query concurrency %d and session concurrency %d must be at least one", c.HTTP.QueryConcurrency, c.HTTP.SessionConcurrency)
+	}
+	if err := c.Quota.Validate(); err != nil {
+		return err
+	}
+
+	// A block must fit in the slots of every parameter set
+	accepted, err := acceptedParams()
+	if err != nil {
+		return err
+	}
+	for i, params := range accepted {
+		if c.BlockSize > params.MaxSlots() {
+			return fmt.Errorf("block size %d is larger than the %d slots of parameter set %q", c.BlockSize, params.MaxSlots(), ParameterSets[i].Name)
+		}
+	}
+	return nil
+}
+
+// Apply sets the globals the rest of the server reads its settings from.
+// It is called once, before serving.
+func (c *Config) Apply() {
+	blockSize = c.BlockSize
+	maxNorm = c.MaxNorm
+	defaultKernel = c.Kernel
+	maxStreamQueries = c.StreamQueries
+	policy = c.Validation
+	serverLimits = c.HTTP
+	quotas.SetDefaults(c.Quota)
+	sessions = NewSessionStore(c.SessionTTL, c.Sessions)
+}
+
+// SchedulerSize returns the workers and the queue size of the scheduler.
+func (c *Config) SchedulerSize() (workers, queueSize int) {
+	workers, queueSize = c.Workers, c.QueueSize
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if queueSize == 0 {
+		queueSize = 4 * workers
+	}
+	return workers, queueSize
+}
+
+// logConfig logs the effective value of every flag of fs, that is every setting.
+func logConfig(fs *flag.FlagSet) {
+	var attrs []any
+	fs.VisitAll(func(f *flag.Flag) {
+		attrs = append(attrs, slog.String(f.Name, f.Value.String()))
+	})
+	slog.Info("Configuration", attrs...)
+}
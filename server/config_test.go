@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := func(content string) string {
+		f, err := os.CreateTemp(dir, "*.yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(content); err != nil {
+			t.Fatal(err)
+		}
+		return f.Name()
+	}
+	layered := file("listen: :9000\nworkers: 2\nquota:\n  rate: 4\n  burst: 8\ngallery:\n  path: file.csv\n")
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		check func(Config) bool
+		err   string
+	}{
+		{"defaults", nil, nil, func(c Config) bool {
+			return c.Listen == ":8080" && c.Kernel == KernelSquaredDifference && c.Sessions == defaultSessionLimits
+		}, ""},
+		{"file over defaults", nil, []string{"-config", layered}, func(c Config) bool {
+			return c.Listen == ":9000" && c.Workers == 2 && c.Quota.Rate == 4 && c.Quota.Burst == 8 && c.Gallery.Path == "file.csv" &&
+				c.StreamListen == ":8081" && c.Gallery.WatchInterval == 5*time.Second
+		}, ""},
+		{"environment over file", map[string]string{"SECURESIGHT_WORKERS": "3", "SECURESIGHT_GALLERY": "env.csv"}, []string{"-config", layered}, func(c Config) bool {
+			return c.Workers == 3 && c.Gallery.Path == "env.csv" && c.Listen == ":9000"
+		}, ""},
+		{"flags over environment", map[string]string{"SECURESIGHT_WORKERS": "3"}, []string{"-config", layered, "-workers", "5", "-query-rate", "1"}, func(c Config) bool {
+			return c.Workers == 5 && c.Quota.Rate == 1 && c.Quota.Burst == 8
+		}, ""},
+		{"flag set to its default", map[string]string{"SECURESIGHT_LISTEN": ":7000"}, []string{"-config", layered, "-listen", ":8080"}, func(c Config) bool {
+			return c.Listen == ":8080"
+		}, ""},
+		{"file from the environment", map[string]string{"SECURESIGHT_CONFIG": layered}, nil, func(c Config) bool {
+			return c.Listen == ":9000"
+		}, ""},
+		{"empty file", nil, []string{"-config", file("")}, func(c Config) bool {
+			return c.Listen == ":8080"
+		}, ""},
+		{"unknown key", nil, []string{"-config", file("listen: :9000\nworker: 2\n")}, nil, "field worker not found"},
+		{"key of the client", nil, []string{"-config", file("source: 0\n")}, nil, "field source not found"},
+		{"missing file", nil, []string{"-config", filepath.Join(dir, "missing.yaml")}, nil, "no such file"},
+		{"malformed environment", map[string]string{"SECURESIGHT_SESSION_TTL": "soon"}, nil, nil, "SECURESIGHT_SESSION_TTL"},
+		{"unknown flag", nil, []string{"-worker", "2"}, nil, "flag provided but not defined"},
+		{"invalid value", nil, []string{"-kernel", "cosine"}, nil, `unknown distance kernel "cosine"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			fs := flag.NewFlagSet("server", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			config, err := LoadConfig(fs, test.args)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.check(config) {
+				t.Errorf("got %+v", config)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(*Config)
+		err  string
+	}{
+		{"defaults", func(*Config) {}, ""},
+		{"no gallery", func(c *Config) { c.Gallery.Path = "" }, "no gallery file"},
+		{"block size not a power of two", func(c *Config) { c.BlockSize = 500 }, "not a power of two"},
+		{"block size beyond the slots", func(c *Config) { c.BlockSize = 1 << 16 }, "larger than the 8192 slots"},
+		{"zero max norm", func(c *Config) { c.MaxNorm = 0 }, "max norm 0 is not a positive number"},
+		{"negative workers", func(c *Config) { c.Workers = -1 }, "-1 workers"},
+		{"no session", func(c *Config) { c.Sessions.MaxPerClient = 0 }, "at least one"},
+		{"no session bytes", func(c *Config) { c.Sessions.MaxKeyBytes = 0 }, "max session bytes"},
+		{"scale drift not a number", func(c *Config) { c.Validation.MaxScaleDrift = -1 }, "scale drift"},
+		{"no idle timeout", func(c *Config) { c.HTTP.IdleTimeout = 0 }, "timeouts must be positive"},
+		{"no session concurrency", func(c *Config) { c.HTTP.SessionConcurrency = 0 }, "session concurrency 0"},
+		{"rate without burst", func(c *Config) { c.Quota = QuotaPolicy{Rate: 1} }, "burst"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := defaultConfig()
+			test.edit(&config)
+			err := config.Validate()
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestSchedulerSize(t *testing.T) {
+	config := defaultConfig()
+	config.Workers, config.QueueSize = 3, 0
+	if workers, queue := config.SchedulerSize(); workers != 3 || queue != 12 {
+		t.Errorf("got %d workers and a queue of %d, expected 3 and 12", workers, queue)
+	}
+	config.Workers, config.QueueSize = 0, 5
+	if workers, queue := config.SchedulerSize(); workers < 1 || queue != 5 {
+		t.Errorf("got %d workers and a queue of %d, expected at least one and 5", workers, queue)
+	}
+}
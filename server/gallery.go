@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrUnknownIdentity is returned when removing a label that has no sample in the gallery.
+var ErrUnknownIdentity = errors.New("unknown identity")
+
+// ErrInvalidEnrollment is wrapped by the errors describing why embeddings cannot be enrolled.
+var ErrInvalidEnrollment = errors.New("invalid enrollment")
+
+// ErrLastIdentity is returned when removing the only identity left, which would leave nothing to query.
+var ErrLastIdentity = errors.New("cannot remove the last identity of the gallery")
+
+// Identity summarizes the samples of one label, as listed by GET /api/gallery.
+type Identity struct {
+	Label   string `json:"Label"`
+	Samples int    `json:"Samples"`
+}
+
+// GalleryResponse is the body returned by GET /api/gallery.
+type GalleryResponse struct {
+	Dimension  int        `json:"Dimension"`  // Length of every embedding in the gallery
+	Identities []Identity `json:"Identities"` // Labels in order of first appearance
+}
+
+// EnrollRequest is the body of POST /api/gallery.
+type EnrollRequest struct {
+	Label      string      `json:"Label"`      // Identity the embeddings belong to, new or existing
+	Embeddings [][]float64 `json:"Embeddings"` // Plaintext embeddings, each as long as the ones in the gallery
+}
+
+// packCache holds the targets of a KNN model packed for a given number of targets per ciphertext.
+type packCache struct {
+	mu    sync.Mutex
+	packs map[int][]PackedTarget
+}
+
+// Packs returns the targets of the model packed maxRepeat per ciphertext, computing them on first use.
+func (m *KNN) Packs(maxRepeat int) []PackedTarget {
+	if m.packs == nil {
+		return packTargets(batchTargets(m.Data, maxRepeat), m.Classes)
+	}
+
+	m.packs.mu.Lock()
+	defer m.packs.mu.Unlock()
+	packs, ok := m.packs.packs[maxRepeat]
+	if !ok {
+		packs = packTargets(batchTargets(m.Data, maxRepeat), m.Classes)
+		m.packs.packs[maxRepeat] = packs
+	}
+	return packs
+}
+
+// Gallery holds the KNN model served to queries and the file it is persisted to.
+// Queries work on the snapshot returned by Model, so enrolling or removing identities
+// swaps in a new model without disturbing the requests in flight.
+type Gallery struct {
+	path  string
+	mu    sync.Mutex // Serializes changes to the gallery
+	model atomic.Pointer[KNN]
+	stamp fileStamp // Version of the file last loaded or saved, to tell external changes apart
+
+	versions atomic.Uint64 // Counts the models published, numbering their version
+}
+
+// Name returns the name of the gallery, under which clients are allowed to search it:
+// the base name of its file without extension.
+func (g *Gallery) Name() string {
+	return strings.TrimSuffix(filepath.Base(g.path), filepath.Ext(g.path))
+}
+
+// NewGallery serves model, loaded from path, and persists its changes to path.
+func NewGallery(path string, model KNN) (*Gallery, error) {
+	g := &Gallery{path: path}
+	g.stamp, _ = statFile(path)
+	if err := g.store(model); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Model returns the current snapshot of the gallery. It must not be modified.
+func (g *Gallery) Model() *KNN {
+	return g.model.Load()
+}
+
+// Identities lists the labels of the gallery with their number of samples.
+func (g *Gallery) Identities() GalleryResponse {
+	model := g.Model()
+
+	response := GalleryResponse{Identities: []Identity{}}
+	if len(model.Data) > 0 {
+		response.Dimension = len(model.Data[0])
+	}
+	index := make(map[string]int)
+	for _, class := range model.Classes {
+		i, ok := index[class]
+		if !ok {
+			i = len(response.Identities)
+			index[class] = i
+			response.Identities = append(response.Identities, Identity{Label: class})
+		}
+		response.Identities[i].Samples++
+	}
+	return response
+}
+
+// Enroll adds embeddings under label, persists the gallery and swaps in the new model.
+// It returns the updated identity.
+func (g *Gallery) Enroll(label string, embeddings [][]float64) (Identity, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	current := g.Model()
+
+	dimension := blockSize
+	if len(current.Data) > 0 {
+		dimension = len(current.Data[0])
+	}
+	if err := validateEnrollment(label, embeddings, dimension); err != nil {
+		return Identity{}, err
+	}
+
+	// Copy the slices so that the current snapshot stays untouched
+	next := KNN{
+		Data:    append(append([][]float64{}, current.Data...), embeddings...),
+		Classes: append([]string{}, current.Classes...),
+	}
+	identity := Identity{Label: label, Samples: len(embeddings)}
+	for _, class := range current.Classes {
+		if class == label {
+			identity.Samples++
+		}
+	}
+	for range embeddings {
+		next.Classes = append(next.Classes, label)
+	}
+
+	if err := g.swap(next); err != nil {
+		return Identity{}, err
+	}
+	return identity, nil
+}
+
+// Remove deletes every sample of label, persists the gallery and swaps in the new model.
+// It returns the number of samples removed.
+func (g *Gallery) Remove(label string) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	current := g.Model()
+
+	var next KNN
+	for i, class := range current.Classes {
+		if class != label {
+			next.Data = append(next.Data, current.Data[i])
+			next.Classes = append(next.Classes, class)
+		}
+	}
+
+	removed := len(current.Classes) - len(next.Classes)
+	if removed == 0 {
+		return 0, fmt.Errorf("%w %q", ErrUnknownIdentity, label)
+	}
+	if len(next.Classes) == 0 {
+		return 0, ErrLastIdentity
+	}
+
+	if err := g.swap(next); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// swap persists next and makes it the model served to new queries. The caller must hold the lock.
+func (g *Gallery) swap(next KNN) error {
+	if err := SaveKNN(g.path, &next); err != nil {
+		return fmt.Errorf("failed to persist gallery: %v", err)
+	}
+	g.stamp, _ = statFile(g.path)
+	return g.store(next)
+}
+
+// store publishes model with the next version number and its hash. The model is packed for every
+// parameter set first, so that no query waits for it.
+func (g *Gallery) store(model KNN) error {
+	model.packs = &packCache{packs: make(map[int][]PackedTarget)}
+	if err := model.warmPacks(); err != nil {
+		return fmt.Errorf("failed to pack gallery: %v", err)
+	}
+	model.version = g.versions.Add(1)
+	model.hash = galleryHash(&model)
+	g.model.Store(&model)
+	return nil
+}
+
+// validateEnrollment checks that the embeddings can join a gallery of the given dimension.
+func validateEnrollment(label string, embeddings [][]float64, dimension int) error {
+	if label == "" {
+		return fmt.Errorf("%w: empty label", ErrInvalidEnrollment)
+	}
+	if len(embeddings) == 0 {
+		return fmt.Errorf("%w: no embeddings", ErrInvalidEnrollment)
+	}
+	for i, embedding := range embeddings {
+		if len(embedding) != dimension {
+			return fmt.Errorf("%w: embedding %d has %d values, the gallery expects %d", ErrInvalidEnrollment, i, len(embedding), dimension)
+		}
+		for j, v := range embedding {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return fmt.Errorf("%w: embedding %d has a non-finite value at index %d", ErrInvalidEnrollment, i, j)
+			}
+		}
+		if norm := l2Norm(embedding); norm > maxNorm*(1+maxNormTolerance) {
+			return fmt.Errorf("%w: embedding %d has norm %g, longer than the max norm %g", ErrInvalidEnrollment, i, norm, maxNorm)
+		}
+	}
+	return nil
+}
+
+// SaveKNN writes the model to path in the format given by its extension, as read by LoadKNN.
+// The file is written next to path and renamed over it, so readers never see a partial gallery.
+func SaveKNN(path string, model *KNN) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		return writeGallery(w, galleryFormat(path), model, npyLabelsPath(path))
+	})
+}
+
+// galleryHandler lists (GET), enrolls (POST) and removes (DELETE ?label=) identities of the gallery.
+// It speaks JSON, since it carries plaintext embeddings from the operators rather than ciphertexts.
+func galleryHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, gallery.Identities())
+
+	case "POST":
+		// The body is read to the end first, which checks its HMAC signature if it has one
+		body, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+		var req EnrollRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, fmt.Sprintf("failed to decode enrollment: %v", err), http.StatusBadRequest)
+			return
+		}
+		identity, err := gallery.Enroll(req.Label, req.Embeddings)
+		if errors.Is(err, ErrInvalidEnrollment) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		requestLogger(r.Context()).Info("Enrolled identity", "label", identity.Label, "samples", len(req.Embeddings), "total", identity.Samples)
+		writeJSON(w, http.StatusOK, identity)
+
+	case "DELETE":
+		label := r.URL.Query().Get("label")
+		removed, err := gallery.Remove(label)
+		switch {
+		case errors.Is(err, ErrUnknownIdentity):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, ErrLastIdentity):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		requestLogger(r.Context()).Info("Removed identity", "label", label, "samples", removed)
+		writeJSON(w, http.StatusOK, Identity{Label: label, Samples: removed})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeJSON writes v as the JSON body of the response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
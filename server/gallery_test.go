@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSaveKNN(t *testing.T) {
+	model := testGallery(1, 5, "alice", "bob")
+	for _, name := range []string{"knn.csv", "knn.jsonl", "knn.npz", "knn.npy"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			if err := SaveKNN(path, model); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := LoadKNN(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(loaded.Classes, model.Classes) || !slices.EqualFunc(loaded.Data, model.Data, slices.Equal[[]float64]) {
+				t.Errorf("loaded %d samples labelled %q, expected the %d saved ones labelled %q", len(loaded.Data), loaded.Classes, len(model.Data), model.Classes)
+			}
+		})
+	}
+}
+
+func TestValidateEnrollment(t *testing.T) {
+	embeddings := func(edit func([][]float64)) [][]float64 {
+		e := testGallery(2, 2, "alice").Data
+		edit(e)
+		return e
+	}
+
+	tests := []struct {
+		name       string
+		label      string
+		embeddings [][]float64
+		err        string
+	}{
+		{"valid", "alice", embeddings(func([][]float64) {}), ""},
+		{"empty label", "", embeddings(func([][]float64) {}), "empty label"},
+		{"no embeddings", "alice", nil, "no embeddings"},
+		{"wrong dimension", "alice", embeddings(func(e [][]float64) { e[1] = e[1][:10] }), "embedding 1 has 10 values"},
+		{"not a number", "alice", embeddings(func(e [][]float64) { e[0][3] = math.NaN() }), "non-finite value at index 3"},
+		{"longer than the max norm", "alice", embeddings(func(e [][]float64) { e[1][0] = 2 }), "embedding 1 has norm"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateEnrollment(test.label, test.embeddings, blockSize)
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidEnrollment) || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestGalleryEnrollRemove(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "knn.jsonl")
+	g, err := NewGallery(path, *testGallery(1, 3, "alice", "bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := g.Model()
+
+	// Every change publishes a new version with a new hash, packed and persisted
+	changed := func(step string) {
+		t.Helper()
+		model := g.Model()
+		if model.version <= previous.version || model.hash == previous.hash {
+			t.Errorf("%s: version %d and hash %s, previously %d and %s", step, model.version, model.hash, previous.version, previous.hash)
+		}
+		if len(model.packs.packs) != len(ParameterSets) {
+			t.Errorf("%s: published with %d packings, expected one per parameter set", step, len(model.packs.packs))
+		}
+		saved, err := LoadKNN(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(saved.Classes, model.Classes) {
+			t.Errorf("%s: saved %q, serving %q", step, saved.Classes, model.Classes)
+		}
+		previous = model
+	}
+
+	identity, err := g.Enroll("alice", testGallery(2, 2, "alice").Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity != (Identity{Label: "alice", Samples: 4}) {
+		t.Errorf("enrolled %+v, expected alice with 4 samples", identity)
+	}
+	changed("enroll")
+
+	if _, err := g.Enroll("carol", testGallery(3, 1, "carol").Data); err != nil {
+		t.Fatal(err)
+	}
+	changed("enroll a new identity")
+
+	removed, err := g.Remove("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 4 {
+		t.Errorf("removed %d samples, expected 4", removed)
+	}
+	changed("remove")
+
+	// Refused changes leave the gallery as it is
+	if _, err := g.Enroll("bob", [][]float64{{1, 2}}); !errors.Is(err, ErrInvalidEnrollment) {
+		t.Errorf("got error %v, expected %v", err, ErrInvalidEnrollment)
+	}
+	if _, err := g.Remove("alice"); !errors.Is(err, ErrUnknownIdentity) {
+		t.Errorf("got error %v, expected %v", err, ErrUnknownIdentity)
+	}
+	if _, err := g.Remove("bob"); err != nil {
+		t.Fatal(err)
+	}
+	changed("remove")
+	if _, err := g.Remove("carol"); !errors.Is(err, ErrLastIdentity) {
+		t.Errorf("got error %v, expected %v", err, ErrLastIdentity)
+	}
+	if model := g.Model(); model != previous {
+		t.Errorf("serving version %d after refused changes, expected %d", model.version, previous.version)
+	}
+}
+
+func TestGalleryHandler(t *testing.T) {
+	saved := gallery
+	t.Cleanup(func() { gallery = saved })
+	var err error
+	if gallery, err = NewGallery(filepath.Join(t.TempDir(), "knn.csv"), *testGallery(1, 3, "alice", "bob")); err != nil {
+		t.Fatal(err)
+	}
+
+	enroll := func(label string, embeddings [][]float64) string {
+		body, err := json.Marshal(EnrollRequest{Label: label, Embeddings: embeddings})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+		result string // Substring of the response body
+	}{
+		{"list", "GET", "/api/gallery", "", http.StatusOK, `{"Label":"alice","Samples":2}`},
+		{"enroll", "POST", "/api/gallery", enroll("carol", testGallery(2, 2, "carol").Data), http.StatusOK, `{"Label":"carol","Samples":2}`},
+		{"list enrolled", "GET", "/api/gallery", "", http.StatusOK, `{"Label":"carol","Samples":2}`},
+		{"enroll malformed", "POST", "/api/gallery", `{"Label": 3}`, http.StatusBadRequest, "failed to decode enrollment"},
+		{"enroll wrong dimension", "POST", "/api/gallery", enroll("dave", [][]float64{{1, 0}}), http.StatusBadRequest, "the gallery expects 512"},
+		{"enroll too long", "POST", "/api/gallery", enroll("dave", [][]float64{append([]float64{3}, make([]float64, blockSize-1)...)}), http.StatusBadRequest, "longer than the max norm"},
+		{"delete", "DELETE", "/api/gallery?label=alice", "", http.StatusOK, `{"Label":"alice","Samples":2}`},
+		{"delete unknown", "DELETE", "/api/gallery?label=alice", "", http.StatusNotFound, "unknown identity"},
+		{"delete", "DELETE", "/api/gallery?label=bob", "", http.StatusOK, `{"Label":"bob","Samples":1}`},
+		{"delete the last identity", "DELETE", "/api/gallery?label=carol", "", http.StatusConflict, "last identity"},
+		{"other method", "PUT", "/api/gallery", "", http.StatusMethodNotAllowed, "Method not allowed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			galleryHandler(w, httptest.NewRequest(test.method, test.target, strings.NewReader(test.body)))
+			if w.Code != test.status || !strings.Contains(w.Body.String(), test.result) {
+				t.Errorf("got %d %q, expected %d with %q", w.Code, w.Body.String(), test.status, test.result)
+			}
+		})
+	}
+	if identities := gallery.Identities().Identities; !slices.Equal(identities, []Identity{{Label: "carol", Samples: 2}}) {
+		t.Errorf("gallery holds %+v, expected carol alone", identities)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// Health, readiness and build information
+//
+// The server listens as soon as it starts, and loads the gallery meanwhile. /healthz answers
+// while the process runs; /readyz only once the gallery is loaded and packed for every parameter
+// set, and no longer once the server drains on shutdown. Until then the API answers 503, and the
+// stream codes.Unavailable, so that clients and load balancers wait instead of failing.
+
+// ReadinessResponse is the body returned by GET /readyz.
+type ReadinessResponse struct {
+	Ready  bool   `json:"Ready"`
+	Reason string `json:"Reason,omitempty"` // Why the server is not ready
+}
+
+// VersionResponse is the body returned by GET /version.
+type VersionResponse struct {
+	Version       string   `json:"Version"`            // Version of the module, "(devel)" for a local build
+	Revision      string   `json:"Revision,omitempty"` // VCS revision the binary was built from
+	BuildTime     string   `json:"BuildTime,omitempty"`
+	Modified      bool     `json:"Modified"` // The working tree had local changes
+	GoVersion     string   `json:"GoVersion"`
+	WireVersion   string   `json:"WireVersion"`
+	ParameterSets []string `json:"ParameterSets"` // Names of the accepted parameter sets, see /api/capabilities
+
+	// Gallery served, empty until the server is ready
+	GalleryHash    string `json:"GalleryHash,omitempty"` // SHA-256 of the labels and embeddings of the gallery
+	GalleryVersion uint64 `json:"GalleryVersion,omitempty"`
+	Dimension      int    `json:"Dimension,omitempty"` // Length of the embeddings in the gallery
+}
+
+// galleryReady is set once the gallery is loaded and packed, after which gallery may be read.
+var galleryReady atomic.Bool
+
+// draining is set when the server starts shutting down.
+var draining atomic.Bool
+
+// readiness returns whether the server is ready, and why not.
+func readiness() (bool, string) {
+	switch {
+	case !galleryReady.Load():
+		return false, "loading the gallery"
+	case draining.Load():
+		return false, "shutting down"
+	}
+	return true, ""
+}
+
+// warmPacks packs the targets of the model for the slots of every accepted parameter set,
+// which the first query of each set would otherwise wait for.
+func (m *KNN) warmPacks() error {
+	accepted, err := acceptedParams()
+	if err != nil {
+		return err
+	}
+	for _, params := range accepted {
+		m.Packs(params.MaxSlots() / blockSize)
+	}
+	return nil
+}
+
+// galleryHash returns the hex of the SHA-256 of the labels and embeddings of a model, in order.
+func galleryHash(model *KNN) string {
+	h := sha256.New()
+	var buffer [8]byte
+	for i, row := range model.Data {
+		binary.LittleEndian.PutUint64(buffer[:], uint64(len(model.Classes[i])))
+		h.Write(buffer[:])
+		h.Write([]byte(model.Classes[i]))
+		for _, v := range row {
+			binary.LittleEndian.PutUint64(buffer[:], math.Float64bits(v))
+			h.Write(buffer[:])
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// requireReady answers the requests of handler with 503 until the gallery is ready.
+// Requests that arrive while draining are still answered.
+func requireReady(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !galleryReady.Load() {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "server is not ready: loading the gallery", http.StatusServiceUnavailable)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// healthzHandler answers as long as the process serves HTTP.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// readyzHandler answers 200 once the server can answer queries, and 503 before and while draining.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ok, reason := readiness()
+	if !ok {
+		w.Header().Set("Retry-After", "1")
+		writeJSON(w, http.StatusServiceUnavailable, ReadinessResponse{Reason: reason})
+		return
+	}
+	writeJSON(w, http.StatusOK, ReadinessResponse{Ready: true})
+}
+
+// versionHandler returns the build of the server and the gallery it serves.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := VersionResponse{
+		Version:     "(unknown)",
+		WireVersion: fmt.Sprintf("%d.%d", WireVersionMajor, WireVersionMinor),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		response.Version, response.GoVersion = info.Main.Version, info.GoVersion
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				response.Revision = setting.Value
+			case "vcs.time":
+				response.BuildTime = setting.Value
+			case "vcs.modified":
+				response.Modified = setting.Value == "true"
+			}
+		}
+	}
+	for _, set := range ParameterSets {
+		response.ParameterSets = append(response.ParameterSets, set.Name)
+	}
+	if galleryReady.Load() {
+		model := gallery.Model()
+		response.GalleryHash, response.GalleryVersion, response.Dimension = model.hash, model.version, len(model.Data[0])
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// swapReadiness restores the gallery and the readiness of the server at the end of the test.
+func swapReadiness(t *testing.T) {
+	t.Helper()
+	savedGallery, savedReady, savedDraining := gallery, galleryReady.Load(), draining.Load()
+	t.Cleanup(func() {
+		gallery = savedGallery
+		galleryReady.Store(savedReady)
+		draining.Store(savedDraining)
+	})
+}
+
+func TestReadyz(t *testing.T) {
+	swapReadiness(t)
+	galleryReady.Store(false)
+	draining.Store(false)
+	api := requireReady(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+
+	tests := []struct {
+		name      string
+		ready     bool // Gallery loaded
+		draining  bool
+		status    int
+		reason    string
+		apiStatus int
+	}{
+		{"loading", false, false, http.StatusServiceUnavailable, "loading the gallery", http.StatusServiceUnavailable},
+		{"ready", true, false, http.StatusOK, "", http.StatusOK},
+		{"draining", true, true, http.StatusServiceUnavailable, "shutting down", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			galleryReady.Store(test.ready)
+			draining.Store(test.draining)
+
+			w := httptest.NewRecorder()
+			readyzHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+			var readiness ReadinessResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &readiness); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != test.status || readiness.Ready != (test.status == http.StatusOK) || readiness.Reason != test.reason {
+				t.Errorf("got %d %+v, expected %d with reason %q", w.Code, readiness, test.status, test.reason)
+			}
+			if retry := w.Header().Get("Retry-After"); (retry != "") != (test.status != http.StatusOK) {
+				t.Errorf("got Retry-After %q with status %d", retry, w.Code)
+			}
+
+			// The API waits for the gallery, but keeps answering while draining
+			w = httptest.NewRecorder()
+			api(w, httptest.NewRequest("POST", "/api/knn", nil))
+			if w.Code != test.apiStatus {
+				t.Errorf("API answered %d, expected %d", w.Code, test.apiStatus)
+			}
+
+			// The process is alive all along
+			w = httptest.NewRecorder()
+			healthzHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("/healthz answered %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestVersionGallery(t *testing.T) {
+	swapReadiness(t)
+	galleryReady.Store(false)
+
+	version := func() VersionResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		versionHandler(w, httptest.NewRequest("GET", "/version", nil))
+		var response VersionResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusOK || response.WireVersion == "" || len(response.ParameterSets) != len(ParameterSets) {
+			t.Fatalf("got %d %+v", w.Code, response)
+		}
+		return response
+	}
+
+	// No gallery is reported until it is loaded
+	if response := version(); response.GalleryHash != "" || response.GalleryVersion != 0 || response.Dimension != 0 {
+		t.Errorf("reported gallery %s version %d before it is ready", response.GalleryHash, response.GalleryVersion)
+	}
+
+	path := filepath.Join(t.TempDir(), "knn.csv")
+	var err error
+	if gallery, err = NewGallery(path, *testGallery(1, 3, "alice", "bob")); err != nil {
+		t.Fatal(err)
+	}
+	galleryReady.Store(true)
+	previous := version()
+	if model := gallery.Model(); previous.GalleryHash != galleryHash(model) || previous.GalleryVersion != model.version || previous.Dimension != blockSize {
+		t.Errorf("reported gallery %s version %d, serving %s version %d", previous.GalleryHash, previous.GalleryVersion, galleryHash(model), model.version)
+	}
+
+	// Every change of the gallery shows in a new version and hash
+	changed := func(step string) {
+		t.Helper()
+		response := version()
+		if response.GalleryVersion <= previous.GalleryVersion || response.GalleryHash == previous.GalleryHash {
+			t.Errorf("%s: reported version %d and hash %s, previously %d and %s", step, response.GalleryVersion, response.GalleryHash, previous.GalleryVersion, previous.GalleryHash)
+		}
+		previous = response
+	}
+	if _, err := gallery.Enroll("carol", testGallery(2, 1, "carol").Data); err != nil {
+		t.Fatal(err)
+	}
+	changed("enroll")
+	if _, err := gallery.Remove("carol"); err != nil {
+		t.Fatal(err)
+	}
+	changed("remove")
+	if err := SaveKNN(path, testGallery(3, 4, "dave", "erin")); err != nil {
+		t.Fatal(err)
+	}
+	if err := gallery.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	changed("reload")
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// ServerLimits bounds the connections of the HTTP server and how long it waits for them on shutdown.
+type ServerLimits struct {
+	ReadHeaderTimeout time.Duration `yaml:"read-header-timeout"` // Time to read the request line and headers
+	IdleTimeout       time.Duration `yaml:"idle-timeout"`        // Time a keep-alive connection may wait for its next request
+	MaxHeaderBytes    int           `yaml:"max-header-bytes"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown-timeout"` // Time given to in-flight requests to finish on SIGTERM
+
+	// Requests served at once by /api/knn and /api/sessions, more are refused with 503
+	QueryConcurrency   int `yaml:"query-concurrency"`
+	SessionConcurrency int `yaml:"session-concurrency"`
+}
+
+// serverLimits are the ServerLimits of the HTTP server, set by Config.Apply.
+var serverLimits = ServerLimits{
+	ReadHeaderTimeout: 10 * time.Second,
+	IdleTimeout:       2 * time.Minute,
+	MaxHeaderBytes:    64 << 10,
+	ShutdownTimeout:   5 * time.Minute,
+
+	QueryConcurrency:   64,
+	SessionConcurrency: 8,
+}
+
+// RouteLimits bounds the requests of one route. The deadlines are counted from the end of the headers.
+type RouteLimits struct {
+	MaxBody      int64         // Size of the request body, in bytes
+	ReadTimeout  time.Duration // Time to read the body
+	WriteTimeout time.Duration // Time to compute and write the response
+	MaxInFlight  int           // Requests served at once, more are refused with 503; 0 for no limit
+}
+
+// Limits of the routes that carry no ciphertexts: the gallery API, capabilities and the OpenAPI document.
+var smallRouteLimits = RouteLimits{MaxBody: 16 << 20, ReadTimeout: 30 * time.Second, WriteTimeout: 30 * time.Second}
+
+// sessionRouteLimits bounds the registration of evaluation keys, whose body is sized by
+// sessionBodyLimit once the parameters are built.
+var sessionRouteLimits = RouteLimits{ReadTimeout: 10 * time.Minute, WriteTimeout: time.Minute}
+
+// queryRouteLimits bounds the queries, whose body is sized by queryBodyLimit once the parameters are built.
+// The write deadline covers the homomorphic evaluation, bootstrapping included in ModeTopK.
+var queryRouteLimits = RouteLimits{ReadTimeout: 2 * time.Minute, WriteTimeout: 10 * time.Minute}
+
+// queryBodyLimit returns the size of the largest query accepted by policy: MaxQueries ciphertexts
+// at the maximum level of the largest parameter set, in base64, plus room for the other fields.
+func queryBodyLimit() (int64, error) {
+	accepted, err := acceptedParams()
+	if err != nil {
+		return 0, err
+	}
+	var ciphertext int
+	for _, params := range accepted {
+		ciphertext = max(ciphertext, ciphertextSize(params.N(), params.MaxLevel()))
+	}
+	return int64(policy.MaxQueries)*int64(ciphertext)*4/3 + 64<<10, nil
+}
+
+// sessionBodyLimit returns the size of the largest session the server can use: a relinearization
+// key and the Galois keys of every mode, for the largest parameter set, plus, for the sets that
+// bootstrap, the keys of the bootstrapping circuit and its six ring switching keys, in base64,
+// plus room for the parameters. The bootstrapping keys alone weigh gigabytes.
+func sessionBodyLimit() (int64, error) {
+	accepted, err := acceptedParams()
+	if err != nil {
+		return 0, err
+	}
+	btp, err := acceptedBootstrapping()
+	if err != nil {
+		return 0, err
+	}
+	evaluationKeys := func(params ckks.Parameters, galEls ...[]uint64) int64 {
+		distinct := make(map[uint64]bool)
+		for _, els := range galEls {
+			for _, galEl := range els {
+				distinct[galEl] = true
+			}
+		}
+		galoisKeys := min(len(distinct), policy.MaxGaloisKeys)
+		return int64(1+galoisKeys) * int64(16+8+gadgetCiphertextSize(params, params.N()))
+	}
+	var keys int64
+	for i, params := range accepted {
+		size := evaluationKeys(params, SummationGaloisElements(params),
+			params.GaloisElementsForInnerSum(1, params.MaxSlots()), TopKGaloisElements(params))
+		if btp[i] != nil {
+			btpParams := btp[i].BootstrappingParameters
+			n := max(btpParams.N(), params.N())
+			size += evaluationKeys(btpParams, btp[i].GaloisElements(btpParams), []uint64{btpParams.GaloisElementForComplexConjugation()})
+			size += 6 * int64(gadgetCiphertextSize(btpParams, n))
+		}
+		keys = max(keys, size)
+	}
+	return keys*4/3 + 1<<20, nil
+}
+
+// gadgetCiphertextSize returns the size of the binary encoding of an evaluation key at the
+// maximum levels of params over a ring of degree n, as walked by layoutReader.gadgetCiphertext.
+func gadgetCiphertextSize(params ckks.Parameters, n int) int {
+	levelQ, levelP := params.MaxLevelQ(), params.MaxLevelP()
+	poly := func(level int) int {
+		return 8 + (level+1)*(8+8*n)
+	}
+	cols := params.BaseTwoDecompositionVectorSize(levelQ, levelP, 0)
+	size := 8 + 8
+	for i := 0; i < params.BaseRNSDecompositionVectorSize(levelQ, levelP); i++ {
+		size += 8 + cols[i]*(8+2*(poly(levelQ)+poly(levelP)))
+	}
+	return size
+}
+
+// ciphertextSize returns the size of the binary encoding of a degree 1 ciphertext with metadata,
+// as walked by layoutReader.ciphertext, without allocating one.
+func ciphertextSize(n, level int) int {
+	poly := 8 + (level+1)*(8+8*n)
+	return 1 + rlwe.MetaData{}.BinarySize() + 8 + 2*poly
+}
+
+// limitRoute applies the RouteLimits of a route to the requests of handler.
+func limitRoute(limits RouteLimits, handler http.HandlerFunc) http.HandlerFunc {
+	var slots chan struct{}
+	if limits.MaxInFlight > 0 {
+		slots = make(chan struct{}, limits.MaxInFlight)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			default:
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, fmt.Sprintf("server is busy with %d requests of this route, retry later", limits.MaxInFlight), http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		controller := http.NewResponseController(w)
+		now := time.Now()
+		if err := controller.SetReadDeadline(now.Add(limits.ReadTimeout)); err != nil {
+			requestLogger(r.Context()).Warn("Failed to set the read deadline", "err", err)
+		}
+		if err := controller.SetWriteDeadline(now.Add(limits.WriteTimeout)); err != nil {
+			requestLogger(r.Context()).Warn("Failed to set the write deadline", "err", err)
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limits.MaxBody)
+		handler(w, r)
+	}
+}
+
+// readBody reads the request body, limited by limitRoute. On failure it writes the error
+// response, 413 for a body over the limit or 401 for a body that does not match its HMAC
+// signature, and returns false.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, fmt.Sprintf("request body is larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return nil, false
+	case errors.Is(err, ErrUnauthenticated):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	case err != nil:
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return nil, false
+	}
+	return body, true
+}
+
+// NewHTTPServer returns the HTTP server of the API on addr, with the limits of each route.
+// It serves TLS unless tlsConfig is nil, tags every request with its ID and the identity of its client,
+// and traces it when tracing is on.
+func NewHTTPServer(addr string, tlsConfig *tls.Config) (*http.Server, error) {
+	queryLimits := queryRouteLimits
+	maxQuery, err := queryBodyLimit()
+	if err != nil {
+		return nil, err
+	}
+	queryLimits.MaxBody = maxQuery
+	queryLimits.MaxInFlight = serverLimits.QueryConcurrency
+	sessionLimits := sessionRouteLimits
+	sessionLimits.MaxInFlight = serverLimits.SessionConcurrency
+	if sessionLimits.MaxBody, err = sessionBodyLimit(); err != nil {
+		return nil, err
+	}
+
+	// The routes that need the gallery answer 503 until it is loaded
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/sessions", instrumentRoute("sessions", limitRoute(sessionLimits, requireReady(requireScope(ScopeQuery, sessionsHandler)))))
+	mux.HandleFunc("/api/knn", instrumentRoute("knn", limitRoute(queryLimits, requireReady(requireScope(ScopeQuery, knnHandler)))))
+	mux.HandleFunc("/api/gallery", limitRoute(smallRouteLimits, requireReady(requireScope(ScopeGalleryAdmin, galleryHandler))))
+	mux.HandleFunc("/api/openapi.json", limitRoute(smallRouteLimits, openAPIHandler))
+	mux.HandleFunc("/api/capabilities", limitRoute(smallRouteLimits, requireReady(capabilitiesHandler)))
+	mux.HandleFunc("/metrics", limitRoute(smallRouteLimits, metricsHandler.ServeHTTP))
+	mux.HandleFunc("/healthz", limitRoute(smallRouteLimits, healthzHandler))
+	mux.HandleFunc("/readyz", limitRoute(smallRouteLimits, readyzHandler))
+	mux.HandleFunc("/version", limitRoute(smallRouteLimits, versionHandler))
+
+	return &http.Server{
+		Addr:              addr,
+		Handler:           withRequestID(withTrace(withClientIdentity(mux))),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: serverLimits.ReadHeaderTimeout,
+		IdleTimeout:       serverLimits.IdleTimeout,
+		MaxHeaderBytes:    serverLimits.MaxHeaderBytes,
+	}, nil
+}
+
+// shutdownOnSignal waits for SIGTERM or SIGINT, then runs shutdown with a context that expires
+// after serverLimits.ShutdownTimeout. It returns the error of shutdown.
+func shutdownOnSignal(shutdown func(ctx context.Context) error) error {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-stop
+	signal.Stop(stop)
+
+	slog.Info("Draining in-flight requests", "signal", sig, "timeout", serverLimits.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), serverLimits.ShutdownTimeout)
+	defer cancel()
+	return shutdown(ctx)
+}
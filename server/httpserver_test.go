@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodingSizes(t *testing.T) {
+	accepted, err := acceptedParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, params := range accepted {
+		t.Run(ParameterSets[i].Name, func(t *testing.T) {
+			if size, expected := gadgetCiphertextSize(params, params.N()), rlwe.NewGaloisKey(params).GadgetCiphertext.BinarySize(); size != expected {
+				t.Errorf("gadgetCiphertextSize = %d, expected %d", size, expected)
+			}
+			for _, level := range []int{0, params.MaxLevel()} {
+				if size, expected := ciphertextSize(params.N(), level), ckks.NewCiphertext(params, 1, level).BinarySize(); size != expected {
+					t.Errorf("ciphertextSize at level %d = %d, expected %d", level, size, expected)
+				}
+			}
+		})
+	}
+}
+
+// echoHandler answers the body of the request, read with readBody.
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	if body, ok := readBody(w, r); ok {
+		w.Write(body)
+	}
+}
+
+// blockingHandler answers once release is closed, and signals every request it holds on entered.
+func blockingHandler(entered chan<- struct{}, release <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+		io.WriteString(w, "done")
+	}
+}
+
+// post sends body to url and returns the status and the body of the response.
+func post(t *testing.T, url string, body string) (int, string) {
+	t.Helper()
+	resp, err := http.Post(url, "application/octet-stream", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+func TestLimitRouteBody(t *testing.T) {
+	server := httptest.NewServer(limitRoute(RouteLimits{MaxBody: 16, ReadTimeout: time.Minute, WriteTimeout: time.Minute}, echoHandler))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		result string
+	}{
+		{"within the limit", "0123456789abcdef", http.StatusOK, "0123456789abcdef"},
+		{"over the limit", "0123456789abcdefg", http.StatusRequestEntityTooLarge, "larger than 16 bytes"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status, body := post(t, server.URL, test.body); status != test.status || !strings.Contains(body, test.result) {
+				t.Errorf("got %d %q, expected %d with %q", status, body, test.status, test.result)
+			}
+		})
+	}
+}
+
+func TestLimitRouteConcurrency(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	limits := RouteLimits{MaxBody: 16, ReadTimeout: time.Minute, WriteTimeout: time.Minute, MaxInFlight: 2}
+	server := httptest.NewServer(limitRoute(limits, blockingHandler(entered, release)))
+	defer server.Close()
+
+	// Fill the route with requests held by the handler
+	statuses := make(chan int, limits.MaxInFlight)
+	for i := 0; i < limits.MaxInFlight; i++ {
+		go func() {
+			resp, err := http.Get(server.URL)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+		<-entered
+	}
+
+	// The next one is refused without reaching the handler
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("got %d with Retry-After %q, expected %d with a delay", resp.StatusCode, resp.Header.Get("Retry-After"), http.StatusServiceUnavailable)
+	}
+
+	// The held requests complete and free their slots
+	close(release)
+	for i := 0; i < limits.MaxInFlight; i++ {
+		if status := <-statuses; status != http.StatusOK {
+			t.Errorf("held request answered %d, expected %d", status, http.StatusOK)
+		}
+	}
+	go func() { <-entered }()
+	if status, body := post(t, server.URL, ""); status != http.StatusOK || body != "done" {
+		t.Errorf("got %d %q after the held requests, expected %d", status, body, http.StatusOK)
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(limitRoute(smallRouteLimits, blockingHandler(entered, release)))
+	defer server.Close()
+
+	type reply struct {
+		status int
+		body   string
+		err    error
+	}
+	replies := make(chan reply, 1)
+	go func() {
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			replies <- reply{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		replies <- reply{resp.StatusCode, string(body), err}
+	}()
+	<-entered
+
+	// Shutdown waits for the request in flight
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Config.Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned %v with a request in flight", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if r := <-replies; r.err != nil || r.status != http.StatusOK || r.body != "done" {
+		t.Errorf("in-flight request got %d %q and error %v, expected %d", r.status, r.body, r.err, http.StatusOK)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("shutdown returned %v", err)
+	}
+	if resp, err := http.Get(server.URL); err == nil {
+		resp.Body.Close()
+		t.Errorf("got %d after shutdown, expected the connection to be refused", resp.StatusCode)
+	}
+}
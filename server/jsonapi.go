@@ -0,0 +1,138 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+	"net/http"
+)
+
+// JSON variant of the API
+//
+// Clients that cannot produce gob or frames post JSON to /api/sessions and /api/knn.
+// CKKS parameters are given as a ckks.ParametersLiteral, while ciphertexts, keys and
+// bootstrapping parameters are the base64 of their Lattigo MarshalBinary encodings.
+// The schemas are described by the OpenAPI document served at /api/openapi.json.
+
+// JSONContentType is the media type of the JSON variant.
+const JSONContentType = "application/json"
+
+// JSONSessionRequest is the JSON form of SessionRequest.
+type JSONSessionRequest struct {
+	Params            ckks.ParametersLiteral `json:"Params"`
+	Evk               []byte                 `json:"Evk"`                         // rlwe.MemEvaluationKeySet, with the relinearization key if any
+	Bootstrapping     []byte                 `json:"Bootstrapping,omitempty"`     // bootstrapping.Parameters, for ModeTopK
+	BootstrappingKeys []byte                 `json:"BootstrappingKeys,omitempty"` // bootstrapping.EvaluationKeys, for ModeTopK
+}
+
+// JSONQueryRequest is the JSON form of QueryRequest.
+type JSONQueryRequest struct {
+	SessionID string   `json:"SessionID"`
+	Kernel    string   `json:"Kernel,omitempty"`
+	SumSlots  bool     `json:"SumSlots,omitempty"`
+	Mode      string   `json:"Mode,omitempty"`
+	K         int      `json:"K,omitempty"`
+	Query     [][]byte `json:"Query"` // rlwe.Ciphertext per query vector
+}
+
+// JSONResponse is the JSON form of Response.
+type JSONResponse struct {
+	Params    ckks.ParametersLiteral `json:"Params"`
+	Kernel    string                 `json:"Kernel"`
+	Mode      string                 `json:"Mode"`
+	Classes   []string               `json:"Classes,omitempty"`
+	Distances [][]JSONDistance       `json:"Distances,omitempty"`
+	Votes     [][]byte               `json:"Votes,omitempty"` // rlwe.Ciphertext per query vector
+	Labels    []string               `json:"Labels,omitempty"`
+}
+
+// JSONDistance is the JSON form of Distance.
+type JSONDistance struct {
+	Distance  []byte   `json:"Distance"` // rlwe.Ciphertext
+	Classes   []string `json:"Classes"`
+	PackSizes []int    `json:"PackSizes,omitempty"`
+}
+
+// UnmarshalJSON decodes a JSONSessionRequest.
+func (req *SessionRequest) UnmarshalJSON(data []byte) error {
+	var body JSONSessionRequest
+	if err := json.Unmarshal(data, &body); err != nil {
+		return err
+	}
+
+	// The parameters are validated from the JSON of their literal, the encoding of ckks.Parameters
+	params, err := json.Marshal(body.Params)
+	if err != nil {
+		return err
+	}
+	raw := sessionEncodings{Params: params, Evk: body.Evk}
+	if body.Bootstrapping != nil {
+		raw.Bootstrapping = (*rawBinary)(&body.Bootstrapping)
+	}
+	if body.BootstrappingKeys != nil {
+		raw.BootstrappingKeys = (*rawBinary)(&body.BootstrappingKeys)
+	}
+	*req, err = raw.decode()
+	return err
+}
+
+// UnmarshalJSON decodes a JSONQueryRequest.
+func (query *QueryRequest) UnmarshalJSON(data []byte) error {
+	var body JSONQueryRequest
+	if err := json.Unmarshal(data, &body); err != nil {
+		return err
+	}
+
+	raw := queryEncodings{SessionID: body.SessionID, Kernel: body.Kernel, SumSlots: body.SumSlots, Mode: body.Mode, K: body.K}
+	for _, data := range body.Query {
+		raw.Query = append(raw.Query, data)
+	}
+	var err error
+	*query, err = raw.decode()
+	return err
+}
+
+// MarshalJSON encodes the response as a JSONResponse.
+func (r Response) MarshalJSON() ([]byte, error) {
+	body := JSONResponse{
+		Params:  r.Params.ParametersLiteral(),
+		Kernel:  r.Kernel,
+		Mode:    r.Mode,
+		Classes: r.Classes,
+		Labels:  r.Labels,
+	}
+	for i := range r.Votes {
+		data, err := r.Votes[i].MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		body.Votes = append(body.Votes, data)
+	}
+	for _, distances := range r.Distances {
+		query := make([]JSONDistance, len(distances))
+		for i := range distances {
+			data, err := distances[i].Distance.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			query[i] = JSONDistance{Distance: data, Classes: distances[i].Classes, PackSizes: distances[i].PackSizes}
+		}
+		body.Distances = append(body.Distances, query)
+	}
+	return json.Marshal(body)
+}
+
+// openAPIDocument describes the JSON variant of the API and the gallery API.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// openAPIHandler serves the OpenAPI document of the server.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", JSONContentType)
+	w.Write(openAPIDocument)
+}
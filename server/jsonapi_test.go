@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestQueryRequestUnmarshalJSON(t *testing.T) {
+	keys := newTestKeys(t)
+	ciphertexts := [][]byte{marshal(t, keys.encrypt(t, []float64{1, 2, 3})), marshal(t, keys.encrypt(t, []float64{4, 5}))}
+	body, err := json.Marshal(JSONQueryRequest{SessionID: "session", Kernel: KernelInnerProduct, SumSlots: true, Mode: ModeTopK, K: 3, Query: ciphertexts})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got QueryRequest
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.SessionID != "session" || got.Kernel != KernelInnerProduct || !got.SumSlots || got.Mode != ModeTopK || got.K != 3 {
+		t.Errorf("decoded %+v", got)
+	}
+	if len(got.Query) != len(ciphertexts) {
+		t.Fatalf("decoded %d ciphertexts, expected %d", len(got.Query), len(ciphertexts))
+	}
+	for i := range got.Query {
+		if !bytes.Equal(marshal(t, &got.Query[i]), ciphertexts[i]) {
+			t.Errorf("ciphertext %d differs from the one encoded", i)
+		}
+	}
+}
+
+func TestSessionRequestUnmarshalJSON(t *testing.T) {
+	keys := newTestKeys(t)
+	galEl := keys.params.GaloisElement(1)
+	evk := marshal(t, rlwe.NewMemEvaluationKeySet(keys.kgen.GenRelinearizationKeyNew(keys.sk), keys.kgen.GenGaloisKeyNew(galEl, keys.sk)))
+	body, err := json.Marshal(JSONSessionRequest{Params: keys.params.ParametersLiteral(), Evk: evk})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got SessionRequest
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Params.Equal(&keys.params) {
+		t.Errorf("decoded parameters %+v, expected %+v", got.Params.ParametersLiteral(), keys.params.ParametersLiteral())
+	}
+	if !bytes.Equal(marshal(t, &got.Evk), evk) || len(got.Rlk.Value) == 0 {
+		t.Errorf("decoded keys differ from the ones encoded")
+	}
+	if got.Bootstrapping != nil || got.BootstrappingKeys != nil {
+		t.Errorf("decoded bootstrapping keys that were not sent")
+	}
+}
+
+func TestResponseMarshalJSON(t *testing.T) {
+	keys := newTestKeys(t)
+	distance, votes := keys.encrypt(t, []float64{0.5}), keys.encrypt(t, []float64{1, 0})
+	response := Response{
+		Distances: [][]Distance{{{Distance: *distance, Classes: []string{"alice", "bob"}, PackSizes: []int{2}}}},
+		Params:    keys.params,
+		Kernel:    KernelInnerProduct,
+		Mode:      ModeTopK,
+		Votes:     []rlwe.Ciphertext{*votes},
+		Labels:    []string{"alice", "bob"},
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got JSONResponse
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	params, err := ckks.NewParametersFromLiteral(got.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !params.Equal(&keys.params) || got.Kernel != KernelInnerProduct || got.Mode != ModeTopK || !slices.Equal(got.Labels, response.Labels) {
+		t.Errorf("encoded %s", data)
+	}
+	if len(got.Votes) != 1 || !bytes.Equal(got.Votes[0], marshal(t, votes)) {
+		t.Errorf("encoded votes differ from the response")
+	}
+	if len(got.Distances) != 1 || len(got.Distances[0]) != 1 {
+		t.Fatalf("encoded distances %s", data)
+	}
+	d := got.Distances[0][0]
+	if !bytes.Equal(d.Distance, marshal(t, distance)) || !slices.Equal(d.Classes, []string{"alice", "bob"}) || !slices.Equal(d.PackSizes, []int{2}) {
+		t.Errorf("encoded distance differs from the response")
+	}
+}
+
+func TestJSONRequestErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    string
+		reason  string
+	}{
+		{"query not base64", knnHandler, `{"SessionID": "session", "Query": ["not base64!"]}`, "illegal base64"},
+		{"query not a list", knnHandler, `{"SessionID": "session", "Query": 5}`, "JSONQueryRequest.Query"},
+		{"K not a number", knnHandler, `{"SessionID": "session", "K": "three", "Query": []}`, "JSONQueryRequest.K"},
+		{"truncated body", knnHandler, `{"SessionID": "session"`, "unexpected end of JSON input"},
+		{"keys not base64", sessionsHandler, `{"Params": {"LogN": 14}, "Evk": "%%%"}`, "illegal base64"},
+		{"parameters not an object", sessionsHandler, `{"Params": "default", "Evk": ""}`, "cannot unmarshal string"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", strings.NewReader(test.body))
+			r.Header.Set("Content-Type", JSONContentType)
+			w := httptest.NewRecorder()
+			test.handler(w, r)
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), test.reason) {
+				t.Errorf("got %d %q, expected %d with %q", w.Code, w.Body.String(), http.StatusBadRequest, test.reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+)
+
+// Distance kernels a query can select.
+const (
+	// KernelSquaredDifference computes (q - t)² slot-wise with a ciphertext-ciphertext multiplication.
+	// It needs the relinearization key of the session.
+	KernelSquaredDifference = "squared-difference"
+
+	// KernelInnerProduct computes -2·q·t slot-wise with a plaintext multiplication and adds ||t||²
+	// at the start of each block. The client adds ||q||² after decryption, so no relinearization key is needed.
+	KernelInnerProduct = "inner-product"
+)
+
+// SupportedKernels lists the distance kernels understood by the server.
+var SupportedKernels = []string{KernelSquaredDifference, KernelInnerProduct}
+
+// kernelDepth is the number of levels each kernel consumes, a rescaling after its multiplication.
+var kernelDepth = map[string]int{KernelSquaredDifference: 1, KernelInnerProduct: 1}
+
+// defaultKernel is the kernel of the queries that name none, set by Config.Apply.
+var defaultKernel = KernelSquaredDifference
+
+// resolveKernel returns the kernel to use for a query, defaulting to defaultKernel,
+// and checks that the session registered the keys it needs.
+func resolveKernel(kernel string, session *Session) (string, error) {
+	if kernel == "" {
+		kernel = defaultKernel
+	}
+	switch kernel {
+	case KernelSquaredDifference:
+		if session.Evk.RelinearizationKey == nil {
+			return "", fmt.Errorf("kernel %q requires a relinearization key, register the session with one or use %q", KernelSquaredDifference, KernelInnerProduct)
+		}
+		return KernelSquaredDifference, nil
+	case KernelInnerProduct:
+		return KernelInnerProduct, nil
+	default:
+		return "", fmt.Errorf("unknown distance kernel %q, supported kernels are %v", kernel, SupportedKernels)
+	}
+}
+
+// squaredDifference computes (q - t)² slot-wise. The difference is written to the worker buffer diff.
+func squaredDifference(ciphertext *rlwe.Ciphertext, pack *PackedTarget, evaluator *ckks.Evaluator, diff *rlwe.Ciphertext) (*rlwe.Ciphertext, error) {
+
+	// Compute the difference between the query and the target
+	if err := evaluator.Sub(ciphertext, pack.Vec, diff); err != nil {
+		return nil, err
+	}
+
+	// Square the difference (compute the squared Euclidean distance)
+	squaredDiff, err := evaluator.MulRelinNew(diff, diff)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rescale again after squaring to keep the ciphertext manageable
+	if err := evaluator.Rescale(squaredDiff, squaredDiff); err != nil {
+		return nil, err
+	}
+	return squaredDiff, nil
+}
+
+// innerProduct computes -2·q·t + ||t||² where the norm sits in the first slot of each block,
+// so that summing a block gives the squared distance minus ||q||².
+func innerProduct(ciphertext *rlwe.Ciphertext, pack *PackedTarget, evaluator *ckks.Evaluator) (*rlwe.Ciphertext, error) {
+
+	// Multiply the query with the precomputed -2·t
+	product, err := evaluator.MulNew(ciphertext, pack.ScaledVec)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rescale to bring the scale back to the one of the query
+	if err := evaluator.Rescale(product, product); err != nil {
+		return nil, err
+	}
+
+	// Add the precomputed ||t||² of each target
+	if err := evaluator.Add(product, pack.Norms, product); err != nil {
+		return nil, err
+	}
+	return product, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"strings"
+	"testing"
+)
+
+func TestResolveKernel(t *testing.T) {
+	withRlk := &Session{Evk: rlwe.MemEvaluationKeySet{RelinearizationKey: &rlwe.RelinearizationKey{}}}
+	withoutRlk := &Session{}
+
+	tests := []struct {
+		name    string
+		kernel  string
+		session *Session
+		result  string
+		err     string
+	}{
+		{"default", "", withRlk, KernelSquaredDifference, ""},
+		{"squared difference", KernelSquaredDifference, withRlk, KernelSquaredDifference, ""},
+		{"inner product", KernelInnerProduct, withRlk, KernelInnerProduct, ""},
+		{"inner product without relinearization key", KernelInnerProduct, withoutRlk, KernelInnerProduct, ""},
+		{"squared difference without relinearization key", KernelSquaredDifference, withoutRlk, "", "requires a relinearization key"},
+		{"default without relinearization key", "", withoutRlk, "", "requires a relinearization key"},
+		{"unknown", "cosine", withRlk, "", `unknown distance kernel "cosine"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kernel, err := resolveKernel(test.kernel, test.session)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kernel != test.result {
+				t.Errorf("resolved %q, expected %q", kernel, test.result)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+	"testing"
+)
+
+// testKeys holds the keys of a client of the default parameter set, for the tests that need
+// real ciphertexts and evaluation keys.
+type testKeys struct {
+	params    ckks.Parameters
+	kgen      *rlwe.KeyGenerator
+	sk        *rlwe.SecretKey
+	encoder   *ckks.Encoder
+	encryptor *rlwe.Encryptor
+}
+
+func newTestKeys(t testing.TB) *testKeys {
+	t.Helper()
+	accepted, err := acceptedParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := accepted[0]
+	kgen := rlwe.NewKeyGenerator(params)
+	sk := kgen.GenSecretKeyNew()
+	return &testKeys{
+		params:    params,
+		kgen:      kgen,
+		sk:        sk,
+		encoder:   ckks.NewEncoder(params),
+		encryptor: rlwe.NewEncryptor(params, sk),
+	}
+}
+
+// encrypt returns the encryption of values at the maximum level and the default scale.
+func (k *testKeys) encrypt(t testing.TB, values []float64) *rlwe.Ciphertext {
+	t.Helper()
+	pt := ckks.NewPlaintext(k.params, k.params.MaxLevel())
+	if err := k.encoder.Encode(values, pt); err != nil {
+		t.Fatal(err)
+	}
+	ct, err := k.encryptor.EncryptNew(pt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ct
+}
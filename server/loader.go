@@ -0,0 +1,652 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Gallery file formats, selected by the extension of the path.
+//
+//   - .csv: one sample per line, the embedding followed by the label, as written by model/train.py.
+//   - .npz: a NumPy archive holding a float array X of shape (samples, dimension) and a string array y
+//     of labels, as written by np.savez(path, X=X, y=y). The names embeddings and labels are accepted too.
+//   - .npy: the float array X, with the labels in a second file named after it, knn.npy and knn_labels.npy.
+//   - .jsonl: one JSON object {"Label": ..., "Embedding": [...]} per line.
+//
+// A .npy gallery is watched through its embeddings file, so replace the labels first.
+const (
+	FormatCSV       = ".csv"
+	FormatNPZ       = ".npz"
+	FormatNPY       = ".npy"
+	FormatJSONLines = ".jsonl"
+)
+
+const (
+	maxLoadErrors    = 20        // Errors reported before giving up on a file
+	npyLabelsSuffix  = "_labels" // Suffix of the labels file paired with a .npy gallery
+	npyHeaderPadding = 64        // Alignment of the data in the .npy files we write
+
+	// Bytes read from an array of a .npz archive, whose announced size is not checked until
+	// the array has been read: 4 GiB holds a million 512-dimensional float64 embeddings.
+	maxNPZArrayBytes = 4 << 30
+)
+
+// galleryFormat returns the format of the gallery file at path, defaulting to CSV.
+func galleryFormat(path string) string {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case FormatNPZ, FormatNPY, FormatJSONLines:
+		return ext
+	case ".ndjson":
+		return FormatJSONLines
+	default:
+		return FormatCSV
+	}
+}
+
+// readGallery parses the gallery file at path in the format given by its extension.
+func readGallery(path string) (KNN, error) {
+	switch galleryFormat(path) {
+	case FormatNPZ:
+		return readNPZ(path)
+	case FormatNPY:
+		return readNPYPair(path)
+	case FormatJSONLines:
+		return readJSONLines(path)
+	default:
+		return readCSV(path)
+	}
+}
+
+// writeGallery writes the model to w in the given format.
+// A .npy gallery also writes its labels to labelsPath.
+func writeGallery(w io.Writer, format string, model *KNN, labelsPath string) error {
+	switch format {
+	case FormatNPZ:
+		return writeNPZ(w, model)
+	case FormatNPY:
+		if err := writeFileAtomic(labelsPath, func(w io.Writer) error { return writeNPYStrings(w, model.Classes) }); err != nil {
+			return err
+		}
+		return writeNPYFloats(w, model.Data)
+	case FormatJSONLines:
+		return writeJSONLines(w, model)
+	default:
+		return writeCSV(w, model)
+	}
+}
+
+// loadErrors collects the errors found while reading a file, up to maxLoadErrors.
+type loadErrors struct {
+	errs []error
+}
+
+// add records err and reports whether reading should stop.
+func (l *loadErrors) add(err error) bool {
+	l.errs = append(l.errs, err)
+	return len(l.errs) >= maxLoadErrors
+}
+
+// err returns all the errors recorded, or nil.
+func (l *loadErrors) err() error {
+	if len(l.errs) >= maxLoadErrors {
+		l.errs = append(l.errs, fmt.Errorf("too many errors, stopped reading"))
+	}
+	return errors.Join(l.errs...)
+}
+
+// readCSV parses a CSV gallery, reporting every malformed record and value with its line and column.
+// All records must have as many fields as the first one.
+func readCSV(path string) (KNN, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return KNN{}, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.ReuseRecord = true
+
+	var model KNN
+	var errs loadErrors
+records:
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			if errs.add(fmt.Errorf("%s:%d:%d: %v", path, parseErr.Line, parseErr.Column, parseErr.Err)) {
+				break records
+			}
+			continue
+		}
+		if err != nil {
+			return KNN{}, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		if len(record) < 2 {
+			if errs.add(fmt.Errorf("%s:%d: expected an embedding followed by a label", path, line)) {
+				break
+			}
+			continue
+		}
+
+		row := make([]float64, len(record)-1)
+		for i := range row {
+			f, err := strconv.ParseFloat(strings.TrimSpace(record[i]), 64)
+			if err == nil && (math.IsNaN(f) || math.IsInf(f, 0)) {
+				err = fmt.Errorf("non-finite value")
+			}
+			if err != nil {
+				line, column := reader.FieldPos(i)
+				if errs.add(fmt.Errorf("%s:%d:%d: invalid value %q in field %d: %v", path, line, column, record[i], i+1, errorCause(err))) {
+					break records
+				}
+			}
+			row[i] = f
+		}
+		model.Data = append(model.Data, row)
+		model.Classes = append(model.Classes, record[len(record)-1])
+	}
+
+	if err := errs.err(); err != nil {
+		return KNN{}, err
+	}
+	return model, nil
+}
+
+// writeCSV writes the model in the format read by readCSV.
+func writeCSV(w io.Writer, model *KNN) error {
+	writer := csv.NewWriter(w)
+	for i, row := range model.Data {
+		record := make([]string, 0, len(row)+1)
+		for _, v := range row {
+			record = append(record, strconv.FormatFloat(v, 'g', -1, 64))
+		}
+		if err := writer.Write(append(record, model.Classes[i])); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// jsonSample is one line of a JSON-lines gallery.
+type jsonSample struct {
+	Label     string    `json:"Label"`
+	Embedding []float64 `json:"Embedding"`
+}
+
+// readJSONLines parses a JSON-lines gallery, reporting every malformed line with its line and column.
+// Blank lines are skipped and all embeddings must have the length of the first one.
+func readJSONLines(path string) (KNN, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return KNN{}, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<24) // Embeddings make for long lines
+
+	var model KNN
+	var errs loadErrors
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Bytes()
+		if len(bytes.TrimSpace(text)) == 0 {
+			continue
+		}
+
+		var sample jsonSample
+		decoder := json.NewDecoder(bytes.NewReader(text))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&sample); err != nil {
+			if errs.add(fmt.Errorf("%s:%d:%d: %v", path, line, jsonErrorColumn(err, text), err)) {
+				break
+			}
+			continue
+		}
+
+		var problem error
+		switch {
+		case sample.Label == "":
+			problem = fmt.Errorf("missing Label")
+		case len(sample.Embedding) == 0:
+			problem = fmt.Errorf("missing Embedding")
+		case len(model.Data) > 0 && len(sample.Embedding) != len(model.Data[0]):
+			problem = fmt.Errorf("embedding has %d values, expected %d", len(sample.Embedding), len(model.Data[0]))
+		}
+		if problem != nil {
+			if errs.add(fmt.Errorf("%s:%d: %v", path, line, problem)) {
+				break
+			}
+			continue
+		}
+
+		model.Data = append(model.Data, sample.Embedding)
+		model.Classes = append(model.Classes, sample.Label)
+	}
+	if err := scanner.Err(); err != nil {
+		return KNN{}, err
+	}
+
+	if err := errs.err(); err != nil {
+		return KNN{}, err
+	}
+	return model, nil
+}
+
+// writeJSONLines writes the model in the format read by readJSONLines.
+func writeJSONLines(w io.Writer, model *KNN) error {
+	encoder := json.NewEncoder(w)
+	for i, row := range model.Data {
+		if err := encoder.Encode(jsonSample{Label: model.Classes[i], Embedding: row}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonErrorColumn returns the 1-based column of a JSON decoding error in line, or 1 if unknown.
+func jsonErrorColumn(err error, line []byte) int {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return 1
+	}
+	if offset > int64(len(line)) {
+		offset = int64(len(line))
+	}
+	return utf8.RuneCount(line[:offset]) + 1
+}
+
+// errorCause strips the function and input that strconv adds to its errors.
+func errorCause(err error) error {
+	var numErr *strconv.NumError
+	if errors.As(err, &numErr) {
+		return numErr.Err
+	}
+	return err
+}
+
+// npyArray is an array read from a .npy file. Exactly one of floats and strings is set.
+type npyArray struct {
+	shape   []int
+	floats  []float64
+	strings []string
+}
+
+// npyMagic starts every .npy file.
+var npyMagic = []byte("\x93NUMPY")
+
+var (
+	npyDescr   = regexp.MustCompile(`'descr':\s*'([^']*)'`)
+	npyFortran = regexp.MustCompile(`'fortran_order':\s*(True|False)`)
+	npyShape   = regexp.MustCompile(`'shape':\s*\(([^)]*)\)`)
+)
+
+// readNPY parses a .npy array of floats (f4, f8) or fixed-width strings (U, S), in either byte order,
+// from the left bytes of r. Object arrays are pickled and cannot be read; save labels with
+// np.array(y, dtype=str). The header is checked against left before anything is allocated, so that
+// a corrupt file fails the reload instead of the server.
+func readNPY(r io.Reader, left int64, name string) (npyArray, error) {
+	var array npyArray
+
+	// Magic, version and header length, which takes 2 bytes in version 1 and 4 bytes afterwards
+	preamble := make([]byte, 8)
+	if _, err := io.ReadFull(r, preamble); err != nil {
+		return array, fmt.Errorf("%s: not a .npy file: %v", name, err)
+	}
+	if !bytes.Equal(preamble[:6], npyMagic) {
+		return array, fmt.Errorf("%s: not a .npy file", name)
+	}
+	var headerLen int
+	switch preamble[6] {
+	case 1:
+		var b [2]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return array, fmt.Errorf("%s: truncated header: %v", name, err)
+		}
+		headerLen = int(binary.LittleEndian.Uint16(b[:]))
+		left -= 10
+	case 2, 3:
+		var b [4]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return array, fmt.Errorf("%s: truncated header: %v", name, err)
+		}
+		headerLen = int(binary.LittleEndian.Uint32(b[:]))
+		left -= 12
+	default:
+		return array, fmt.Errorf("%s: unsupported .npy version %d", name, preamble[6])
+	}
+	if int64(headerLen) > left {
+		return array, fmt.Errorf("%s: header of %d bytes, only %d bytes left", name, headerLen, left)
+	}
+	left -= int64(headerLen)
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return array, fmt.Errorf("%s: truncated header: %v", name, err)
+	}
+
+	// The header is a Python dict literal
+	descr := npyDescr.FindSubmatch(header)
+	fortran := npyFortran.FindSubmatch(header)
+	shape := npyShape.FindSubmatch(header)
+	if descr == nil || fortran == nil || shape == nil {
+		return array, fmt.Errorf("%s: malformed header %q", name, header)
+	}
+	count := 1
+	for _, dim := range strings.Split(string(shape[1]), ",") {
+		if dim = strings.TrimSpace(dim); dim == "" {
+			continue
+		}
+		n, err := strconv.Atoi(dim)
+		if err != nil || n < 0 {
+			return array, fmt.Errorf("%s: malformed shape %q", name, shape[1])
+		}
+		if n > 0 && count > math.MaxInt/n {
+			return array, fmt.Errorf("%s: shape %q overflows", name, shape[1])
+		}
+		array.shape = append(array.shape, n)
+		count *= n
+	}
+
+	// Element type, size and byte order
+	dtype := string(descr[1])
+	if len(dtype) < 3 {
+		return array, fmt.Errorf("%s: unsupported dtype %q", name, dtype)
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if dtype[0] == '>' {
+		order = binary.BigEndian
+	}
+	size, err := strconv.Atoi(dtype[2:])
+	if err != nil || size <= 0 {
+		return array, fmt.Errorf("%s: unsupported dtype %q", name, dtype)
+	}
+	width := size // Bytes of an element
+	switch {
+	case dtype[1:] == "f4", dtype[1:] == "f8", dtype[1] == 'S':
+	case dtype[1] == 'U' && size <= math.MaxInt/4:
+		width = 4 * size
+	default:
+		return array, fmt.Errorf("%s: unsupported dtype %q, expected floats or fixed-width strings", name, dtype)
+	}
+
+	// The data must be in the file, whatever the header announces
+	if count > 0 && int64(width) > left/int64(count) {
+		return array, fmt.Errorf("%s: shape (%s) of %s takes more than the %d bytes left", name, shape[1], dtype, left)
+	}
+	data := make([]byte, count*width)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return array, fmt.Errorf("%s: truncated data: %v", name, err)
+	}
+
+	switch {
+	case dtype[1:] == "f4":
+		array.floats = make([]float64, count)
+		for i := range array.floats {
+			array.floats[i] = float64(math.Float32frombits(order.Uint32(data[4*i:])))
+		}
+	case dtype[1:] == "f8":
+		array.floats = make([]float64, count)
+		for i := range array.floats {
+			array.floats[i] = math.Float64frombits(order.Uint64(data[8*i:]))
+		}
+	case dtype[1] == 'U':
+		// UTF-32 code points, padded with zeros
+		array.strings = make([]string, count)
+		for i := range array.strings {
+			var sb strings.Builder
+			for j := 0; j < size; j++ {
+				r := rune(order.Uint32(data[4*(i*size+j):]))
+				if r == 0 {
+					break
+				}
+				sb.WriteRune(r)
+			}
+			array.strings[i] = sb.String()
+		}
+	default:
+		// Bytes, padded with zeros
+		array.strings = make([]string, count)
+		for i := range array.strings {
+			array.strings[i] = string(bytes.TrimRight(data[i*size:(i+1)*size], "\x00"))
+		}
+	}
+
+	// Bring a 2D Fortran-ordered array back to row-major order
+	if string(fortran[1]) == "True" && len(array.shape) == 2 && array.floats != nil {
+		rows, cols := array.shape[0], array.shape[1]
+		transposed := make([]float64, len(array.floats))
+		for i := 0; i < rows; i++ {
+			for j := 0; j < cols; j++ {
+				transposed[i*cols+j] = array.floats[j*rows+i]
+			}
+		}
+		array.floats = transposed
+	}
+
+	return array, nil
+}
+
+// writeNPYHeader writes the preamble and the header of a version 1 .npy file.
+func writeNPYHeader(w io.Writer, descr string, shape string) error {
+	header := fmt.Sprintf("{'descr': '%s', 'fortran_order': False, 'shape': (%s), }", descr, shape)
+
+	// Pad with spaces so that the data starts on an aligned offset, and end with a newline
+	total := len(npyMagic) + 2 + 2 + len(header) + 1
+	header += strings.Repeat(" ", (npyHeaderPadding-total%npyHeaderPadding)%npyHeaderPadding) + "\n"
+
+	preamble := append(append([]byte{}, npyMagic...), 1, 0, 0, 0)
+	binary.LittleEndian.PutUint16(preamble[8:], uint16(len(header)))
+	if _, err := w.Write(preamble); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, header)
+	return err
+}
+
+// writeNPYFloats writes a matrix as a little-endian float64 .npy array.
+func writeNPYFloats(w io.Writer, data [][]float64) error {
+	cols := 0
+	if len(data) > 0 {
+		cols = len(data[0])
+	}
+	if err := writeNPYHeader(w, "<f8", fmt.Sprintf("%d, %d", len(data), cols)); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 8*cols)
+	for _, row := range data {
+		for j, v := range row {
+			binary.LittleEndian.PutUint64(buf[8*j:], math.Float64bits(v))
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeNPYStrings writes strings as a little-endian fixed-width unicode .npy array.
+func writeNPYStrings(w io.Writer, values []string) error {
+	width := 1
+	for _, v := range values {
+		if n := utf8.RuneCountInString(v); n > width {
+			width = n
+		}
+	}
+	if err := writeNPYHeader(w, fmt.Sprintf("<U%d", width), fmt.Sprintf("%d,", len(values))); err != nil {
+		return err
+	}
+
+	for _, v := range values {
+		buf := make([]byte, 4*width)
+		i := 0
+		for _, r := range v {
+			binary.LittleEndian.PutUint32(buf[4*i:], uint32(r))
+			i++
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// knnFromArrays builds a model from a (samples, dimension) float array and a (samples,) string array.
+func knnFromArrays(embeddings, labels npyArray, name string) (KNN, error) {
+	if embeddings.floats == nil || len(embeddings.shape) != 2 {
+		return KNN{}, fmt.Errorf("%s: embeddings must be a 2D float array, got shape %v", name, embeddings.shape)
+	}
+	if labels.strings == nil || len(labels.shape) != 1 {
+		return KNN{}, fmt.Errorf("%s: labels must be a 1D string array, got shape %v", name, labels.shape)
+	}
+	rows, cols := embeddings.shape[0], embeddings.shape[1]
+	if labels.shape[0] != rows {
+		return KNN{}, fmt.Errorf("%s: %d embeddings but %d labels", name, rows, labels.shape[0])
+	}
+
+	model := KNN{Classes: labels.strings}
+	for i := 0; i < rows; i++ {
+		model.Data = append(model.Data, embeddings.floats[i*cols:(i+1)*cols])
+	}
+	return model, nil
+}
+
+// npyLabelsPath returns the path of the labels paired with the embeddings of a .npy gallery.
+func npyLabelsPath(path string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + npyLabelsSuffix + ext
+}
+
+// readNPYPair reads the embeddings at path and the labels next to it.
+func readNPYPair(path string) (KNN, error) {
+	readFile := func(path string) (npyArray, error) {
+		file, err := os.Open(path)
+		if err != nil {
+			return npyArray{}, err
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return npyArray{}, err
+		}
+		return readNPY(bufio.NewReader(file), info.Size(), path)
+	}
+
+	embeddings, err := readFile(path)
+	if err != nil {
+		return KNN{}, err
+	}
+	labels, err := readFile(npyLabelsPath(path))
+	if err != nil {
+		return KNN{}, err
+	}
+	return knnFromArrays(embeddings, labels, path)
+}
+
+// readNPZ reads the embeddings and labels of a NumPy archive.
+func readNPZ(path string) (KNN, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return KNN{}, fmt.Errorf("%s: %v", path, err)
+	}
+	defer archive.Close()
+
+	arrays := make(map[string]npyArray)
+	for _, f := range archive.File {
+		key := strings.TrimSuffix(f.Name, ".npy")
+		if key != "X" && key != "y" && key != "embeddings" && key != "labels" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return KNN{}, fmt.Errorf("%s: %v", path, err)
+		}
+		array, err := readNPY(bufio.NewReader(rc), int64(min(f.UncompressedSize64, maxNPZArrayBytes)), path+":"+f.Name)
+		rc.Close()
+		if err != nil {
+			return KNN{}, err
+		}
+		arrays[key] = array
+	}
+
+	embeddings, ok := arrays["X"]
+	if !ok {
+		embeddings, ok = arrays["embeddings"]
+	}
+	labels, ok2 := arrays["y"]
+	if !ok2 {
+		labels, ok2 = arrays["labels"]
+	}
+	if !ok || !ok2 {
+		return KNN{}, fmt.Errorf("%s: expected arrays X and y (or embeddings and labels)", path)
+	}
+	return knnFromArrays(embeddings, labels, path)
+}
+
+// writeNPZ writes the model as a NumPy archive holding X and y.
+func writeNPZ(w io.Writer, model *KNN) error {
+	archive := zip.NewWriter(w)
+	f, err := archive.Create("X.npy")
+	if err != nil {
+		return err
+	}
+	if err := writeNPYFloats(f, model.Data); err != nil {
+		return err
+	}
+	if f, err = archive.Create("y.npy"); err != nil {
+		return err
+	}
+	if err := writeNPYStrings(f, model.Classes); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// writeFileAtomic writes a file next to path and renames it over path, so readers never see a partial file.
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	writer := bufio.NewWriter(tmp)
+	if err := write(writer); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// npyFile returns a version 1 .npy file with the given header dict and data.
+func npyFile(header string, data []byte) []byte {
+	file := append(bytes.Clone(npyMagic), 1, 0)
+	file = binary.LittleEndian.AppendUint16(file, uint16(len(header)))
+	return append(append(file, header...), data...)
+}
+
+// npyData returns the encoding of values in order, each as a float32, a float64 or a string of runes.
+func npyData(order binary.AppendByteOrder, values ...any) []byte {
+	var data []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case float32:
+			data = order.AppendUint32(data, math.Float32bits(v))
+		case float64:
+			data = order.AppendUint64(data, math.Float64bits(v))
+		case string:
+			for _, r := range v {
+				data = order.AppendUint32(data, uint32(r))
+			}
+		}
+	}
+	return data
+}
+
+// npzArchive returns a .npz archive holding npy, stored uncompressed as name, whose directory announces size bytes.
+func npzArchive(name string, npy []byte, size uint64) string {
+	var b bytes.Buffer
+	archive := zip.NewWriter(&b)
+	w, err := archive.CreateRaw(&zip.FileHeader{
+		Name:               name,
+		Method:             zip.Store,
+		CRC32:              crc32.ChecksumIEEE(npy),
+		CompressedSize64:   uint64(len(npy)),
+		UncompressedSize64: size,
+	})
+	if err != nil {
+		panic(err)
+	}
+	w.Write(npy)
+	archive.Close()
+	return b.String()
+}
+
+func TestReadNPY(t *testing.T) {
+	le, be := binary.LittleEndian, binary.BigEndian
+	header := func(descr, shape string, fortran bool) string {
+		order := "False"
+		if fortran {
+			order = "True"
+		}
+		return "{'descr': '" + descr + "', 'fortran_order': " + order + ", 'shape': (" + shape + "), }\n"
+	}
+
+	tests := []struct {
+		name    string
+		file    []byte
+		shape   []int
+		floats  []float64
+		strings []string
+		err     string
+	}{
+		{"f8", npyFile(header("<f8", "2, 2", false), npyData(le, 1.0, 2.0, 3.0, 4.0)), []int{2, 2}, []float64{1, 2, 3, 4}, nil, ""},
+		{"big-endian f4", npyFile(header(">f4", "3,", false), npyData(be, float32(0.5), float32(-1), float32(2))), []int{3}, []float64{0.5, -1, 2}, nil, ""},
+		{"Fortran order", npyFile(header("<f8", "2, 3", true), npyData(le, 1.0, 4.0, 2.0, 5.0, 3.0, 6.0)), []int{2, 3}, []float64{1, 2, 3, 4, 5, 6}, nil, ""},
+		{"scalar", npyFile(header("<f8", "", false), npyData(le, 7.0)), nil, []float64{7}, nil, ""},
+		{"empty", npyFile(header("<f8", "0, 512", false), nil), []int{0, 512}, []float64{}, nil, ""},
+		{"unicode", npyFile(header("<U5", "2,", false), npyData(le, "alice", "bob\x00\x00")), []int{2}, nil, []string{"alice", "bob"}, ""},
+		{"bytes", npyFile(header("|S3", "2,", false), []byte("bobal\x00")), []int{2}, nil, []string{"bob", "al"}, ""},
+		{"not npy", []byte("X,y\n1,alice\n"), nil, nil, nil, "not a .npy file"},
+		{"truncated preamble", npyMagic, nil, nil, nil, "not a .npy file"},
+		{"unknown version", append(bytes.Clone(npyMagic), 4, 0, 0, 0), nil, nil, nil, "unsupported .npy version 4"},
+		{"header beyond the file", append(bytes.Clone(npyMagic), 1, 0, 0xff, 0xff), nil, nil, nil, "header of 65535 bytes, only 0 bytes left"},
+		{"malformed header", npyFile("{}", nil), nil, nil, nil, "malformed header"},
+		{"negative dimension", npyFile(header("<f8", "-1,", false), nil), nil, nil, nil, "malformed shape"},
+		{"overflowing shape", npyFile(header("<f8", "4294967296, 4294967296, 4294967296", false), nil), nil, nil, nil, "overflows"},
+		{"shape beyond the file", npyFile(header("<f8", "1000000, 512", false), npyData(le, 1.0)), nil, nil, nil, "takes more than the 8 bytes left"},
+		{"string width beyond the file", npyFile(header("<U1000000000", "1,", false), npyData(le, "a")), nil, nil, nil, "takes more than the 4 bytes left"},
+		{"string width overflowing", npyFile(header("<U4611686018427387904", "1,", false), nil), nil, nil, nil, "unsupported dtype"},
+		{"integers", npyFile(header("<i8", "1,", false), npyData(le, 1.0)), nil, nil, nil, "unsupported dtype"},
+		{"objects", npyFile(header("|O", "1,", false), nil), nil, nil, nil, "unsupported dtype"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			array, err := readNPY(bytes.NewReader(test.file), int64(len(test.file)), "test.npy")
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(array.shape, test.shape) || !slices.Equal(array.floats, test.floats) || !slices.Equal(array.strings, test.strings) {
+				t.Errorf("got shape %v, floats %v and strings %q", array.shape, array.floats, array.strings)
+			}
+		})
+	}
+
+	// A reader shorter than announced fails while reading instead of returning partial data
+	file := npyFile(header("<f8", "2,", false), npyData(le, 1.0, 2.0))
+	if _, err := readNPY(bytes.NewReader(file[:len(file)-1]), int64(len(file)), "test.npy"); err == nil || !strings.Contains(err.Error(), "truncated data") {
+		t.Errorf("got error %v, expected truncated data", err)
+	}
+}
+
+func TestGalleryRoundTrip(t *testing.T) {
+	model := &KNN{
+		Data:    [][]float64{{0.5, -1, 1e-9}, {2, 0, 3.25}, {-0.125, 1, 0}},
+		Classes: []string{"alice", "bob", "zoë"},
+	}
+	for _, name := range []string{"knn.csv", "knn.jsonl", "knn.npz", "knn.npy"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			err := writeFileAtomic(path, func(w io.Writer) error {
+				return writeGallery(w, galleryFormat(path), model, npyLabelsPath(path))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			read, err := readGallery(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(read.Classes, model.Classes) || !slices.EqualFunc(read.Data, model.Data, slices.Equal[[]float64]) {
+				t.Errorf("read %v %q, expected %v %q", read.Data, read.Classes, model.Data, model.Classes)
+			}
+		})
+	}
+}
+
+func TestReadGalleryErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		errs    []string
+	}{
+		{"invalid values", "knn.csv", "1,2,alice\n1,x,bob\n1,inf,carol\n", []string{"knn.csv:2:3: invalid value \"x\" in field 2", "knn.csv:3:3: invalid value \"inf\" in field 2: non-finite value"}},
+		{"wrong number of fields", "knn.csv", "1,2,alice\n1,2,3,bob\n", []string{"knn.csv:2:1: wrong number of fields"}},
+		{"no embedding", "knn.csv", "alice\n", []string{"knn.csv:1: expected an embedding followed by a label"}},
+		{"embedding lengths", "knn.jsonl", "{\"Label\": \"alice\", \"Embedding\": [1, 2]}\n\n{\"Label\": \"bob\", \"Embedding\": [1]}\n{\"Label\": 3}\n", []string{"knn.jsonl:3: embedding has 1 values, expected 2", "knn.jsonl:4:"}},
+		{"unknown and missing fields", "knn.jsonl", "{\"Label\": \"alice\", \"Embedding\": [1], \"Extra\": 1}\n{\"Embedding\": [1]}\n", []string{"knn.jsonl:1:1: json: unknown field \"Extra\"", "knn.jsonl:2: missing Label"}},
+		{"not an archive", "knn.npz", "not a zip", []string{"knn.npz: zip: not a valid zip file"}},
+		{"array larger than the limit", "knn.npz", npzArchive("X.npy", npyFile("{'descr': '<f8', 'fortran_order': False, 'shape': (1099511627776, 512), }\n", nil), math.MaxInt64),
+			[]string{"knn.npz:X.npy: shape (1099511627776, 512) of <f8 takes more than the 4294967"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), test.file)
+			if err := os.WriteFile(path, []byte(test.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := readGallery(path)
+			if err == nil {
+				t.Fatal("gallery read without error")
+			}
+			for _, expected := range test.errs {
+				if !strings.Contains(err.Error(), filepath.Join(filepath.Dir(path), expected)) {
+					t.Errorf("got error %q, expected %q", err, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestTooManyLoadErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "knn.csv")
+	if err := os.WriteFile(path, []byte(strings.Repeat("x,alice\n", 2*maxLoadErrors)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := readGallery(path)
+	if err == nil || strings.Count(err.Error(), "invalid value") != maxLoadErrors || !strings.Contains(err.Error(), "too many errors") {
+		t.Errorf("got error %v, expected %d errors and a note", err, maxLoadErrors)
+	}
+}
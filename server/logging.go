@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Structured logging
+//
+// The server logs with log/slog, as text by default or as JSON with -log-format json. Every
+// request carries an ID, sent by the client in the X-Request-ID header, or the x-request-id
+// metadata of the gRPC stream, or generated here when missing. The ID is echoed in the response
+// and attached to every line logged for the request, along with the time spent in each of its
+// stages, so that a frame can be followed from the client log to the server log.
+
+// RequestIDHeader is the HTTP header, and in lower case the gRPC metadata, carrying the request ID.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the request IDs accepted from clients.
+const maxRequestIDLength = 64
+
+// setupLogging makes the default logger write records to stderr in format, "text" or "json".
+func setupLogging(format string) error {
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, nil)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, nil)
+	default:
+		return fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs err and exits, for the errors that prevent the server from starting.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// newRequestID returns a random request ID, for requests that come without one.
+func newRequestID() string {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// validRequestID reports whether a request ID sent by a client can be logged as is:
+// letters, digits, dots, dashes and underscores, up to maxRequestIDLength.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDKey is the context key of the request ID.
+type requestIDKey struct{}
+
+// RequestID returns the ID of the request of ctx, as set by withRequestID or streamRequestID.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLogger returns the default logger with the ID of the request of ctx.
+func requestLogger(ctx context.Context) *slog.Logger {
+	if id := RequestID(ctx); id != "" {
+		return slog.With("request_id", id)
+	}
+	return slog.Default()
+}
+
+// withRequestID tags each request with the request ID sent by its client, or a new one,
+// and echoes it in the response.
+func withRequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// streamRequestID tags a gRPC call with the request ID of its metadata, or a new one,
+// and echoes it in the header metadata of the response.
+func streamRequestID(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var id string
+	if values := md.Get(RequestIDHeader); len(values) > 0 && validRequestID(values[0]) {
+		id = values[0]
+	} else {
+		id = newRequestID()
+	}
+	if err := grpc.SetHeader(ctx, metadata.Pairs(RequestIDHeader, id)); err != nil {
+		slog.Warn("Failed to echo the request ID", "request_id", id, "err", err)
+	}
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// stageTimer times the consecutive stages of a request, for the stage metrics, the request log
+// and the trace, where each stage is a span of its own under the span of the request.
+type stageTimer struct {
+	route  string
+	start  time.Time // Start of the request
+	last   time.Time // End of the previous stage
+	stages []any     // slog.Attr of each stage, in order
+
+	span spanRef // Span of the request, if traced
+	next [8]byte // ID of the span of the stage in progress
+}
+
+// newStageTimer starts timing a request of route, traced under the current span of ctx.
+func newStageTimer(ctx context.Context, route string) *stageTimer {
+	now := time.Now()
+	t := &stageTimer{route: route, start: now, last: now}
+	if tracer != nil {
+		t.span, _ = ctx.Value(spanKey{}).(spanRef)
+		t.next = newSpanID()
+	}
+	return t
+}
+
+// Stage records the time spent in stage since the end of the previous stage.
+func (t *stageTimer) Stage(stage string) {
+	now := time.Now()
+	elapsed := now.Sub(t.last)
+	stageSeconds.WithLabelValues(t.route, stage).Observe(elapsed.Seconds())
+	t.stages = append(t.stages, slog.Duration(stage, elapsed))
+	if t.span.local {
+		span := &Span{Parent: t.span.SpanID, Name: stage, Start: t.last, track: t.span.track}
+		span.TraceID, span.SpanID = t.span.TraceID, t.next
+		tracer.record(span, now)
+		t.next = newSpanID()
+	}
+	t.last = now
+}
+
+// Context returns ctx with the stage in progress as its current span, the parent of the spans
+// started within the stage.
+func (t *stageTimer) Context(ctx context.Context) context.Context {
+	if !t.span.local {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, spanRef{SpanContext: SpanContext{TraceID: t.span.TraceID, SpanID: t.next}, track: t.span.track, local: true})
+}
+
+// Attr returns the stages recorded so far and the total time of the request, as the "stages" group.
+func (t *stageTimer) Attr() slog.Attr {
+	return slog.Group("stages", append(t.stages, slog.Duration("total", time.Since(t.start)))...)
+}
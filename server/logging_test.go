@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidRequestID(t *testing.T) {
+	tests := []struct {
+		id    string
+		valid bool
+	}{
+		{"4bf92f3577b34da6", true},
+		{"camera-1_frame.42", true},
+		{strings.Repeat("a", maxRequestIDLength), true},
+		{"", false},
+		{strings.Repeat("a", maxRequestIDLength+1), false},
+		{"id with spaces", false},
+		{"id\nforged=log", false},
+		{"id\"quoted", false},
+		{"idé", false},
+	}
+	for _, test := range tests {
+		if valid := validRequestID(test.id); valid != test.valid {
+			t.Errorf("validRequestID(%q) = %v, expected %v", test.id, valid, test.valid)
+		}
+	}
+}
+
+func TestWithRequestID(t *testing.T) {
+	var seen string
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestID(r.Context())
+	}))
+	tests := []struct {
+		name string
+		sent string
+		kept bool // The ID sent is the one of the request
+	}{
+		{"sent by the client", "frame-42", true},
+		{"none", "", false},
+		{"invalid", "frame 42\n", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/healthz", nil)
+			if test.sent != "" {
+				r.Header.Set(RequestIDHeader, test.sent)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			echoed := w.Header().Get(RequestIDHeader)
+			if echoed != seen || !validRequestID(seen) {
+				t.Fatalf("handler saw %q and %q was echoed", seen, echoed)
+			}
+			if (seen == test.sent) != test.kept {
+				t.Errorf("request ID %q for %q sent", seen, test.sent)
+			}
+		})
+	}
+}
+
+func TestStageTimerAttr(t *testing.T) {
+	timer := newStageTimer(context.Background(), "knn")
+	timer.Stage("receive")
+	timer.Stage("predict")
+	attr := timer.Attr()
+	var keys []string
+	for _, a := range attr.Value.Group() {
+		keys = append(keys, a.Key)
+		if a.Value.Kind() != slog.KindDuration {
+			t.Errorf("stage %q is a %v", a.Key, a.Value.Kind())
+		}
+	}
+	if attr.Key != "stages" || strings.Join(keys, ",") != "receive,predict,total" {
+		t.Errorf("got %s with stages %v", attr.Key, keys)
+	}
+}
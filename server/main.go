@@ -1,112 +1,289 @@
 package main
 
 import (
-	"encoding/csv"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
 	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
-	"io/ioutil"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
 	"os"
-	"strconv"
-	"strings"
 	"time"
 )
 
 // Global variables
-var model KNN             // KNN model containing training data and associated classes
-var context PublicContext // PublicContext for managing the encryption context
+var gallery *Gallery       // KNN model served to queries, editable through /api/gallery
+var sessions *SessionStore // Registered client sessions and their evaluation keys, created by Config.Apply
+var scheduler *Scheduler   // Worker pool computing encrypted distances
 
 // Response struct to define the format of the API response
+// It is sent as gob or as a frame, see MarshalWire; the JSON variant is a JSONResponse, see MarshalJSON.
 type Response struct {
-	Distances [][]Distance    `json:"Distances"` // Distance matrix for KNN predictions
-	Classes   []string        `json:"Classes"`   // List of classes for KNN predictions
-	Params    ckks.Parameters `json:"Params"`    // Parameters required for decryption
+	Distances [][]Distance      // Distance matrix for KNN predictions
+	Classes   []string          // List of classes for KNN predictions
+	Params    ckks.Parameters   // Parameters required for decryption
+	Kernel    string            // Distance kernel used to compute the distances
+	Mode      string            // Response mode of the query
+	Votes     []rlwe.Ciphertext // Per query vector in ModeTopK and ModeClassScores, slot c scores Labels[c]
+	Labels    []string          // Distinct labels indexing the vote vectors
+	FrameID   uint64            // Frame and face of the query answered, set on the gRPC stream
+	FaceID    uint64
 }
 
 // KNN struct to represent the K-Nearest Neighbors model
 type KNN struct {
 	Data    [][]float64 // Matrix of data points (features) for KNN
 	Classes []string    // Corresponding classes for each data point
+
+	packs   *packCache // Packed targets, set for models served by a Gallery
+	version uint64     // Version of the gallery, set for models served by a Gallery
+	hash    string     // galleryHash of the model, set for models served by a Gallery
 }
 
-// LoadKNN loads the KNN model from a CSV file.
-// The CSV file should contain features as columns and the class as the last column.
-func LoadKNN(path string) KNN {
+// LoadKNN loads the KNN model from a gallery file, in the format given by its extension (see FormatCSV).
+// A CSV file should contain features as columns and the class as the last column.
+// It returns an error if the file cannot be parsed or fails validateKNN.
+func LoadKNN(path string) (KNN, error) {
 	startTime := time.Now()
 
-	// Open the CSV file
-	file, err := os.Open(path)
+	model, err := readGallery(path)
 	if err != nil {
-		panic(err) // Panic if file can't be opened
+		return KNN{}, err
+	}
+	if err := validateKNN(&model); err != nil {
+		return KNN{}, fmt.Errorf("%s: %v", path, err)
 	}
-	defer file.Close()
 
-	// Initialize the CSV reader
-	reader := csv.NewReader(file)
+	// Log the shape of the KNN model (number of rows and columns) and the time it took to load it
+	slog.Info("Loaded KNN model", "path", path, "rows", len(model.Data), "cols", len(model.Data[0]), "duration", time.Since(startTime))
+
+	// Return the KNN model
+	return model, nil
+}
 
-	var matrix [][]float64
-	var classes []string
+// validateKNN checks that a model can be served: at least one sample, one label per sample,
+// and finite embeddings that fill a block exactly. Shorter embeddings would be packed at their own
+// stride while the blocks are summed over blockSize slots, mixing the distances of neighbouring samples.
+func validateKNN(model *KNN) error {
+	if len(model.Data) == 0 {
+		return fmt.Errorf("gallery is empty")
+	}
+	if len(model.Classes) != len(model.Data) {
+		return fmt.Errorf("gallery has %d samples but %d labels", len(model.Data), len(model.Classes))
+	}
+	dimension := len(model.Data[0])
+	if dimension != blockSize {
+		return fmt.Errorf("gallery embeddings have %d values, expected the block size %d", dimension, blockSize)
+	}
+	for i, row := range model.Data {
+		if len(row) != dimension {
+			return fmt.Errorf("sample %d has %d values, expected %d", i, len(row), dimension)
+		}
+		if model.Classes[i] == "" {
+			return fmt.Errorf("sample %d has an empty label", i)
+		}
+		for j, v := range row {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return fmt.Errorf("sample %d has a non-finite value at index %d", i, j)
+			}
+		}
+		if norm := l2Norm(row); norm > maxNorm*(1+maxNormTolerance) {
+			return fmt.Errorf("sample %d has norm %g, longer than the max norm %g", i, norm, maxNorm)
+		}
+	}
+	return nil
+}
+
+func main() {
+	// Settings from the defaults, the configuration file, the environment and the flags, in that order
+	config, err := LoadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		os.Exit(2)
+	}
+	if err := setupLogging(config.LogFormat); err != nil {
+		fatal("Invalid log format", err)
+	}
+	logConfig(flag.CommandLine)
+	config.Apply()
+
+	if config.TraceFile != "" {
+		if tracer, err = OpenTracer(config.TraceFile, "securesight server"); err != nil {
+			fatal("Failed to create the trace file", err)
+		}
+		slog.Info("Tracing requests", "path", config.TraceFile)
+	}
+
+	var tlsConfig *tls.Config
+	if config.TLS.Enabled() {
+		if tlsConfig, err = config.TLS.Config(); err != nil {
+			fatal("Failed to load the TLS certificates", err)
+		}
+	}
+
+	// Authenticate the API clients listed in the clients file
+	if config.Clients != "" {
+		if authenticator, err = LoadAuthenticator(config.Clients); err != nil {
+			fatal("Failed to load the API clients", err)
+		}
+		slog.Info("Authenticating API clients", "clients", authenticator.Len(), "path", config.Clients)
+	} else {
+		slog.Warn("No clients file given, the API is open to anyone who can reach it")
+	}
 
-	// Read the CSV file line by line
-	for {
-		record, err := reader.Read()
+	// The advertised parameter sets and their bootstrapping parameters are built once,
+	// a broken one is a programming error
+	if _, err := acceptedBootstrapping(); err != nil {
+		fatal("Invalid parameter sets", err)
+	}
+
+	// Start the distance workers, one per usable CPU by default, with a bounded queue of pending jobs
+	scheduler = NewScheduler(config.SchedulerSize())
+	slog.Info("Scheduler started", "workers", scheduler.Workers(), "queue", scheduler.Capacity())
+
+	// Set up the HTTP server to handle requests, with body limits and deadlines per route
+	server, err := NewHTTPServer(config.Listen, tlsConfig)
+	if err != nil {
+		fatal("Failed to set up the HTTP server", err)
+	}
+
+	// Serve the gRPC stream for continuous video recognition
+	stream, err := NewStreamServer(tlsConfig)
+	if err != nil {
+		fatal("Failed to set up the gRPC stream", err)
+	}
+	go func() {
+		slog.Info("gRPC stream is listening", "addr", config.StreamListen, "tls", tlsConfig != nil)
+		if err := ServeStream(stream, config.StreamListen); err != nil {
+			fatal("gRPC stream failed", err)
+		}
+	}()
+
+	// On SIGTERM, stop accepting requests and let the running predictions finish
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		err := shutdownOnSignal(func(ctx context.Context) error {
+			draining.Store(true) // Fail /readyz so that load balancers stop sending requests
+			streamStopped := make(chan struct{})
+			go func() {
+				StopStream(ctx, stream)
+				close(streamStopped)
+			}()
+			err := server.Shutdown(ctx)
+			<-streamStopped
+			return err
+		})
 		if err != nil {
-			break // Break the loop when the file ends or on error
+			slog.Warn("Shutdown timed out, closing the remaining connections", "err", err)
+			server.Close()
 		}
-		var row []float64
+	}()
 
-		// Convert each feature in the record to a float and append it to the row
-		for i := 0; i < len(record)-1; i++ {
-			f, err := strconv.ParseFloat(record[i], 64)
-			if err != nil {
-				panic(err) // Panic if a feature can't be parsed as a float
-			}
-			row = append(row, f)
+	// Start the server and listen for requests, with the certificates already in tlsConfig.
+	// It answers /healthz and /readyz while the gallery loads, and the API once it is ready.
+	served := make(chan error, 1)
+	go func() {
+		slog.Info("Server is listening", "addr", server.Addr, "tls", tlsConfig != nil)
+		if tlsConfig != nil {
+			served <- server.ListenAndServeTLS("", "")
+		} else {
+			served <- server.ListenAndServe()
 		}
-		matrix = append(matrix, row) // Add the row of features to the data matrix
-		class := record[len(record)-1]
-		classes = append(classes, class) // Add the class (last column) to the classes list
+	}()
+
+	// Load the KNN model from the gallery file, which also receives the changes made through the API
+	knn, err := LoadKNN(config.Gallery.Path)
+	if err != nil {
+		fatal("Failed to load the gallery", err) // The server cannot answer queries without a gallery
 	}
 
-	// Print out the shape of the KNN model (number of rows and columns)
-	rows := len(matrix)
-	cols := len(matrix[0])
-	fmt.Printf("KNN model shape: %d x %d\n", rows, cols)
+	// The gallery is packed for every parameter set before the first query, then reported ready
+	if gallery, err = NewGallery(config.Gallery.Path, knn); err != nil {
+		fatal("Failed to pack the gallery", err)
+	}
+	galleryReady.Store(true)
+	slog.Info("Server is ready", "gallery", gallery.Name(), "version", gallery.Model().version)
 
-	// Calculate and print the time it took to load the model
-	elapsedTime := time.Since(startTime)
-	fmt.Println("Total time loading model: ", elapsedTime.Milliseconds())
+	// Pick up replacements of the gallery file, polled every few seconds or signalled with SIGHUP
+	go gallery.Watch(config.Gallery.WatchInterval)
 
-	// Return the KNN model
-	return KNN{
-		Data:    matrix,
-		Classes: classes,
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		fatal("Server failed", err) // Log error and terminate if the server fails to start
+	}
+	<-drained
+	if err := tracer.Close(); err != nil {
+		slog.Error("Failed to close the trace file", "err", err)
 	}
+	slog.Info("Server stopped")
 }
 
-func main() {
-	// Load the KNN model from the specified CSV file
-	model = LoadKNN("../weights/knn.csv")
+// sessionsHandler registers the evaluation keys of a client once so that
+// subsequent queries only need to carry the ciphertexts and the session ID.
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	timer := newStageTimer(r.Context(), "sessions")
+	logger := requestLogger(r.Context())
+
+	// Check if the request method is POST, return error if not
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	// Set up the HTTP server to handle requests
-	http.HandleFunc("/api/knn", knnHandler)
+	// Read the request body, up to the limit of the route
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	timer.Stage("receive")
+	requestBytes.WithLabelValues("sessions").Observe(float64(len(body)))
 
-	// Start the server and listen for requests on port 8080
-	fmt.Println("Server is listening on port 8080...")
-	err := http.ListenAndServe(":8080", nil)
+	// Deserialize the keys and store them under a new session ID
+	var req SessionRequest
+	format, err := readRequest(r, body, MsgSessionRequest, &req)
+	timer.Stage("deserialize")
 	if err != nil {
-		log.Fatal(err) // Log error and terminate if the server fails to start
+		logger.Info("Rejected session", "err", err, timer.Attr())
+		if !writeValidationError(w, err) {
+			http.Error(w, fmt.Sprintf("failed to deserialize struct: %v", err), http.StatusBadRequest)
+		}
+		return
 	}
+	session, err := sessions.Create(req, ClientIdentity(r.Context()), RequestClient(r.Context()), r.RemoteAddr)
+	if err != nil {
+		logger.Info("Rejected session", "err", err, timer.Attr())
+	}
+	if writeValidationError(w, err) {
+		return
+	}
+	if errors.Is(err, ErrTooManySessions) {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to create session: %v", err), http.StatusInternalServerError)
+		return
+	}
+	timer.Stage("register")
+
+	size := writeResponse(w, format, MsgSessionResponse, SessionResponse{SessionID: session.ID})
+	timer.Stage("serialize")
+	responseBytes.WithLabelValues("sessions").Observe(float64(size))
+
+	// Log the registration and the number of live sessions
+	logger.Info("Registered session", "session", session.ID, "client", session.Owner, "identity", session.Client,
+		"parameter_set", session.ParameterSet, "active", sessions.Len(), "key_bytes", len(body), timer.Attr())
 }
 
 // knnHandler handles incoming HTTP requests for KNN predictions.
-// It expects POST requests containing encrypted data for prediction.
+// It expects POST requests containing the encrypted queries and the ID of a registered session.
 func knnHandler(w http.ResponseWriter, r *http.Request) {
-	startTime := time.Now()
-
-	// Print the start of request processing
-	fmt.Println(strings.Repeat("-", 20) + "\nProcessing request...\n" + strings.Repeat("-", 20))
+	timer := newStageTimer(r.Context(), "knn")
+	logger := requestLogger(r.Context())
 
 	// Check if the request method is POST, return error if not
 	if r.Method != "POST" {
@@ -114,42 +291,175 @@ func knnHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Read the request body
-	body, err := ioutil.ReadAll(r.Body)
+	// Read the request body, up to the limit of the route
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	timer.Stage("receive")
+	requestBytes.WithLabelValues("knn").Observe(float64(len(body)))
+
+	// Deserialize the request body into the QueryRequest object, framed, as JSON or as gob
+	var query QueryRequest
+	format, err := readRequest(r, body, MsgQueryRequest, &query)
+	timer.Stage("deserialize")
 	if err != nil {
-		http.Error(w, "failed to read body", http.StatusInternalServerError)
+		logger.Info("Rejected query", "err", err, timer.Attr())
+		if !writeValidationError(w, err) {
+			http.Error(w, fmt.Sprintf("failed to deserialize struct: %v", err), http.StatusBadRequest)
+		}
+		return
+	}
+	logger = logger.With("session", query.SessionID, "queries", len(query.Query))
+
+	// Check the query against the keys of its session
+	pc, err := prepareQuery(r.Context(), query, RequestClient(r.Context()), r.RemoteAddr)
+	timer.Stage("prepare")
+	if err != nil {
+		logger.Info("Rejected query", "err", err, timer.Attr())
+		if !writeValidationError(w, err) && !writeQuotaError(w, err) {
+			http.Error(w, err.Error(), queryStatus(err))
+		}
 		return
 	}
+	queriesPerRequest.WithLabelValues("knn").Observe(float64(len(query.Query)))
 
-	// Deserialize the request body into the PublicContext object
-	context, err = DeserializeObject(body)
+	// Perform the encrypted KNN prediction.
+	// The request context is cancelled when the client disconnects, which stops the CKKS work.
+	response, err := evaluateQuery(timer.Context(r.Context()), &pc)
+	timer.Stage("predict")
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to deserialize struct: %v", err), http.StatusBadRequest)
+		if r.Context().Err() != nil {
+			logger.Info("Query cancelled by client", "err", err, timer.Attr())
+			return
+		}
+		logger.Error("Failed to evaluate query", "err", err, timer.Attr())
+		http.Error(w, fmt.Sprintf("failed to evaluate queries: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Perform the encrypted KNN prediction using the model and context
-	res, params := PredictEncrypted(&model, &context)
+	// Serialize the response in the encoding of the request and write it back to the client
+	size := writeResponse(w, format, MsgQueryResponse, response)
+	timer.Stage("serialize")
+	responseBytes.WithLabelValues("knn").Observe(float64(size))
 
-	// Prepare the response with distances, classes, and decryption parameters
-	response := Response{
-		Distances: res,           // Predicted distances for KNN
-		Classes:   model.Classes, // Classes from the KNN model
-		Params:    params,        // Parameters needed to decrypt the result
+	// Log the time taken by each stage of the request
+	logger.Info("Answered query", "mode", pc.Mode, "kernel", pc.Kernel, "response_bytes", size,
+		"queue_depth", scheduler.QueueDepth(), timer.Attr())
+}
+
+// queryError is an error caused by the query itself, reported with an HTTP status.
+type queryError struct {
+	status int
+	err    error
+}
+
+func (e *queryError) Error() string {
+	return e.err.Error()
+}
+
+// queryStatus returns the HTTP status of an error returned by decoding or preparing a query.
+func queryStatus(err error) int {
+	var qe *queryError
+	if errors.As(err, &qe) {
+		return qe.status
+	}
+	var invalid *ValidationError
+	if errors.As(err, &invalid) {
+		return invalid.Status
+	}
+	if errors.Is(err, ErrQuotaExceeded) {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// prepareQuery checks that client may search the gallery, looks up the session of a query,
+// resolves its kernel and mode, checks that the session registered the keys they need and that
+// the ciphertexts have the levels they consume, and charges the query to the quota of the client, or of its remote address when anonymous.
+func prepareQuery(ctx context.Context, query QueryRequest, client *APIClient, remote string) (PublicContext, error) {
+	badRequest := func(err error) (PublicContext, error) {
+		return PublicContext{}, &queryError{status: http.StatusBadRequest, err: err}
+	}
+
+	if name := gallery.Name(); !client.CanSearch(name) {
+		return PublicContext{}, &queryError{status: http.StatusForbidden, err: fmt.Errorf("%w: client %q may not search gallery %q", ErrForbidden, client.Name, name)}
 	}
 
-	// Serialize the response object into bytes
-	serializedResponse, err := SerializeObject(response)
+	// Look up the evaluation keys registered for this session, which only its owner may use
+	session, err := sessions.Get(query.SessionID)
+	if err == nil && session.Owner != client.Name {
+		err = ErrUnknownSession
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to serialize response: %v", err), http.StatusInternalServerError)
-		return
+		return PublicContext{}, &queryError{status: http.StatusNotFound, err: err}
+	}
+
+	// Resolve the distance kernel selected by the client
+	kernel, err := resolveKernel(query.Kernel, session)
+	if err != nil {
+		return badRequest(err)
+	}
+
+	// Server-side summation needs the rotation keys of the inner sum
+	if query.SumSlots {
+		if err := checkGaloisKeys(&session.Evk, SummationGaloisElements(session.Params)); err != nil {
+			return badRequest(err)
+		}
+	}
+	pc := session.NewPublicContext(kernel, query.SumSlots, query.Query)
+
+	// The top-k and class-score modes reduce the summed distances to one value per class,
+	// which needs more rotations, and bootstrapping for top-k
+	switch query.Mode {
+	case "", ModeDistances:
+		pc.Mode = ModeDistances
+	case ModeTopK:
+		if err := checkTopK(query, session); err != nil {
+			return badRequest(err)
+		}
+		pc.Mode, pc.K, pc.SumSlots = ModeTopK, query.K, true
+	case ModeClassScores:
+		if err := checkClassScores(session); err != nil {
+			return badRequest(err)
+		}
+		pc.Mode, pc.SumSlots = ModeClassScores, true
+	default:
+		return badRequest(fmt.Errorf("unknown mode %q", query.Mode))
+	}
+
+	// The ciphertexts must have been encrypted under the parameters registered for the session,
+	// with enough levels left for the kernel and the mode
+	if err := checkQueryCiphertexts(query.Query, session, minQueryLevel(&pc)); err != nil {
+		return PublicContext{}, err
 	}
 
-	// Set the response content type and write the serialized response back to the client
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Write(serializedResponse)
+	// Only queries that would run are charged to the quota of the client
+	if err := quotas.Charge(client, remote, len(query.Query)); err != nil {
+		auditQuotaRefusal(ctx, err, client, session, remote, len(query.Query))
+		return PublicContext{}, err
+	}
+	return pc, nil
+}
 
-	// Log the time taken to process the request
-	elapsedTime := time.Since(startTime)
-	fmt.Println("Total time processing request: ", elapsedTime.Milliseconds())
+// evaluateQuery runs a prepared query on the current gallery.
+// The query keeps using this snapshot of the gallery even if it changes meanwhile.
+func evaluateQuery(ctx context.Context, pc *PublicContext) (Response, error) {
+	model := gallery.Model()
+	response := Response{
+		Kernel: pc.Kernel, // Kernel the client must account for when decrypting
+		Mode:   pc.Mode,
+	}
+
+	var err error
+	switch pc.Mode {
+	case ModeTopK:
+		response.Votes, response.Labels, response.Params, err = PredictVotes(ctx, model, pc)
+	case ModeClassScores:
+		response.Votes, response.Labels, response.Params, err = PredictScores(ctx, model, pc)
+	default:
+		response.Distances, response.Params, err = PredictEncrypted(ctx, model, pc)
+		response.Classes = model.Classes
+	}
+	return response, err
 }
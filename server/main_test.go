@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestValidateKNN(t *testing.T) {
+	valid := func(edit func(*KNN)) *KNN {
+		model := testGallery(1, 3, "alice", "bob")
+		edit(model)
+		return model
+	}
+
+	tests := []struct {
+		name  string
+		model *KNN
+		err   string
+	}{
+		{"valid", valid(func(*KNN) {}), ""},
+		{"empty", &KNN{}, "gallery is empty"},
+		{"missing labels", valid(func(m *KNN) { m.Classes = m.Classes[:2] }), "3 samples but 2 labels"},
+		{"shorter than a block", valid(func(m *KNN) {
+			for i := range m.Data {
+				m.Data[i] = m.Data[i][:blockSize/2]
+			}
+		}), "expected the block size"},
+		{"longer than a block", valid(func(m *KNN) {
+			for i := range m.Data {
+				m.Data[i] = append(m.Data[i], 0)
+			}
+		}), "expected the block size"},
+		{"ragged", valid(func(m *KNN) { m.Data[2] = m.Data[2][:blockSize-1] }), "sample 2 has"},
+		{"empty label", valid(func(m *KNN) { m.Classes[1] = "" }), "sample 1 has an empty label"},
+		{"not a number", valid(func(m *KNN) { m.Data[1][7] = math.NaN() }), "non-finite value at index 7"},
+		{"infinite", valid(func(m *KNN) { m.Data[0][0] = math.Inf(-1) }), "non-finite value at index 0"},
+		{"longer than the max norm", valid(func(m *KNN) { m.Data[2][3] = 2 }), "sample 2 has norm"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateKNN(test.model)
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+)
+
+// Prometheus metrics, served on /metrics
+//
+// The route label is "sessions" or "knn" for the HTTP API and "stream" for the gRPC stream.
+// The stages of a query are "receive" (reading the body), "deserialize" (decoding and validating
+// it), "prepare" (checking it against its session and charging the quota), "predict"
+// (PredictEncrypted, PredictVotes or PredictScores, waiting for workers included) and
+// "serialize" (encoding and writing the response). Sessions go through "register" instead of
+// "prepare" and "predict". The queries of the stream are received apart and have no "receive" stage.
+// The same stages are logged with each request, see stageTimer.
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "securesight_requests_total",
+		Help: "Requests handled, by route and HTTP status.",
+	}, []string{"route", "status"})
+
+	stageSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "securesight_stage_duration_seconds",
+		Help: "Time spent in each stage of a request.",
+		// From a few milliseconds to decode a query up to minutes of bootstrapping in the top-k mode
+		Buckets: prometheus.ExponentialBuckets(0.005, 2.5, 12),
+	}, []string{"route", "stage"})
+
+	queriesPerRequest = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "securesight_queries_per_request",
+		Help:    "Query ciphertexts, one per face, carried by a request.",
+		Buckets: []float64{1, 2, 4, 8, 16, 32, 64},
+	}, []string{"route"})
+
+	packsPerQuery = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "securesight_packs_per_query",
+		Help:    "Packed gallery ciphertexts each query ciphertext is compared with.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	})
+
+	requestBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "securesight_request_bytes",
+		Help: "Size of the request bodies, evaluation keys or query ciphertexts.",
+		// From a single ciphertext to the bootstrapping keys
+		Buckets: prometheus.ExponentialBuckets(64<<10, 4, 10),
+	}, []string{"route"})
+
+	responseBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "securesight_response_bytes",
+		Help:    "Size of the response bodies.",
+		Buckets: prometheus.ExponentialBuckets(1<<10, 4, 12),
+	}, []string{"route"})
+
+	inFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "securesight_in_flight_requests",
+		Help: "Requests, or queries of the stream, being handled.",
+	}, []string{"route"})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "securesight_gallery_samples",
+		Help: "Embeddings in the gallery.",
+	}, func() float64 {
+		if !galleryReady.Load() {
+			return 0
+		}
+		return float64(len(gallery.Model().Data))
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "securesight_gallery_identities",
+		Help: "Distinct labels in the gallery.",
+	}, func() float64 {
+		if !galleryReady.Load() {
+			return 0
+		}
+		return float64(len(gallery.Identities().Identities))
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "securesight_sessions",
+		Help: "Registered sessions that have not expired.",
+	}, func() float64 {
+		return float64(sessions.Len())
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "securesight_scheduler_queue_depth",
+		Help: "Distance jobs waiting for a worker.",
+	}, func() float64 {
+		if scheduler == nil {
+			return 0
+		}
+		return float64(scheduler.QueueDepth())
+	})
+)
+
+// statusRecorder remembers the status written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the connection, to set the deadlines of limitRoute.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrumentRoute counts the requests of handler by status and tracks those in flight.
+func instrumentRoute(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		gauge := inFlight.WithLabelValues(route)
+		gauge.Inc()
+		defer gauge.Dec()
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(recorder, r)
+		requestsTotal.WithLabelValues(route, strconv.Itoa(recorder.status)).Inc()
+	}
+}
+
+// metricsHandler serves the metrics of the server and of the Go runtime, goroutines included.
+var metricsHandler = promhttp.Handler()
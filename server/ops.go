@@ -2,153 +2,176 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"fmt"
+	"github.com/tuneinsight/lattigo/v6/circuits/ckks/bootstrapping"
 	"github.com/tuneinsight/lattigo/v6/core/rlwe"
 	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
-	"sort"
 	"sync"
 )
 
+// Number of slots holding one embedding in a packed ciphertext, set by Config.Apply
+var blockSize = 512
+
+// Longest L2 norm of the gallery embeddings and of the queries, set by Config.Apply. The top-k and
+// class-score modes derive the range of the distances from it, and clients scale longer queries down to it.
+var maxNorm = 1.0
+
+// Relative excess over maxNorm accepted from embeddings normalized in single precision
+const maxNormTolerance = 1e-6
+
 // Server side CKKS context
 type PublicContext struct {
-	Params ckks.Parameters          // CKKS parameters
-	Rlk    rlwe.RelinearizationKey  // Relinearization key for homomorphic multiplication
-	Evk    rlwe.MemEvaluationKeySet // Memory-based evaluation keys for homomorphic operations
-	Query  []rlwe.Ciphertext        // List of encrypted query vectors
+	Params    ckks.Parameters          // CKKS parameters
+	Rlk       rlwe.RelinearizationKey  // Relinearization key for homomorphic multiplication
+	Evk       rlwe.MemEvaluationKeySet // Memory-based evaluation keys for homomorphic operations
+	Evaluator *ckks.Evaluator          // Evaluator built once per session from Params and Evk
+	Kernel    string                   // Distance kernel selected by the query
+	SumSlots  bool                     // Sum each block and merge the packs on the server
+	Mode      string                   // Response mode selected by the query
+	K         int                      // Number of neighbours voting in ModeTopK
+
+	Bootstrapper *bootstrapping.Evaluator // Bootstrapper of the session, nil if it registered no bootstrapping keys
+	Query        []rlwe.Ciphertext        // List of encrypted query vectors
 }
 
 // Distance of KNN datapoint
 type Distance struct {
-	Distance rlwe.Ciphertext // Distance from a given target example
-	Classes  []string        // Class of the given target example
-}
-
-type QueryResult struct {
-	Distances []Distance
-	QueryNum  int
+	Distance  rlwe.Ciphertext // Distance from a given target example
+	Classes   []string        // Class of the given target example
+	PackSizes []int           // Targets per merged pack when the slots were summed on the server, empty otherwise
 }
 
 type PackedTarget struct {
-	Vec     []float64
-	Classes []string
+	Vec       []float64 // Concatenated target vectors
+	ScaledVec []float64 // Vec multiplied by -2, used by the inner-product kernel
+	Norms     []float64 // Squared norm of each target in the first slot of its block, zero elsewhere
+	Mask      []float64 // One in the first slot of each block holding a target, zero elsewhere
+	Classes   []string
 }
 
 // PredictEncrypted calculates the Euclidean distance of encrypted queries in CKKS FHE for a KNN model
-// It performs the calculation concurrently for multiple queries and multiple KNN data points.
-func PredictEncrypted(knnModel *KNN, context *PublicContext) ([][]Distance, ckks.Parameters) {
-	// Initialize evaluator from server-side context for FHE operations
-	evaluator := ckks.NewEvaluator(context.Params, &context.Evk)
+// It processes the queries concurrently and hands every query/target pair to the worker pool.
+// The computation stops early and returns ctx.Err() once ctx is cancelled, and the first
+// evaluation error cancels the remaining work.
+func PredictEncrypted(ctx context.Context, knnModel *KNN, pc *PublicContext) ([][]Distance, ckks.Parameters, error) {
+	// Use the evaluator of the session, or build one for a standalone context
+	evaluator := pc.Evaluator
+	if evaluator == nil {
+		evaluator = ckks.NewEvaluator(pc.Params, &pc.Evk)
+	}
 
-	// Channel for collecting results from goroutines
-	resultChannel := make(chan QueryResult, len(context.Query))
+	// Derive a context so that the first failure stops all other work
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Record the first error and cancel the remaining work
+	errChannel := make(chan error, 1)
+	fail := func(err error) {
+		select {
+		case errChannel <- err:
+			cancel()
+		default:
+		}
+	}
 
-	maxRepeat := int(context.Params.MaxSlots()) / 512
-	batches := batchTargets(knnModel.Data, maxRepeat)
-	packs := packTargets(batches, knnModel.Classes)
+	maxRepeat := int(pc.Params.MaxSlots()) / blockSize
+	packs := knnModel.Packs(maxRepeat)
+	for range pc.Query {
+		packsPerQuery.Observe(float64(len(packs)))
+	}
+
+	// Results are written in place, indexed by query
+	results := make([][]Distance, len(pc.Query))
 
 	// WaitGroup to manage concurrent execution of query processing
 	var wg sync.WaitGroup
 
 	// Process each encrypted query concurrently
-	for queryIdx, ciphertext := range context.Query {
+	for queryIdx := range pc.Query {
 		wg.Add(1)
-		go processQuery(ciphertext, queryIdx, packs, *evaluator.ShallowCopy(), resultChannel, &wg)
+		go func(queryIdx int) {
+			defer wg.Done()
+			distances, err := processQuery(ctx, pc, &pc.Query[queryIdx], packs, evaluator)
+			if err != nil {
+				fail(err)
+				return
+			}
+			results[queryIdx] = distances
+		}(queryIdx)
 	}
 
 	// Wait for all query processing goroutines to finish
 	wg.Wait()
 
-	// Close the result channel after all queries are processed
-	close(resultChannel)
+	// Report the first evaluation error, or the cancellation of the caller
+	select {
+	case err := <-errChannel:
+		return nil, pc.Params, err
+	default:
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, pc.Params, err
+	}
 
-	// Collect the results and sort by query index
-	return collectAndSortResults(resultChannel), context.Params
+	return results, pc.Params, nil
 }
 
 // processQuery calculates the Euclidean distance for a single query against all KNN data points.
-// It runs in a separate goroutine for each query.
-func processQuery(ciphertext rlwe.Ciphertext, queryIdx int, packs []PackedTarget, evaluator ckks.Evaluator, resultChannel chan<- QueryResult, wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	// Channel for collecting distances of the current query from each target in the KNN model
-	innerResultChannel := make(chan Distance, len(packs))
-	var innerWg sync.WaitGroup
-
-	// Process each target in the KNN model concurrently
-	for _, pack := range packs {
-		innerWg.Add(1)
-		go processTarget(ciphertext, pack, *evaluator.ShallowCopy(), innerResultChannel, &innerWg)
-	}
-
-	// Wait for all target distance calculations to finish
-	innerWg.Wait()
-
-	// Close the inner result channel after all targets have been processed
-	close(innerResultChannel)
-
-	// Collect the distances for the current query
-	var distances []Distance
-	for dist := range innerResultChannel {
-		distances = append(distances, dist)
+// Each packed target becomes one job of the scheduler; the call returns once all of them are done.
+// When the slots are summed on the server, the per-pack results are then merged in one more job.
+func processQuery(ctx context.Context, pc *PublicContext, ciphertext *rlwe.Ciphertext, packs []PackedTarget, evaluator *ckks.Evaluator) ([]Distance, error) {
+	// The queries of a request run at the same time, each on a track of its own in the trace
+	ctx, span := StartParallelSpan(ctx, "processQuery", "packs", len(packs), "level", ciphertext.Level(), "kernel", pc.Kernel)
+	defer span.End()
+
+	distances := make([]Distance, len(packs))
+
+	err := scheduler.Run(ctx, evaluator, ciphertext.Level(), len(packs), func(i int, evaluator *ckks.Evaluator, buffer *rlwe.Ciphertext) (err error) {
+		distances[i], err = processTarget(ciphertext, &packs[i], pc.Kernel, pc.SumSlots, evaluator, buffer)
+		return err
+	})
+	if err != nil || !pc.SumSlots {
+		return distances, err
 	}
 
-	// Send the result for the current query into the main result channel
-	resultChannel <- QueryResult{
-		QueryNum:  queryIdx,
-		Distances: distances,
-	}
+	// Fold the summed distances of all packs into as few ciphertexts as possible
+	var merged []Distance
+	err = scheduler.Run(ctx, evaluator, ciphertext.Level(), 1, func(_ int, evaluator *ckks.Evaluator, _ *rlwe.Ciphertext) (err error) {
+		merged, err = mergeDistances(distances, evaluator)
+		return err
+	})
+	return merged, err
 }
 
-// processTarget computes the squared Euclidean distance for a single target and a query.
-// It is executed concurrently for each target in the KNN model.
-func processTarget(ciphertext rlwe.Ciphertext, pack PackedTarget, evaluator ckks.Evaluator, resultChannel chan<- Distance, wg *sync.WaitGroup) {
-
-	defer wg.Done()
-
-	// Compute the difference between the query and the target
-	diff, err := evaluator.SubNew(&ciphertext, pack.Vec)
-	if err != nil {
-		panic(err)
+// processTarget computes the distance between a query and a packed target with the selected kernel.
+// It is executed by a scheduler worker, which provides its own evaluator and a buffer for intermediate results.
+func processTarget(ciphertext *rlwe.Ciphertext, pack *PackedTarget, kernel string, sumSlots bool, evaluator *ckks.Evaluator, buffer *rlwe.Ciphertext) (Distance, error) {
+	var distance *rlwe.Ciphertext
+	var err error
+
+	switch kernel {
+	case KernelInnerProduct:
+		distance, err = innerProduct(ciphertext, pack, evaluator)
+	default:
+		distance, err = squaredDifference(ciphertext, pack, evaluator, buffer)
 	}
-
-	// Square the difference (compute the squared Euclidean distance)
-	squaredDiff, err := evaluator.MulRelinNew(diff, diff)
 	if err != nil {
-		panic(err)
+		return Distance{}, err
 	}
 
-	// Rescale again after squaring to keep the ciphertext manageable
-	if err := evaluator.Rescale(squaredDiff, squaredDiff); err != nil {
-		panic(err)
+	// Reduce each block to a single slot holding the distance
+	if sumSlots {
+		if err := sumBlocks(distance, pack, evaluator); err != nil {
+			return Distance{}, err
+		}
 	}
 
-	// Send the result to the result channel (using squaredDiff as the final distance)
-	resultChannel <- Distance{
-		Distance: *squaredDiff, // You might want to send squaredDiff as the distance, not diff
+	return Distance{
+		Distance: *distance,
 		Classes:  pack.Classes,
-	}
-}
-
-// collectAndSortResults collects results from the result channel and sorts them by query index.
-func collectAndSortResults(resultChannel <-chan QueryResult) [][]Distance {
-	// Collect all results into a slice
-	var unsortedResults []QueryResult
-	for result := range resultChannel {
-		unsortedResults = append(unsortedResults, result)
-	}
-
-	// Sort the results by query index (QueryNum)
-	sort.Slice(unsortedResults, func(i, j int) bool {
-		return unsortedResults[i].QueryNum < unsortedResults[j].QueryNum
-	})
-
-	// Extract and return the sorted distances for each query
-	var sortedResults [][]Distance
-	for _, result := range unsortedResults {
-		sortedResults = append(sortedResults, result.Distances)
-	}
-	return sortedResults
+	}, nil
 }
 
 func SerializeObject(obj interface{}) ([]byte, error) {
@@ -161,15 +184,13 @@ func SerializeObject(obj interface{}) ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
-// Function to deserialize the object
-func DeserializeObject(data []byte) (PublicContext, error) {
-	var obj PublicContext
+// DeserializeObject decodes gob data into the object pointed to by obj
+func DeserializeObject(data []byte, obj interface{}) error {
 	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&obj)
-	if err != nil {
-		panic(err)
+	if err := decoder.Decode(obj); err != nil {
+		return fmt.Errorf("Failed to deserialize object: %v", err)
 	}
-	return obj, nil
+	return nil
 }
 
 func batchTargets(targets [][]float64, n int) [][][]float64 {
@@ -190,16 +211,34 @@ func packTargets(batches [][][]float64, classes []string) []PackedTarget {
 	var packs []PackedTarget
 	targetIdx := 0
 	for _, batch := range batches {
-		var concatenated []float64
+		var concatenated, scaled, norms, mask []float64
 		var packClasses []string
 		for _, vec := range batch {
 			concatenated = append(concatenated, vec...)
 			packClasses = append(packClasses, classes[targetIdx])
 			targetIdx++
+
+			// Precompute -2·t and ||t||² for the inner-product kernel
+			block := make([]float64, len(vec))
+			var norm float64
+			for _, v := range vec {
+				scaled = append(scaled, -2*v)
+				norm += v * v
+			}
+			block[0] = norm
+			norms = append(norms, block...)
+
+			// Select the slot holding the sum of the block
+			block = make([]float64, len(vec))
+			block[0] = 1
+			mask = append(mask, block...)
 		}
 		packedTarget := PackedTarget{
-			Vec:     concatenated,
-			Classes: packClasses,
+			Vec:       concatenated,
+			ScaledVec: scaled,
+			Norms:     norms,
+			Mask:      mask,
+			Classes:   packClasses,
 		}
 		packs = append(packs, packedTarget)
 	}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+	"math"
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+// decrypt returns the real parts of the slots of ct.
+func (k *testKeys) decrypt(t testing.TB, ct *rlwe.Ciphertext) []float64 {
+	t.Helper()
+	values := make([]float64, k.params.MaxSlots())
+	if err := k.encoder.Decode(rlwe.NewDecryptor(k.params, k.sk).DecryptNew(ct), values); err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+// startTestScheduler starts the worker pool used by PredictEncrypted, once for all tests.
+func startTestScheduler() {
+	if scheduler == nil {
+		scheduler = NewScheduler(runtime.NumCPU(), 64)
+	}
+}
+
+// testGallery returns n random embeddings of blockSize values drawn from seed, labelled in turn with labels.
+func testGallery(seed int64, n int, labels ...string) *KNN {
+	r := rand.New(rand.NewSource(seed))
+	model := &KNN{}
+	for i := 0; i < n; i++ {
+		vec := make([]float64, blockSize)
+		for j := range vec {
+			vec[j] = (r.Float64() - 0.5) / 8
+		}
+		model.Data = append(model.Data, vec)
+		model.Classes = append(model.Classes, labels[i%len(labels)])
+	}
+	return model
+}
+
+// replicate returns the embedding repeated in every block of the slots, as the client encrypts it.
+func replicate(params ckks.Parameters, vec []float64) []float64 {
+	var values []float64
+	for len(values)+len(vec) <= params.MaxSlots() {
+		values = append(values, vec...)
+	}
+	return values
+}
+
+// squaredDistance returns ||q - t||².
+func squaredDistance(q, t []float64) float64 {
+	var d float64
+	for i := range q {
+		d += (q[i] - t[i]) * (q[i] - t[i])
+	}
+	return d
+}
+
+func TestPredictEncrypted(t *testing.T) {
+	startTestScheduler()
+	keys := newTestKeys(t)
+	evk := rlwe.NewMemEvaluationKeySet(keys.kgen.GenRelinearizationKeyNew(keys.sk))
+	model := testGallery(1, 20, "alice", "bob", "carol")
+	query := testGallery(2, 1, "query").Data[0]
+
+	var queryNorm float64
+	for _, v := range query {
+		queryNorm += v * v
+	}
+
+	tests := []struct {
+		name   string
+		kernel string
+		offset float64 // Added by the client to the sum of a block, ||q||² for the inner-product kernel
+	}{
+		{"squared difference", KernelSquaredDifference, 0},
+		{"inner product", KernelInnerProduct, queryNorm},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pc := &PublicContext{
+				Params:    keys.params,
+				Evk:       *evk,
+				Evaluator: ckks.NewEvaluator(keys.params, evk),
+				Kernel:    test.kernel,
+				Query:     []rlwe.Ciphertext{*keys.encrypt(t, replicate(keys.params, query)), *keys.encrypt(t, replicate(keys.params, model.Data[7]))},
+			}
+			distances, _, err := PredictEncrypted(context.Background(), model, pc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(distances) != 2 || len(distances[0]) != 2 {
+				t.Fatalf("got %d queries of %d packs, expected 2 queries of 2 packs", len(distances), len(distances[0]))
+			}
+
+			// Sum the blocks of the first query as the client does
+			var target int
+			for _, pack := range distances[0] {
+				values := keys.decrypt(t, &pack.Distance)
+				for x, class := range pack.Classes {
+					var sum float64
+					for _, v := range values[x*blockSize : (x+1)*blockSize] {
+						sum += v
+					}
+					expected := squaredDistance(query, model.Data[target])
+					if math.Abs(sum+test.offset-expected) > 1e-3 || class != model.Classes[target] {
+						t.Errorf("target %d of class %q at %f, expected %q at %f", target, class, sum+test.offset, model.Classes[target], expected)
+					}
+					target++
+				}
+			}
+			if target != len(model.Data) {
+				t.Errorf("got %d targets, expected %d", target, len(model.Data))
+			}
+		})
+	}
+}
+
+func TestPredictEncryptedCancelled(t *testing.T) {
+	startTestScheduler()
+	keys := newTestKeys(t)
+	pc := &PublicContext{
+		Params: keys.params,
+		Kernel: KernelInnerProduct,
+		Query:  []rlwe.Ciphertext{*keys.encrypt(t, []float64{1})},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := PredictEncrypted(ctx, testGallery(1, 40, "alice"), pc); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, expected context.Canceled", err)
+	}
+}
+
+func TestPackTargets(t *testing.T) {
+	tests := []struct {
+		targets int
+		repeat  int
+		sizes   []int
+	}{
+		{1, 16, []int{1}},
+		{16, 16, []int{16}},
+		{20, 16, []int{16, 4}},
+		{5, 2, []int{2, 2, 1}},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%d by %d", test.targets, test.repeat), func(t *testing.T) {
+			model := testGallery(1, test.targets, "alice", "bob")
+			packs := packTargets(batchTargets(model.Data, test.repeat), model.Classes)
+			if len(packs) != len(test.sizes) {
+				t.Fatalf("got %d packs, expected %d", len(packs), len(test.sizes))
+			}
+			target := 0
+			for i, pack := range packs {
+				n := test.sizes[i]
+				if len(pack.Classes) != n || len(pack.Vec) != n*blockSize || len(pack.ScaledVec) != n*blockSize ||
+					len(pack.Norms) != n*blockSize || len(pack.Mask) != n*blockSize {
+					t.Fatalf("pack %d has %d classes and %d slots, expected %d targets", i, len(pack.Classes), len(pack.Vec), n)
+				}
+				for x := 0; x < n; x++ {
+					block := x * blockSize
+					if pack.Classes[x] != model.Classes[target] || pack.Vec[block+1] != model.Data[target][1] ||
+						pack.ScaledVec[block+1] != -2*model.Data[target][1] || pack.Mask[block] != 1 || pack.Mask[block+1] != 0 ||
+						math.Abs(pack.Norms[block]-squaredDistance(model.Data[target], make([]float64, blockSize))) > 1e-12 {
+						t.Errorf("target %d of pack %d is not packed as target %d", x, i, target)
+					}
+					target++
+				}
+			}
+		})
+	}
+}
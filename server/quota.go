@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Query quotas
+//
+// Every query reveals the distances, votes or scores of one embedding against the whole gallery,
+// so a client sending many of them can probe the gallery and reconstruct its templates. Each
+// authenticated client, or each remote address when the API is open, gets a token bucket refilling
+// Rate ciphertexts per second up to Burst, and a budget of ciphertexts per UTC day. A query
+// is charged one unit per ciphertext once it passed every other check, before PredictEncrypted runs.
+// Anonymous clients are not charged per session, which they could create at will to start over;
+// IPv6 addresses are grouped by /64, the smallest prefix usually handed to one host.
+
+// ErrQuotaExceeded is wrapped by the QuotaError of queries refused by the quotas.
+var ErrQuotaExceeded = errors.New("query quota exceeded")
+
+// QuotaPolicy bounds the query ciphertexts of one client. Zero values turn the matching limit off.
+type QuotaPolicy struct {
+	Rate        float64 `json:"Rate" yaml:"rate"`                // Ciphertexts per second refilled into the bucket
+	Burst       int     `json:"Burst" yaml:"burst"`              // Size of the bucket, the largest query accepted at once
+	DailyBudget int     `json:"DailyBudget" yaml:"daily-budget"` // Ciphertexts per UTC day
+}
+
+// Validate checks that a policy can accept queries.
+func (p QuotaPolicy) Validate() error {
+	switch {
+	case p.Rate < 0 || math.IsNaN(p.Rate) || math.IsInf(p.Rate, 0):
+		return fmt.Errorf("quota rate %g is not a finite positive number", p.Rate)
+	case p.Rate > 0 && p.Burst < 1:
+		return fmt.Errorf("quota rate %g needs a burst of at least one ciphertext", p.Rate)
+	case p.DailyBudget < 0:
+		return fmt.Errorf("daily budget %d is negative", p.DailyBudget)
+	}
+	return nil
+}
+
+// QuotaError is returned for a query over the quota of its client, answered with 429.
+type QuotaError struct {
+	Key        string // Client or session charged
+	Reason     string
+	RetryAfter time.Duration // Time until the query would fit, 0 if it never will
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%v for %s: %s", ErrQuotaExceeded, e.Key, e.Reason)
+}
+
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// quotaUsage is what a client spent of its quota.
+type quotaUsage struct {
+	tokens   float64   // Tokens left in the bucket at refilled
+	refilled time.Time // Last refill of the bucket
+	day      time.Time // UTC day of spent
+	spent    int       // Ciphertexts charged during day
+}
+
+// Quotas tracks the usage of the clients against their QuotaPolicy.
+type Quotas struct {
+	mu       sync.Mutex
+	defaults QuotaPolicy // Policy of the clients that have none of their own, and of the remote addresses of anonymous ones
+	usage    map[string]*quotaUsage
+}
+
+// defaultQuota is the default QuotaPolicy, unless overridden by the configuration.
+var defaultQuota = QuotaPolicy{Rate: 5, Burst: 30, DailyBudget: 200000}
+
+// quotas enforces the query quotas.
+var quotas = NewQuotas(defaultQuota)
+
+// NewQuotas returns an empty Quotas with the given default policy.
+func NewQuotas(defaults QuotaPolicy) *Quotas {
+	return &Quotas{defaults: defaults, usage: make(map[string]*quotaUsage)}
+}
+
+// SetDefaults replaces the default policy.
+func (q *Quotas) SetDefaults(defaults QuotaPolicy) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.defaults = defaults
+}
+
+// Charge takes n ciphertexts from the quota of the client, or of its remote address, as in
+// http.Request.RemoteAddr, for anonymous clients. It charges nothing and returns a *QuotaError
+// if the rate limit or the daily budget would be exceeded.
+func (q *Quotas) Charge(client *APIClient, remote string, n int) error {
+	key, policy := callerKey(client, remote), client.Quota
+	if client == anonymous {
+		policy = nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if policy == nil {
+		policy = &q.defaults
+	}
+	now := time.Now()
+	usage := q.usage[key]
+	if usage == nil {
+		usage = &quotaUsage{tokens: float64(policy.Burst), refilled: now}
+		q.usage[key] = usage
+		q.evictIdle(now)
+	}
+
+	// The daily budget starts over at midnight UTC
+	if day := now.UTC().Truncate(24 * time.Hour); !usage.day.Equal(day) {
+		usage.day, usage.spent = day, 0
+	}
+	if policy.DailyBudget > 0 && usage.spent+n > policy.DailyBudget {
+		return &QuotaError{
+			Key:        key,
+			Reason:     fmt.Sprintf("%d of the %d ciphertexts of the daily budget are spent", usage.spent, policy.DailyBudget),
+			RetryAfter: usage.day.Add(24 * time.Hour).Sub(now),
+		}
+	}
+
+	if policy.Rate > 0 {
+		usage.tokens = min(float64(policy.Burst), usage.tokens+policy.Rate*now.Sub(usage.refilled).Seconds())
+		usage.refilled = now
+		if n > policy.Burst {
+			return &QuotaError{Key: key, Reason: fmt.Sprintf("%d ciphertexts in one query, the burst is %d", n, policy.Burst)}
+		}
+		if usage.tokens < float64(n) {
+			return &QuotaError{
+				Key:        key,
+				Reason:     fmt.Sprintf("rate limit of %g ciphertexts per second", policy.Rate),
+				RetryAfter: time.Duration((float64(n) - usage.tokens) / policy.Rate * float64(time.Second)),
+			}
+		}
+		usage.tokens -= float64(n)
+	}
+	usage.spent += n
+	return nil
+}
+
+// callerKey names who is charged for the requests of client from remote: the client itself,
+// or its remote address when anonymous. Quotas and SessionLimits both count by it.
+func callerKey(client *APIClient, remote string) string {
+	if client == anonymous {
+		return "address " + remoteHost(remote)
+	}
+	return "client " + client.Name
+}
+
+// auditQuotaRefusal logs a query refused by the quotas, with everything needed to tell who was refused and why.
+func auditQuotaRefusal(ctx context.Context, err error, client *APIClient, session *Session, remote string, n int) {
+	var quota *QuotaError
+	if !errors.As(err, &quota) {
+		return
+	}
+	requestLogger(ctx).Warn("Refused query over quota", "audit", "quota", "client", client.Name,
+		"identity", ClientIdentity(ctx), "session", session.ID, "remote", remote, "charged", quota.Key,
+		"ciphertexts", n, "reason", quota.Reason, "retry_after", quota.RetryAfter)
+}
+
+// evictIdle forgets the usage of the clients idle for a day, whose bucket is full and budget renewed.
+// It must be called with the lock held.
+func (q *Quotas) evictIdle(now time.Time) {
+	for key, usage := range q.usage {
+		if now.Sub(usage.refilled) > 24*time.Hour && now.UTC().Truncate(24*time.Hour).After(usage.day) {
+			delete(q.usage, key)
+		}
+	}
+}
+
+// writeQuotaError answers a query refused by the quotas with 429 and Retry-After,
+// and reports whether err was a *QuotaError.
+func writeQuotaError(w http.ResponseWriter, err error) bool {
+	var quota *QuotaError
+	if !errors.As(err, &quota) {
+		return false
+	}
+	if quota.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(quota.RetryAfter.Seconds()))))
+	}
+	http.Error(w, err.Error(), http.StatusTooManyRequests)
+	return true
+}
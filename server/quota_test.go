@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuotaPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy QuotaPolicy
+		err    string
+	}{
+		{"default", defaultQuota, ""},
+		{"no limits", QuotaPolicy{}, ""},
+		{"negative rate", QuotaPolicy{Rate: -1, Burst: 1}, "not a finite positive number"},
+		{"infinite rate", QuotaPolicy{Rate: math.Inf(1), Burst: 1}, "not a finite positive number"},
+		{"rate without burst", QuotaPolicy{Rate: 1}, "burst of at least one"},
+		{"negative budget", QuotaPolicy{DailyBudget: -1}, "negative"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.policy.Validate()
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestQuotasCharge(t *testing.T) {
+	// The rate is slow enough for the bucket not to refill during the test
+	slow := QuotaPolicy{Rate: 0.001, Burst: 4}
+	camera := &APIClient{Name: "camera"}
+	operator := &APIClient{Name: "operator", Quota: &QuotaPolicy{DailyBudget: 5}}
+	unlimited := &APIClient{Name: "unlimited", Quota: &QuotaPolicy{}}
+
+	type charge struct {
+		client *APIClient
+		remote string
+		n      int
+		err    string // Reason of the QuotaError, empty if the charge passes
+		key    string // Key of the QuotaError
+	}
+	tests := []struct {
+		name    string
+		charges []charge
+	}{
+		{"burst", []charge{
+			{camera, "10.0.0.1:1000", 3, "", ""},
+			{camera, "10.0.0.1:1000", 1, "", ""},
+			{camera, "10.0.0.1:1000", 1, "rate limit", "client camera"},
+		}},
+		{"query larger than the burst", []charge{
+			{camera, "10.0.0.1:1000", 5, "the burst is 4", "client camera"},
+			{camera, "10.0.0.1:1000", 4, "", ""},
+		}},
+		{"clients apart", []charge{
+			{camera, "10.0.0.1:1000", 4, "", ""},
+			{&APIClient{Name: "camera-2"}, "10.0.0.1:1000", 4, "", ""},
+		}},
+		{"daily budget of the client", []charge{
+			{operator, "10.0.0.1:1000", 3, "", ""},
+			{operator, "10.0.0.1:1000", 3, "daily budget", "client operator"},
+			{operator, "10.0.0.1:1000", 2, "", ""},
+		}},
+		{"no limits", []charge{
+			{unlimited, "10.0.0.1:1000", 1000, "", ""},
+			{unlimited, "10.0.0.1:1000", 1000, "", ""},
+		}},
+		{"anonymous by address", []charge{
+			{anonymous, "10.0.0.1:1000", 4, "", ""},
+			{anonymous, "10.0.0.1:2000", 1, "rate limit", "address 10.0.0.1"},
+			{anonymous, "10.0.0.2:1000", 4, "", ""},
+		}},
+		{"anonymous IPv6 by /64", []charge{
+			{anonymous, "[2001:db8::1]:1000", 4, "", ""},
+			{anonymous, "[2001:db8::ffff:1]:1000", 1, "rate limit", "address 2001:db8::/64"},
+			{anonymous, "[2001:db8:0:1::1]:1000", 4, "", ""},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := NewQuotas(slow)
+			for i, c := range test.charges {
+				err := q.Charge(c.client, c.remote, c.n)
+				if c.err == "" {
+					if err != nil {
+						t.Fatalf("charge %d: %v", i, err)
+					}
+					continue
+				}
+				var quota *QuotaError
+				if !errors.As(err, &quota) || !errors.Is(err, ErrQuotaExceeded) {
+					t.Fatalf("charge %d: got error %v, expected a QuotaError", i, err)
+				}
+				if !strings.Contains(quota.Reason, c.err) || quota.Key != c.key {
+					t.Errorf("charge %d: got %q for %q, expected %q for %q", i, quota.Reason, quota.Key, c.err, c.key)
+				}
+			}
+		})
+	}
+}
+
+func TestQuotasRetryAfter(t *testing.T) {
+	q := NewQuotas(QuotaPolicy{Rate: 2, Burst: 2})
+	if err := q.Charge(anonymous, "10.0.0.1:1000", 2); err != nil {
+		t.Fatal(err)
+	}
+	err := q.Charge(anonymous, "10.0.0.1:1000", 2)
+	var quota *QuotaError
+	if !errors.As(err, &quota) {
+		t.Fatalf("got error %v, expected a QuotaError", err)
+	}
+	if quota.RetryAfter <= 0 || quota.RetryAfter > time.Second {
+		t.Errorf("retry after %v, expected up to a second for 2 ciphertexts at 2 per second", quota.RetryAfter)
+	}
+
+	w := httptest.NewRecorder()
+	if !writeQuotaError(w, err) {
+		t.Fatal("QuotaError not written")
+	}
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("got status %d and Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestRemoteHost(t *testing.T) {
+	tests := []struct {
+		remote string
+		host   string
+	}{
+		{"192.0.2.1:443", "192.0.2.1"},
+		{"192.0.2.1", "192.0.2.1"},
+		{"[::ffff:192.0.2.1]:443", "192.0.2.1"},
+		{"[2001:db8:1:2:3:4:5:6]:443", "2001:db8:1:2::/64"},
+		{"pipe", "pipe"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if host := remoteHost(test.remote); host != test.host {
+			t.Errorf("remoteHost(%q) = %q, expected %q", test.remote, host, test.host)
+		}
+	}
+}
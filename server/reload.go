@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// fileStamp identifies a version of the gallery file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// statFile returns the current stamp of the file at path.
+func statFile(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// Reload parses the gallery file again and swaps in the new model.
+// The current model is kept if the file cannot be loaded or fails validation.
+func (g *Gallery) Reload() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// Remember this version even if it is broken, so that it is only retried once replaced
+	stamp, err := statFile(g.path)
+	if err != nil {
+		return err
+	}
+	g.stamp = stamp
+
+	model, err := LoadKNN(g.path)
+	if err != nil {
+		return err
+	}
+	return g.store(model)
+}
+
+// Watch reloads the gallery when its file changes, checking every interval, and on SIGHUP.
+// It never returns.
+func (g *Gallery) Watch(interval time.Duration) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hangup:
+			slog.Info("Received SIGHUP, reloading gallery")
+		case <-ticker.C:
+			if !g.changed() {
+				continue
+			}
+			slog.Info("Gallery file changed, reloading gallery", "path", g.path)
+		}
+
+		if err := g.Reload(); err != nil {
+			slog.Error("Keeping the current gallery, failed to reload", "err", err)
+			continue
+		}
+		slog.Info("Reloaded gallery", "identities", len(g.Identities().Identities))
+	}
+}
+
+// changed reports whether the gallery file differs from the version last loaded or saved.
+func (g *Gallery) changed() bool {
+	stamp, err := statFile(g.path)
+	if err != nil {
+		return false // The file is being replaced, look again at the next tick
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return stamp != g.stamp
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGalleryReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "knn.jsonl")
+	first := testGallery(1, 2, "alice")
+	if err := SaveKNN(path, first); err != nil {
+		t.Fatal(err)
+	}
+	gallery, err := NewGallery(path, *first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := gallery.Model().version
+	if gallery.changed() {
+		t.Error("gallery changed right after loading")
+	}
+
+	// A new file is swapped in
+	second := testGallery(2, 3, "alice", "bob")
+	if err := SaveKNN(path, second); err != nil {
+		t.Fatal(err)
+	}
+	if !gallery.changed() {
+		t.Fatal("new file not noticed")
+	}
+	if err := gallery.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if model := gallery.Model(); !slices.Equal(model.Classes, second.Classes) || model.version != version+1 {
+		t.Errorf("serving %q at version %d, expected %q at version %d", model.Classes, model.version, second.Classes, version+1)
+	}
+	if packs := len(gallery.Model().packs.packs); packs != len(ParameterSets) {
+		t.Errorf("reloaded gallery published with %d packings, expected one per parameter set", packs)
+	}
+	if gallery.changed() {
+		t.Error("gallery changed right after reloading")
+	}
+
+	// A file of another block size is refused, and only retried once replaced
+	broken := &KNN{Data: [][]float64{make([]float64, blockSize/2)}, Classes: []string{"carol"}}
+	if err := SaveKNN(path, broken); err != nil {
+		t.Fatal(err)
+	}
+	if err := gallery.Reload(); err == nil || !strings.Contains(err.Error(), "expected the block size") {
+		t.Errorf("got error %v, expected the block size mismatch", err)
+	}
+	if model := gallery.Model(); !slices.Equal(model.Classes, second.Classes) || model.version != version+1 {
+		t.Errorf("serving %q at version %d after a failed reload, expected the previous gallery", model.Classes, model.version)
+	}
+	if gallery.changed() {
+		t.Error("broken file retried before being replaced")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+	"sync"
+	"sync/atomic"
+)
+
+// job is one unit of homomorphic work, such as a distance between an encrypted query and a packed target.
+type job struct {
+	ctx       context.Context
+	evaluator *ckks.Evaluator // Evaluator of the session; workers use their own shallow copy of it
+	level     int             // Level of the worker buffer passed to run
+	run       func(evaluator *ckks.Evaluator, buffer *rlwe.Ciphertext) error
+	done      func(err error) // Called exactly once when the job has been handled
+}
+
+// Scheduler runs distance jobs on a fixed pool of workers fed by a bounded queue,
+// so that memory and CPU use stay predictable however many queries and targets arrive.
+type Scheduler struct {
+	jobs    chan job
+	depth   atomic.Int64 // Number of jobs queued but not yet picked up by a worker
+	workers int
+}
+
+// NewScheduler starts the given number of workers reading from a queue of queueSize jobs.
+func NewScheduler(workers, queueSize int) *Scheduler {
+	s := &Scheduler{
+		jobs:    make(chan job, queueSize),
+		workers: workers,
+	}
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	return s
+}
+
+// Submit queues a job, blocking while the queue is full.
+// It returns ctx.Err() without queueing if ctx is cancelled first, in which case done is not called.
+func (s *Scheduler) Submit(ctx context.Context, j job) error {
+	s.depth.Add(1)
+	select {
+	case s.jobs <- j:
+		return nil
+	case <-ctx.Done():
+		s.depth.Add(-1)
+		return ctx.Err()
+	}
+}
+
+// Run queues n jobs calling fn(i, ...) for i in [0, n) and waits for all of them.
+// It returns the first error, or ctx.Err() if ctx is cancelled before all jobs are queued.
+func (s *Scheduler) Run(ctx context.Context, evaluator *ckks.Evaluator, level, n int, fn func(i int, evaluator *ckks.Evaluator, buffer *rlwe.Ciphertext) error) error {
+	errChannel := make(chan error, n)
+	var wg sync.WaitGroup
+
+	// Queue one job per index, stopping if the request is cancelled while the queue is full
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(1)
+		err := s.Submit(ctx, job{
+			ctx:       ctx,
+			evaluator: evaluator,
+			level:     level,
+			run: func(evaluator *ckks.Evaluator, buffer *rlwe.Ciphertext) error {
+				return fn(i, evaluator, buffer)
+			},
+			done: func(err error) {
+				if err != nil {
+					errChannel <- err
+				}
+				wg.Done()
+			},
+		})
+		if err != nil {
+			wg.Done()
+			errChannel <- err
+			break
+		}
+	}
+
+	// Wait for all queued jobs to finish
+	wg.Wait()
+	close(errChannel)
+	return <-errChannel
+}
+
+// QueueDepth returns the number of jobs waiting for a worker.
+// A depth close to Capacity means the server is saturated.
+func (s *Scheduler) QueueDepth() int {
+	return int(s.depth.Load())
+}
+
+// Capacity returns the size of the job queue.
+func (s *Scheduler) Capacity() int {
+	return cap(s.jobs)
+}
+
+// Workers returns the number of workers in the pool.
+func (s *Scheduler) Workers() int {
+	return s.workers
+}
+
+// work processes jobs until the queue is closed.
+// Each worker keeps its own evaluator copy and ciphertext buffer, reused while
+// consecutive jobs come from the same session.
+func (s *Scheduler) work() {
+	var source *ckks.Evaluator
+	var evaluator *ckks.Evaluator
+	var buffer *rlwe.Ciphertext
+
+	for j := range s.jobs {
+		s.depth.Add(-1)
+
+		// Drop jobs of cancelled requests without doing the CKKS work
+		if err := j.ctx.Err(); err != nil {
+			j.done(err)
+			continue
+		}
+
+		// Refresh the per-worker evaluator and buffer when the session or level changes
+		if j.evaluator != source {
+			source = j.evaluator
+			evaluator = j.evaluator.ShallowCopy()
+			buffer = nil
+		}
+		if buffer == nil || buffer.Level() != j.level {
+			buffer = ckks.NewCiphertext(*evaluator.GetParameters(), 1, j.level)
+		}
+
+		j.done(j.run(evaluator, buffer))
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSchedulerRun(t *testing.T) {
+	keys := newTestKeys(t)
+	evaluator := ckks.NewEvaluator(keys.params, nil)
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		name    string
+		workers int
+		queue   int
+		n       int
+		fail    int // Index of the job returning errFailed, -1 if none
+	}{
+		{"no job", 2, 4, 0, -1},
+		{"fewer jobs than workers", 4, 4, 2, -1},
+		{"more jobs than the queue", 2, 1, 16, -1},
+		{"one worker", 1, 1, 5, -1},
+		{"failing job", 2, 4, 8, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewScheduler(test.workers, test.queue)
+			if s.Workers() != test.workers || s.Capacity() != test.queue {
+				t.Fatalf("%d workers and a queue of %d, expected %d and %d", s.Workers(), s.Capacity(), test.workers, test.queue)
+			}
+
+			ran := make([]atomic.Int32, test.n)
+			err := s.Run(context.Background(), evaluator, 2, test.n, func(i int, worker *ckks.Evaluator, buffer *rlwe.Ciphertext) error {
+				ran[i].Add(1)
+				if worker == evaluator {
+					t.Errorf("job %d got the evaluator of the session instead of a copy", i)
+				}
+				if buffer.Level() != 2 {
+					t.Errorf("job %d got a buffer at level %d, expected 2", i, buffer.Level())
+				}
+				if i == test.fail {
+					return errFailed
+				}
+				return nil
+			})
+			if test.fail >= 0 {
+				if !errors.Is(err, errFailed) {
+					t.Errorf("got error %v, expected the error of job %d", err, test.fail)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			for i := range ran {
+				if n := ran[i].Load(); n != 1 {
+					t.Errorf("job %d ran %d times", i, n)
+				}
+			}
+			if depth := s.QueueDepth(); depth != 0 {
+				t.Errorf("queue depth %d after the run", depth)
+			}
+		})
+	}
+}
+
+func TestSchedulerCancelled(t *testing.T) {
+	keys := newTestKeys(t)
+	evaluator := ckks.NewEvaluator(keys.params, nil)
+
+	// Cancelled before the run, no job does any work
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s := NewScheduler(2, 4)
+	var ran atomic.Int32
+	err := s.Run(ctx, evaluator, 0, 8, func(int, *ckks.Evaluator, *rlwe.Ciphertext) error {
+		ran.Add(1)
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || ran.Load() != 0 {
+		t.Errorf("got error %v after %d jobs, expected context.Canceled and none", err, ran.Load())
+	}
+
+	// Cancelled while the only worker is busy and the queue is full, Run returns once the worker is freed
+	s = NewScheduler(1, 1)
+	ctx, cancel = context.WithCancel(context.Background())
+	started, release := make(chan struct{}), make(chan struct{})
+	ran.Store(0)
+	go func() {
+		<-started
+		cancel()
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+	}()
+	err = s.Run(ctx, evaluator, 0, 8, func(i int, _ *ckks.Evaluator, _ *rlwe.Ciphertext) error {
+		ran.Add(1)
+		if i == 0 {
+			close(started)
+			<-release
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || ran.Load() != 1 {
+		t.Errorf("got error %v after %d jobs, expected context.Canceled after the first", err, ran.Load())
+	}
+	if depth := s.QueueDepth(); depth != 0 {
+		t.Errorf("queue depth %d after the run", depth)
+	}
+}
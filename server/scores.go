@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/tuneinsight/lattigo/v6/circuits/ckks/polynomial"
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+	"github.com/tuneinsight/lattigo/v6/utils/bignum"
+	"math"
+)
+
+// ModeClassScores returns, per query, an encrypted vector whose slot c holds the kernel-weighted
+// score of class c: the sum of exp(-classScoreGamma·d) over its gallery entries. The client only
+// learns the number of classes.
+const ModeClassScores = "class-scores"
+
+// Bandwidth of the Gaussian kernel weighting each gallery entry by exp(-classScoreGamma·d)
+const classScoreGamma = 2.0
+
+// Degree of the Chebyshev approximation of the kernel, and the number of levels its evaluation consumes.
+// Together with the distance, the summation and the per-class count, it fits in the levels of the
+// default client parameters.
+const (
+	classScoreDegree = 6
+	classScoreDepth  = 3
+)
+
+// checkClassScores validates a ModeClassScores query against the keys and parameters of the session.
+func checkClassScores(session *Session) error {
+	if session.Evk.RelinearizationKey == nil {
+		return fmt.Errorf("mode %q requires a relinearization key to evaluate the kernel", ModeClassScores)
+	}
+	if err := checkGaloisKeys(&session.Evk, SummationGaloisElements(session.Params)); err != nil {
+		return err
+	}
+	if err := checkGaloisKeys(&session.Evk, session.Params.GaloisElementsForInnerSum(1, session.Params.MaxSlots())); err != nil {
+		return err
+	}
+
+	// Distance, block summation, kernel and per-class count
+	levels := 1 + 1 + classScoreDepth + 2
+	if session.Params.MaxLevel() < levels {
+		return fmt.Errorf("mode %q needs %d levels, the session parameters have %d", ModeClassScores, levels, session.Params.MaxLevel())
+	}
+	return nil
+}
+
+// PredictScores computes the encrypted distances of each query with PredictEncrypted and reduces them
+// to one score per class. The distances must have been summed on the server.
+//
+// With the inner-product kernel every score is multiplied by exp(classScoreGamma·||q||²),
+// which does not change the class with the highest score.
+func PredictScores(ctx context.Context, knnModel *KNN, pc *PublicContext) ([]rlwe.Ciphertext, []string, ckks.Parameters, error) {
+	distances, params, err := PredictEncrypted(ctx, knnModel, pc)
+	if err != nil {
+		return nil, nil, params, err
+	}
+
+	labels := uniqueLabels(knnModel.Classes)
+
+	kernel := classScoreKernel(distanceRange(knnModel.Data, pc.Kernel))
+
+	evaluator := pc.Evaluator
+	if evaluator == nil {
+		evaluator = ckks.NewEvaluator(pc.Params, &pc.Evk)
+	}
+
+	// Each query is reduced in its own job
+	scores := make([]rlwe.Ciphertext, len(distances))
+	err = scheduler.Run(ctx, evaluator, params.MaxLevel(), len(distances), func(i int, evaluator *ckks.Evaluator, _ *rlwe.Ciphertext) error {
+		var total *rlwe.Ciphertext
+		for j := range distances[i] {
+			score, err := classScores(&distances[i][j], labels, kernel, evaluator)
+			if err != nil {
+				return err
+			}
+			if total == nil {
+				total = score
+			} else if err := evaluator.Add(total, score, total); err != nil {
+				return err
+			}
+		}
+		scores[i] = *total
+		return nil
+	})
+	if err != nil {
+		return nil, nil, params, err
+	}
+	return scores, labels, params, nil
+}
+
+// classScoreKernel returns the Chebyshev approximation of exp(-classScoreGamma·d) over the distances
+// in [a, b], as given by distanceRange.
+func classScoreKernel(a, b float64) bignum.Polynomial {
+	return bignum.ChebyshevApproximation(func(x float64) float64 {
+		return math.Exp(-classScoreGamma * x)
+	}, bignum.Interval{Nodes: classScoreDegree + 1, A: *bignum.NewFloat(a, 53), B: *bignum.NewFloat(b, 53)})
+}
+
+// classScores evaluates the kernel on every summed distance of a merged Distance and adds up the weights
+// of each class in slot c. The change of basis of the Chebyshev polynomial only updates the scale of the
+// ciphertext, so that it does not consume a level.
+func classScores(distance *Distance, labels []string, kernel bignum.Polynomial, evaluator *ckks.Evaluator) (*rlwe.Ciphertext, error) {
+	params := *evaluator.GetParameters()
+	layout := newSlotLayout(distance, labels, 0, params.MaxSlots())
+
+	// Map the interval of the distances to [-1, 1]
+	scalar, constant := kernel.ChangeOfBasis()
+	d := distance.Distance.CopyNew()
+	d.Scale = d.Scale.Div(rlwe.NewScale(scalar))
+	if err := evaluator.Add(d, constant, d); err != nil {
+		return nil, err
+	}
+
+	// Slots holding no entry get a weight too, countPerLabel masks them out
+	weights, err := polynomial.NewEvaluator(params, evaluator).Evaluate(d, kernel, params.DefaultScale())
+	if err != nil {
+		return nil, err
+	}
+	return countPerLabel(weights, layout, evaluator)
+}
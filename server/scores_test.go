@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+	"github.com/tuneinsight/lattigo/v6/utils/bignum"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheckClassScores(t *testing.T) {
+	keys := newTestKeys(t)
+	shallow, err := ckks.NewParametersFromLiteral(ckks.ParametersLiteral{LogN: 14, LogQ: []int{55, 40, 40, 40}, LogP: []int{55}, LogDefaultScale: 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the presence of the keys is checked, so empty ones stand in for them
+	session := func(params ckks.Parameters, rlk bool, skip uint64) *Session {
+		s := &Session{Params: params, Evk: rlwe.MemEvaluationKeySet{GaloisKeys: map[uint64]*rlwe.GaloisKey{}}}
+		if rlk {
+			s.Evk.RelinearizationKey = &rlwe.RelinearizationKey{}
+		}
+		for _, galEl := range params.GaloisElementsForInnerSum(1, params.MaxSlots()) {
+			if galEl != skip {
+				s.Evk.GaloisKeys[galEl] = &rlwe.GaloisKey{}
+			}
+		}
+		return s
+	}
+
+	tests := []struct {
+		name    string
+		session *Session
+		err     string
+	}{
+		{"valid", session(keys.params, true, 0), ""},
+		{"no relinearization key", session(keys.params, false, 0), "requires a relinearization key"},
+		{"no summation key", session(keys.params, true, keys.params.GaloisElement(1)), "missing the Galois key"},
+		{"no key summing the slots", session(keys.params, true, keys.params.GaloisElement(keys.params.MaxSlots()/2)), "missing the Galois key"},
+		{"too few levels", session(shallow, true, 0), "needs 7 levels, the session parameters have 3"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkClassScores(test.session)
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestPredictScores(t *testing.T) {
+	startTestScheduler()
+	keys := newTestKeys(t)
+	evk := rlwe.NewMemEvaluationKeySet(keys.kgen.GenRelinearizationKeyNew(keys.sk),
+		keys.kgen.GenGaloisKeysNew(keys.params.GaloisElementsForInnerSum(1, keys.params.MaxSlots()), keys.sk)...)
+	model := testGallery(1, 40, "alice", "bob", "carol")
+	query := testGallery(2, 1, "query").Data[0]
+
+	var queryNorm float64
+	for _, v := range query {
+		queryNorm += v * v
+	}
+
+	tests := []struct {
+		name   string
+		kernel string
+		offset float64 // Subtracted from the distances by the kernel, ||q||² for the inner-product kernel
+	}{
+		{"squared difference", KernelSquaredDifference, 0},
+		{"inner product", KernelInnerProduct, queryNorm},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pc := &PublicContext{
+				Params:    keys.params,
+				Evk:       *evk,
+				Evaluator: ckks.NewEvaluator(keys.params, evk),
+				Kernel:    test.kernel,
+				SumSlots:  true,
+				Mode:      ModeClassScores,
+				Query:     []rlwe.Ciphertext{*keys.encrypt(t, replicate(keys.params, query))},
+			}
+			scores, got, _, err := PredictScores(context.Background(), model, pc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			labels := uniqueLabels(model.Classes)
+			if len(scores) != 1 || !slices.Equal(got, labels) {
+				t.Fatalf("got %d scores for labels %q, expected 1 for %q", len(scores), got, labels)
+			}
+
+			// Score of each class in plaintext, with the polynomial evaluated on the server
+			kernel := classScoreKernel(distanceRange(model.Data, test.kernel))
+			expected := make([]float64, len(labels))
+			for i, vec := range model.Data {
+				weight := evaluateChebyshev(kernel, squaredDistance(query, vec)-test.offset)
+				expected[slices.Index(labels, model.Classes[i])] += weight
+			}
+
+			values := keys.decrypt(t, &scores[0])
+			for c, label := range labels {
+				if math.Abs(values[c]-expected[c]) > 1e-3 {
+					t.Errorf("class %q scored %f, expected %f", label, values[c], expected[c])
+				}
+			}
+			if math.Abs(values[len(labels)]) > 1e-3 {
+				t.Errorf("slot %d holds %f, expected zero", len(labels), values[len(labels)])
+			}
+		})
+	}
+}
+
+// evaluateChebyshev evaluates p at x in plaintext, with the change of basis of the server.
+func evaluateChebyshev(p bignum.Polynomial, x float64) float64 {
+	scalar, constant := p.ChangeOfBasis()
+	s, _ := scalar.Float64()
+	c, _ := constant.Float64()
+	u := s*x + c
+
+	var y float64
+	previous, current := 1.0, u
+	for i, coeff := range p.Coeffs {
+		switch i {
+		case 0:
+			y, _ = coeff[0].Float64()
+			continue
+		case 1:
+		default:
+			previous, current = current, 2*u*current-previous
+		}
+		v, _ := coeff[0].Float64()
+		y += v * current
+	}
+	return y
+}
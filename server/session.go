@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/tuneinsight/lattigo/v6/circuits/ckks/bootstrapping"
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrUnknownSession is returned when a query refers to a session that was never registered or has expired.
+var ErrUnknownSession = errors.New("unknown or expired session")
+
+// ErrTooManySessions is returned when the server holds as many sessions, or as many bytes of keys,
+// as its SessionLimits allow. It is answered with 429, or ResourceExhausted on the gRPC stream.
+var ErrTooManySessions = errors.New("too many sessions")
+
+// SessionRequest is the body of POST /api/sessions.
+// It carries the public evaluation keys a client registers once instead of with every frame.
+type SessionRequest struct {
+	Params ckks.Parameters          // CKKS parameters
+	Rlk    rlwe.RelinearizationKey  // Relinearization key for homomorphic multiplication
+	Evk    rlwe.MemEvaluationKeySet // Memory-based evaluation keys for homomorphic operations
+
+	// Optional bootstrapping parameters and keys, needed by ModeTopK
+	Bootstrapping     *bootstrapping.Parameters
+	BootstrappingKeys *bootstrapping.EvaluationKeys
+}
+
+// SessionResponse is returned to the client after a successful registration.
+type SessionResponse struct {
+	SessionID string // Identifier to attach to every subsequent query
+}
+
+// QueryRequest is the body of POST /api/knn once a session has been registered.
+type QueryRequest struct {
+	SessionID string            // Session holding the evaluation keys for this query
+	Kernel    string            // Distance kernel, see SupportedKernels; empty selects the squared difference
+	SumSlots  bool              // Sum each block on the server, needs the keys of SummationGaloisElements
+	Mode      string            // Response mode, ModeDistances when empty
+	K         int               // Number of neighbours voting in ModeTopK
+	Query     []rlwe.Ciphertext // List of encrypted query vectors
+	FrameID   uint64            // Video frame of the query, echoed in the response on the gRPC stream
+	FaceID    uint64            // Face within the frame, echoed in the response on the gRPC stream
+}
+
+// Session holds the deserialized evaluation keys of a registered client.
+type Session struct {
+	ID           string
+	Client       string // Identity of the client certificate that registered the session, see ClientIdentity
+	Owner        string // Name of the APIClient that registered the session, the only one allowed to query it
+	ParameterSet string // Name of the entry of ParameterSets matching Params
+	Params       ckks.Parameters
+	Rlk          rlwe.RelinearizationKey
+	Evk          rlwe.MemEvaluationKeySet
+	lastUsed     time.Time
+	holder       string // Client, or remote address when anonymous, counted against SessionLimits.MaxPerClient
+	size         int64  // Size of the keys, counted against SessionLimits.MaxKeyBytes
+
+	evaluator    *ckks.Evaluator          // Built once at registration and shared by all queries of the session
+	bootstrapper *bootstrapping.Evaluator // Built at registration when the client sent bootstrapping keys
+}
+
+// NewPublicContext combines the session keys with a query into the context consumed by PredictEncrypted.
+func (s *Session) NewPublicContext(kernel string, sumSlots bool, query []rlwe.Ciphertext) PublicContext {
+	return PublicContext{
+		Params:       s.Params,
+		Rlk:          s.Rlk,
+		Evk:          s.Evk,
+		Evaluator:    s.evaluator,
+		Kernel:       kernel,
+		SumSlots:     sumSlots,
+		Bootstrapper: s.bootstrapper,
+		Query:        query,
+	}
+}
+
+// SessionLimits bounds the sessions held in memory, whose keys take tens of megabytes each,
+// and gigabytes with bootstrapping. A client, or a remote address when the API is open, registering more than
+// MaxPerClient sessions loses its least recently used one; a session that would exceed the limits
+// of the whole server is refused with ErrTooManySessions.
+type SessionLimits struct {
+	MaxSessions  int   `yaml:"max-sessions"`   // Sessions of all clients
+	MaxPerClient int   `yaml:"max-per-client"` // Sessions of one client
+	MaxKeyBytes  int64 `yaml:"max-key-bytes"`  // Keys of all sessions, in bytes of their binary encoding
+}
+
+// defaultSessionLimits are the SessionLimits, unless overridden by the configuration.
+var defaultSessionLimits = SessionLimits{MaxSessions: 256, MaxPerClient: 4, MaxKeyBytes: 32 << 30}
+
+// SessionStore keeps registered sessions in memory and evicts the ones that have been idle for too long.
+type SessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+	ttl      time.Duration
+	limits   SessionLimits
+	bytes    int64 // Sum of the sizes of the sessions
+}
+
+// NewSessionStore creates an empty store whose sessions expire after ttl without use.
+func NewSessionStore(ttl time.Duration, limits SessionLimits) *SessionStore {
+	return &SessionStore{
+		sessions: make(map[string]*Session),
+		ttl:      ttl,
+		limits:   limits,
+	}
+}
+
+// Create registers the keys of a SessionRequest sent by the API client owner from the remote address,
+// over a connection with the certificate identity client, and returns the new session.
+func (s *SessionStore) Create(req SessionRequest, client string, owner *APIClient, remote string) (*Session, error) {
+	// Refuse early what cannot fit, before building the bootstrapper
+	holder, size := callerKey(owner, remote), req.keySize()
+	if err := s.reserve(holder, size, false); err != nil {
+		return nil, err
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the advertised parameter sets are accepted, the others may lack the levels the modes need
+	set, err := matchParameterSet(req.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	session := &Session{
+		ID:           id,
+		Client:       client,
+		Owner:        owner.Name,
+		ParameterSet: set.Name,
+		Params:       req.Params,
+		Rlk:          req.Rlk,
+		Evk:          req.Evk,
+		lastUsed:     time.Now(),
+		holder:       holder,
+		size:         size,
+	}
+	session.evaluator = ckks.NewEvaluator(session.Params, &session.Evk)
+
+	// The bootstrapper precomputes its linear transformations, which is slow, so it is built once here
+	if req.Bootstrapping != nil && req.BootstrappingKeys != nil {
+		if !req.Bootstrapping.ResidualParameters.Equal(&req.Params) {
+			return nil, fmt.Errorf("%w: bootstrapping parameters do not match the session parameters", ErrUnsupportedParameters)
+		}
+		if session.bootstrapper, err = newBootstrapper(req.Bootstrapping, req.BootstrappingKeys); err != nil {
+			return nil, err
+		}
+	}
+
+	// Other sessions may have been registered meanwhile
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reserveLocked(holder, size, true); err != nil {
+		return nil, err
+	}
+	s.sessions[id] = session
+	s.bytes += size
+	return session, nil
+}
+
+// keySize returns the size of the binary encoding of the keys of req, about the memory they take.
+func (req SessionRequest) keySize() int64 {
+	size := req.Evk.BinarySize()
+	if req.Evk.RelinearizationKey == nil {
+		size += req.Rlk.BinarySize()
+	}
+	if req.BootstrappingKeys != nil {
+		size += req.BootstrappingKeys.BinarySize()
+	}
+	return int64(size)
+}
+
+// reserve checks that a session of size bytes for holder fits the limits, see reserveLocked.
+func (s *SessionStore) reserve(holder string, size int64, evict bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reserveLocked(holder, size, evict)
+}
+
+// reserveLocked checks that a session of size bytes for holder fits the limits, once the least
+// recently used sessions of holder beyond MaxPerClient are gone. If evict is set and the session
+// fits, those sessions are dropped. The caller must hold the lock.
+func (s *SessionStore) reserveLocked(holder string, size int64, evict bool) error {
+	s.evictExpired()
+	var held []*Session
+	for _, session := range s.sessions {
+		if session.holder == holder {
+			held = append(held, session)
+		}
+	}
+	slices.SortFunc(held, func(a, b *Session) int {
+		return a.lastUsed.Compare(b.lastUsed)
+	})
+	stale := held[:max(0, len(held)-s.limits.MaxPerClient+1)]
+	count, bytes := len(s.sessions)-len(stale), s.bytes
+	for _, session := range stale {
+		bytes -= session.size
+	}
+	switch {
+	case count >= s.limits.MaxSessions:
+		return fmt.Errorf("%w: %d sessions are registered", ErrTooManySessions, count)
+	case bytes+size > s.limits.MaxKeyBytes:
+		return fmt.Errorf("%w: the keys of the registered sessions take %d of the %d bytes allowed", ErrTooManySessions, bytes, s.limits.MaxKeyBytes)
+	}
+	if evict {
+		for _, session := range stale {
+			s.remove(session)
+		}
+	}
+	return nil
+}
+
+// newBootstrapper builds the bootstrapping evaluator of a session. Keys that passed validation but
+// still do not fit the parameters make it panic, which is reported as a ValidationError.
+func newBootstrapper(params *bootstrapping.Parameters, keys *bootstrapping.EvaluationKeys) (bootstrapper *bootstrapping.Evaluator, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = refused("BootstrappingKeys", "keys do not fit the bootstrapping parameters: %v", p)
+		}
+	}()
+	if bootstrapper, err = bootstrapping.NewEvaluator(*params, keys); err != nil {
+		return nil, refused("BootstrappingKeys", "%v", err)
+	}
+	return bootstrapper, nil
+}
+
+// Get returns the session with the given ID and refreshes its expiry.
+func (s *SessionStore) Get(id string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evictExpired()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil, ErrUnknownSession
+	}
+	session.lastUsed = time.Now()
+	return session, nil
+}
+
+// Len returns the number of live sessions.
+func (s *SessionStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// evictExpired drops sessions idle for longer than the TTL. The caller must hold the lock.
+func (s *SessionStore) evictExpired() {
+	now := time.Now()
+	for _, session := range s.sessions {
+		if now.Sub(session.lastUsed) > s.ttl {
+			s.remove(session)
+		}
+	}
+}
+
+// remove drops a session. The caller must hold the lock.
+func (s *SessionStore) remove(session *Session) {
+	delete(s.sessions, session.ID)
+	s.bytes -= session.size
+}
+
+// remoteHost returns the host of a remote address, masked to its /64 for IPv6.
+func remoteHost(remote string) string {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip.To4() != nil {
+		return ip.String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
+
+// newSessionID returns a random 128-bit identifier encoded as hex.
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
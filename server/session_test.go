@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSessionStoreLimits(t *testing.T) {
+	keys := newTestKeys(t)
+	rlk := keys.kgen.GenRelinearizationKeyNew(keys.sk)
+	req := SessionRequest{Params: keys.params, Rlk: *rlk, Evk: *rlwe.NewMemEvaluationKeySet(rlk)}
+	size := req.keySize()
+
+	camera := &APIClient{Name: "camera"}
+	operator := &APIClient{Name: "operator"}
+
+	type step struct {
+		owner   *APIClient
+		remote  string
+		touch   int  // Session, by step, used before registering, -1 for none
+		refused bool // Whether the registration fails with ErrTooManySessions
+	}
+	tests := []struct {
+		name   string
+		limits SessionLimits
+		steps  []step
+		live   []int // Sessions left, by step
+	}{
+		{"within the limits", SessionLimits{MaxSessions: 4, MaxPerClient: 2, MaxKeyBytes: 4 * size}, []step{
+			{camera, "10.0.0.1:1", -1, false},
+			{operator, "10.0.0.1:1", -1, false},
+		}, []int{0, 1}},
+		{"per client, the least recently used goes", SessionLimits{MaxSessions: 8, MaxPerClient: 2, MaxKeyBytes: 8 * size}, []step{
+			{camera, "10.0.0.1:1", -1, false},
+			{camera, "10.0.0.1:1", -1, false},
+			{operator, "10.0.0.1:1", -1, false},
+			{camera, "10.0.0.2:1", 0, false},
+		}, []int{0, 2, 3}},
+		{"anonymous per remote address", SessionLimits{MaxSessions: 8, MaxPerClient: 1, MaxKeyBytes: 8 * size}, []step{
+			{anonymous, "10.0.0.1:1", -1, false},
+			{anonymous, "10.0.0.2:1", -1, false},
+			{anonymous, "10.0.0.1:2", -1, false},
+		}, []int{1, 2}},
+		{"too many sessions", SessionLimits{MaxSessions: 2, MaxPerClient: 2, MaxKeyBytes: 8 * size}, []step{
+			{camera, "10.0.0.1:1", -1, false},
+			{operator, "10.0.0.1:1", -1, false},
+			{anonymous, "10.0.0.1:1", -1, true},
+			{camera, "10.0.0.1:1", -1, true},
+		}, []int{0, 1}},
+		{"eviction makes room", SessionLimits{MaxSessions: 2, MaxPerClient: 1, MaxKeyBytes: 8 * size}, []step{
+			{camera, "10.0.0.1:1", -1, false},
+			{operator, "10.0.0.1:1", -1, false},
+			{camera, "10.0.0.1:1", -1, false},
+		}, []int{1, 2}},
+		{"too many bytes", SessionLimits{MaxSessions: 8, MaxPerClient: 4, MaxKeyBytes: 2*size + size/2}, []step{
+			{camera, "10.0.0.1:1", -1, false},
+			{operator, "10.0.0.1:1", -1, false},
+			{anonymous, "10.0.0.1:1", -1, true},
+		}, []int{0, 1}},
+		{"keys larger than the limit", SessionLimits{MaxSessions: 8, MaxPerClient: 4, MaxKeyBytes: size - 1}, []step{
+			{camera, "10.0.0.1:1", -1, true},
+		}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewSessionStore(time.Hour, test.limits)
+			ids := make([]string, len(test.steps))
+			for i, s := range test.steps {
+				if s.touch >= 0 {
+					if _, err := store.Get(ids[s.touch]); err != nil {
+						t.Fatalf("step %d: %v", i, err)
+					}
+				}
+				session, err := store.Create(req, "", s.owner, s.remote)
+				if s.refused {
+					if !errors.Is(err, ErrTooManySessions) {
+						t.Fatalf("step %d: got error %v, expected ErrTooManySessions", i, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				if session.Owner != s.owner.Name || session.ParameterSet != "default" {
+					t.Errorf("step %d: session of %q with set %q", i, session.Owner, session.ParameterSet)
+				}
+				ids[i] = session.ID
+			}
+
+			var live []int
+			for i, id := range ids {
+				if id == "" {
+					continue
+				}
+				_, err := store.Get(id)
+				switch {
+				case err == nil:
+					live = append(live, i)
+				case !errors.Is(err, ErrUnknownSession):
+					t.Errorf("session of step %d: %v", i, err)
+				}
+			}
+			if !slices.Equal(live, test.live) {
+				t.Errorf("sessions of steps %v left, expected %v", live, test.live)
+			}
+			if store.Len() != len(test.live) || store.bytes != int64(len(test.live))*size {
+				t.Errorf("%d sessions of %d bytes left, expected %d of %d", store.Len(), store.bytes, len(test.live), int64(len(test.live))*size)
+			}
+		})
+	}
+}
+
+func TestSessionStoreExpiry(t *testing.T) {
+	keys := newTestKeys(t)
+	rlk := keys.kgen.GenRelinearizationKeyNew(keys.sk)
+	req := SessionRequest{Params: keys.params, Rlk: *rlk, Evk: *rlwe.NewMemEvaluationKeySet(rlk)}
+
+	store := NewSessionStore(time.Hour, SessionLimits{MaxSessions: 1, MaxPerClient: 1, MaxKeyBytes: req.keySize()})
+	session, err := store.Create(req, "", &APIClient{Name: "camera"}, "10.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An expired session frees its room for the next registration
+	session.lastUsed = time.Now().Add(-2 * time.Hour)
+	if _, err := store.Create(req, "", &APIClient{Name: "operator"}, "10.0.0.1:1"); err != nil {
+		t.Fatalf("registration after expiry: %v", err)
+	}
+	if _, err := store.Get(session.ID); !errors.Is(err, ErrUnknownSession) {
+		t.Errorf("got error %v for the expired session, expected ErrUnknownSession", err)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// gRPC streaming service
+//
+// Live cameras keep one gRPC connection open instead of posting every frame to /api/knn.
+// The service "securesight.KNN" carries the frames of the wire protocol as raw messages,
+// with the codec "frame", so it needs no generated code:
+//
+//	Register  unary, MsgSessionRequest -> MsgSessionResponse, same as POST /api/sessions
+//	Stream    bidirectional, MsgQueryRequest -> MsgQueryResponse or MsgError
+//
+// Every message received is bounded by the body limit of POST /api/knn, since gRPC cannot bound
+// each method on its own. Keys larger than that, bootstrapping keys among them, are refused with
+// ResourceExhausted and go through POST /api/sessions instead.
+//
+// Each query of the stream carries the IDs of its frame and face, which are echoed in the
+// response. Queries are evaluated concurrently, so responses come back in the order they
+// finish, not in the order they were sent.
+
+// Full method names of the streaming service.
+const (
+	StreamRegisterMethod = "/securesight.KNN/Register"
+	StreamQueryMethod    = "/securesight.KNN/Stream"
+)
+
+// maxStreamQueries bounds the queries of one stream evaluated at the same time, set by Config.Apply.
+// Further queries are not read until one finishes, which slows the client down through flow control.
+var maxStreamQueries = 8
+
+// frameCodec passes the frames of the wire protocol through gRPC untouched.
+type frameCodec struct{}
+
+func (frameCodec) Marshal(v any) ([]byte, error) {
+	frame, ok := v.(*[]byte)
+	if !ok {
+		return nil, fmt.Errorf("frame codec cannot marshal %T", v)
+	}
+	return *frame, nil
+}
+
+func (frameCodec) Unmarshal(data []byte, v any) error {
+	frame, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("frame codec cannot unmarshal into %T", v)
+	}
+	*frame = append((*frame)[:0], data...)
+	return nil
+}
+
+func (frameCodec) Name() string {
+	return "frame"
+}
+
+// streamServiceDesc describes the streaming service to the gRPC server.
+var streamServiceDesc = grpc.ServiceDesc{
+	ServiceName: "securesight.KNN",
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Register", Handler: registerStreamSession},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "Stream", Handler: streamQueries, ServerStreams: true, ClientStreams: true},
+	},
+}
+
+// NewStreamServer returns a gRPC server of the streaming service, over TLS unless tlsConfig is nil.
+func NewStreamServer(tlsConfig *tls.Config) (*grpc.Server, error) {
+	maxQuery, err := queryBodyLimit()
+	if err != nil {
+		return nil, err
+	}
+	options := []grpc.ServerOption{
+		grpc.ForceServerCodec(frameCodec{}),
+		// Ciphertexts are far larger than the default limit of 4 MiB. The responses are built by
+		// the server and grow with the gallery, up to the largest message gRPC carries.
+		grpc.MaxRecvMsgSize(int(min(maxQuery, math.MaxInt32))),
+		grpc.MaxSendMsgSize(math.MaxInt32),
+	}
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(options...)
+	server.RegisterService(&streamServiceDesc, nil)
+	return server, nil
+}
+
+// ServeStream serves the streaming service on addr until the listener fails or StopStream is called.
+func ServeStream(server *grpc.Server, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return server.Serve(listener)
+}
+
+// streamsDraining is closed by StopStream, for the streams to stop taking queries.
+var streamsDraining = make(chan struct{})
+
+// StopStream stops the streaming service. Streams stop taking queries and end once the queries
+// in flight are answered; whatever still runs when ctx expires is cancelled.
+func StopStream(ctx context.Context, server *grpc.Server) {
+	close(streamsDraining)
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		server.Stop()
+	}
+}
+
+// registerStreamSession registers the evaluation keys of a client, like sessionsHandler.
+func registerStreamSession(_ any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+	ctx = withStreamSpan(streamRequestID(ctx))
+	ctx, span := StartSpan(ctx, "Register", "request_id", RequestID(ctx))
+	defer span.End()
+	timer := newStageTimer(ctx, "stream")
+	logger := requestLogger(ctx)
+	if !galleryReady.Load() {
+		return nil, status.Error(codes.Unavailable, "server is not ready: loading the gallery")
+	}
+	client, err := authenticateStream(ctx, ScopeQuery)
+	if err != nil {
+		return nil, authStatus(err)
+	}
+	var frame []byte
+	if err := dec(&frame); err != nil {
+		return nil, err
+	}
+	timer.Stage("receive")
+	var req SessionRequest
+	err = decodeStreamFrame(frame, MsgSessionRequest, &req)
+	timer.Stage("deserialize")
+	if err != nil {
+		logger.Info("Rejected stream session", "err", err, timer.Attr())
+		return nil, invalidArgument(err)
+	}
+	var remote string
+	if p, ok := peer.FromContext(ctx); ok {
+		remote = p.Addr.String()
+	}
+	session, err := sessions.Create(req, ClientIdentity(ctx), client, remote)
+	if err != nil {
+		logger.Info("Rejected stream session", "err", err, timer.Attr())
+	}
+	var invalid *ValidationError
+	if errors.As(err, &invalid) {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to create session: %v", err)
+	}
+	if errors.Is(err, ErrTooManySessions) {
+		return nil, status.Errorf(codes.ResourceExhausted, "failed to create session: %v", err)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create session: %v", err)
+	}
+
+	payload, err := SessionResponse{SessionID: session.ID}.MarshalWire()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to serialize response: %v", err)
+	}
+	response := EncodeFrame(MsgSessionResponse, payload)
+	timer.Stage("serialize")
+	logger.Info("Registered stream session", "session", session.ID, "client", session.Owner, "identity", session.Client,
+		"parameter_set", session.ParameterSet, "active", sessions.Len(), "key_bytes", len(frame), timer.Attr())
+	return &response, nil
+}
+
+// streamQueries answers the queries of a stream as they finish, until the client closes its side
+// or the server shuts down, which ends the stream with codes.Unavailable.
+// A query that fails is answered with a MsgError and the stream goes on; a frame that cannot
+// be decoded ends the stream, since the IDs of the query it carried are unknown.
+func streamQueries(_ any, stream grpc.ServerStream) error {
+	ctx := withStreamSpan(streamRequestID(stream.Context()))
+	logger := requestLogger(ctx)
+	if !galleryReady.Load() {
+		return status.Error(codes.Unavailable, "server is not ready: loading the gallery")
+	}
+	client, err := authenticateStream(ctx, ScopeQuery)
+	if err != nil {
+		return authStatus(err)
+	}
+	var remote string
+	if p, ok := peer.FromContext(ctx); ok {
+		remote = p.Addr.String()
+	}
+	logger.Info("Stream opened", "client", client.Name, "identity", ClientIdentity(ctx), "remote", remote)
+
+	// SendMsg must not be called from several goroutines at once
+	var sendMu sync.Mutex
+	send := func(msgType MessageType, v wireMessage) {
+		payload, err := v.MarshalWire()
+		if err != nil {
+			logger.Error("Failed to serialize stream response", "err", err)
+			return
+		}
+		frame := EncodeFrame(msgType, payload)
+		responseBytes.WithLabelValues("stream").Observe(float64(len(frame)))
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		if err := stream.SendMsg(&frame); err != nil && ctx.Err() == nil {
+			logger.Warn("Failed to send stream response", "err", err)
+		}
+	}
+	fail := func(query QueryRequest, timer *stageTimer, httpStatus int, err error) {
+		logger.Info("Rejected stream query", "frame", query.FrameID, "face", query.FaceID, "status", httpStatus, "err", err, timer.Attr())
+		requestsTotal.WithLabelValues("stream", strconv.Itoa(httpStatus)).Inc()
+		send(MsgError, ErrorMessage{Message: err.Error(), Status: httpStatus, FrameID: query.FrameID, FaceID: query.FaceID})
+	}
+
+	// The handler must not return while queries are still being answered. When it returns early,
+	// on a broken stream or a frame that cannot be decoded, the queries in flight are cancelled first.
+	pending := make(chan struct{}, maxStreamQueries)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Frames are received apart, so that a shutdown does not wait for the next frame of the client
+	type receivedFrame struct {
+		frame []byte
+		err   error
+	}
+	frames := make(chan receivedFrame)
+	go func() {
+		for {
+			var next receivedFrame
+			next.err = stream.RecvMsg(&next.frame)
+			select {
+			case frames <- next:
+			case <-ctx.Done():
+				return
+			}
+			if next.err != nil {
+				return
+			}
+		}
+	}()
+
+	for received := 0; ; received++ {
+		var frame []byte
+		select {
+		case next := <-frames:
+			if errors.Is(next.err, io.EOF) {
+				// The client still reads the responses of the queries in flight
+				wg.Wait()
+				logger.Info("Stream closed by client", "queries", received)
+				return nil
+			}
+			if next.err != nil {
+				return next.err
+			}
+			frame = next.frame
+		case <-streamsDraining:
+			wg.Wait()
+			logger.Info("Stream drained on shutdown", "queries", received)
+			return status.Error(codes.Unavailable, "server is shutting down")
+		}
+
+		// Queries whose ciphertexts fail validation are answered with a MsgError like the others
+		requestBytes.WithLabelValues("stream").Observe(float64(len(frame)))
+		var query QueryRequest
+		queryCtx, span := StartSpan(ctx, "Stream query", "request_id", RequestID(ctx))
+		timer := newStageTimer(queryCtx, "stream")
+		err := decodeStreamFrame(frame, MsgQueryRequest, &query)
+		timer.Stage("deserialize")
+		span.SetAttr("frame", query.FrameID)
+		span.SetAttr("face", query.FaceID)
+		if err != nil {
+			var invalid *ValidationError
+			if !errors.As(err, &invalid) {
+				span.End()
+				logger.Info("Ending stream on an undecodable frame", "err", err)
+				return invalidArgument(err)
+			}
+			fail(query, timer, invalid.Status, err)
+			span.End()
+			continue
+		}
+		pc, err := prepareQuery(queryCtx, query, client, remote)
+		timer.Stage("prepare")
+		if err != nil {
+			fail(query, timer, queryStatus(err), err)
+			span.End()
+			continue
+		}
+		queriesPerRequest.WithLabelValues("stream").Observe(float64(len(query.Query)))
+
+		select {
+		case pending <- struct{}{}:
+		case <-ctx.Done():
+			span.End()
+			return ctx.Err()
+		}
+		wg.Add(1)
+		go func() {
+			gauge := inFlight.WithLabelValues("stream")
+			gauge.Inc()
+			defer func() {
+				span.End()
+				gauge.Dec()
+				<-pending
+				wg.Done()
+			}()
+
+			// The stream context is cancelled when the client disconnects, which stops the CKKS work
+			response, err := evaluateQuery(timer.Context(queryCtx), &pc)
+			timer.Stage("predict")
+			if err != nil {
+				if ctx.Err() == nil {
+					fail(query, timer, http.StatusInternalServerError, fmt.Errorf("failed to evaluate queries: %v", err))
+				}
+				return
+			}
+			response.FrameID, response.FaceID = query.FrameID, query.FaceID
+			send(MsgQueryResponse, response)
+			timer.Stage("serialize")
+			logger.Info("Answered stream query", "frame", query.FrameID, "face", query.FaceID, "session", query.SessionID,
+				"mode", pc.Mode, "kernel", pc.Kernel, timer.Attr())
+			requestsTotal.WithLabelValues("stream", strconv.Itoa(http.StatusOK)).Inc()
+		}()
+	}
+}
+
+// decodeStreamFrame decodes a frame of type msgType into v. A *ValidationError of the content is
+// returned as is, since the frame itself was sound; other errors carry gRPC status codes.
+func decodeStreamFrame(frame []byte, msgType MessageType, v interface{ UnmarshalWire([]byte) error }) error {
+	got, payload, err := DecodeFrame(frame)
+	if err != nil {
+		if errors.Is(err, ErrUnsupportedVersion) {
+			return status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if got != msgType {
+		return status.Errorf(codes.InvalidArgument, "expected message type %d, got %d", msgType, got)
+	}
+	if err := v.UnmarshalWire(payload); err != nil {
+		var invalid *ValidationError
+		if errors.As(err, &invalid) {
+			return err
+		}
+		return status.Errorf(codes.InvalidArgument, "failed to deserialize message: %v", err)
+	}
+	return nil
+}
+
+// authStatus turns an error of authenticateStream into a gRPC status.
+func authStatus(err error) error {
+	if errors.Is(err, ErrForbidden) {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return status.Error(codes.Unauthenticated, err.Error())
+}
+
+// invalidArgument turns a *ValidationError returned by decodeStreamFrame into a gRPC status.
+func invalidArgument(err error) error {
+	var invalid *ValidationError
+	if errors.As(err, &invalid) {
+		return status.Errorf(codes.InvalidArgument, "failed to deserialize message: %v", err)
+	}
+	return err
+}
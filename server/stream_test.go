@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startStreamServer serves the streaming service over an in-memory connection with a gallery of model
+// and a store of its own, and returns a connection to it speaking the frame codec.
+func startStreamServer(t *testing.T, model *KNN) *grpc.ClientConn {
+	t.Helper()
+	startTestScheduler()
+	savedGallery, savedSessions, savedReady := gallery, sessions, galleryReady.Load()
+	t.Cleanup(func() {
+		gallery, sessions = savedGallery, savedSessions
+		galleryReady.Store(savedReady)
+	})
+	var err error
+	if gallery, err = NewGallery(filepath.Join(t.TempDir(), "knn.csv"), *model); err != nil {
+		t.Fatal(err)
+	}
+	sessions = NewSessionStore(time.Hour, defaultSessionLimits)
+	galleryReady.Store(true)
+
+	server, err := NewStreamServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := bufconn.Listen(1 << 20)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(frameCodec{})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// streamReply is a MsgQueryResponse or a MsgError received on the stream, with the IDs it echoes.
+type streamReply struct {
+	msgType MessageType
+	status  int // Status of a MsgError
+}
+
+// readStreamReply decodes the type and the frame and face IDs of a reply of the stream.
+func readStreamReply(t *testing.T, frame []byte) ([2]uint64, streamReply) {
+	t.Helper()
+	msgType, payload, err := DecodeFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both messages end with the IDs, in fields 8 and 9 of a response and 3 and 4 of an error
+	frameTag, faceTag := uint64(8), uint64(9)
+	if msgType == MsgError {
+		frameTag, faceTag = 3, 4
+	}
+	var ids [2]uint64
+	reply := streamReply{msgType: msgType}
+	err = readFields(payload, func(tag uint64, data []byte) (err error) {
+		var v uint64
+		switch {
+		case tag == frameTag:
+			ids[0], err = readUint(data)
+		case tag == faceTag:
+			ids[1], err = readUint(data)
+		case tag == 2 && msgType == MsgError:
+			v, err = readUint(data)
+			reply.status = int(v)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids, reply
+}
+
+func TestStreamQueries(t *testing.T) {
+	conn := startStreamServer(t, testGallery(1, 4, "alice", "bob"))
+	keys := newTestKeys(t)
+	ctx := context.Background()
+
+	// Register the relinearization key, which the default squared-difference kernel needs
+	var w wireWriter
+	w.bytes(1, marshal(t, keys.params))
+	w.bytes(2, marshal(t, rlwe.NewMemEvaluationKeySet(keys.kgen.GenRelinearizationKeyNew(keys.sk))))
+	request := EncodeFrame(MsgSessionRequest, w.buf.Bytes())
+	var reply []byte
+	if err := conn.Invoke(ctx, StreamRegisterMethod, &request, &reply); err != nil {
+		t.Fatal(err)
+	}
+	msgType, payload, err := DecodeFrame(reply)
+	if err != nil || msgType != MsgSessionResponse {
+		t.Fatalf("got message type %d and error %v, expected a session response", msgType, err)
+	}
+	var sessionID string
+	readFields(payload, func(tag uint64, data []byte) error {
+		if tag == 1 {
+			sessionID = string(data)
+		}
+		return nil
+	})
+	if _, err := sessions.Get(sessionID); err != nil {
+		t.Fatalf("session %q not registered: %v", sessionID, err)
+	}
+
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, StreamQueryMethod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := marshal(t, keys.encrypt(t, replicate(keys.params, testGallery(2, 1, "carol").Data[0])))
+	send := func(session string, frameID, faceID uint64) {
+		t.Helper()
+		var w wireWriter
+		w.string(1, session)
+		w.bytes(6, ciphertext)
+		w.uint(7, frameID)
+		w.uint(8, faceID)
+		frame := EncodeFrame(MsgQueryRequest, w.buf.Bytes())
+		if err := stream.SendMsg(&frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The query of an unknown session fails alone, the stream goes on with the next ones
+	send(sessionID, 1, 0)
+	send(sessionID, 1, 1)
+	send("expired", 2, 0)
+	send(sessionID, 2, 1)
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replies come in the order the queries finish, each tagged with the IDs of its query
+	expected := map[[2]uint64]streamReply{
+		{1, 0}: {msgType: MsgQueryResponse},
+		{1, 1}: {msgType: MsgQueryResponse},
+		{2, 0}: {msgType: MsgError, status: http.StatusNotFound},
+		{2, 1}: {msgType: MsgQueryResponse},
+	}
+	got := make(map[[2]uint64]streamReply)
+	for {
+		var frame []byte
+		err := stream.RecvMsg(&frame)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, reply := readStreamReply(t, frame)
+		if _, ok := got[ids]; ok {
+			t.Errorf("frame %d face %d answered twice", ids[0], ids[1])
+		}
+		got[ids] = reply
+	}
+	if !maps.Equal(got, expected) {
+		t.Errorf("got replies %v, expected %v", got, expected)
+	}
+}
+
+func TestStreamUndecodableFrame(t *testing.T) {
+	conn := startStreamServer(t, testGallery(1, 4, "alice", "bob"))
+	stream, err := conn.NewStream(context.Background(), &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, StreamQueryMethod)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A frame whose IDs cannot be read ends the stream
+	frame := []byte("not a frame")
+	if err := stream.SendMsg(&frame); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.RecvMsg(&frame); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got error %v, expected InvalidArgument", err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+)
+
+// SummationGaloisElements returns the Galois elements a session must register to use server-side
+// slot summation. The inner sum over a block needs rotations by powers of two below blockSize,
+// which are also the rotations used to merge the packs.
+func SummationGaloisElements(params ckks.Parameters) []uint64 {
+	return params.GaloisElementsForInnerSum(1, blockSize)
+}
+
+// checkGaloisKeys returns an error naming the first Galois element missing from the session keys.
+func checkGaloisKeys(evk *rlwe.MemEvaluationKeySet, galEls []uint64) error {
+	for _, galEl := range galEls {
+		if _, err := evk.GetGaloisKey(galEl); err != nil {
+			return fmt.Errorf("session is missing the Galois key for element %d", galEl)
+		}
+	}
+	return nil
+}
+
+// sumBlocks adds up the slots of each block in place and keeps only the first slot of every
+// block that holds a target, so that the ciphertext carries one distance per target.
+// Masking consumes one level and leaves the distance at the default scale.
+func sumBlocks(distance *rlwe.Ciphertext, pack *PackedTarget, evaluator *ckks.Evaluator) error {
+
+	// Slot x*blockSize now holds the sum of block x, other slots hold partial sums
+	if err := evaluator.InnerSum(distance, 1, blockSize, distance); err != nil {
+		return err
+	}
+
+	// Zero every slot except the sums of the targets. The squared-difference kernel leaves the distance
+	// below the default scale, so the mask is encoded at the scale that brings it back once rescaled:
+	// the polynomials of the other modes would lose their precision on a smaller scale.
+	params := *evaluator.GetParameters()
+	level := distance.Level()
+	mask := ckks.NewPlaintext(params, level)
+	mask.Scale = params.DefaultScale().Mul(rlwe.NewScale(params.Q()[level])).Div(distance.Scale)
+	if err := evaluator.Encode(pack.Mask, mask); err != nil {
+		return err
+	}
+	if err := evaluator.Mul(distance, mask, distance); err != nil {
+		return err
+	}
+	return evaluator.Rescale(distance, distance)
+}
+
+// mergeDistances folds summed distances of up to blockSize packs into one ciphertext.
+// The distance of target x of the r-th pack of a group ends up in slot x*blockSize - r (mod slots),
+// and PackSizes records how many targets each pack of the group contributed.
+// Packs are merged pairwise: at step j, the second group of each pair is rotated by 2^j.
+func mergeDistances(distances []Distance, evaluator *ckks.Evaluator) ([]Distance, error) {
+	var merged []Distance
+
+	for start := 0; start < len(distances); start += blockSize {
+		end := start + blockSize
+		if end > len(distances) {
+			end = len(distances)
+		}
+
+		// Every group starts as a single pack
+		groups := make([]Distance, end-start)
+		for i, distance := range distances[start:end] {
+			groups[i] = Distance{
+				Distance:  distance.Distance,
+				Classes:   distance.Classes,
+				PackSizes: []int{len(distance.Classes)},
+			}
+		}
+
+		// Merge pairs of groups until one is left
+		for step := 1; len(groups) > 1; step <<= 1 {
+			var next []Distance
+			for i := 0; i < len(groups); i += 2 {
+				if i+1 == len(groups) {
+					next = append(next, groups[i])
+					continue
+				}
+
+				rotated, err := evaluator.RotateNew(&groups[i+1].Distance, step)
+				if err != nil {
+					return nil, err
+				}
+				if err := evaluator.Add(&groups[i].Distance, rotated, rotated); err != nil {
+					return nil, err
+				}
+
+				next = append(next, Distance{
+					Distance:  *rotated,
+					Classes:   append(append([]string{}, groups[i].Classes...), groups[i+1].Classes...),
+					PackSizes: append(append([]int{}, groups[i].PackSizes...), groups[i+1].PackSizes...),
+				})
+			}
+			groups = next
+		}
+
+		merged = append(merged, groups[0])
+	}
+
+	return merged, nil
+}
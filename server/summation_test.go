@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestPredictEncryptedSumSlots(t *testing.T) {
+	startTestScheduler()
+	keys := newTestKeys(t)
+	evk := rlwe.NewMemEvaluationKeySet(keys.kgen.GenRelinearizationKeyNew(keys.sk),
+		keys.kgen.GenGaloisKeysNew(SummationGaloisElements(keys.params), keys.sk)...)
+	query := testGallery(2, 1, "query").Data[0]
+	slots := keys.params.MaxSlots()
+
+	tests := []struct {
+		name    string
+		targets int
+		packs   []int // PackSizes of the merged distance
+	}{
+		{"one pack", 5, []int{5}},
+		{"full pack", 16, []int{16}},
+		{"three packs", 40, []int{16, 16, 8}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			model := testGallery(1, test.targets, "alice", "bob", "carol")
+			pc := &PublicContext{
+				Params:    keys.params,
+				Evk:       *evk,
+				Evaluator: ckks.NewEvaluator(keys.params, evk),
+				Kernel:    KernelSquaredDifference,
+				SumSlots:  true,
+				Query:     []rlwe.Ciphertext{*keys.encrypt(t, replicate(keys.params, query))},
+			}
+			distances, _, err := PredictEncrypted(context.Background(), model, pc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(distances) != 1 || len(distances[0]) != 1 {
+				t.Fatalf("got %d queries of %d distances, expected one merged distance", len(distances), len(distances[0]))
+			}
+			merged := distances[0][0]
+			if len(merged.PackSizes) != len(test.packs) || len(merged.Classes) != test.targets {
+				t.Fatalf("got packs %v and %d classes, expected packs %v", merged.PackSizes, len(merged.Classes), test.packs)
+			}
+
+			if !merged.Distance.Scale.Equal(keys.params.DefaultScale()) {
+				t.Errorf("distances at scale 2^%.2f, expected the default scale", merged.Distance.Scale.Log2())
+			}
+
+			// Target x of pack r sits in slot x*blockSize - r, every other slot is zero
+			values := keys.decrypt(t, &merged.Distance)
+			expected := make([]float64, slots)
+			target := 0
+			for r, size := range test.packs {
+				if merged.PackSizes[r] != size {
+					t.Errorf("pack %d has %d targets, expected %d", r, merged.PackSizes[r], size)
+				}
+				for x := 0; x < size; x++ {
+					expected[(x*blockSize-r+slots)%slots] = squaredDistance(query, model.Data[target])
+					if merged.Classes[target] != model.Classes[target] {
+						t.Errorf("target %d of class %q, expected %q", target, merged.Classes[target], model.Classes[target])
+					}
+					target++
+				}
+			}
+			for slot := range values {
+				if math.Abs(values[slot]-expected[slot]) > 1e-3 {
+					t.Fatalf("slot %d holds %f, expected %f", slot, values[slot], expected[slot])
+				}
+			}
+		})
+	}
+}
+
+func TestCheckGaloisKeys(t *testing.T) {
+	keys := newTestKeys(t)
+	galEls := SummationGaloisElements(keys.params)
+	evk := rlwe.NewMemEvaluationKeySet(nil, keys.kgen.GenGaloisKeysNew(galEls[:len(galEls)-1], keys.sk)...)
+
+	if err := checkGaloisKeys(evk, galEls[:len(galEls)-1]); err != nil {
+		t.Errorf("registered keys refused: %v", err)
+	}
+	err := checkGaloisKeys(evk, galEls)
+	if err == nil || !strings.Contains(err.Error(), "missing the Galois key") {
+		t.Errorf("got error %v, expected the missing key of the last element", err)
+	}
+}
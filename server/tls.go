@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"net/http"
+	"os"
+)
+
+// TLSFiles holds the certificate paths of the server. Without CertFile the server speaks plain
+// HTTP and gRPC; with ClientCAFile it also asks clients for a certificate signed by that CA.
+type TLSFiles struct {
+	CertFile          string `yaml:"cert"`                // PEM certificate chain of the server
+	KeyFile           string `yaml:"key"`                 // PEM private key of the server
+	ClientCAFile      string `yaml:"client-ca"`           // PEM bundle of the CAs trusted to sign client certificates, for mutual TLS
+	RequireClientCert bool   `yaml:"require-client-cert"` // Refuse clients without a certificate instead of serving them anonymously
+}
+
+// Enabled reports whether the server should serve TLS.
+func (f TLSFiles) Enabled() bool {
+	return f.CertFile != ""
+}
+
+// Config loads the certificates into a tls.Config for the HTTP and gRPC servers.
+func (f TLSFiles) Config() (*tls.Config, error) {
+	if f.KeyFile == "" {
+		return nil, fmt.Errorf("TLS certificate %s given without its private key", f.CertFile)
+	}
+	cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the TLS certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if f.ClientCAFile == "" {
+		if f.RequireClientCert {
+			return nil, fmt.Errorf("client certificates are required but no client CA is given")
+		}
+		return config, nil
+	}
+	pem, err := os.ReadFile(f.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the client CA: %v", err)
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s holds no PEM certificate", f.ClientCAFile)
+	}
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if f.RequireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// certIdentity returns the identity of the verified client certificate of a connection:
+// its first URI SAN, such as a SPIFFE ID, or else its subject common name.
+// It is empty when the client presented no certificate.
+func certIdentity(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return ""
+	}
+	cert := state.VerifiedChains[0][0]
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	return cert.Subject.CommonName
+}
+
+// identityKey is the context key of the identity of the client of a request.
+type identityKey struct{}
+
+// ClientIdentity returns the identity of the client certificate of the request of ctx, as tagged
+// by withClientIdentity or found on a gRPC connection, or "anonymous" without certificate.
+func ClientIdentity(ctx context.Context) string {
+	if identity, ok := ctx.Value(identityKey{}).(string); ok {
+		return identity
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			if identity := certIdentity(&info.State); identity != "" {
+				return identity
+			}
+		}
+	}
+	return "anonymous"
+}
+
+// withClientIdentity tags each request with the identity of its client certificate and logs it for auditing.
+func withClientIdentity(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := certIdentity(r.TLS)
+		if identity == "" {
+			identity = "anonymous"
+		}
+		requestLogger(r.Context()).Info("Request", "method", r.Method, "path", r.URL.Path, "identity", identity, "remote", r.RemoteAddr)
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+	})
+}
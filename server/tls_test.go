@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is a throwaway certificate authority signing the certificates of a test.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	ca := &testCA{cert: &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}}
+	var err error
+	if ca.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, ca.cert, ca.cert, &ca.key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	ca.pem = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return ca
+}
+
+// issue signs a certificate of template and returns it with its key, in PEM.
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore, template.NotAfter = ca.cert.NotBefore, ca.cert.NotAfter
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// clientCert returns a client certificate of ca for the common name and the URI SANs.
+func (ca *testCA) clientCert(t *testing.T, commonName string, uris ...string) *tls.Certificate {
+	t.Helper()
+	template := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	for _, uri := range uris {
+		parsed, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.URIs = append(template.URIs, parsed)
+	}
+	certPEM, keyPEM := ca.issue(t, template)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cert
+}
+
+// writeFile writes data to name in dir and returns its path.
+func writeFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTLSFilesConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "test CA")
+	certPEM, keyPEM := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "server"}})
+	cert, key := writeFile(t, dir, "server.pem", certPEM), writeFile(t, dir, "server.key", keyPEM)
+	clientCA, notPEM := writeFile(t, dir, "ca.pem", ca.pem), writeFile(t, dir, "ca.txt", []byte("not a certificate"))
+	_, otherKey := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "other"}})
+
+	tests := []struct {
+		name       string
+		files      TLSFiles
+		clientAuth tls.ClientAuthType
+		err        string
+	}{
+		{"server only", TLSFiles{CertFile: cert, KeyFile: key}, tls.NoClientCert, ""},
+		{"optional client certificates", TLSFiles{CertFile: cert, KeyFile: key, ClientCAFile: clientCA}, tls.VerifyClientCertIfGiven, ""},
+		{"required client certificates", TLSFiles{CertFile: cert, KeyFile: key, ClientCAFile: clientCA, RequireClientCert: true}, tls.RequireAndVerifyClientCert, ""},
+		{"no key", TLSFiles{CertFile: cert}, 0, "without its private key"},
+		{"key of another certificate", TLSFiles{CertFile: cert, KeyFile: writeFile(t, dir, "other.key", otherKey)}, 0, "failed to load the TLS certificate"},
+		{"required without a CA", TLSFiles{CertFile: cert, KeyFile: key, RequireClientCert: true}, 0, "no client CA"},
+		{"missing CA", TLSFiles{CertFile: cert, KeyFile: key, ClientCAFile: filepath.Join(dir, "missing.pem")}, 0, "failed to read the client CA"},
+		{"CA without a certificate", TLSFiles{CertFile: cert, KeyFile: key, ClientCAFile: notPEM}, 0, "holds no PEM certificate"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := test.files.Config()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.ClientAuth != test.clientAuth || config.MinVersion != tls.VersionTLS12 {
+				t.Errorf("got client auth %v and min version %x, expected %v and TLS 1.2", config.ClientAuth, config.MinVersion, test.clientAuth)
+			}
+		})
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca, other := newTestCA(t, "test CA"), newTestCA(t, "other CA")
+	certPEM, keyPEM := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "server"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	files := TLSFiles{
+		CertFile:     writeFile(t, dir, "server.pem", certPEM),
+		KeyFile:      writeFile(t, dir, "server.key", keyPEM),
+		ClientCAFile: writeFile(t, dir, "ca.pem", ca.pem),
+	}
+
+	// serve answers the identity tagged on each request, with client certificates required or optional
+	serve := func(require bool) *httptest.Server {
+		files := files
+		files.RequireClientCert = require
+		config, err := files.Config()
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := httptest.NewUnstartedServer(withClientIdentity(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, ClientIdentity(r.Context()))
+		})))
+		server.TLS = config
+		server.StartTLS()
+		t.Cleanup(server.Close)
+		return server
+	}
+	servers := map[bool]*httptest.Server{true: serve(true), false: serve(false)}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	tests := []struct {
+		name     string
+		require  bool
+		cert     *tls.Certificate
+		identity string // Empty when the connection is refused
+	}{
+		{"common name", true, ca.clientCert(t, "camera-1"), "camera-1"},
+		{"URI SAN", true, ca.clientCert(t, "camera-2", "spiffe://securesight/camera/2"), "spiffe://securesight/camera/2"},
+		{"no certificate", true, nil, ""},
+		{"certificate of another CA", true, other.clientCert(t, "intruder"), ""},
+		{"optional certificate", false, ca.clientCert(t, "camera-3"), "camera-3"},
+		{"anonymous", false, nil, "anonymous"},
+		{"optional certificate of another CA", false, other.clientCert(t, "intruder"), "anonymous"}, // Not sent, the server names its CAs
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &tls.Config{RootCAs: roots}
+			if test.cert != nil {
+				config.Certificates = []tls.Certificate{*test.cert}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+			defer client.CloseIdleConnections()
+
+			resp, err := client.Get(servers[test.require].URL)
+			if test.identity == "" {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("got %d, expected the handshake to fail", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != test.identity {
+				t.Errorf("got identity %q, expected %q", body, test.identity)
+			}
+		})
+	}
+}
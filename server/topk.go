@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/tuneinsight/lattigo/v6/circuits/ckks/bootstrapping"
+	"github.com/tuneinsight/lattigo/v6/circuits/ckks/comparison"
+	"github.com/tuneinsight/lattigo/v6/circuits/ckks/minimax"
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+	"math"
+	"math/big"
+)
+
+// Response modes a query can select.
+const (
+	// ModeDistances returns an encrypted distance to every gallery entry.
+	ModeDistances = "distances"
+
+	// ModeTopK returns, per query, an encrypted vote vector counting the k nearest
+	// gallery entries of each class. The client learns nothing about the other entries.
+	// Entries tied within topKMargin all vote, so the votes can add up to more than k.
+	ModeTopK = "top-k"
+)
+
+// Upper bound on K, each neighbour costs one more encrypted minimum over the gallery
+const maxTopK = 16
+
+// Margin added to the minimum before comparing it with each distance, in normalized units.
+// Entries closer than this to the minimum are counted as winners too, in the same round,
+// which is how ties are broken: every tied entry gets a vote.
+const topKMargin = 1.0 / (1 << 12)
+
+// TopKGaloisElements returns the Galois elements a session must register to use ModeTopK:
+// rotations by every positive and negative power of two, and the complex conjugation used
+// by the comparison polynomials.
+func TopKGaloisElements(params ckks.Parameters) []uint64 {
+	var rotations []int
+	for k := 1; k < params.MaxSlots(); k <<= 1 {
+		rotations = append(rotations, k, -k)
+	}
+	return append(params.GaloisElements(rotations), params.GaloisElementForComplexConjugation())
+}
+
+// checkTopK validates the parameters of a ModeTopK query against the keys of the session.
+func checkTopK(query QueryRequest, session *Session) error {
+	if query.K < 1 || query.K > maxTopK {
+		return fmt.Errorf("mode %q needs K between 1 and %d, got %d", ModeTopK, maxTopK, query.K)
+	}
+	if session.Evk.RelinearizationKey == nil {
+		return fmt.Errorf("mode %q requires a relinearization key to evaluate the comparisons", ModeTopK)
+	}
+	if session.bootstrapper == nil {
+		return fmt.Errorf("mode %q requires the session to register bootstrapping keys", ModeTopK)
+	}
+	if err := checkGaloisKeys(&session.Evk, SummationGaloisElements(session.Params)); err != nil {
+		return err
+	}
+	return checkGaloisKeys(&session.Evk, TopKGaloisElements(session.Params))
+}
+
+// PredictVotes computes the encrypted distances of each query with PredictEncrypted and reduces them to
+// a vote vector: slot c of the returned ciphertext counts how many of the k nearest entries have label c.
+// The distances must have been summed on the server and fit in a single ciphertext per query.
+func PredictVotes(ctx context.Context, knnModel *KNN, pc *PublicContext) ([]rlwe.Ciphertext, []string, ckks.Parameters, error) {
+	if pc.Bootstrapper == nil {
+		return nil, nil, pc.Params, fmt.Errorf("mode %q requires the session to register bootstrapping keys", ModeTopK)
+	}
+
+	distances, params, err := PredictEncrypted(ctx, knnModel, pc)
+	if err != nil {
+		return nil, nil, params, err
+	}
+
+	labels := uniqueLabels(knnModel.Classes)
+	lo, hi := distanceRange(knnModel.Data, pc.Kernel)
+	evaluator := pc.Evaluator
+	if evaluator == nil {
+		evaluator = ckks.NewEvaluator(pc.Params, &pc.Evk)
+	}
+
+	// Each query is reduced in its own job, with its own copy of the bootstrapper
+	votes := make([]rlwe.Ciphertext, len(distances))
+	err = scheduler.Run(ctx, evaluator, params.MaxLevel(), len(distances), func(i int, evaluator *ckks.Evaluator, _ *rlwe.Ciphertext) error {
+		if len(distances[i]) != 1 {
+			return fmt.Errorf("gallery does not fit in one ciphertext, mode %q is not available", ModeTopK)
+		}
+		vote, err := topKVotes(ctx, &distances[i][0], labels, pc.K, lo, hi, evaluator, pc.Bootstrapper.ShallowCopy())
+		if err != nil {
+			return err
+		}
+		votes[i] = *vote
+		return nil
+	})
+	if err != nil {
+		return nil, nil, params, err
+	}
+	return votes, labels, params, nil
+}
+
+// topKVotes finds the k smallest summed distances with homomorphic comparisons and counts them per label.
+//
+// The distances, which lie in [lo, hi], are normalized to [0, 0.5] and the empty slots are set to 0.5.
+// Each round computes the minimum with a tournament of comparison.Min over the packs and then over the
+// blocks, replicates it to every slot, marks the entries within topKMargin of it with comparison.Step,
+// adds the marks to the votes and pushes the marked entries to 0.5 so that the next round finds the next
+// neighbour. A round marks every entry tied with the minimum, so the votes add up to more than k when
+// there are ties. Every comparison evaluates a composite sign polynomial and bootstraps when it runs out
+// of levels, so this mode is orders of magnitude slower than ModeDistances.
+func topKVotes(ctx context.Context, distance *Distance, labels []string, k int, lo, hi float64, evaluator *ckks.Evaluator, btp bootstrapping.Bootstrapper) (*rlwe.Ciphertext, error) {
+	params := *evaluator.GetParameters()
+	slots := params.MaxSlots()
+	cmp := comparison.NewEvaluator(params, minimax.NewEvaluator(params, evaluator, btp))
+	layout := newSlotLayout(distance, labels, -0.5*lo/(hi-lo), slots)
+
+	// Normalize the distances and bring them to the default scale, which the comparison outputs use,
+	// then shift the entries and fill the empty slots with the largest value
+	factor := params.DefaultScale().Div(distance.Distance.Scale).Value
+	factor.Mul(&factor, new(big.Float).SetFloat64(0.5/(hi-lo)))
+	d, err := evaluator.MulNew(&distance.Distance, &factor)
+	if err != nil {
+		return nil, err
+	}
+	if err := evaluator.Rescale(d, d); err != nil {
+		return nil, err
+	}
+	d.Scale = params.DefaultScale()
+	if err := evaluator.Add(d, layout.fill, d); err != nil {
+		return nil, err
+	}
+
+	var votes *rlwe.Ciphertext
+	for round := 0; round < k; round++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// Minimum over the packs of each block, then over the blocks, ending in the slot of the last pack of block 0
+		minimum := d.CopyNew()
+		for _, rotation := range layout.tournament {
+			rotated, err := evaluator.RotateNew(minimum, rotation)
+			if err != nil {
+				return nil, err
+			}
+			if minimum, err = cmp.Min(minimum, rotated); err != nil {
+				return nil, err
+			}
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		// Keep only that slot and copy it over every pack and block
+		if minimum, err = withLevels(minimum, 1, btp); err != nil {
+			return nil, err
+		}
+		if err := evaluator.Mul(minimum, layout.pivot, minimum); err != nil {
+			return nil, err
+		}
+		if err := evaluator.Rescale(minimum, minimum); err != nil {
+			return nil, err
+		}
+		if err := evaluator.Replicate(minimum, 1, layout.packs, minimum); err != nil {
+			return nil, err
+		}
+		if err := evaluator.Replicate(minimum, blockSize, layout.blocks, minimum); err != nil {
+			return nil, err
+		}
+
+		// winners = step(minimum + margin - d) is one on the nearest entries and zero elsewhere
+		diff, err := evaluator.SubNew(minimum, d)
+		if err != nil {
+			return nil, err
+		}
+		if err := evaluator.Add(diff, topKMargin, diff); err != nil {
+			return nil, err
+		}
+		winners, err := cmp.Step(diff)
+		if err != nil {
+			return nil, err
+		}
+
+		// Count the winners per label
+		if winners, err = withLevels(winners, 2, btp); err != nil {
+			return nil, err
+		}
+		count, err := countPerLabel(winners, layout, evaluator)
+		if err != nil {
+			return nil, err
+		}
+		if votes == nil {
+			votes = count
+		} else if err := evaluator.Add(votes, count, votes); err != nil {
+			return nil, err
+		}
+
+		// Push the winners out of reach of the next round
+		if round+1 < k {
+			if err := evaluator.Mul(winners, 0.5, winners); err != nil {
+				return nil, err
+			}
+			if err := evaluator.Rescale(winners, winners); err != nil {
+				return nil, err
+			}
+			if err := evaluator.Add(d, winners, d); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return votes, nil
+}
+
+// countPerLabel sums the slots of each label and writes the total of label c in slot c.
+// It consumes two levels.
+func countPerLabel(values *rlwe.Ciphertext, layout slotLayout, evaluator *ckks.Evaluator) (*rlwe.Ciphertext, error) {
+	var counts *rlwe.Ciphertext
+	for c := range layout.labelMasks {
+
+		// Keep the entries of label c and sum them into every slot
+		total, err := evaluator.MulNew(values, layout.labelMasks[c])
+		if err != nil {
+			return nil, err
+		}
+		if err := evaluator.Rescale(total, total); err != nil {
+			return nil, err
+		}
+		if err := evaluator.InnerSum(total, 1, layout.slots, total); err != nil {
+			return nil, err
+		}
+
+		// Keep the total in slot c only
+		if err := evaluator.Mul(total, layout.labelSlots[c], total); err != nil {
+			return nil, err
+		}
+		if err := evaluator.Rescale(total, total); err != nil {
+			return nil, err
+		}
+
+		if counts == nil {
+			counts = total
+		} else if err := evaluator.Add(counts, total, counts); err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+// withLevels bootstraps ct if fewer than levels levels are left.
+func withLevels(ct *rlwe.Ciphertext, levels int, btp bootstrapping.Bootstrapper) (*rlwe.Ciphertext, error) {
+	if ct.Level() >= levels+btp.MinimumInputLevel() {
+		return ct, nil
+	}
+	return btp.Bootstrap(ct)
+}
+
+// slotLayout describes where the entries of a merged Distance sit in the slots,
+// and holds the plaintext masks derived from it.
+type slotLayout struct {
+	slots      int
+	packs      int         // Number of merged packs, rounded up to a power of two
+	blocks     int         // Number of blocks of the largest pack, rounded up to a power of two
+	tournament []int       // Rotations reducing the minimum into the pivot slot
+	fill       []float64   // 0.5 in the slots holding no entry, the normalized shift in the others
+	pivot      []float64   // One in the slot receiving the minimum
+	labelMasks [][]float64 // For each label, one in the slots of its entries
+	labelSlots [][]float64 // For each label c, one in slot c
+}
+
+// newSlotLayout computes the layout of a Distance merged by mergeDistances,
+// where target x of the r-th pack sits in slot x*blockSize - r.
+func newSlotLayout(distance *Distance, labels []string, shift float64, slots int) slotLayout {
+	layout := slotLayout{
+		slots:      slots,
+		packs:      nextPowerOfTwo(len(distance.PackSizes)),
+		fill:       make([]float64, slots),
+		pivot:      make([]float64, slots),
+		labelMasks: make([][]float64, len(labels)),
+		labelSlots: make([][]float64, len(labels)),
+	}
+
+	index := make(map[string]int, len(labels))
+	for c, label := range labels {
+		index[label] = c
+		layout.labelMasks[c] = make([]float64, slots)
+		layout.labelSlots[c] = make([]float64, slots)
+		layout.labelSlots[c][c] = 1
+	}
+
+	for i := range layout.fill {
+		layout.fill[i] = 0.5
+	}
+
+	classIdx, maxSize := 0, 0
+	for r, size := range distance.PackSizes {
+		for x := 0; x < size; x++ {
+			slot := (x*blockSize - r + slots) % slots
+			layout.fill[slot] = shift
+			layout.labelMasks[index[distance.Classes[classIdx]]][slot] = 1
+			classIdx++
+		}
+		if size > maxSize {
+			maxSize = size
+		}
+	}
+	layout.blocks = nextPowerOfTwo(maxSize)
+
+	// Slot i ends up holding the minimum of slots i, i+1, ..., i+packs-1 and then of
+	// i, i+blockSize, ..., so the last pack of block 0 sees every entry
+	for step := 1; step < layout.packs; step <<= 1 {
+		layout.tournament = append(layout.tournament, step)
+	}
+	for step := 1; step < layout.blocks; step <<= 1 {
+		layout.tournament = append(layout.tournament, step*blockSize)
+	}
+	layout.pivot[(slots-(layout.packs-1))%slots] = 1
+
+	return layout
+}
+
+// uniqueLabels returns the distinct classes in order of first appearance.
+func uniqueLabels(classes []string) []string {
+	var labels []string
+	seen := make(map[string]bool)
+	for _, class := range classes {
+		if !seen[class] {
+			seen[class] = true
+			labels = append(labels, class)
+		}
+	}
+	return labels
+}
+
+// distanceRange returns the interval holding the distances of the kernel between any query no longer than
+// maxNorm and the targets in data. With m = maxNorm and T = max ||t||, the squared difference lies in
+// [0, (m+T)²] and the inner product, which leaves out ||q||², in [-m², T²+2mT].
+func distanceRange(data [][]float64, kernel string) (lo, hi float64) {
+	var targetNorm float64
+	for _, vec := range data {
+		targetNorm = math.Max(targetNorm, l2Norm(vec))
+	}
+	if kernel == KernelInnerProduct {
+		return -maxNorm * maxNorm, targetNorm*targetNorm + 2*maxNorm*targetNorm
+	}
+	return 0, (maxNorm + targetNorm) * (maxNorm + targetNorm)
+}
+
+// l2Norm returns ||vec||.
+func l2Norm(vec []float64) float64 {
+	var norm float64
+	for _, v := range vec {
+		norm += v * v
+	}
+	return math.Sqrt(norm)
+}
+
+// nextPowerOfTwo returns the smallest power of two greater or equal to n.
+func nextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"github.com/tuneinsight/lattigo/v6/circuits/ckks/bootstrapping"
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheckTopK(t *testing.T) {
+	keys := newTestKeys(t)
+	conjugation := keys.params.GaloisElementForComplexConjugation()
+
+	// Only the presence of the keys and of the bootstrapper is checked, so empty ones stand in for them
+	session := func(rlk bool, btp bool, skip uint64) *Session {
+		s := &Session{Params: keys.params, Evk: rlwe.MemEvaluationKeySet{GaloisKeys: map[uint64]*rlwe.GaloisKey{}}}
+		if rlk {
+			s.Evk.RelinearizationKey = &rlwe.RelinearizationKey{}
+		}
+		if btp {
+			s.bootstrapper = &bootstrapping.Evaluator{}
+		}
+		for _, galEl := range append(SummationGaloisElements(keys.params), TopKGaloisElements(keys.params)...) {
+			if galEl != skip {
+				s.Evk.GaloisKeys[galEl] = &rlwe.GaloisKey{}
+			}
+		}
+		return s
+	}
+
+	tests := []struct {
+		name    string
+		k       int
+		session *Session
+		err     string
+	}{
+		{"valid", 3, session(true, true, 0), ""},
+		{"largest k", maxTopK, session(true, true, 0), ""},
+		{"k zero", 0, session(true, true, 0), "needs K between 1 and"},
+		{"k too large", maxTopK + 1, session(true, true, 0), "needs K between 1 and"},
+		{"no relinearization key", 3, session(false, true, 0), "requires a relinearization key"},
+		{"no bootstrapping keys", 3, session(true, false, 0), "requires the session to register bootstrapping keys"},
+		{"no summation key", 3, session(true, true, keys.params.GaloisElement(blockSize/2)), "missing the Galois key"},
+		{"no conjugation key", 3, session(true, true, conjugation), "missing the Galois key"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkTopK(QueryRequest{Mode: ModeTopK, K: test.k}, test.session)
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestNewSlotLayout(t *testing.T) {
+	const slots = 1 << 13
+	distance := &Distance{
+		PackSizes: []int{3, 2, 1},
+		Classes:   []string{"alice", "bob", "alice", "carol", "bob", "carol"},
+	}
+	labels := uniqueLabels(distance.Classes)
+	layout := newSlotLayout(distance, labels, 0.25, slots)
+
+	if layout.packs != 4 || layout.blocks != 4 {
+		t.Errorf("got %d packs and %d blocks, expected 4 and 4", layout.packs, layout.blocks)
+	}
+	if expected := []int{1, 2, blockSize, 2 * blockSize}; !slices.Equal(layout.tournament, expected) {
+		t.Errorf("got tournament %v, expected %v", layout.tournament, expected)
+	}
+	if layout.pivot[slots-3] != 1 || slices.Index(layout.pivot, 1) != slots-3 || slices.Max(layout.pivot) != 1 {
+		t.Errorf("pivot not in slot %d alone", slots-3)
+	}
+
+	// Target x of pack r in slot x*blockSize - r, labelled in order
+	entries := map[int]string{
+		0:             "alice",
+		blockSize:     "bob",
+		2 * blockSize: "alice",
+		slots - 1:     "carol",
+		blockSize - 1: "bob",
+		slots - 2:     "carol",
+	}
+	for slot := 0; slot < slots; slot++ {
+		label, ok := entries[slot]
+		fill := 0.5
+		if ok {
+			fill = 0.25
+		}
+		if layout.fill[slot] != fill {
+			t.Errorf("slot %d filled with %f, expected %f", slot, layout.fill[slot], fill)
+		}
+		for c, l := range labels {
+			if mask := layout.labelMasks[c][slot]; (mask == 1) != (ok && l == label) {
+				t.Errorf("slot %d has mask %f for label %q", slot, mask, l)
+			}
+		}
+	}
+	for c := range labels {
+		if layout.labelSlots[c][c] != 1 || slices.Max(layout.labelSlots[c]) != 1 || slices.Index(layout.labelSlots[c], 1) != c {
+			t.Errorf("label %d not in slot %d alone", c, c)
+		}
+	}
+}
+
+func TestCountPerLabel(t *testing.T) {
+	keys := newTestKeys(t)
+	slots := keys.params.MaxSlots()
+	evk := rlwe.NewMemEvaluationKeySet(nil, keys.kgen.GenGaloisKeysNew(keys.params.GaloisElementsForInnerSum(1, slots), keys.sk)...)
+	distance := &Distance{
+		PackSizes: []int{3, 2},
+		Classes:   []string{"alice", "bob", "alice", "carol", "alice"},
+	}
+	labels := uniqueLabels(distance.Classes)
+	layout := newSlotLayout(distance, labels, 0, slots)
+
+	// Ones on the entries, noise elsewhere that the masks must remove
+	values := make([]float64, slots)
+	for i := range values {
+		values[i] = 0.25
+	}
+	for _, slot := range []int{0, blockSize, 2 * blockSize, slots - 1, blockSize - 1} {
+		values[slot] = 1
+	}
+	counts, err := countPerLabel(keys.encrypt(t, values), layout, ckks.NewEvaluator(keys.params, evk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := keys.decrypt(t, counts)
+	expected := []float64{3, 1, 1}
+	for c := range labels {
+		if math.Abs(got[c]-expected[c]) > 1e-3 {
+			t.Errorf("label %q counted %f, expected %f", labels[c], got[c], expected[c])
+		}
+	}
+	if math.Abs(got[len(labels)]) > 1e-3 {
+		t.Errorf("slot %d holds %f, expected zero", len(labels), got[len(labels)])
+	}
+}
+
+func TestTopKGaloisElements(t *testing.T) {
+	keys := newTestKeys(t)
+	galEls := TopKGaloisElements(keys.params)
+	for _, rotation := range []int{1, -1, blockSize, -blockSize, keys.params.MaxSlots() / 2} {
+		if !slices.Contains(galEls, keys.params.GaloisElement(rotation)) {
+			t.Errorf("rotation by %d missing", rotation)
+		}
+	}
+	if !slices.Contains(galEls, keys.params.GaloisElementForComplexConjugation()) {
+		t.Error("complex conjugation missing")
+	}
+}
+
+func TestUniqueLabels(t *testing.T) {
+	tests := []struct {
+		classes []string
+		labels  []string
+	}{
+		{nil, nil},
+		{[]string{"alice"}, []string{"alice"}},
+		{[]string{"bob", "alice", "bob", "carol", "alice"}, []string{"bob", "alice", "carol"}},
+	}
+	for _, test := range tests {
+		if labels := uniqueLabels(test.classes); !slices.Equal(labels, test.labels) {
+			t.Errorf("uniqueLabels(%q) = %q, expected %q", test.classes, labels, test.labels)
+		}
+	}
+}
+
+func TestDistanceRange(t *testing.T) {
+	tests := []struct {
+		data   [][]float64
+		kernel string
+		lo, hi float64
+	}{
+		{nil, KernelSquaredDifference, 0, 1},
+		{[][]float64{{1, 0}, {0, 0}}, KernelSquaredDifference, 0, 4},
+		{[][]float64{{1, 0}, {0, 0}}, KernelInnerProduct, -1, 3},
+		{[][]float64{{1, 1}, {0, 3}, {-2, 0}}, KernelSquaredDifference, 0, 16},
+		{[][]float64{{1, 1}, {0, 3}, {-2, 0}}, KernelInnerProduct, -1, 15},
+	}
+	for _, test := range tests {
+		if lo, hi := distanceRange(test.data, test.kernel); lo != test.lo || hi != test.hi {
+			t.Errorf("distanceRange(%v, %q) = [%f, %f], expected [%f, %f]", test.data, test.kernel, lo, hi, test.lo, test.hi)
+		}
+	}
+}
+
+func TestTopKVotes(t *testing.T) {
+	startTestScheduler()
+
+	// Small insecure parameters, with a secret-key bootstrapper standing in for the bootstrapping keys
+	params, err := ckks.NewParametersFromLiteral(ckks.ParametersLiteral{
+		LogN:            11,
+		LogQ:            []int{60, 40, 40, 40, 40, 40, 40, 40, 40, 40, 40, 40, 40},
+		LogP:            []int{61, 61},
+		LogDefaultScale: 40,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kgen := rlwe.NewKeyGenerator(params)
+	sk := kgen.GenSecretKeyNew()
+	keys := &testKeys{params: params, kgen: kgen, sk: sk, encoder: ckks.NewEncoder(params), encryptor: rlwe.NewEncryptor(params, sk)}
+	galEls := append(SummationGaloisElements(params), TopKGaloisElements(params)...)
+	galEls = append(galEls, params.GaloisElementsForInnerSum(1, params.MaxSlots())...)
+	evk := rlwe.NewMemEvaluationKeySet(kgen.GenRelinearizationKeyNew(sk), kgen.GenGaloisKeysNew(galEls, sk)...)
+	btp := bootstrapping.NewSecretKeyBootstrapper(params, sk)
+
+	// A query close to the third entry, and a gallery holding two copies of it under different labels
+	model := testGallery(3, 7, "alice", "bob", "carol")
+	query := slices.Clone(model.Data[2])
+	query[0] += 0.05
+	tied := &KNN{Data: append(slices.Clone(model.Data), model.Data[2]), Classes: append(slices.Clone(model.Classes), "dave")}
+
+	tests := []struct {
+		name   string
+		model  *KNN
+		kernel string
+		k      int
+		total  float64 // Sum of the votes, k plus the ties
+	}{
+		{"squared difference", model, KernelSquaredDifference, 3, 3},
+		{"inner product", model, KernelInnerProduct, 2, 2},
+		{"tie", tied, KernelSquaredDifference, 1, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pc := &PublicContext{
+				Params:    params,
+				Evk:       *evk,
+				Evaluator: ckks.NewEvaluator(params, evk),
+				Kernel:    test.kernel,
+				SumSlots:  true,
+				Mode:      ModeTopK,
+				K:         test.k,
+				Query:     []rlwe.Ciphertext{*keys.encrypt(t, replicate(params, query))},
+			}
+			distances, _, err := PredictEncrypted(context.Background(), test.model, pc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(distances[0]) != 1 {
+				t.Fatalf("got %d distance ciphertexts, expected 1", len(distances[0]))
+			}
+			labels := uniqueLabels(test.model.Classes)
+			lo, hi := distanceRange(test.model.Data, test.kernel)
+			votes, err := topKVotes(context.Background(), &distances[0][0], labels, test.k, lo, hi, pc.Evaluator, btp)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Plaintext k-NN, where the entries tied with a neighbour vote too
+			plain := make([]float64, len(test.model.Data))
+			for i, vec := range test.model.Data {
+				plain[i] = squaredDistance(query, vec)
+			}
+			order := make([]int, len(plain))
+			for i := range order {
+				order[i] = i
+			}
+			slices.SortFunc(order, func(a, b int) int { return cmp.Compare(plain[a], plain[b]) })
+			margin := 2 * topKMargin * (hi - lo)
+			expected := make([]float64, len(labels))
+			for rank, i := range order {
+				if rank >= test.k && plain[i]-plain[order[test.k-1]] > margin {
+					break
+				}
+				expected[slices.Index(labels, test.model.Classes[i])]++
+				if rank > 0 && gap(plain, order, rank) > 0 && gap(plain, order, rank) < 4*margin {
+					t.Fatalf("entries %d and %d are too close to tell apart", order[rank-1], i)
+				}
+			}
+
+			values := keys.decrypt(t, votes)
+			var total float64
+			for c, label := range labels {
+				if math.Abs(values[c]-expected[c]) > 0.1 {
+					t.Errorf("label %q got %f votes, expected %f", label, values[c], expected[c])
+				}
+				total += values[c]
+			}
+			if math.Abs(total-test.total) > 0.1 {
+				t.Errorf("votes add up to %f, expected %f", total, test.total)
+			}
+			if math.Abs(values[len(labels)]) > 0.1 {
+				t.Errorf("slot %d holds %f, expected zero", len(labels), values[len(labels)])
+			}
+		})
+	}
+}
+
+// gap returns the distance between the entries of the given rank and the previous one.
+func gap(distances []float64, order []int, rank int) float64 {
+	return distances[order[rank]] - distances[order[rank-1]]
+}
+
+func TestNextPowerOfTwo(t *testing.T) {
+	tests := []struct{ n, p int }{{0, 1}, {1, 1}, {2, 2}, {3, 4}, {16, 16}, {17, 32}}
+	for _, test := range tests {
+		if p := nextPowerOfTwo(test.n); p != test.p {
+			t.Errorf("nextPowerOfTwo(%d) = %d, expected %d", test.n, p, test.p)
+		}
+	}
+}
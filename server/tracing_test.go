@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name   string
+		header string
+		valid  bool
+	}{
+		{"sampled", "00-" + traceID + "-" + spanID + "-01", true},
+		{"not sampled", "00-" + traceID + "-" + spanID + "-00", true},
+		{"surrounding spaces", " 00-" + traceID + "-" + spanID + "-01 ", true},
+		{"empty", "", false},
+		{"other version", "01-" + traceID + "-" + spanID + "-01", false},
+		{"short trace ID", "00-" + traceID[2:] + "-" + spanID + "-01", false},
+		{"long span ID", "00-" + traceID + "-" + spanID + "00-01", false},
+		{"missing flags", "00-" + traceID + "-" + spanID, false},
+		{"extra field", "00-" + traceID + "-" + spanID + "-01-00", false},
+		{"not hex", "00-" + strings.Repeat("g", 32) + "-" + spanID + "-01", false},
+		{"zero trace ID", "00-" + strings.Repeat("0", 32) + "-" + spanID + "-01", false},
+		{"zero span ID", "00-" + traceID + "-" + strings.Repeat("0", 16) + "-01", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sc, ok := ParseTraceparent(test.header)
+			if ok != test.valid {
+				t.Fatalf("got %v, expected %v", ok, test.valid)
+			}
+			if ok && sc.Traceparent() != "00-"+traceID+"-"+spanID+"-01" {
+				t.Errorf("parsed back into %q", sc.Traceparent())
+			}
+		})
+	}
+}
+
+func TestTracer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.json")
+	var err error
+	if tracer, err = OpenTracer(path, "server"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { tracer = nil }()
+
+	// A request traced by the client, with a stage and two predictions running side by side
+	ctx := withRemoteSpan(context.Background(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, request := StartSpan(ctx, "POST /api/knn", "request_id", "r1")
+	stageCtx, stage := StartSpan(ctx, "predict")
+	_, first := StartParallelSpan(stageCtx, "pack 0")
+	_, second := StartParallelSpan(stageCtx, "pack 1")
+	second.End()
+	first.End()
+	first.End()
+	stage.End()
+	request.End()
+	if err := tracer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []traceEvent
+	if err := json.Unmarshal(data, &events); err != nil {
+		t.Fatalf("trace file is not JSON: %v\n%s", err, data)
+	}
+	spans := make(map[string]traceEvent)
+	for _, event := range events[1:] {
+		spans[event.Name] = event
+	}
+	if len(events) != 5 || events[0].Phase != "M" || len(spans) != 4 {
+		t.Fatalf("got events %+v, expected the process name and 4 spans once each", events)
+	}
+	for _, name := range []string{"POST /api/knn", "predict", "pack 0", "pack 1"} {
+		if spans[name].Args["trace_id"] != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("span %q is in trace %v", name, spans[name].Args["trace_id"])
+		}
+	}
+	parents := map[string]string{"POST /api/knn": "", "predict": "POST /api/knn", "pack 0": "predict", "pack 1": "predict"}
+	for name, parent := range parents {
+		expected := "00f067aa0ba902b7"
+		if parent != "" {
+			expected = spans[parent].Args["span_id"].(string)
+		}
+		if spans[name].Args["parent_id"] != expected {
+			t.Errorf("span %q has parent %v, expected %s", name, spans[name].Args["parent_id"], expected)
+		}
+	}
+	if spans["predict"].TID != spans["POST /api/knn"].TID || spans["pack 0"].TID == spans["pack 1"].TID {
+		t.Errorf("stages must share the track of their request and parallel spans get their own, got %+v", spans)
+	}
+	if spans["POST /api/knn"].Args["request_id"] != "r1" {
+		t.Errorf("request span lost its attributes: %v", spans["POST /api/knn"].Args)
+	}
+}
+
+func TestSpansOffWithoutTracer(t *testing.T) {
+	ctx, span := StartSpan(context.Background(), "request")
+	span.SetAttr("key", "value")
+	span.End()
+	if span != nil || SpanFromContext(ctx).IsValid() {
+		t.Errorf("got span %v without a tracer", span)
+	}
+}
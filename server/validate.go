@@ -0,0 +1,633 @@
+package main
+
+import (
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/tuneinsight/lattigo/v6/circuits/ckks/bootstrapping"
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+	"math"
+	"math/bits"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// Validation of client input
+//
+// Sessions and queries carry Lattigo binary encodings whose length prefixes Lattigo trusts:
+// a forged prefix makes UnmarshalBinary allocate gigabytes or panic. Every encoding is first
+// walked by a layoutReader, which checks each prefix against the bytes left and the shapes of
+// the accepted parameter sets, and only then decoded by Lattigo, under recover. The decoded
+// parameters, keys and ciphertexts are then checked against the parameters of the session and
+// the ValidationPolicy. Whatever the body format, failures are *ValidationError, sent to HTTP
+// clients as JSON with a 4xx status and to gRPC clients as InvalidArgument.
+
+// ValidationPolicy bounds what a client may register or query.
+type ValidationPolicy struct {
+	MaxQueries    int     `yaml:"max-queries"`     // Ciphertexts in one query request
+	MaxGaloisKeys int     `yaml:"max-galois-keys"` // Galois keys in one evaluation key set
+	MaxScaleDrift float64 `yaml:"max-scale-drift"` // Largest gap, in bits, between the scale of a query ciphertext and the default scale
+}
+
+// policy is the ValidationPolicy enforced by the server, set by Config.Apply.
+var policy = ValidationPolicy{
+	MaxQueries:    64,
+	MaxGaloisKeys: 256,
+	MaxScaleDrift: 1,
+}
+
+// ValidationError reports input rejected by the validation layer.
+// It is written as the JSON body of the error response.
+type ValidationError struct {
+	Status int    `json:"Status"` // HTTP status: 400 for malformed input, 422 for input refused by policy
+	Field  string `json:"Field"`  // Part of the request at fault, for instance "Evk" or "Query[2]"
+	Reason string `json:"Error"`
+	err    error  // Sentinel error wrapped, if any
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Reason)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.err
+}
+
+// invalid returns a ValidationError for malformed input.
+func invalid(field, format string, args ...any) *ValidationError {
+	return &ValidationError{Status: http.StatusBadRequest, Field: field, Reason: fmt.Sprintf(format, args...)}
+}
+
+// refused returns a ValidationError for well-formed input that the server policy refuses.
+func refused(field, format string, args ...any) *ValidationError {
+	return &ValidationError{Status: http.StatusUnprocessableEntity, Field: field, Reason: fmt.Sprintf(format, args...)}
+}
+
+// writeValidationError writes err as JSON if it is a *ValidationError, and reports whether it was.
+func writeValidationError(w http.ResponseWriter, err error) bool {
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) {
+		return false
+	}
+	writeJSON(w, invalid.Status, invalid)
+	return true
+}
+
+// encodingLimits bounds the shapes of the encodings accepted from clients.
+type encodingLimits struct {
+	maxLogN    int // Largest ring degree of the accepted parameters, bootstrapping included
+	maxModuli  int // Largest number of moduli in Q or P
+	metaDataSz int // Size of the encoded rlwe.MetaData of a ciphertext
+}
+
+// limits derives the encodingLimits from the accepted parameter sets, checked at startup.
+var limits = sync.OnceValue(func() encodingLimits {
+	l := encodingLimits{metaDataSz: rlwe.MetaData{}.BinarySize()}
+	grow := func(params ckks.Parameters) {
+		l.maxLogN = max(l.maxLogN, params.LogN())
+		l.maxModuli = max(l.maxModuli, params.QCount(), params.PCount())
+	}
+	accepted, _ := acceptedParams()
+	for _, params := range accepted {
+		grow(params)
+	}
+	btp, _ := acceptedBootstrapping()
+	for _, params := range btp {
+		if params != nil {
+			grow(params.BootstrappingParameters)
+		}
+	}
+	return l
+})
+
+// layoutReader walks a Lattigo binary encoding without decoding it. Every length prefix is
+// checked against the bytes left and the encodingLimits, so that an encoding it accepts
+// cannot make UnmarshalBinary allocate much more than its own size.
+type layoutReader struct {
+	data   []byte
+	limits encodingLimits
+	err    error
+}
+
+func newLayoutReader(data []byte) *layoutReader {
+	return &layoutReader{data: data, limits: limits()}
+}
+
+// fail records the first error and stops the walk.
+func (r *layoutReader) fail(format string, args ...any) {
+	if r.err == nil {
+		r.err = fmt.Errorf(format, args...)
+	}
+	r.data = nil
+}
+
+// finish returns the error of the walk, if any, or complains about trailing bytes.
+func (r *layoutReader) finish() error {
+	if r.err == nil && len(r.data) > 0 {
+		r.err = fmt.Errorf("%d trailing bytes", len(r.data))
+	}
+	return r.err
+}
+
+func (r *layoutReader) next(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.data)) {
+		r.fail("truncated encoding, %d bytes needed but %d left", n, len(r.data))
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *layoutReader) u8() uint8 {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *layoutReader) u32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *layoutReader) u64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+// flag reads the presence byte of an optional value.
+func (r *layoutReader) flag() bool {
+	switch v := r.u8(); v {
+	case 0:
+		return false
+	case 1:
+		return true
+	default:
+		r.fail("presence flag %d is neither 0 nor 1", v)
+		return false
+	}
+}
+
+// count checks a length prefix n against max and against the bytes left,
+// given that every element takes at least minSize bytes.
+func (r *layoutReader) count(what string, n, max, minSize uint64) int {
+	if r.err != nil {
+		return 0
+	}
+	if n > max {
+		r.fail("%d %s, at most %d are accepted", n, what, max)
+		return 0
+	}
+	if n > uint64(len(r.data))/minSize {
+		r.fail("%d %s announced but only %d bytes left", n, what, len(r.data))
+		return 0
+	}
+	return int(n)
+}
+
+// poly walks a ring.Poly: one row of coefficients per modulus, all of the same power-of-two length.
+func (r *layoutReader) poly() {
+	rows := r.count("moduli", r.u64(), uint64(r.limits.maxModuli), 8)
+	var degree uint64
+	for i := 0; i < rows && r.err == nil; i++ {
+		n := r.u64()
+		switch {
+		case r.err != nil:
+		case n == 0 || bits.OnesCount64(n) != 1 || n > 1<<r.limits.maxLogN:
+			r.fail("ring degree %d is not a power of two up to 2^%d", n, r.limits.maxLogN)
+		case i > 0 && n != degree:
+			r.fail("rows of %d and %d coefficients in the same polynomial", degree, n)
+		}
+		degree = n
+		r.next(n * 8)
+	}
+}
+
+// ciphertext walks an rlwe.Ciphertext: optional metadata, then at most three polynomials.
+func (r *layoutReader) ciphertext() {
+	if r.flag() {
+		r.next(uint64(r.limits.metaDataSz))
+	}
+	for n := r.count("polynomials", r.u64(), 3, 8); n > 0; n-- {
+		r.poly()
+	}
+}
+
+// gadgetCiphertext walks the rlwe.GadgetCiphertext of a key: a matrix of pairs of polynomials over QP.
+func (r *layoutReader) gadgetCiphertext() {
+	r.u64() // BaseTwoDecomposition
+	rows := r.count("decomposition rows", r.u64(), uint64(r.limits.maxModuli), 8)
+	for ; rows > 0; rows-- {
+		cols := r.count("decomposition columns", r.u64(), 64, 8)
+		for ; cols > 0; cols-- {
+			for n := r.count("polynomials", r.u64(), 2, 16); n > 0; n-- {
+				r.poly() // Q
+				r.poly() // P
+			}
+		}
+	}
+}
+
+// galoisKey walks an rlwe.GaloisKey.
+func (r *layoutReader) galoisKey() {
+	r.u64() // GaloisElement
+	r.u64() // NthRoot
+	r.gadgetCiphertext()
+}
+
+// evaluationKeySet walks an rlwe.MemEvaluationKeySet: an optional relinearization key,
+// then an optional map of Galois keys.
+func (r *layoutReader) evaluationKeySet() {
+	if r.flag() {
+		r.gadgetCiphertext()
+	}
+	if r.flag() {
+		for n := r.count("Galois keys", uint64(r.u32()), uint64(policy.MaxGaloisKeys), 40); n > 0; n-- {
+			r.u64() // Map key
+			r.galoisKey()
+		}
+	}
+}
+
+// bootstrappingKeys walks a bootstrapping.EvaluationKeys: six optional evaluation keys,
+// then an optional evaluation key set.
+func (r *layoutReader) bootstrappingKeys() {
+	for i := 0; i < 6; i++ {
+		if r.flag() {
+			r.gadgetCiphertext()
+		}
+	}
+	if r.flag() {
+		r.evaluationKeySet()
+	}
+}
+
+// decodeBinary walks data with walk, then decodes it into v.
+// Errors and panics of the decoder are both reported as a ValidationError for field.
+func decodeBinary(field string, data []byte, walk func(*layoutReader), v encoding.BinaryUnmarshaler) error {
+	r := newLayoutReader(data)
+	walk(r)
+	if err := r.finish(); err != nil {
+		return invalid(field, "%v", err)
+	}
+	return safely(field, func() error { return v.UnmarshalBinary(data) })
+}
+
+// safely runs a decoder, turning its error or panic into a ValidationError for field.
+func safely(field string, decode func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = invalid(field, "malformed encoding: %v", p)
+		}
+	}()
+	if err := decode(); err != nil {
+		return invalid(field, "%v", err)
+	}
+	return nil
+}
+
+// decodeParameters decodes CKKS parameters encoded as the JSON of a ckks.ParametersLiteral,
+// refusing ring degrees and moduli counts beyond the accepted parameter sets before any ring is built.
+func decodeParameters(field string, data []byte) (ckks.Parameters, error) {
+	var literal ckks.ParametersLiteral
+	if err := safely(field, func() error { return json.Unmarshal(data, &literal) }); err != nil {
+		return ckks.Parameters{}, err
+	}
+	if err := checkParametersLiteral(field, literal); err != nil {
+		return ckks.Parameters{}, err
+	}
+	var params ckks.Parameters
+	err := safely(field, func() (err error) {
+		params, err = ckks.NewParametersFromLiteral(literal)
+		return err
+	})
+	return params, err
+}
+
+// checkParametersLiteral checks the shape of a literal against the encodingLimits.
+func checkParametersLiteral(field string, literal ckks.ParametersLiteral) error {
+	l := limits()
+	if literal.LogN < 1 || literal.LogN > l.maxLogN || literal.LogNthRoot > l.maxLogN+1 {
+		return refused(field, "LogN %d is outside of the accepted parameter sets, at most %d", literal.LogN, l.maxLogN)
+	}
+	if max(len(literal.Q), len(literal.LogQ)) > l.maxModuli || max(len(literal.P), len(literal.LogP)) > l.maxModuli {
+		return refused(field, "more moduli than the accepted parameter sets, at most %d", l.maxModuli)
+	}
+	for _, logQ := range slices.Concat(literal.LogQ, literal.LogP) {
+		if logQ < 1 || logQ > 61 {
+			return invalid(field, "modulus of %d bits, moduli have between 1 and 61 bits", logQ)
+		}
+	}
+	return nil
+}
+
+// decodeBootstrappingParameters decodes the JSON of bootstrapping.Parameters after checking both
+// of its parameter literals, and requires them to be those of the parameter set of the session.
+func decodeBootstrappingParameters(field string, data []byte, set *ParameterSet) (*bootstrapping.Parameters, error) {
+	expected, err := expectedBootstrapping(set)
+	if err != nil {
+		return nil, err
+	}
+	if expected == nil {
+		return nil, refused(field, "parameter set %q cannot be bootstrapped", set.Name)
+	}
+
+	var literals struct {
+		ResidualParameters      ckks.ParametersLiteral
+		BootstrappingParameters ckks.ParametersLiteral
+	}
+	if err := safely(field, func() error { return json.Unmarshal(data, &literals) }); err != nil {
+		return nil, err
+	}
+	if err := checkParametersLiteral(field+".ResidualParameters", literals.ResidualParameters); err != nil {
+		return nil, err
+	}
+	if err := checkParametersLiteral(field+".BootstrappingParameters", literals.BootstrappingParameters); err != nil {
+		return nil, err
+	}
+
+	params := new(bootstrapping.Parameters)
+	if err := safely(field, func() error { return params.UnmarshalBinary(data) }); err != nil {
+		return nil, err
+	}
+	if !params.Equal(expected) {
+		return nil, refused(field, "bootstrapping parameters differ from those of parameter set %q", set.Name)
+	}
+	return params, nil
+}
+
+// checkGadgetCiphertext checks that every polynomial of a key has ring degree n and the same levels,
+// at most maxLevelQ and maxLevelP, with exact requiring the levels to be the maximum ones.
+func checkGadgetCiphertext(field string, ct *rlwe.GadgetCiphertext, n, maxLevelQ, maxLevelP int, exact bool) error {
+	if len(ct.Value) == 0 || len(ct.Value[0]) == 0 || len(ct.Value[0][0]) == 0 {
+		return invalid(field, "key holds no polynomial")
+	}
+	levelQ, levelP := ct.LevelQ(), ct.LevelP()
+	if levelQ > maxLevelQ || levelP > maxLevelP || exact && (levelQ != maxLevelQ || levelP != maxLevelP) {
+		return refused(field, "key at levels %d and %d, the parameters have levels %d and %d", levelQ, levelP, maxLevelQ, maxLevelP)
+	}
+	for i := range ct.Value {
+		for j := range ct.Value[i] {
+			if len(ct.Value[i][j]) != 2 {
+				return invalid(field, "key entry [%d][%d] has %d polynomials instead of 2", i, j, len(ct.Value[i][j]))
+			}
+			for _, p := range ct.Value[i][j] {
+				if p.Q.N() != n || p.Q.Level() != levelQ || levelP >= 0 && p.P.N() != n || p.P.Level() != levelP {
+					return invalid(field, "key entry [%d][%d] does not match ring degree %d and levels %d and %d", i, j, n, levelQ, levelP)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkEvaluationKeySet checks a relinearization key and Galois keys against params.
+func checkEvaluationKeySet(field string, evk *rlwe.MemEvaluationKeySet, params ckks.Parameters) error {
+	if rlk := evk.RelinearizationKey; rlk != nil {
+		if err := checkGadgetCiphertext(field+".RelinearizationKey", &rlk.GadgetCiphertext, params.N(), params.MaxLevelQ(), params.MaxLevelP(), true); err != nil {
+			return err
+		}
+	}
+	for galEl, gk := range evk.GaloisKeys {
+		keyField := fmt.Sprintf("%s.GaloisKeys[%d]", field, galEl)
+		switch {
+		case gk == nil:
+			return invalid(keyField, "missing key")
+		case gk.GaloisElement != galEl:
+			return invalid(keyField, "key for Galois element %d", gk.GaloisElement)
+		case galEl&1 == 0 || galEl >= uint64(params.NthRoot()):
+			return invalid(keyField, "not a Galois element of the ring, odd and below %d", params.NthRoot())
+		case gk.NthRoot != uint64(params.NthRoot()):
+			return invalid(keyField, "key for the %d-th root of unity, the parameters use %d", gk.NthRoot, params.NthRoot())
+		}
+		if err := checkGadgetCiphertext(keyField, &gk.GadgetCiphertext, params.N(), params.MaxLevelQ(), params.MaxLevelP(), true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkBootstrappingKeys checks bootstrapping keys against the bootstrapping parameters.
+// The ring switching keys live in the larger of the two rings, at any level.
+func checkBootstrappingKeys(field string, keys *bootstrapping.EvaluationKeys, params *bootstrapping.Parameters) error {
+	btp := params.BootstrappingParameters
+	n := max(btp.N(), params.ResidualParameters.N())
+	switchingKeys := []struct {
+		name string
+		evk  *rlwe.EvaluationKey
+	}{
+		{"EvkN1ToN2", keys.EvkN1ToN2},
+		{"EvkN2ToN1", keys.EvkN2ToN1},
+		{"EvkRealToCmplx", keys.EvkRealToCmplx},
+		{"EvkCmplxToReal", keys.EvkCmplxToReal},
+		{"EvkDenseToSparse", keys.EvkDenseToSparse},
+		{"EvkSparseToDense", keys.EvkSparseToDense},
+	}
+	for _, key := range switchingKeys {
+		if key.evk == nil {
+			continue
+		}
+		if err := checkGadgetCiphertext(field+"."+key.name, &key.evk.GadgetCiphertext, n, btp.MaxLevelQ(), btp.MaxLevelP(), false); err != nil {
+			return err
+		}
+	}
+	if keys.MemEvaluationKeySet == nil {
+		return invalid(field, "missing the evaluation keys of the bootstrapping circuit")
+	}
+	return checkEvaluationKeySet(field, keys.MemEvaluationKeySet, btp)
+}
+
+// checkQueryCiphertexts checks that the ciphertexts of a query are fresh encryptions under the parameters of its session,
+// at minLevel or above so that the evaluation of the query does not run out of levels.
+func checkQueryCiphertexts(query []rlwe.Ciphertext, session *Session, minLevel int) error {
+	params := session.Params
+	for i := range query {
+		ct := &query[i]
+		field := fmt.Sprintf("Query[%d]", i)
+		switch {
+		case ct.MetaData == nil:
+			return invalid(field, "ciphertext carries no metadata")
+		case len(ct.Value) != 2:
+			return refused(field, "ciphertext of degree %d, queries must be fresh ciphertexts of degree 1", len(ct.Value)-1)
+		case ct.Value[0].N() != params.N() || ct.Value[1].N() != params.N():
+			return refused(field, "ring degree 2^%d, the session parameters %q use 2^%d", bits.Len(uint(ct.Value[0].N()))-1, session.ParameterSet, params.LogN())
+		case ct.Value[0].Level() != ct.Value[1].Level():
+			return invalid(field, "polynomials at levels %d and %d", ct.Value[0].Level(), ct.Value[1].Level())
+		case ct.Level() > params.MaxLevel():
+			return refused(field, "level %d is above the maximum level %d of the session parameters %q", ct.Level(), params.MaxLevel(), session.ParameterSet)
+		case ct.Level() < minLevel:
+			return refused(field, "level %d is below the level %d the kernel and mode of the query need", ct.Level(), minLevel)
+		case !ct.IsNTT || ct.IsMontgomery:
+			return refused(field, "ciphertext must be in the NTT domain and not in the Montgomery domain")
+		case ct.LogDimensions != params.LogMaxDimensions():
+			return refused(field, "slot dimensions %v, the session parameters %q use %v", ct.LogDimensions, session.ParameterSet, params.LogMaxDimensions())
+		}
+		if drift := math.Abs(ct.Scale.Log2() - float64(params.LogDefaultScale())); !(drift <= policy.MaxScaleDrift) {
+			return refused(field, "scale of 2^%.2f is too far from the default scale 2^%d of the session parameters", ct.Scale.Log2(), params.LogDefaultScale())
+		}
+	}
+	return nil
+}
+
+// minQueryLevel returns the number of levels the kernel, the summation and the mode of a prepared query
+// consume before its result is returned. ModeTopK also keeps the levels its bootstrapper needs as input.
+func minQueryLevel(pc *PublicContext) int {
+	levels := kernelDepth[pc.Kernel]
+	if pc.SumSlots {
+		levels++ // Masking of the block sums
+	}
+	switch pc.Mode {
+	case ModeClassScores:
+		levels += classScoreDepth + 2 // Kernel polynomial and per-class count
+	case ModeTopK:
+		levels += 1 + pc.Bootstrapper.MinimumInputLevel() // Normalization of the distances, then bootstrapping
+	}
+	return levels
+}
+
+// rawBinary holds a Lattigo binary encoding until it is validated. Decoding gob into structs
+// with rawBinary fields keeps gob from calling the UnmarshalBinary methods of Lattigo.
+type rawBinary []byte
+
+func (b *rawBinary) UnmarshalBinary(data []byte) error {
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+// sessionEncodings holds the encodings of a SessionRequest, whatever the body format.
+// Its fields mirror SessionRequest, so that it also decodes the gob of legacy clients.
+type sessionEncodings struct {
+	Params            rawBinary // JSON of a ckks.ParametersLiteral
+	Rlk               rawBinary // rlwe.RelinearizationKey, only sent apart from Evk by gob clients
+	Evk               rawBinary // rlwe.MemEvaluationKeySet
+	Bootstrapping     *rawBinary
+	BootstrappingKeys *rawBinary
+}
+
+// decode validates the encodings and decodes them into a SessionRequest.
+func (raw *sessionEncodings) decode() (SessionRequest, error) {
+	var req SessionRequest
+	var err error
+	if req.Params, err = decodeParameters("Params", raw.Params); err != nil {
+		return SessionRequest{}, err
+	}
+	set, err := matchParameterSet(req.Params)
+	if err != nil {
+		return SessionRequest{}, err
+	}
+
+	if err := decodeBinary("Evk", raw.Evk, (*layoutReader).evaluationKeySet, &req.Evk); err != nil {
+		return SessionRequest{}, err
+	}
+	if err := checkEvaluationKeySet("Evk", &req.Evk, req.Params); err != nil {
+		return SessionRequest{}, err
+	}
+	if req.Evk.RelinearizationKey != nil {
+		req.Rlk = *req.Evk.RelinearizationKey
+	} else if len(raw.Rlk) > 0 {
+		// Gob clients leaving the key out still send its empty value
+		if err := decodeBinary("Rlk", raw.Rlk, (*layoutReader).gadgetCiphertext, &req.Rlk); err != nil {
+			return SessionRequest{}, err
+		}
+		if len(req.Rlk.Value) > 0 {
+			if err := checkGadgetCiphertext("Rlk", &req.Rlk.GadgetCiphertext, req.Params.N(), req.Params.MaxLevelQ(), req.Params.MaxLevelP(), true); err != nil {
+				return SessionRequest{}, err
+			}
+		}
+	}
+
+	if raw.Bootstrapping != nil {
+		if req.Bootstrapping, err = decodeBootstrappingParameters("Bootstrapping", *raw.Bootstrapping, set); err != nil {
+			return SessionRequest{}, err
+		}
+	}
+	if raw.BootstrappingKeys != nil {
+		if req.Bootstrapping == nil {
+			return SessionRequest{}, invalid("BootstrappingKeys", "sent without the bootstrapping parameters")
+		}
+		req.BootstrappingKeys = new(bootstrapping.EvaluationKeys)
+		if err := decodeBinary("BootstrappingKeys", *raw.BootstrappingKeys, (*layoutReader).bootstrappingKeys, req.BootstrappingKeys); err != nil {
+			return SessionRequest{}, err
+		}
+		if err := checkBootstrappingKeys("BootstrappingKeys", req.BootstrappingKeys, req.Bootstrapping); err != nil {
+			return SessionRequest{}, err
+		}
+	}
+	return req, nil
+}
+
+// UnmarshalGob decodes the gob of a SessionRequest sent by legacy clients.
+func (req *SessionRequest) UnmarshalGob(data []byte) error {
+	var raw sessionEncodings
+	if err := DeserializeObject(data, &raw); err != nil {
+		return err
+	}
+	decoded, err := raw.decode()
+	*req = decoded
+	return err
+}
+
+// queryEncodings holds a QueryRequest whose ciphertexts are not decoded yet.
+// Its fields mirror QueryRequest, so that it also decodes the gob of legacy clients.
+type queryEncodings struct {
+	SessionID string
+	Kernel    string
+	SumSlots  bool
+	Mode      string
+	K         int
+	Query     []rawBinary // rlwe.Ciphertext per query vector
+	FrameID   uint64
+	FaceID    uint64
+}
+
+// decode validates the ciphertexts and decodes them into a QueryRequest. The other fields
+// are set even on failure, for the stream to report the failure to the right frame and face.
+func (raw *queryEncodings) decode() (QueryRequest, error) {
+	query := QueryRequest{
+		SessionID: raw.SessionID,
+		Kernel:    raw.Kernel,
+		SumSlots:  raw.SumSlots,
+		Mode:      raw.Mode,
+		K:         raw.K,
+		FrameID:   raw.FrameID,
+		FaceID:    raw.FaceID,
+	}
+	if len(raw.Query) == 0 {
+		return query, invalid("Query", "query carries no ciphertext")
+	}
+	if len(raw.Query) > policy.MaxQueries {
+		return query, refused("Query", "%d ciphertexts, at most %d are accepted per query", len(raw.Query), policy.MaxQueries)
+	}
+
+	ciphertexts := make([]rlwe.Ciphertext, len(raw.Query))
+	for i, data := range raw.Query {
+		if err := decodeBinary(fmt.Sprintf("Query[%d]", i), data, (*layoutReader).ciphertext, &ciphertexts[i]); err != nil {
+			return query, err
+		}
+	}
+	query.Query = ciphertexts
+	return query, nil
+}
+
+// UnmarshalGob decodes the gob of a QueryRequest sent by legacy clients.
+func (query *QueryRequest) UnmarshalGob(data []byte) error {
+	var raw queryEncodings
+	if err := DeserializeObject(data, &raw); err != nil {
+		return err
+	}
+	decoded, err := raw.decode()
+	*query = decoded
+	return err
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/tuneinsight/lattigo/v6/circuits/ckks/bootstrapping"
+	"github.com/tuneinsight/lattigo/v6/core/rlwe"
+	"github.com/tuneinsight/lattigo/v6/schemes/ckks"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// checkValidationError fails t unless err is a *ValidationError with the given status
+// whose message contains reason.
+func checkValidationError(t *testing.T, err error, status int, reason string) {
+	t.Helper()
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("got error %v, expected a ValidationError", err)
+	}
+	if invalid.Status != status || !strings.Contains(invalid.Error(), reason) {
+		t.Errorf("got %d %q, expected %d and %q", invalid.Status, invalid.Error(), status, reason)
+	}
+}
+
+func TestDecodeParameters(t *testing.T) {
+	literal := func(edit func(*ckks.ParametersLiteral)) []byte {
+		l := ParameterSets[0].Params
+		l.LogQ = append([]int(nil), l.LogQ...)
+		edit(&l)
+		data, err := json.Marshal(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	tests := []struct {
+		name   string
+		data   []byte
+		status int // 0 when the parameters decode
+		reason string
+	}{
+		{"accepted set", literal(func(*ckks.ParametersLiteral) {}), 0, ""},
+		{"ring too large", literal(func(l *ckks.ParametersLiteral) { l.LogN = 20 }), http.StatusUnprocessableEntity, "LogN 20"},
+		{"no ring", literal(func(l *ckks.ParametersLiteral) { l.LogN = 0 }), http.StatusUnprocessableEntity, "LogN 0"},
+		{"too many moduli", literal(func(l *ckks.ParametersLiteral) { l.LogQ = make([]int, 64) }), http.StatusUnprocessableEntity, "more moduli"},
+		{"modulus too wide", literal(func(l *ckks.ParametersLiteral) { l.LogQ[1] = 62 }), http.StatusBadRequest, "62 bits"},
+		{"not JSON", []byte("{"), http.StatusBadRequest, "Params"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params, err := decodeParameters("Params", test.data)
+			if test.status != 0 {
+				checkValidationError(t, err, test.status, test.reason)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := matchParameterSet(params); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestSessionEncodingsDecode(t *testing.T) {
+	keys := newTestKeys(t)
+	params := marshal(t, keys.params)
+	rlk := keys.kgen.GenRelinearizationKeyNew(keys.sk)
+	galEl := keys.params.GaloisElement(1)
+	evk := marshal(t, rlwe.NewMemEvaluationKeySet(rlk, keys.kgen.GenGaloisKeyNew(galEl, keys.sk)))
+
+	// Keys of a ring the server does not accept
+	small, err := ckks.NewParametersFromLiteral(ckks.ParametersLiteral{LogN: 12, LogQ: []int{40, 30}, LogP: []int{40}, LogDefaultScale: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	smallKgen := rlwe.NewKeyGenerator(small)
+	smallEvk := marshal(t, rlwe.NewMemEvaluationKeySet(smallKgen.GenRelinearizationKeyNew(smallKgen.GenSecretKeyNew())))
+
+	// A Galois key filed under another element
+	misfiled := rlwe.NewMemEvaluationKeySet(nil, keys.kgen.GenGaloisKeyNew(galEl, keys.sk))
+	misfiled.GaloisKeys[galEl+2] = misfiled.GaloisKeys[galEl]
+	delete(misfiled.GaloisKeys, galEl)
+
+	bootstrapping := rawBinary(`{}`)
+	tests := []struct {
+		name   string
+		raw    sessionEncodings
+		status int // 0 when the session decodes
+		reason string
+	}{
+		{"valid", sessionEncodings{Params: params, Evk: evk}, 0, ""},
+		{"unknown parameters", sessionEncodings{Params: marshal(t, small), Evk: smallEvk}, http.StatusUnprocessableEntity, "Params"},
+		{"truncated keys", sessionEncodings{Params: params, Evk: evk[:len(evk)/2]}, http.StatusBadRequest, "Evk"},
+		{"trailing bytes", sessionEncodings{Params: params, Evk: append(evk, 0)}, http.StatusBadRequest, "Evk"},
+		{"keys of another ring", sessionEncodings{Params: params, Evk: smallEvk}, http.StatusUnprocessableEntity, "Evk.RelinearizationKey"},
+		{"misfiled Galois key", sessionEncodings{Params: params, Evk: marshal(t, misfiled)}, http.StatusBadRequest, "key for Galois element"},
+		{"bootstrapping keys alone", sessionEncodings{Params: params, Evk: evk, BootstrappingKeys: &bootstrapping}, http.StatusBadRequest, "without the bootstrapping parameters"},
+		{"bootstrapping the default set", sessionEncodings{Params: params, Evk: evk, Bootstrapping: &bootstrapping}, http.StatusUnprocessableEntity, "cannot be bootstrapped"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := test.raw.decode()
+			if test.status != 0 {
+				checkValidationError(t, err, test.status, test.reason)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.Evk.RelinearizationKey == nil || req.Evk.GaloisKeys[galEl] == nil || len(req.Rlk.Value) == 0 {
+				t.Errorf("keys missing from the decoded session")
+			}
+		})
+	}
+}
+
+func TestLayoutReader(t *testing.T) {
+	keys := newTestKeys(t)
+	ciphertext := marshal(t, keys.encrypt(t, []float64{1}))
+
+	// poly encodes a polynomial with a row of each of the given numbers of coefficients
+	poly := func(degrees ...uint64) []byte {
+		r := appendUint64(nil, uint64(len(degrees)))
+		for _, n := range degrees {
+			r = appendUint64(r, n)
+			r = append(r, make([]byte, 8*n)...)
+		}
+		return r
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		walk func(*layoutReader)
+		err  string
+	}{
+		{"ciphertext", ciphertext, (*layoutReader).ciphertext, ""},
+		{"truncated ciphertext", ciphertext[:len(ciphertext)-1], (*layoutReader).ciphertext, "truncated"},
+		{"trailing bytes", append(ciphertext, 0), (*layoutReader).ciphertext, "trailing"},
+		{"polynomial", poly(8, 8), (*layoutReader).poly, ""},
+		{"degree not a power of two", poly(6), (*layoutReader).poly, "not a power of two"},
+		{"too many moduli", poly(make([]uint64, 1000)...), (*layoutReader).poly, "moduli"},
+		{"rows of different degrees", poly(8, 16), (*layoutReader).poly, "rows of 8 and 16"},
+		{"count beyond data", appendUint64(nil, 2), (*layoutReader).poly, "announced"},
+		{"too many polynomials", append([]byte{0}, appendUint64(nil, 4)...), (*layoutReader).ciphertext, "4 polynomials"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newLayoutReader(test.data)
+			test.walk(r)
+			err := r.finish()
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
+
+// appendUint64 appends v as Lattigo encodes lengths, little-endian.
+func appendUint64(b []byte, v uint64) []byte {
+	for i := 0; i < 8; i++ {
+		b = append(b, byte(v>>(8*i)))
+	}
+	return b
+}
+
+func TestCheckQueryCiphertexts(t *testing.T) {
+	keys := newTestKeys(t)
+	session := &Session{ParameterSet: "default", Params: keys.params}
+	fresh := func(edit func(*rlwe.Ciphertext)) []rlwe.Ciphertext {
+		ct := keys.encrypt(t, []float64{1, 2})
+		edit(ct)
+		return []rlwe.Ciphertext{*ct}
+	}
+	evaluator := ckks.NewEvaluator(keys.params, nil)
+
+	tests := []struct {
+		name   string
+		query  []rlwe.Ciphertext
+		status int // 0 when the query is accepted
+		reason string
+	}{
+		{"fresh", fresh(func(*rlwe.Ciphertext) {}), 0, ""},
+		{"lower level", fresh(func(ct *rlwe.Ciphertext) { evaluator.DropLevel(ct, 1) }), 0, ""},
+		{"below the minimum level", fresh(func(ct *rlwe.Ciphertext) { evaluator.DropLevel(ct, ct.Level()) }), http.StatusUnprocessableEntity, "below the level 1"},
+		{"no metadata", fresh(func(ct *rlwe.Ciphertext) { ct.MetaData = nil }), http.StatusBadRequest, "no metadata"},
+		{"degree 2", fresh(func(ct *rlwe.Ciphertext) { ct.Value = append(ct.Value, *ct.Value[1].CopyNew()) }), http.StatusUnprocessableEntity, "degree 2"},
+		{"polynomials at different levels", fresh(func(ct *rlwe.Ciphertext) { ct.Value[1].Resize(0) }), http.StatusBadRequest, "levels"},
+		{"not NTT", fresh(func(ct *rlwe.Ciphertext) { ct.IsNTT = false }), http.StatusUnprocessableEntity, "NTT"},
+		{"scale drift", fresh(func(ct *rlwe.Ciphertext) { ct.Scale = rlwe.NewScale(1 << 20) }), http.StatusUnprocessableEntity, "scale"},
+		{"slot dimensions", fresh(func(ct *rlwe.Ciphertext) { ct.LogDimensions.Cols-- }), http.StatusUnprocessableEntity, "slot dimensions"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkQueryCiphertexts(test.query, session, 1)
+			if test.status != 0 {
+				checkValidationError(t, err, test.status, test.reason)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestMinQueryLevel(t *testing.T) {
+	btpParams, err := acceptedBootstrapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bootstrapper := &bootstrapping.Evaluator{Parameters: *btpParams[1]}
+
+	tests := []struct {
+		name  string
+		pc    PublicContext
+		level int
+	}{
+		{"squared difference", PublicContext{Kernel: KernelSquaredDifference, Mode: ModeDistances}, 1},
+		{"inner product", PublicContext{Kernel: KernelInnerProduct, Mode: ModeDistances}, 1},
+		{"summed slots", PublicContext{Kernel: KernelSquaredDifference, SumSlots: true, Mode: ModeDistances}, 2},
+		{"class scores", PublicContext{Kernel: KernelInnerProduct, SumSlots: true, Mode: ModeClassScores}, 2 + classScoreDepth + 2},
+		{"top-k", PublicContext{Kernel: KernelSquaredDifference, SumSlots: true, Mode: ModeTopK, Bootstrapper: bootstrapper}, 3 + bootstrapper.MinimumInputLevel()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if level := minQueryLevel(&test.pc); level != test.level {
+				t.Errorf("got level %d, expected %d", level, test.level)
+			}
+		})
+	}
+
+	// Every mode a parameter set offers fits in its levels
+	accepted, err := acceptedParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, set := range ParameterSets {
+		for _, test := range tests {
+			if slices.Contains(set.Modes, test.pc.Mode) && minQueryLevel(&test.pc) > accepted[i].MaxLevel() {
+				t.Errorf("parameter set %q offers %s but has %d levels", set.Name, test.name, accepted[i].MaxLevel())
+			}
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Wire protocol
+//
+// Every message is a frame made of a 16-byte header followed by the payload:
+//
+//	offset 0   magic "SSWP"
+//	offset 4   major version, uint8
+//	offset 5   minor version, uint8
+//	offset 6   message type, uint16 big-endian
+//	offset 8   payload length, uint64 big-endian
+//
+// The payload is a sequence of fields, each a uvarint tag, a uvarint length and that many bytes.
+// Repeated fields repeat the tag, integers and booleans are uvarints, strings are UTF-8, and
+// ciphertexts, keys and parameters are the output of their Lattigo MarshalBinary method.
+// Readers skip the tags they do not know, so new optional fields only bump the minor version;
+// peers must reject frames of another major version.
+//
+// Field tags of each message type:
+//
+//	MsgSessionRequest   1 Params, 2 Evk, 3 Bootstrapping parameters, 4 Bootstrapping keys
+//	MsgSessionResponse  1 SessionID
+//	MsgQueryRequest     1 SessionID, 2 Kernel, 3 SumSlots, 4 Mode, 5 K, 6 Query (repeated),
+//	                    7 FrameID, 8 FaceID
+//	MsgQueryResponse    1 Params, 2 Kernel, 3 Mode, 4 Classes (repeated), 5 Labels (repeated),
+//	                    6 Votes (repeated), 7 Distances of one query (repeated, nested Distance fields),
+//	                    8 FrameID, 9 FaceID
+//	Distance            1 Distance, 2 Classes (repeated), 3 PackSizes (repeated)
+//	MsgError            1 Message, 2 Status, 3 FrameID, 4 FaceID
+//
+// Version 1.1 added the frame and face IDs and MsgError, used by the gRPC stream.
+//
+// Requests sent as gob, without the magic, are still accepted and answered as gob,
+// and JSON requests are handled as described in jsonapi.go.
+
+// MessageType identifies the content of a frame.
+type MessageType uint16
+
+// Message types of the wire protocol.
+const (
+	MsgSessionRequest  MessageType = 1
+	MsgSessionResponse MessageType = 2
+	MsgQueryRequest    MessageType = 3
+	MsgQueryResponse   MessageType = 4
+	MsgError           MessageType = 5
+)
+
+// Version of the wire protocol spoken by this server.
+const (
+	WireVersionMajor = 1
+	WireVersionMinor = 1
+)
+
+// WireContentType is the media type of framed messages.
+const WireContentType = "application/vnd.securesight.frame"
+
+const (
+	wireMagic      = "SSWP"
+	wireHeaderSize = 16
+)
+
+// ErrUnsupportedVersion is returned for frames of another major version.
+var ErrUnsupportedVersion = errors.New("unsupported wire protocol version")
+
+// EncodeFrame wraps a payload in a frame of the given type.
+func EncodeFrame(msgType MessageType, payload []byte) []byte {
+	frame := make([]byte, wireHeaderSize, wireHeaderSize+len(payload))
+	copy(frame, wireMagic)
+	frame[4] = WireVersionMajor
+	frame[5] = WireVersionMinor
+	binary.BigEndian.PutUint16(frame[6:], uint16(msgType))
+	binary.BigEndian.PutUint64(frame[8:], uint64(len(payload)))
+	return append(frame, payload...)
+}
+
+// DecodeFrame checks the header of a frame and returns its type and payload.
+func DecodeFrame(frame []byte) (MessageType, []byte, error) {
+	if !IsFrame(frame) || len(frame) < wireHeaderSize {
+		return 0, nil, fmt.Errorf("not a wire protocol frame")
+	}
+	if frame[4] != WireVersionMajor {
+		return 0, nil, fmt.Errorf("%w %d.%d, this server speaks %d.%d", ErrUnsupportedVersion, frame[4], frame[5], WireVersionMajor, WireVersionMinor)
+	}
+	length := binary.BigEndian.Uint64(frame[8:])
+	if length != uint64(len(frame)-wireHeaderSize) {
+		return 0, nil, fmt.Errorf("frame announces %d bytes of payload but carries %d", length, len(frame)-wireHeaderSize)
+	}
+	return MessageType(binary.BigEndian.Uint16(frame[6:])), frame[wireHeaderSize:], nil
+}
+
+// IsFrame reports whether data starts with the magic of the wire protocol.
+func IsFrame(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(wireMagic))
+}
+
+// wireWriter appends fields to a payload.
+type wireWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *wireWriter) bytes(tag uint64, data []byte) {
+	w.buf.Write(binary.AppendUvarint(nil, tag))
+	w.buf.Write(binary.AppendUvarint(nil, uint64(len(data))))
+	w.buf.Write(data)
+}
+
+func (w *wireWriter) string(tag uint64, s string) {
+	if s != "" {
+		w.bytes(tag, []byte(s))
+	}
+}
+
+func (w *wireWriter) strings(tag uint64, values []string) {
+	for _, s := range values {
+		w.bytes(tag, []byte(s))
+	}
+}
+
+func (w *wireWriter) uint(tag uint64, v uint64) {
+	if v != 0 {
+		w.bytes(tag, binary.AppendUvarint(nil, v))
+	}
+}
+
+func (w *wireWriter) bool(tag uint64, v bool) {
+	if v {
+		w.uint(tag, 1)
+	}
+}
+
+func (w *wireWriter) binary(tag uint64, v encoding.BinaryMarshaler) error {
+	data, err := v.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	w.bytes(tag, data)
+	return nil
+}
+
+// readFields calls fn for every field of a payload, in order.
+func readFields(payload []byte, fn func(tag uint64, data []byte) error) error {
+	for len(payload) > 0 {
+		tag, n := binary.Uvarint(payload)
+		if n <= 0 {
+			return fmt.Errorf("malformed field tag")
+		}
+		payload = payload[n:]
+		length, n := binary.Uvarint(payload)
+		if n <= 0 || length > uint64(len(payload)-n) {
+			return fmt.Errorf("malformed length of field %d", tag)
+		}
+		payload = payload[n:]
+		if err := fn(tag, payload[:length]); err != nil {
+			return fmt.Errorf("field %d: %v", tag, err)
+		}
+		payload = payload[length:]
+	}
+	return nil
+}
+
+// readUint decodes an integer field.
+func readUint(data []byte) (uint64, error) {
+	v, n := binary.Uvarint(data)
+	if n != len(data) {
+		return 0, fmt.Errorf("malformed integer")
+	}
+	return v, nil
+}
+
+// UnmarshalWire decodes the payload of a MsgSessionRequest.
+func (req *SessionRequest) UnmarshalWire(payload []byte) error {
+	var raw sessionEncodings
+	err := readFields(payload, func(tag uint64, data []byte) error {
+		switch tag {
+		case 1:
+			raw.Params = data
+		case 2:
+			raw.Evk = data
+		case 3:
+			raw.Bootstrapping = (*rawBinary)(&data)
+		case 4:
+			raw.BootstrappingKeys = (*rawBinary)(&data)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	*req, err = raw.decode()
+	return err
+}
+
+// MarshalWire encodes the payload of a MsgSessionResponse.
+func (resp SessionResponse) MarshalWire() ([]byte, error) {
+	var w wireWriter
+	w.string(1, resp.SessionID)
+	return w.buf.Bytes(), nil
+}
+
+// UnmarshalWire decodes the payload of a MsgQueryRequest.
+func (query *QueryRequest) UnmarshalWire(payload []byte) error {
+	var raw queryEncodings
+	err := readFields(payload, func(tag uint64, data []byte) (err error) {
+		switch tag {
+		case 1:
+			raw.SessionID = string(data)
+		case 2:
+			raw.Kernel = string(data)
+		case 3:
+			var v uint64
+			v, err = readUint(data)
+			raw.SumSlots = v != 0
+		case 4:
+			raw.Mode = string(data)
+		case 5:
+			var v uint64
+			v, err = readUint(data)
+			raw.K = int(v)
+		case 6:
+			raw.Query = append(raw.Query, data)
+		case 7:
+			raw.FrameID, err = readUint(data)
+		case 8:
+			raw.FaceID, err = readUint(data)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	*query, err = raw.decode()
+	return err
+}
+
+// MarshalWire encodes the payload of a MsgQueryResponse.
+func (r Response) MarshalWire() ([]byte, error) {
+	var w wireWriter
+	if err := w.binary(1, r.Params); err != nil {
+		return nil, err
+	}
+	w.string(2, r.Kernel)
+	w.string(3, r.Mode)
+	w.strings(4, r.Classes)
+	w.strings(5, r.Labels)
+	for i := range r.Votes {
+		if err := w.binary(6, &r.Votes[i]); err != nil {
+			return nil, err
+		}
+	}
+	for _, distances := range r.Distances {
+		var query wireWriter
+		for i := range distances {
+			var distance wireWriter
+			if err := distance.binary(1, &distances[i].Distance); err != nil {
+				return nil, err
+			}
+			distance.strings(2, distances[i].Classes)
+			for _, size := range distances[i].PackSizes {
+				distance.bytes(3, binary.AppendUvarint(nil, uint64(size)))
+			}
+			query.bytes(1, distance.buf.Bytes())
+		}
+		w.bytes(7, query.buf.Bytes())
+	}
+	w.uint(8, r.FrameID)
+	w.uint(9, r.FaceID)
+	return w.buf.Bytes(), nil
+}
+
+// ErrorMessage reports a failed query on the gRPC stream, where it replaces the response.
+type ErrorMessage struct {
+	Message string // Description of the failure
+	Status  int    // HTTP status the failure would have on /api/knn
+	FrameID uint64 // Frame and face of the failed query
+	FaceID  uint64
+}
+
+// MarshalWire encodes the payload of a MsgError.
+func (e ErrorMessage) MarshalWire() ([]byte, error) {
+	var w wireWriter
+	w.string(1, e.Message)
+	w.uint(2, uint64(e.Status))
+	w.uint(3, e.FrameID)
+	w.uint(4, e.FaceID)
+	return w.buf.Bytes(), nil
+}
+
+// wireMessage is implemented by the responses that can be sent framed, as gob or as JSON.
+type wireMessage interface {
+	MarshalWire() ([]byte, error)
+}
+
+// bodyEncoding is the encoding of a request or response body.
+type bodyEncoding int
+
+// Encodings understood by /api/sessions and /api/knn.
+const (
+	encodingGob   bodyEncoding = iota // Legacy gob of the Go structs
+	encodingFrame                     // Frames of the wire protocol
+	encodingJSON                      // JSON variant, see JSONContentType
+)
+
+// request is implemented by the request messages, which validate their content while decoding.
+type request interface {
+	UnmarshalWire([]byte) error
+	UnmarshalGob([]byte) error
+}
+
+// readRequest decodes a request body into v, as JSON when the Content-Type says so, and otherwise
+// from a frame of type msgType or from gob. It returns the encoding the response should use:
+// the one asked for by the Accept header, or else the encoding of the request.
+func readRequest(r *http.Request, body []byte, msgType MessageType, v request) (bodyEncoding, error) {
+	format, err := decodeRequest(r, body, msgType, v)
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, JSONContentType):
+		format = encodingJSON
+	case strings.Contains(accept, WireContentType):
+		format = encodingFrame
+	}
+	return format, err
+}
+
+// decodeRequest decodes a request body into v and returns its encoding.
+func decodeRequest(r *http.Request, body []byte, msgType MessageType, v request) (bodyEncoding, error) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == JSONContentType {
+		return encodingJSON, json.Unmarshal(body, v)
+	}
+	if !IsFrame(body) {
+		return encodingGob, v.UnmarshalGob(body)
+	}
+	got, payload, err := DecodeFrame(body)
+	if err != nil {
+		return encodingFrame, err
+	}
+	if got != msgType {
+		return encodingFrame, fmt.Errorf("expected message type %d, got %d", msgType, got)
+	}
+	return encodingFrame, v.UnmarshalWire(payload)
+}
+
+// writeResponse sends v framed as msgType, as gob or as JSON.
+func writeResponse(w http.ResponseWriter, format bodyEncoding, msgType MessageType, v wireMessage) int {
+	var body []byte
+	var err error
+	contentType := "application/octet-stream"
+	switch format {
+	case encodingFrame:
+		contentType = WireContentType
+		var payload []byte
+		if payload, err = v.MarshalWire(); err == nil {
+			body = EncodeFrame(msgType, payload)
+		}
+	case encodingJSON:
+		contentType = JSONContentType
+		body, err = json.Marshal(v)
+	default:
+		body, err = SerializeObject(v)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to serialize response: %v", err), http.StatusInternalServerError)
+		return 0
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+	return len(body)
+}
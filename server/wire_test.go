@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// marshal returns the binary encoding of v.
+func marshal(t testing.TB, v interface{ MarshalBinary() ([]byte, error) }) []byte {
+	t.Helper()
+	data, err := v.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDecodeFrame(t *testing.T) {
+	valid := EncodeFrame(MsgQueryRequest, []byte("payload"))
+	otherMajor := bytes.Clone(valid)
+	otherMajor[4] = WireVersionMajor + 1
+	newerMinor := bytes.Clone(valid)
+	newerMinor[5] = WireVersionMinor + 1
+	longer := bytes.Clone(valid)
+	binary.BigEndian.PutUint64(longer[8:], 8)
+
+	tests := []struct {
+		name    string
+		frame   []byte
+		payload string
+		err     string
+	}{
+		{"valid", valid, "payload", ""},
+		{"newer minor version", newerMinor, "payload", ""},
+		{"empty payload", EncodeFrame(MsgQueryRequest, nil), "", ""},
+		{"gob", []byte{0x1f, 0xff, 0x81}, "", "not a wire protocol frame"},
+		{"truncated header", valid[:wireHeaderSize-1], "", "not a wire protocol frame"},
+		{"other major version", otherMajor, "", ErrUnsupportedVersion.Error()},
+		{"length beyond payload", longer, "", "announces 8 bytes of payload but carries 7"},
+		{"trailing bytes", append(bytes.Clone(valid), 0), "", "announces 7 bytes of payload but carries 8"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msgType, payload, err := DecodeFrame(test.frame)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msgType != MsgQueryRequest || string(payload) != test.payload {
+				t.Errorf("got type %d and payload %q", msgType, payload)
+			}
+		})
+	}
+	if _, _, err := DecodeFrame(otherMajor); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("other major version: got %v, expected ErrUnsupportedVersion", err)
+	}
+}
+
+func TestReadFields(t *testing.T) {
+	var w wireWriter
+	w.string(1, "session")
+	w.uint(2, 300)
+	w.bool(3, false)
+	w.strings(4, []string{"a", "b"})
+
+	type field struct {
+		tag  uint64
+		data string
+	}
+	tests := []struct {
+		name    string
+		payload []byte
+		fields  []field
+		err     string
+	}{
+		{"empty", nil, nil, ""},
+		{"fields", w.buf.Bytes(), []field{{1, "session"}, {2, "\xac\x02"}, {4, "a"}, {4, "b"}}, ""},
+		{"truncated tag", []byte{0x80}, nil, "malformed field tag"},
+		{"missing length", []byte{1}, nil, "malformed length of field 1"},
+		{"length beyond payload", []byte{1, 3, 'a', 'b'}, nil, "malformed length of field 1"},
+		{"huge length", append([]byte{1}, binary.AppendUvarint(nil, 1<<63)...), nil, "malformed length of field 1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []field
+			err := readFields(test.payload, func(tag uint64, data []byte) error {
+				got = append(got, field{tag, string(data)})
+				return nil
+			})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(test.fields) {
+				t.Fatalf("got fields %q, expected %q", got, test.fields)
+			}
+			for i := range got {
+				if got[i] != test.fields[i] {
+					t.Errorf("field %d is %q, expected %q", i, got[i], test.fields[i])
+				}
+			}
+		})
+	}
+}
+
+func TestQueryRequestUnmarshalWire(t *testing.T) {
+	keys := newTestKeys(t)
+	ciphertext := marshal(t, keys.encrypt(t, []float64{1, 2, 3}))
+
+	// query encodes a MsgQueryRequest the way the client does
+	query := func(ciphertexts int, extra func(*wireWriter)) []byte {
+		var w wireWriter
+		w.string(1, "session")
+		w.string(2, KernelInnerProduct)
+		w.bool(3, true)
+		w.string(4, ModeTopK)
+		w.uint(5, 3)
+		for i := 0; i < ciphertexts; i++ {
+			w.bytes(6, ciphertext)
+		}
+		w.uint(7, 42)
+		w.uint(8, 7)
+		if extra != nil {
+			extra(&w)
+		}
+		return w.buf.Bytes()
+	}
+
+	tests := []struct {
+		name    string
+		payload []byte
+		status  int // Status of the ValidationError, 0 for another error
+		err     string
+	}{
+		{"valid", query(2, nil), 0, ""},
+		{"unknown field", query(1, func(w *wireWriter) { w.string(99, "ignored") }), 0, ""},
+		{"no ciphertext", query(0, nil), http.StatusBadRequest, "no ciphertext"},
+		{"too many ciphertexts", query(policy.MaxQueries+1, nil), http.StatusUnprocessableEntity, "at most"},
+		{"truncated ciphertext", query(1, func(w *wireWriter) { w.bytes(6, ciphertext[:len(ciphertext)/2]) }), http.StatusBadRequest, "Query[1]"},
+		{"malformed integer", query(1, func(w *wireWriter) { w.bytes(5, []byte{1, 2}) }), 0, "malformed integer"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got QueryRequest
+			err := got.UnmarshalWire(test.payload)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, expected %q", err, test.err)
+				}
+				var invalid *ValidationError
+				if test.status != 0 && (!errors.As(err, &invalid) || invalid.Status != test.status) {
+					t.Errorf("got error %#v, expected a ValidationError with status %d", err, test.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.SessionID != "session" || got.Kernel != KernelInnerProduct || !got.SumSlots || got.Mode != ModeTopK ||
+				got.K != 3 || got.FrameID != 42 || got.FaceID != 7 || len(got.Query) == 0 {
+				t.Errorf("decoded %+v", got)
+			}
+			if got.Query[0].Level() != keys.params.MaxLevel() {
+				t.Errorf("ciphertext at level %d, expected %d", got.Query[0].Level(), keys.params.MaxLevel())
+			}
+		})
+	}
+}
+
+func TestErrorMessageMarshalWire(t *testing.T) {
+	payload, err := ErrorMessage{Message: "over quota", Status: http.StatusTooManyRequests, FrameID: 3}.MarshalWire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[uint64]string)
+	if err := readFields(payload, func(tag uint64, data []byte) error {
+		got[tag] = string(data)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	status, err := readUint([]byte(got[2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got[4]; got[1] != "over quota" || status != http.StatusTooManyRequests || got[3] != "\x03" || ok {
+		t.Errorf("got fields %q", got)
+	}
+}